@@ -0,0 +1,504 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docopt/docopt-go"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// ClusterSpec describes the desired groups and slots of a cluster in json or
+// the same structure in yaml, e.g.
+//
+//	{
+//	  "groups": [
+//	    {"id": 1, "servers": [{"addr": "10.0.0.1:6379", "role": "master"},
+//	                          {"addr": "10.0.0.2:6379", "role": "slave"}]}
+//	  ],
+//	  "slots": [{"from": 0, "to": 1023, "group": 1}]
+//	}
+//
+// groups and slots not mentioned are left as they are.
+type ClusterSpec struct {
+	Groups []*GroupSpec     `json:"groups"`
+	Slots  []*SlotRangeSpec `json:"slots"`
+}
+
+type GroupSpec struct {
+	Id      int           `json:"id"`
+	Servers []*ServerSpec `json:"servers"`
+}
+
+type ServerSpec struct {
+	Addr string `json:"addr"`
+	Role string `json:"role"`
+}
+
+type SlotRangeSpec struct {
+	From  int `json:"from"`
+	To    int `json:"to"`
+	Group int `json:"group"`
+}
+
+// ops of apply steps, in the order they are executed
+const (
+	APPLY_ADD_GROUP     = "add_group"
+	APPLY_ADD_SERVER    = "add_server"
+	APPLY_PROMOTE       = "promote"
+	APPLY_SET_SLOTS     = "set_slots"
+	APPLY_MIGRATE       = "migrate"
+	APPLY_REMOVE_SERVER = "remove_server"
+	APPLY_REMOVE_GROUP  = "remove_group"
+)
+
+type ApplyStep struct {
+	Op      string `json:"op"`
+	GroupId int    `json:"group_id"`
+	Addr    string `json:"addr,omitempty"`
+	Role    string `json:"role,omitempty"`
+	From    int    `json:"from,omitempty"`
+	To      int    `json:"to,omitempty"`
+}
+
+func (s *ApplyStep) String() string {
+	switch s.Op {
+	case APPLY_ADD_GROUP:
+		return fmt.Sprintf("add group %d", s.GroupId)
+	case APPLY_ADD_SERVER:
+		return fmt.Sprintf("add server %s to group %d as %s", s.Addr, s.GroupId, s.Role)
+	case APPLY_PROMOTE:
+		return fmt.Sprintf("promote server %s to master of group %d", s.Addr, s.GroupId)
+	case APPLY_SET_SLOTS:
+		return fmt.Sprintf("set slots [%d,%d] online in group %d", s.From, s.To, s.GroupId)
+	case APPLY_MIGRATE:
+		return fmt.Sprintf("migrate slots [%d,%d] to group %d", s.From, s.To, s.GroupId)
+	case APPLY_REMOVE_SERVER:
+		return fmt.Sprintf("remove server %s from group %d", s.Addr, s.GroupId)
+	case APPLY_REMOVE_GROUP:
+		return fmt.Sprintf("remove group %d", s.GroupId)
+	}
+	return fmt.Sprintf("%s %+v", s.Op, *s)
+}
+
+type ApplyPlan struct {
+	Steps    []*ApplyStep `json:"steps"`
+	Warnings []string     `json:"warnings,omitempty"`
+}
+
+func (p *ApplyPlan) add(s *ApplyStep) {
+	p.Steps = append(p.Steps, s)
+}
+
+func (p *ApplyPlan) warn(format string, args ...interface{}) {
+	p.Warnings = append(p.Warnings, fmt.Sprintf(format, args...))
+}
+
+// yamlToJson converts a yaml document to json, so that specs in both formats
+// are decoded by the same json tags.
+func yamlToJson(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var convert func(v interface{}) (interface{}, error)
+	convert = func(v interface{}) (interface{}, error) {
+		switch v := v.(type) {
+		case map[interface{}]interface{}:
+			m := make(map[string]interface{}, len(v))
+			for k, e := range v {
+				s, ok := k.(string)
+				if !ok {
+					return nil, errors.Errorf("key %v of yaml is not a string", k)
+				}
+				var err error
+				if m[s], err = convert(e); err != nil {
+					return nil, err
+				}
+			}
+			return m, nil
+		case []interface{}:
+			for i, e := range v {
+				var err error
+				if v[i], err = convert(e); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return v, nil
+	}
+	v, err := convert(v)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(v)
+	return b, errors.Trace(err)
+}
+
+// loadClusterSpec reads a spec in json, or in yaml if file ends with .yaml
+// or .yml.
+func loadClusterSpec(file string) (*ClusterSpec, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJson(data); err != nil {
+			return nil, errors.Errorf("parse %s failed, %s", file, err)
+		}
+	}
+	spec := &ClusterSpec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, errors.Errorf("parse %s failed, %s", file, err)
+	}
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+func (spec *ClusterSpec) validate() error {
+	groups := make(map[int]bool)
+	addrs := make(map[string]int)
+	for _, g := range spec.Groups {
+		if g == nil || g.Id <= 0 {
+			return errors.Errorf("invalid group in spec, id must be positive")
+		}
+		if groups[g.Id] {
+			return errors.Errorf("duplicate group %d in spec", g.Id)
+		}
+		groups[g.Id] = true
+		masters := 0
+		for _, s := range g.Servers {
+			if s == nil || s.Addr == "" {
+				return errors.Errorf("server without addr in group %d", g.Id)
+			}
+			if gid, ok := addrs[s.Addr]; ok {
+				return errors.Errorf("server %s appears in both group %d and group %d", s.Addr, gid, g.Id)
+			}
+			addrs[s.Addr] = g.Id
+			switch s.Role {
+			case models.SERVER_TYPE_MASTER:
+				masters++
+			case models.SERVER_TYPE_SLAVE:
+			default:
+				return errors.Errorf("invalid role %q of server %s, must be master or slave", s.Role, s.Addr)
+			}
+		}
+		if len(g.Servers) != 0 && masters != 1 {
+			return errors.Errorf("group %d must have exactly one master, got %d", g.Id, masters)
+		}
+	}
+	owners := make([]int, models.DEFAULT_SLOT_NUM)
+	for _, r := range spec.Slots {
+		if r == nil || r.From < 0 || r.To >= models.DEFAULT_SLOT_NUM || r.From > r.To {
+			return errors.Errorf("invalid slot range in spec, must be within [0,%d]", models.DEFAULT_SLOT_NUM-1)
+		}
+		if !groups[r.Group] {
+			return errors.Errorf("slots [%d,%d] are assigned to group %d, which is not in spec", r.From, r.To, r.Group)
+		}
+		for i := r.From; i <= r.To; i++ {
+			if owners[i] != 0 {
+				return errors.Errorf("slot %d is assigned to both group %d and group %d", i, owners[i], r.Group)
+			}
+			owners[i] = r.Group
+		}
+	}
+	return nil
+}
+
+// slotOwners returns the group of each slot in spec, 0 if not mentioned.
+func (spec *ClusterSpec) slotOwners() []int {
+	owners := make([]int, models.DEFAULT_SLOT_NUM)
+	for _, r := range spec.Slots {
+		for i := r.From; i <= r.To; i++ {
+			owners[i] = r.Group
+		}
+	}
+	return owners
+}
+
+// addSlotRanges merges contiguous slots of the same group into ranges.
+func (p *ApplyPlan) addSlotRanges(op string, groups []int) {
+	for i := 0; i < len(groups); {
+		if groups[i] == 0 {
+			i++
+			continue
+		}
+		j := i
+		for j+1 < len(groups) && groups[j+1] == groups[i] {
+			j++
+		}
+		p.add(&ApplyStep{Op: op, GroupId: groups[i], From: i, To: j})
+		i = j + 1
+	}
+}
+
+// computeApplyPlan diffs spec against the current groups and slots, slots
+// must be ordered by id. Servers are added before slots are set, and
+// migrations are queued last so that the target groups have masters. With
+// prune, servers and groups not in spec are removed at the end.
+func computeApplyPlan(spec *ClusterSpec, groups []*models.ServerGroup, slots []*models.Slot, prune bool) (*ApplyPlan, error) {
+	plan := &ApplyPlan{Steps: []*ApplyStep{}}
+
+	current := make(map[int]*models.ServerGroup)
+	where := make(map[string]*models.Server)
+	owner := make(map[string]int)
+	for _, g := range groups {
+		current[g.Id] = g
+		for _, s := range g.Servers {
+			where[s.Addr] = s
+			owner[s.Addr] = g.Id
+		}
+	}
+	for _, g := range spec.Groups {
+		for _, s := range g.Servers {
+			if gid, ok := owner[s.Addr]; ok && gid != g.Id {
+				return nil, errors.Errorf("server %s is in group %d, remove it from there before moving it to group %d", s.Addr, gid, g.Id)
+			}
+		}
+	}
+
+	var promotes, readds []*ApplyStep
+	for _, g := range spec.Groups {
+		cur := current[g.Id]
+		if cur == nil {
+			plan.add(&ApplyStep{Op: APPLY_ADD_GROUP, GroupId: g.Id})
+		}
+		var master string
+		if cur != nil {
+			for _, s := range cur.Servers {
+				if s.Type == models.SERVER_TYPE_MASTER {
+					master = s.Addr
+				}
+			}
+		}
+		// the master goes first, so that slaves added later follow it
+		servers := make([]*ServerSpec, 0, len(g.Servers))
+		for _, s := range g.Servers {
+			if s.Role == models.SERVER_TYPE_MASTER {
+				servers = append([]*ServerSpec{s}, servers...)
+			} else {
+				servers = append(servers, s)
+			}
+		}
+		for _, s := range servers {
+			cur := where[s.Addr]
+			switch {
+			case s.Role == models.SERVER_TYPE_MASTER && cur != nil && cur.Type == models.SERVER_TYPE_MASTER:
+			case s.Role == models.SERVER_TYPE_MASTER && cur == nil && master == "":
+				plan.add(&ApplyStep{Op: APPLY_ADD_SERVER, GroupId: g.Id, Addr: s.Addr, Role: s.Role})
+			case s.Role == models.SERVER_TYPE_MASTER:
+				// a group can't have two masters, the new one joins as a slave
+				// of the current master before it's promoted
+				if cur == nil || cur.Type == models.SERVER_TYPE_OFFLINE {
+					plan.add(&ApplyStep{Op: APPLY_ADD_SERVER, GroupId: g.Id, Addr: s.Addr, Role: models.SERVER_TYPE_SLAVE})
+				}
+				promotes = append(promotes, &ApplyStep{Op: APPLY_PROMOTE, GroupId: g.Id, Addr: s.Addr})
+				if master != "" {
+					plan.warn("master of group %d changes from %s to %s, %s goes offline unless it's a slave in spec", g.Id, master, s.Addr, master)
+				}
+			case cur == nil:
+				plan.add(&ApplyStep{Op: APPLY_ADD_SERVER, GroupId: g.Id, Addr: s.Addr, Role: s.Role})
+			case cur.Type != models.SERVER_TYPE_SLAVE:
+				// a demoted master or an offline server joins again as a slave
+				readds = append(readds, &ApplyStep{Op: APPLY_ADD_SERVER, GroupId: g.Id, Addr: s.Addr, Role: s.Role})
+			}
+		}
+	}
+	// promoting a slave turns the old master offline, so demoted masters
+	// are re-added after promotions
+	for _, s := range promotes {
+		plan.add(s)
+	}
+	for _, s := range readds {
+		plan.add(s)
+	}
+
+	owners := spec.slotOwners()
+	sets := make([]int, models.DEFAULT_SLOT_NUM)
+	migrates := make([]int, models.DEFAULT_SLOT_NUM)
+	for _, s := range slots {
+		gid := owners[s.Id]
+		if gid == 0 {
+			continue
+		}
+		switch s.State.Status {
+		case models.SLOT_STATUS_OFFLINE:
+			sets[s.Id] = gid
+		case models.SLOT_STATUS_ONLINE:
+			if current[s.GroupId] == nil {
+				sets[s.Id] = gid
+			} else if s.GroupId != gid {
+				migrates[s.Id] = gid
+			}
+		default:
+			if s.State.MigrateStatus.To != gid {
+				plan.warn("slot %d is migrating to group %d instead of group %d, apply again when the migration is done", s.Id, s.State.MigrateStatus.To, gid)
+			}
+		}
+	}
+	plan.addSlotRanges(APPLY_SET_SLOTS, sets)
+	plan.addSlotRanges(APPLY_MIGRATE, migrates)
+
+	if !prune {
+		return plan, nil
+	}
+	wanted := make(map[int]map[string]bool)
+	for _, g := range spec.Groups {
+		wanted[g.Id] = make(map[string]bool)
+		for _, s := range g.Servers {
+			wanted[g.Id][s.Addr] = true
+		}
+	}
+	used := make(map[int]bool)
+	for _, s := range slots {
+		used[s.GroupId] = true
+		if s.State.Status == models.SLOT_STATUS_MIGRATE || s.State.Status == models.SLOT_STATUS_PRE_MIGRATE {
+			used[s.State.MigrateStatus.From] = true
+		}
+	}
+	var ids []int
+	for id := range current {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		g := current[id]
+		if addrs, ok := wanted[id]; ok {
+			var extra []string
+			for _, s := range g.Servers {
+				if !addrs[s.Addr] {
+					extra = append(extra, s.Addr)
+				}
+			}
+			sort.Strings(extra)
+			for _, addr := range extra {
+				plan.add(&ApplyStep{Op: APPLY_REMOVE_SERVER, GroupId: id, Addr: addr})
+			}
+			continue
+		}
+		if used[id] {
+			plan.warn("group %d is not in spec but still serves slots, apply again when its slots are migrated", id)
+			continue
+		}
+		plan.add(&ApplyStep{Op: APPLY_REMOVE_GROUP, GroupId: id})
+	}
+	return plan, nil
+}
+
+func cmdApply(argv []string) (err error) {
+	usage := `usage:
+	codis-config apply -f <file> [--dry-run] [--yes] [--prune] [--catch-up=<ms>]
+
+options:
+	-f <file>        the cluster spec in json, or in yaml if it ends with .yaml or .yml
+	--dry-run        print the plan only
+	--yes            execute the plan without confirmation
+	--prune          remove servers and groups not in the spec
+	--catch-up=<ms>  wait at most <ms> for a slave to catch up with the master before it's promoted [default: 60000]
+`
+	args, err := docopt.Parse(usage, argv, true, "", false)
+	if err != nil {
+		log.ErrorErrorf(err, "parse args failed")
+		return errors.Trace(err)
+	}
+	log.Debugf("parse args = {%+v}", args)
+
+	catchUp, err := strconv.Atoi(args["--catch-up"].(string))
+	if err != nil || catchUp < 0 {
+		return errors.Errorf("invalid catch-up = %s", args["--catch-up"])
+	}
+	return errors.Trace(runApply(args["-f"].(string), args["--dry-run"].(bool), args["--yes"].(bool), args["--prune"].(bool), catchUp))
+}
+
+func runApply(file string, dryRun, yes, prune bool, catchUp int) error {
+	spec, err := loadClusterSpec(file)
+	if err != nil {
+		return err
+	}
+	var groups []*models.ServerGroup
+	if err := callApi(METHOD_GET, "/api/server_groups", nil, &groups); err != nil {
+		return errors.Trace(err)
+	}
+	var slots []*models.Slot
+	if len(spec.Slots) != 0 || prune {
+		if slots, _, err = loadSlotsAndMasters(); err != nil {
+			return errors.Errorf("load slots failed, run 'codis-config slot init' first? %s", err)
+		}
+	}
+	plan, err := computeApplyPlan(spec, groups, slots, prune)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range plan.Warnings {
+		fmt.Printf("warning: %s\n", w)
+	}
+	if len(plan.Steps) == 0 {
+		fmt.Println("nothing to apply")
+		return nil
+	}
+	fmt.Println("plan:")
+	for i, s := range plan.Steps {
+		fmt.Printf("%4d. %s\n", i+1, s)
+	}
+	if dryRun {
+		return nil
+	}
+	if !yes {
+		fmt.Printf("apply %d steps? [y/N] ", len(plan.Steps))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Println("aborted")
+			return nil
+		}
+	}
+	for i, s := range plan.Steps {
+		if err := runApplyStep(s, catchUp); err != nil {
+			return errors.Errorf("step %d (%s) failed, %d steps done, apply again to continue: %s", i+1, s, i, err)
+		}
+		fmt.Printf("done %d. %s\n", i+1, s)
+	}
+	return nil
+}
+
+// runApplyStep executes a step by the api of dashboard, a server added by the
+// plan must sync from the master before it's promoted, it waits at most catchUp
+// in ms.
+func runApplyStep(s *ApplyStep, catchUp int) error {
+	var v interface{}
+	switch s.Op {
+	case APPLY_ADD_GROUP:
+		return callApi(METHOD_PUT, "/api/server_groups", models.NewServerGroup(globalEnv.ProductName(), s.GroupId), &v)
+	case APPLY_ADD_SERVER:
+		return callApi(METHOD_PUT, fmt.Sprintf("/api/server_group/%d/addServer", s.GroupId), models.NewServer(s.Role, s.Addr), &v)
+	case APPLY_PROMOTE:
+		return callApi(METHOD_POST, promoteApiPath(s.GroupId, catchUp, false), models.Server{Addr: s.Addr, GroupId: s.GroupId}, &v)
+	case APPLY_SET_SLOTS:
+		t := RangeSetTask{FromSlot: s.From, ToSlot: s.To, NewGroupId: s.GroupId, Status: string(models.SLOT_STATUS_ONLINE)}
+		return callApi(METHOD_POST, "/api/slot", t, &v)
+	case APPLY_MIGRATE:
+		return callApi(METHOD_POST, "/api/migrate", &migrateTaskForm{From: s.From, To: s.To, Group: s.GroupId}, &v)
+	case APPLY_REMOVE_SERVER:
+		return callApi(METHOD_PUT, fmt.Sprintf("/api/server_group/%d/removeServer", s.GroupId), models.Server{Addr: s.Addr}, &v)
+	case APPLY_REMOVE_GROUP:
+		return callApi(METHOD_DELETE, fmt.Sprintf("/api/server_group/%d", s.GroupId), nil, &v)
+	}
+	return errors.Errorf("unknown step %s", s.Op)
+}
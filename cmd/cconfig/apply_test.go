@@ -0,0 +1,220 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestLoadClusterSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codis-apply")
+	assert.MustNoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "cluster.json")
+	assert.MustNoError(ioutil.WriteFile(file, []byte(`{
+		"groups": [
+			{"id": 1, "servers": [{"addr": "localhost:6379", "role": "master"}, {"addr": "localhost:6380", "role": "slave"}]},
+			{"id": 2, "servers": [{"addr": "localhost:6381", "role": "master"}]}
+		],
+		"slots": [{"from": 0, "to": 511, "group": 1}, {"from": 512, "to": 1023, "group": 2}]
+	}`), 0644))
+	spec, err := loadClusterSpec(file)
+	assert.MustNoError(err)
+	assert.Must(len(spec.Groups) == 2 && len(spec.Slots) == 2)
+	assert.Must(*spec.Groups[0].Servers[1] == ServerSpec{Addr: "localhost:6380", Role: "slave"})
+	assert.Must(*spec.Slots[1] == SlotRangeSpec{From: 512, To: 1023, Group: 2})
+
+	// the same spec in yaml
+	file = filepath.Join(dir, "cluster.yml")
+	assert.MustNoError(ioutil.WriteFile(file, []byte(`# two groups
+groups:
+- id: 1
+  servers:
+  - addr: "localhost:6379"   # the master
+    role: master
+  - {addr: localhost:6380, role: slave}
+- id: 2
+  servers:
+  - {addr: localhost:6381, role: master}
+slots:
+- {from: 0, to: 511, group: 1}
+- from: 512
+  to: 1023
+  group: 2
+`), 0644))
+	yspec, err := loadClusterSpec(file)
+	assert.MustNoError(err)
+	ja, _ := json.Marshal(spec)
+	jb, _ := json.Marshal(yspec)
+	assert.Must(string(ja) == string(jb))
+
+	file = filepath.Join(dir, "cluster.yaml")
+	assert.MustNoError(ioutil.WriteFile(file, []byte("groups:\n- id: 1\n  servers: [\n"), 0644))
+	_, err = loadClusterSpec(file)
+	assert.Must(err != nil)
+
+	for _, s := range []string{
+		`{"groups":[{"id":1,"servers":[{"addr":"a:1","role":"slave"}]}]}`,
+		`{"groups":[{"id":1,"servers":[{"addr":"a:1","role":"master"}]},{"id":2,"servers":[{"addr":"a:1","role":"master"}]}]}`,
+		`{"groups":[{"id":1}],"slots":[{"from":0,"to":1024,"group":1}]}`,
+		`{"groups":[{"id":1}],"slots":[{"from":0,"to":10,"group":2}]}`,
+		`{"groups":[{"id":1}],"slots":[{"from":0,"to":10,"group":1},{"from":10,"to":20,"group":1}]}`,
+	} {
+		file := filepath.Join(dir, "cluster.json")
+		assert.MustNoError(ioutil.WriteFile(file, []byte(s), 0644))
+		_, err := loadClusterSpec(file)
+		assert.Must(err != nil)
+	}
+}
+
+func newApplyTestSlots() []*models.Slot {
+	slots := make([]*models.Slot, models.DEFAULT_SLOT_NUM)
+	for i := range slots {
+		slots[i] = models.NewSlot(testProductName, i)
+	}
+	return slots
+}
+
+func applyStepStrings(plan *ApplyPlan) []string {
+	var steps []string
+	for _, s := range plan.Steps {
+		steps = append(steps, s.String())
+	}
+	return steps
+}
+
+func assertSteps(plan *ApplyPlan, expect ...string) {
+	steps := applyStepStrings(plan)
+	assert.Must(len(steps) == len(expect))
+	for i := range steps {
+		assert.Must(steps[i] == expect[i])
+	}
+}
+
+func TestComputeApplyPlan(t *testing.T) {
+	spec := &ClusterSpec{}
+	assert.MustNoError(json.Unmarshal([]byte(`{
+		"groups": [
+			{"id": 1, "servers": [{"addr": "a:1", "role": "slave"}, {"addr": "a:2", "role": "master"}]},
+			{"id": 2, "servers": [{"addr": "b:1", "role": "master"}]}
+		],
+		"slots": [{"from": 0, "to": 511, "group": 1}, {"from": 512, "to": 1023, "group": 2}]
+	}`), spec))
+	assert.MustNoError(spec.validate())
+
+	// an empty cluster
+	plan, err := computeApplyPlan(spec, nil, newApplyTestSlots(), false)
+	assert.MustNoError(err)
+	assertSteps(plan,
+		"add group 1",
+		"add server a:2 to group 1 as master",
+		"add server a:1 to group 1 as slave",
+		"add group 2",
+		"add server b:1 to group 2 as master",
+		"set slots [0,511] online in group 1",
+		"set slots [512,1023] online in group 2",
+	)
+
+	// group 1 is a:1 (master) and c:1 (slave), serving all slots except
+	// those being migrated to group 2 and group 3
+	groups := []*models.ServerGroup{
+		{Id: 1, Servers: []*models.Server{
+			{Addr: "a:1", Type: models.SERVER_TYPE_MASTER, GroupId: 1},
+			{Addr: "c:1", Type: models.SERVER_TYPE_SLAVE, GroupId: 1},
+		}},
+		{Id: 3, Servers: []*models.Server{{Addr: "d:1", Type: models.SERVER_TYPE_MASTER, GroupId: 3}}},
+	}
+	slots := newApplyTestSlots()
+	for _, s := range slots {
+		s.GroupId = 1
+		s.State.Status = models.SLOT_STATUS_ONLINE
+	}
+	slots[600].GroupId = 2
+	slots[600].State.Status = models.SLOT_STATUS_MIGRATE
+	slots[600].State.MigrateStatus = models.SlotMigrateStatus{From: 1, To: 2}
+	slots[601].GroupId = 3
+	slots[601].State.Status = models.SLOT_STATUS_PRE_MIGRATE
+	slots[601].State.MigrateStatus = models.SlotMigrateStatus{From: 1, To: 3}
+
+	plan, err = computeApplyPlan(spec, groups, slots, true)
+	assert.MustNoError(err)
+	assertSteps(plan,
+		"add server a:2 to group 1 as slave",
+		"add group 2",
+		"add server b:1 to group 2 as master",
+		"promote server a:2 to master of group 1",
+		"add server a:1 to group 1 as slave",
+		"migrate slots [512,599] to group 2",
+		"migrate slots [602,1023] to group 2",
+		"remove server c:1 from group 1",
+	)
+	assert.Must(len(plan.Warnings) == 3)
+
+	slots[601].GroupId = 1
+	slots[601].State.Status = models.SLOT_STATUS_ONLINE
+	plan, err = computeApplyPlan(spec, groups, slots, true)
+	assert.MustNoError(err)
+	assert.Must(plan.Steps[len(plan.Steps)-1].String() == "remove group 3")
+
+	// nothing to do once applied
+	groups = []*models.ServerGroup{
+		{Id: 1, Servers: []*models.Server{
+			{Addr: "a:1", Type: models.SERVER_TYPE_SLAVE},
+			{Addr: "a:2", Type: models.SERVER_TYPE_MASTER},
+		}},
+		{Id: 2, Servers: []*models.Server{{Addr: "b:1", Type: models.SERVER_TYPE_MASTER}}},
+	}
+	for _, s := range slots {
+		s.State.Status = models.SLOT_STATUS_ONLINE
+		if s.Id >= 512 {
+			s.GroupId = 2
+		}
+	}
+	plan, err = computeApplyPlan(spec, groups, slots, true)
+	assert.MustNoError(err)
+	assert.Must(len(plan.Steps) == 0 && len(plan.Warnings) == 0)
+
+	// an offline server becomes a slave of the current master before it's
+	// promoted, the old master follows it after the promotion
+	groups[0].Servers[0].Type = models.SERVER_TYPE_MASTER
+	groups[0].Servers[1].Type = models.SERVER_TYPE_OFFLINE
+	plan, err = computeApplyPlan(spec, groups, slots, false)
+	assert.MustNoError(err)
+	assertSteps(plan,
+		"add server a:2 to group 1 as slave",
+		"promote server a:2 to master of group 1",
+		"add server a:1 to group 1 as slave",
+	)
+
+	// servers can't move between groups
+	groups[1].Servers = append(groups[1].Servers, &models.Server{Addr: "a:1", Type: models.SERVER_TYPE_SLAVE})
+	groups[0].Servers = groups[0].Servers[1:]
+	_, err = computeApplyPlan(spec, groups, slots, false)
+	assert.Must(err != nil)
+}
+
+func TestRunApplyStepPromote(t *testing.T) {
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.String())
+		w.Write([]byte(`{"msg":"OK","ret":0}`))
+	}))
+	defer ts.Close()
+	globalEnv = &CodisEnv{productName: testProductName, dashboardAddr: strings.TrimPrefix(ts.URL, "http://")}
+
+	// the slave added by the plan is waited to catch up with the master
+	assert.MustNoError(runApplyStep(&ApplyStep{Op: APPLY_PROMOTE, GroupId: 1, Addr: "a:2"}, 60000))
+	assert.Must(len(requests) == 1 && requests[0] == "POST /api/server_group/1/promote?catch_up=60000")
+}
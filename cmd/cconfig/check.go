@@ -0,0 +1,425 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	redigo "github.com/garyburd/redigo/redis"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+func cmdCheck(argv []string) (err error) {
+	usage := `usage:
+	codis-config check keys [--fix] [--rate=<n>] [--progress=<file>] [--resume]
+	codis-config check topology [--repair]
+
+options:
+	--fix              migrate misplaced keys to the groups owning their slots
+	--rate=<n>         max number of keys scanned per second, no limit if 0 [default: 10000]
+	--progress=<file>  where the progress is saved [default: check_keys.progress]
+	--resume           continue from the progress saved in --progress
+	--repair           repair the violations that are safe to repair
+`
+	args, err := docopt.Parse(usage, argv, true, "", false)
+	if err != nil {
+		log.ErrorErrorf(err, "parse args failed")
+		return errors.Trace(err)
+	}
+	log.Debugf("parse args = {%+v}", args)
+
+	if args["keys"].(bool) {
+		rate, err := strconv.Atoi(args["--rate"].(string))
+		if err != nil || rate < 0 {
+			return errors.Errorf("invalid rate = %s", args["--rate"])
+		}
+		return errors.Trace(runCheckKeys(args["--fix"].(bool), rate, args["--progress"].(string), args["--resume"].(bool)))
+	}
+	if args["topology"].(bool) {
+		return errors.Trace(runCheckTopology(args["--repair"].(bool)))
+	}
+	return nil
+}
+
+const (
+	checkKeysMaxReported = 100
+	checkKeysMaxPending  = 1024
+)
+
+type CheckKeysGroup struct {
+	GroupId   int    `json:"group_id"`
+	Addr      string `json:"addr"`
+	Cursor    string `json:"cursor"`
+	Done      bool   `json:"done"`
+	Scanned   int64  `json:"scanned"`
+	Misplaced int64  `json:"misplaced"`
+	Fixed     int64  `json:"fixed"`
+	Conflicts int64  `json:"conflicts"` // the key or its tag-mates exist on the owner too, it's not fixed
+	Skipped   int64  `json:"skipped"`   // keys of slots not online, or changed before they are fixed
+
+	Pending [][]byte `json:"pending,omitempty"` // misplaced keys with hash tags, fixed in batches
+}
+
+type MisplacedKey struct {
+	Key    string `json:"key"`
+	Slot   int    `json:"slot"`
+	Group  int    `json:"group"`
+	Owner  int    `json:"owner"`
+	Status string `json:"status"` // misplaced, fixed, conflict or skipped
+}
+
+type CheckKeysReport struct {
+	Groups    []*CheckKeysGroup `json:"groups"`
+	Misplaced []*MisplacedKey   `json:"misplaced"` // the first few misplaced keys
+}
+
+func loadCheckKeysProgress(file string) (*CheckKeysReport, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	r := &CheckKeysReport{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, errors.Errorf("invalid progress file %s", file)
+	}
+	return r, nil
+}
+
+func saveCheckKeysProgress(file string, r *CheckKeysReport) error {
+	b, _ := json.Marshal(r)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, file))
+}
+
+// keyChecker finds the keys on a group master whose slots are owned by other
+// groups, and migrates them to the owners if fix is set.
+type keyChecker struct {
+	slots   []*models.Slot
+	masters map[int]string
+	fix     bool
+	rate    int
+	passwd  string
+
+	report  *CheckKeysReport
+	scanned int64
+	start   time.Time
+
+	owners map[string]redigo.Conn
+}
+
+// owner returns the group owning the slot, or -1 if the slot is not online,
+// keys of migrating slots may be on both groups.
+func (k *keyChecker) owner(slot int) int {
+	s := k.slots[slot]
+	if s.State.Status != models.SLOT_STATUS_ONLINE {
+		return -1
+	}
+	return s.GroupId
+}
+
+func (k *keyChecker) ownerConn(addr string) (redigo.Conn, error) {
+	if c := k.owners[addr]; c != nil {
+		return c, nil
+	}
+	c, err := utils.DialTo(addr, k.passwd)
+	if err != nil {
+		return nil, err
+	}
+	k.owners[addr] = c
+	return c, nil
+}
+
+func (k *keyChecker) Close() {
+	for _, c := range k.owners {
+		c.Close()
+	}
+}
+
+func (k *keyChecker) record(g *CheckKeysGroup, key []byte, slot, owner int, status string) {
+	log.Warnf("key %q of slot %d is on group %d, owned by group %d: %s", key, slot, g.GroupId, owner, status)
+	if len(k.report.Misplaced) < checkKeysMaxReported {
+		k.report.Misplaced = append(k.report.Misplaced, &MisplacedKey{
+			Key:    string(key),
+			Slot:   slot,
+			Group:  g.GroupId,
+			Owner:  owner,
+			Status: status,
+		})
+	}
+}
+
+// hashTag returns the hash tag of key, or nil if it has no tag.
+func hashTag(key []byte) []byte {
+	if beg := bytes.IndexByte(key, '{'); beg >= 0 {
+		if end := bytes.IndexByte(key[beg+1:], '}'); end >= 0 {
+			return key[beg+1 : beg+1+end]
+		}
+	}
+	return nil
+}
+
+// slotOwnedBy reports whether the slot is online in group owner now, the
+// slots loaded at start may be stale after hours of scanning.
+func slotOwnedBy(slot, owner int) (bool, error) {
+	s := &models.Slot{}
+	if err := callApi(METHOD_GET, fmt.Sprintf("/api/slot/%d", slot), nil, s); err != nil {
+		return false, errors.Trace(err)
+	}
+	return s.State.Status == models.SLOT_STATUS_ONLINE && s.GroupId == owner, nil
+}
+
+// migrate moves keys of the same hash tag to the owner by SLOTSMGRTTAGONE,
+// which moves all mates of the tag and overwrites them on the owner, so the
+// keys are left as they are if any of the mates exists on the owner.
+func (k *keyChecker) migrate(c redigo.Conn, g *CheckKeysGroup, keys, mates [][]byte, slot, owner int) error {
+	skip := func(status string) {
+		for _, key := range keys {
+			k.record(g, key, slot, owner, status)
+		}
+	}
+	if len(mates) == 0 {
+		// removed from the source since it was scanned
+		g.Skipped += int64(len(keys))
+		skip("skipped")
+		return nil
+	}
+	if ok, err := slotOwnedBy(slot, owner); err != nil {
+		return err
+	} else if !ok {
+		log.Warnf("slot %d is not online in group %d any more", slot, owner)
+		g.Skipped += int64(len(keys))
+		skip("skipped")
+		return nil
+	}
+	addr := k.masters[owner]
+	oc, err := k.ownerConn(addr)
+	if err != nil {
+		return err
+	}
+	for _, mate := range mates {
+		exists, err := redigo.Bool(oc.Do("EXISTS", mate))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if exists {
+			log.Warnf("key %q of slot %d is on group %d already", mate, slot, owner)
+			g.Conflicts += int64(len(keys))
+			skip("conflict")
+			return nil
+		}
+	}
+	parts := strings.Split(addr, ":")
+	if len(parts) != 2 {
+		return errors.Trace(utils.ErrInvalidAddr)
+	}
+	if _, err := redigo.Int(c.Do("SLOTSMGRTTAGONE", parts[0], parts[1], 3000, mates[0])); err != nil {
+		return errors.Trace(err)
+	}
+	g.Fixed += int64(len(keys))
+	skip("fixed")
+	return nil
+}
+
+// fixPending finds the mates of the pending keys on the source in a single
+// scan, and migrates the keys tag by tag.
+func (k *keyChecker) fixPending(c redigo.Conn, g *CheckKeysGroup) error {
+	var tags []string
+	pending := make(map[string][][]byte)
+	for _, key := range g.Pending {
+		tag := string(hashTag(key))
+		keys, ok := pending[tag]
+		if !ok {
+			tags = append(tags, tag)
+		}
+		dup := false
+		for _, p := range keys {
+			dup = dup || bytes.Equal(p, key)
+		}
+		if !dup {
+			pending[tag] = append(keys, key)
+		}
+	}
+	mates := make(map[string][][]byte, len(tags))
+	err := scanKeysFrom(c, "0", func(cursor string, keys [][]byte) error {
+		for _, key := range keys {
+			if tag := hashTag(key); tag != nil {
+				if _, ok := pending[string(tag)]; ok {
+					mates[string(tag)] = append(mates[string(tag)], key)
+				}
+			}
+		}
+		k.throttle(len(keys))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, tag := range tags {
+		keys := pending[tag]
+		slot := router.HashSlot(keys[0])
+		if err := k.migrate(c, g, keys, mates[tag], slot, k.owner(slot)); err != nil {
+			g.Pending = nil
+			for _, tag := range tags[i:] {
+				g.Pending = append(g.Pending, pending[tag]...)
+			}
+			return err
+		}
+	}
+	g.Pending = nil
+	return nil
+}
+
+// throttle sleeps to keep the scanned keys per second under rate.
+func (k *keyChecker) throttle(n int) {
+	k.scanned += int64(n)
+	if k.rate <= 0 {
+		return
+	}
+	expect := time.Duration(float64(k.scanned) / float64(k.rate) * float64(time.Second))
+	if d := expect - time.Since(k.start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (k *keyChecker) checkGroup(g *CheckKeysGroup, save func() error) error {
+	c, err := utils.DialToTimeout(g.Addr, k.passwd, time.Minute, time.Minute)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	lastSave := time.Now()
+	return scanKeysFrom(c, g.Cursor, func(cursor string, keys [][]byte) error {
+		for _, key := range keys {
+			slot := router.HashSlot(key)
+			owner := k.owner(slot)
+			switch {
+			case owner < 0:
+				g.Skipped++
+			case owner == g.GroupId:
+			case !k.fix:
+				g.Misplaced++
+				k.record(g, key, slot, owner, "misplaced")
+			case hashTag(key) != nil:
+				// resolving the mates of a tag costs a scan, so it's batched
+				g.Misplaced++
+				g.Pending = append(g.Pending, key)
+			default:
+				g.Misplaced++
+				if err := k.migrate(c, g, [][]byte{key}, [][]byte{key}, slot, owner); err != nil {
+					return err
+				}
+			}
+		}
+		if len(g.Pending) != 0 && (len(g.Pending) >= checkKeysMaxPending || cursor == "0") {
+			if err := k.fixPending(c, g); err != nil {
+				return err
+			}
+		}
+		g.Scanned += int64(len(keys))
+		g.Cursor, g.Done = cursor, cursor == "0"
+		k.throttle(len(keys))
+		if time.Since(lastSave) >= time.Second*5 || g.Done {
+			lastSave = time.Now()
+			log.Infof("check keys of group %d: %d scanned, %d misplaced, %d fixed",
+				g.GroupId, g.Scanned, g.Misplaced, g.Fixed)
+			return save()
+		}
+		return nil
+	})
+}
+
+func runCheckKeys(fix bool, rate int, progressFile string, resume bool) error {
+	if fix {
+		// keys of migrating slots would be moved back and forth
+		var tasks []json.RawMessage
+		if err := callApi(METHOD_GET, "/api/migrate/tasks", nil, &tasks); err != nil {
+			return errors.Trace(err)
+		}
+		if len(tasks) != 0 {
+			return errors.Errorf("%d migrate tasks exist, fix keys when they are done", len(tasks))
+		}
+	}
+	slots, masters, err := loadSlotsAndMasters()
+	if err != nil {
+		return err
+	}
+	var report *CheckKeysReport
+	if resume {
+		if report, err = loadCheckKeysProgress(progressFile); err != nil {
+			return err
+		}
+	}
+	if report == nil {
+		report = &CheckKeysReport{}
+		var ids []int
+		for id := range masters {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			report.Groups = append(report.Groups, &CheckKeysGroup{GroupId: id, Addr: masters[id], Cursor: "0"})
+		}
+	}
+
+	k := &keyChecker{
+		slots:   slots,
+		masters: masters,
+		fix:     fix,
+		rate:    rate,
+		passwd:  globalEnv.Password(),
+		report:  report,
+		start:   time.Now(),
+		owners:  make(map[string]redigo.Conn),
+	}
+	defer k.Close()
+
+	save := func() error {
+		return saveCheckKeysProgress(progressFile, report)
+	}
+	for _, g := range report.Groups {
+		if g.Done {
+			continue
+		}
+		if masters[g.GroupId] != g.Addr {
+			return errors.Errorf("master of group %d has changed from %s to %s, start over without --resume",
+				g.GroupId, g.Addr, masters[g.GroupId])
+		}
+		if err := k.checkGroup(g, save); err != nil {
+			save()
+			return err
+		}
+	}
+	os.Remove(progressFile)
+
+	fmt.Println(jsonify(report))
+	var left int64
+	for _, g := range report.Groups {
+		left += g.Misplaced - g.Fixed
+	}
+	if left != 0 {
+		return errors.Errorf("%d misplaced keys are not fixed", left)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	redigo "github.com/garyburd/redigo/redis"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+func TestHashTag(t *testing.T) {
+	assert.Must(hashTag([]byte("key")) == nil)
+	assert.Must(hashTag([]byte("{key")) == nil)
+	assert.Must(string(hashTag([]byte("a{user:1}b{x}"))) == "user:1")
+	assert.Must(string(hashTag([]byte("a{}b"))) == "")
+
+	// keys of the same tag are in the same slot
+	assert.Must(router.HashSlot([]byte("{user:1}a")) == router.HashSlot([]byte("b{user:1}")))
+}
+
+// checkTestConn serves SCAN, EXISTS and SLOTSMGRTTAGONE of a few keys.
+type checkTestConn struct {
+	keys     []string
+	scans    int
+	migrated []string
+}
+
+func (c *checkTestConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "SCAN":
+		c.scans++
+		var keys []interface{}
+		for _, k := range c.keys {
+			keys = append(keys, []byte(k))
+		}
+		return []interface{}{[]byte("0"), keys}, nil
+	case "EXISTS":
+		for _, k := range c.keys {
+			if k == string(args[0].([]byte)) {
+				return int64(1), nil
+			}
+		}
+		return int64(0), nil
+	case "SLOTSMGRTTAGONE":
+		c.migrated = append(c.migrated, string(args[3].([]byte)))
+		return int64(1), nil
+	}
+	return nil, errors.Errorf("unknown command %s", cmd)
+}
+
+func (c *checkTestConn) Close() error                      { return nil }
+func (c *checkTestConn) Err() error                        { return nil }
+func (c *checkTestConn) Send(string, ...interface{}) error { return nil }
+func (c *checkTestConn) Flush() error                      { return nil }
+func (c *checkTestConn) Receive() (interface{}, error)     { return nil, nil }
+
+func TestCheckKeysFixPending(t *testing.T) {
+	// slots of tag c are moved to group 3 after the check starts
+	moved := router.HashSlot([]byte("c"))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/slot/"))
+		s := models.NewSlot(testProductName, id)
+		s.GroupId, s.State.Status = 2, models.SLOT_STATUS_ONLINE
+		if id == moved {
+			s.GroupId = 3
+		}
+		b, _ := json.Marshal(s)
+		w.Write(b)
+	}))
+	defer ts.Close()
+	globalEnv = &CodisEnv{productName: testProductName, dashboardAddr: strings.TrimPrefix(ts.URL, "http://")}
+
+	slots := newApplyTestSlots()
+	for _, s := range slots {
+		s.GroupId, s.State.Status = 2, models.SLOT_STATUS_ONLINE
+	}
+	src := &checkTestConn{keys: []string{"x", "{a}1", "{a}2", "{b}1", "{c}1"}}
+	owner := &checkTestConn{}
+	k := &keyChecker{
+		slots:   slots,
+		masters: map[int]string{1: "src:1", 2: "owner:2"},
+		fix:     true,
+		report:  &CheckKeysReport{},
+		owners:  map[string]redigo.Conn{"owner:2": owner},
+	}
+	g := &CheckKeysGroup{GroupId: 1, Addr: "src:1"}
+	for _, key := range []string{"{a}1", "{b}1", "{a}2", "{c}1", "{a}1"} {
+		g.Pending = append(g.Pending, []byte(key))
+	}
+
+	// mates of all tags are found by a single scan, which is throttled
+	assert.MustNoError(k.fixPending(src, g))
+	assert.Must(src.scans == 1 && k.scanned == int64(len(src.keys)))
+	assert.Must(len(src.migrated) == 2 && src.migrated[0] == "{a}1" && src.migrated[1] == "{b}1")
+	assert.Must(g.Fixed == 3 && g.Conflicts == 0 && g.Skipped == 1 && len(g.Pending) == 0)
+
+	// a mate on the owner would be overwritten by SLOTSMGRTTAGONE
+	owner.keys = []string{"{a}2"}
+	g.Pending = [][]byte{[]byte("{a}1")}
+	assert.MustNoError(k.fixPending(src, g))
+	assert.Must(g.Conflicts == 1 && len(src.migrated) == 2)
+}
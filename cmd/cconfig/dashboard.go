@@ -188,6 +188,7 @@ func runDashboard(addr string, httpLogFile string) {
 	}))
 
 	m.Get("/api/server_groups", apiGetServerGroupList)
+	m.Get("/api/replication", apiGetReplication)
 	m.Get("/api/overview", apiOverview)
 
 	m.Get("/api/redis/:addr/stat", apiRedisStat)
@@ -205,8 +206,29 @@ func runDashboard(addr string, httpLogFile string) {
 	m.Get("/api/migrate/status", apiMigrateStatus)
 	m.Get("/api/migrate/tasks", apiGetMigrateTasks)
 	m.Post("/api/migrate", binding.Json(migrateTaskForm{}), apiDoMigrate)
+	m.Post("/api/migrate/pause", apiPauseAllMigrateTasks)
+	m.Post("/api/migrate/resume", apiResumeAllMigrateTasks)
+	m.Post("/api/migrate/task/(?P<id>[0-9]+)/pause", apiPauseMigrateTask)
+	m.Post("/api/migrate/task/(?P<id>[0-9]+)/resume", apiResumeMigrateTask)
+	m.Post("/api/migrate/task/(?P<id>[0-9]+)/priority", binding.Json(migratePriorityForm{}), apiSetMigrateTaskPriority)
+	m.Delete("/api/migrate/task/(?P<id>[0-9]+)", apiCancelMigrateTask)
 
 	m.Post("/api/rebalance", apiRebalance)
+	m.Get("/api/rebalance/plan", apiGetRebalancePlan)
+	m.Post("/api/rebalance/plan", binding.Json(rebalancePlanForm{}), apiSubmitRebalancePlan)
+
+	m.Get("/api/topology/check", apiCheckTopology)
+	m.Post("/api/topology/repair", apiRepairTopology)
+	m.Get("/api/health/topology", apiTopologyHealth)
+
+	m.Get("/api/failover/status", apiGetFailoverStatus)
+	m.Get("/api/failover/audit", apiGetFailoverAudits)
+	m.Post("/api/failover/group/(?P<id>[0-9]+)/disable", apiDisableFailover)
+	m.Post("/api/failover/group/(?P<id>[0-9]+)/enable", apiEnableFailover)
+
+	m.Get("/api/dump/schedules", apiGetDumpSchedules)
+	m.Post("/api/dump/schedules", binding.Json(DumpSchedule{}), apiAddDumpSchedule)
+	m.Delete("/api/dump/schedule/(?P<id>[0-9]+)", apiRemoveDumpSchedule)
 
 	m.Get("/api/slot/list", apiGetSlots)
 	m.Get("/api/slot/:id", apiGetSingleSlot)
@@ -235,7 +257,12 @@ func runDashboard(addr string, httpLogFile string) {
 	}
 
 	// create long live migrate manager
-	globalMigrateManager = NewMigrateManager(safeZkConn, globalEnv.ProductName())
+	globalMigrateManager = NewMigrateManager(safeZkConn, globalEnv.ProductName(),
+		globalEnv.MigrateConcurrency(), globalEnv.MigrateGroupConcurrency())
+	globalDumpScheduler = NewDumpScheduler(safeZkConn, globalEnv.ProductName())
+	globalFailoverManager = NewFailoverManager(safeZkConn, globalEnv.ProductName(),
+		globalEnv.FailoverProbeInterval(), globalEnv.FailoverDownAfter(), globalEnv.FailoverQuorum())
+	globalReplicationMonitor = NewReplicationMonitor(safeZkConn, globalEnv.ProductName())
 
 	go func() {
 		tick := time.Tick(time.Second)
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-martini/martini"
@@ -17,10 +18,14 @@ import (
 
 	"github.com/CodisLabs/codis/pkg/models"
 	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
 
 var globalMigrateManager *MigrateManager
+var globalDumpScheduler *DumpScheduler
+var globalFailoverManager *FailoverManager
+var globalReplicationMonitor *ReplicationMonitor
 
 type RangeSetTask struct {
 	FromSlot   int    `json:"from"`
@@ -82,6 +87,11 @@ func apiOverview() (int, string) {
 	return 200, string(b)
 }
 
+func apiGetReplication() (int, string) {
+	b, _ := json.MarshalIndent(globalReplicationMonitor.Report(), " ", "  ")
+	return 200, string(b)
+}
+
 func apiGetServerGroupList() (int, string) {
 	groups, err := models.ServerGroups(safeZkConn, globalEnv.ProductName())
 	if err != nil {
@@ -124,13 +134,18 @@ func apiRedisStat(param martini.Params) (int, string) {
 }
 
 type migrateTaskForm struct {
-	From  int `json:"from"`
-	To    int `json:"to"`
-	Group int `json:"new_group"`
-	Delay int `json:"delay"`
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+	Group    int    `json:"new_group"`
+	Delay    int    `json:"delay"`
+	Priority int    `json:"priority"`
+	Verify   string `json:"verify"`
 }
 
 func apiDoMigrate(form migrateTaskForm) (int, string) {
+	if !validVerifyMode(form.Verify) {
+		return 500, fmt.Sprintf("invalid verify mode = %s", form.Verify)
+	}
 	for i := form.From; i <= form.To; i++ {
 		task := MigrateTaskInfo{
 			SlotId:     i,
@@ -138,30 +153,265 @@ func apiDoMigrate(form migrateTaskForm) (int, string) {
 			NewGroupId: form.Group,
 			Status:     MIGRATE_TASK_PENDING,
 			CreateAt:   strconv.FormatInt(time.Now().Unix(), 10),
+			Priority:   form.Priority,
+			Verify:     form.Verify,
+		}
+		if err := globalMigrateManager.PostTask(&task); err != nil {
+			log.ErrorErrorf(err, "post migrate task failed")
+			return 500, err.Error()
 		}
-		globalMigrateManager.PostTask(&task)
 	}
 	// do migrate async
 	return jsonRetSucc()
 }
 
-func apiRebalance(param martini.Params) (int, string) {
+// parseRebalanceOptions parses options from the query, e.g.
+//
+//	?strategy=load&weights=1:2,2:1&tolerance=10&sample=3
+func parseRebalanceOptions(r *http.Request) (*RebalanceOptions, error) {
+	opts := DefaultRebalanceOptions()
+	if v := r.FormValue("strategy"); v != "" {
+		opts.Strategy = v
+	}
+	if v := r.FormValue("weights"); v != "" {
+		opts.Weights = make(map[int]int64)
+		for _, s := range strings.Split(v, ",") {
+			kv := strings.SplitN(s, ":", 2)
+			if len(kv) != 2 {
+				return nil, errors.Errorf("invalid weights = %s", v)
+			}
+			id, err1 := strconv.Atoi(kv[0])
+			w, err2 := strconv.ParseInt(kv[1], 10, 64)
+			if err1 != nil || err2 != nil {
+				return nil, errors.Errorf("invalid weights = %s", v)
+			}
+			opts.Weights[id] = w
+		}
+	}
+	if v := r.FormValue("tolerance"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t < 0 {
+			return nil, errors.Errorf("invalid tolerance = %s", v)
+		}
+		opts.Tolerance = t
+	}
+	if v := r.FormValue("sample"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, errors.Errorf("invalid sample = %s", v)
+		}
+		opts.Sample = time.Second * time.Duration(n)
+	}
+	return opts, nil
+}
+
+func apiRebalance(r *http.Request) (int, string) {
 	if len(globalMigrateManager.Tasks()) > 0 {
 		return 500, "there are migration tasks running, you should wait them done"
 	}
-	if err := Rebalance(); err != nil {
+	opts, err := parseRebalanceOptions(r)
+	if err != nil {
+		return 500, err.Error()
+	}
+	if err := Rebalance(opts); err != nil {
 		log.ErrorErrorf(err, "rebalance failed")
 		return 500, err.Error()
 	}
 	return jsonRetSucc()
 }
 
+func apiGetRebalancePlan(r *http.Request) (int, string) {
+	opts, err := parseRebalanceOptions(r)
+	if err != nil {
+		return 500, err.Error()
+	}
+	plan, err := PlanRebalance(safeZkConn, opts)
+	if err != nil {
+		log.ErrorErrorf(err, "plan rebalance failed")
+		return 500, err.Error()
+	}
+	b, _ := json.MarshalIndent(plan, " ", "  ")
+	return 200, string(b)
+}
+
+// the output of GET /api/rebalance/plan can be edited and submitted as a form
+type rebalancePlanForm struct {
+	Moves []*RebalanceMove `json:"moves"`
+	Delay int              `json:"delay"`
+}
+
+func apiSubmitRebalancePlan(form rebalancePlanForm) (int, string) {
+	if err := SubmitRebalancePlan(safeZkConn, form.Moves, form.Delay); err != nil {
+		log.ErrorErrorf(err, "submit rebalance plan failed")
+		return 500, err.Error()
+	}
+	return jsonRetSucc()
+}
+
 func apiGetMigrateTasks() (int, string) {
 	tasks := globalMigrateManager.Tasks()
 	b, _ := json.MarshalIndent(tasks, " ", "  ")
 	return 200, string(b)
 }
 
+func topologyRet(repair bool, unhealthy int) (int, string) {
+	r, err := checkTopology(repair)
+	if err != nil {
+		log.ErrorErrorf(err, "check topology failed")
+		return 500, err.Error()
+	}
+	b, _ := json.MarshalIndent(r, " ", "  ")
+	if !r.Healthy {
+		return unhealthy, string(b)
+	}
+	return 200, string(b)
+}
+
+func apiCheckTopology() (int, string) {
+	return topologyRet(false, 200)
+}
+
+func apiRepairTopology() (int, string) {
+	return topologyRet(true, 200)
+}
+
+// apiTopologyHealth is the same as apiCheckTopology, but responds with 503 if
+// any invariant is violated, so it can be used by health checks.
+func apiTopologyHealth() (int, string) {
+	return topologyRet(false, 503)
+}
+
+func apiGetDumpSchedules() (int, string) {
+	schedules := globalDumpScheduler.Schedules()
+	if schedules == nil {
+		schedules = []DumpSchedule{}
+	}
+	b, _ := json.MarshalIndent(schedules, " ", "  ")
+	return 200, string(b)
+}
+
+func apiAddDumpSchedule(s DumpSchedule) (int, string) {
+	if err := globalDumpScheduler.Add(&s); err != nil {
+		log.ErrorErrorf(err, "add dump schedule failed")
+		return jsonRetFail(-1, err.Error())
+	}
+	b, _ := json.MarshalIndent(s, " ", "  ")
+	return 200, string(b)
+}
+
+func apiRemoveDumpSchedule(param martini.Params) (int, string) {
+	if err := globalDumpScheduler.Remove(param["id"]); err != nil {
+		log.ErrorErrorf(err, "remove dump schedule %s failed", param["id"])
+		return jsonRetFail(-1, err.Error())
+	}
+	return jsonRetSucc()
+}
+
+func apiGetFailoverStatus() (int, string) {
+	s, err := globalFailoverManager.Status()
+	if err != nil {
+		log.ErrorErrorf(err, "get failover status failed")
+		return 500, err.Error()
+	}
+	b, _ := json.MarshalIndent(s, " ", "  ")
+	return 200, string(b)
+}
+
+func apiGetFailoverAudits() (int, string) {
+	audits := globalFailoverManager.Audits()
+	if audits == nil {
+		audits = []FailoverAudit{}
+	}
+	b, _ := json.MarshalIndent(audits, " ", "  ")
+	return 200, string(b)
+}
+
+func setNoFailoverRet(param martini.Params, on bool) (int, string) {
+	groupId, err := strconv.Atoi(param["id"])
+	if err != nil {
+		return 500, err.Error()
+	}
+	if err := globalFailoverManager.SetNoFailover(groupId, on); err != nil {
+		log.ErrorErrorf(err, "set no failover of group %d failed", groupId)
+		return 500, err.Error()
+	}
+	return jsonRetSucc()
+}
+
+func apiDisableFailover(param martini.Params) (int, string) {
+	return setNoFailoverRet(param, true)
+}
+
+func apiEnableFailover(param martini.Params) (int, string) {
+	return setNoFailoverRet(param, false)
+}
+
+func migrateTaskRet(info *MigrateTaskInfo, err error) (int, string) {
+	if err != nil {
+		log.ErrorErrorf(err, "update migrate task failed")
+		if errors.Equal(err, ErrMigrateTaskNotFound) {
+			return 404, err.Error()
+		}
+		return 500, err.Error()
+	}
+	b, _ := json.MarshalIndent(info, " ", "  ")
+	return 200, string(b)
+}
+
+func apiPauseMigrateTask(param martini.Params) (int, string) {
+	return migrateTaskRet(globalMigrateManager.Pause(param["id"]))
+}
+
+func apiResumeMigrateTask(param martini.Params) (int, string) {
+	return migrateTaskRet(globalMigrateManager.Resume(param["id"]))
+}
+
+type migratePriorityForm struct {
+	Priority int `json:"priority"`
+}
+
+func apiSetMigrateTaskPriority(form migratePriorityForm, param martini.Params) (int, string) {
+	return migrateTaskRet(globalMigrateManager.SetPriority(param["id"], form.Priority))
+}
+
+func apiCancelMigrateTask(param martini.Params) (int, string) {
+	if err := globalMigrateManager.Cancel(param["id"]); err != nil {
+		log.ErrorErrorf(err, "cancel migrate task %s failed", param["id"])
+		if errors.Equal(err, ErrMigrateTaskNotFound) {
+			return 404, err.Error()
+		}
+		return 500, err.Error()
+	}
+	return jsonRetSucc()
+}
+
+// apiPauseAllMigrateTasks pauses all tasks, e.g. during peak hours.
+func apiPauseAllMigrateTasks() (int, string) {
+	for _, info := range globalMigrateManager.Tasks() {
+		if info.Status == MIGRATE_TASK_PAUSED {
+			continue
+		}
+		if _, err := globalMigrateManager.Pause(info.Id); err != nil && !errors.Equal(err, ErrMigrateTaskNotFound) {
+			log.ErrorErrorf(err, "pause migrate task %s failed", info.Id)
+			return 500, err.Error()
+		}
+	}
+	return jsonRetSucc()
+}
+
+func apiResumeAllMigrateTasks() (int, string) {
+	for _, info := range globalMigrateManager.Tasks() {
+		if info.Status != MIGRATE_TASK_PAUSED {
+			continue
+		}
+		if _, err := globalMigrateManager.Resume(info.Id); err != nil && !errors.Equal(err, ErrMigrateTaskNotFound) {
+			log.ErrorErrorf(err, "resume migrate task %s failed", info.Id)
+			return 500, err.Error()
+		}
+	}
+	return jsonRetSucc()
+}
+
 func apiGetServerGroup(param martini.Params) (int, string) {
 	id := param["id"]
 	groupId, err := strconv.Atoi(id)
@@ -186,7 +436,7 @@ func apiMigrateStatus() (int, string) {
 
 	b, err := json.MarshalIndent(map[string]interface{}{
 		"migrate_slots": migrateSlots,
-		"migrate_task":  globalMigrateManager.runningTask,
+		"migrate_tasks": globalMigrateManager.RunningTasks(),
 	}, " ", "  ")
 	return 200, string(b)
 }
@@ -345,7 +595,20 @@ func apiAddServerToGroup(server models.Server, param martini.Params) (int, strin
 	return jsonRetSucc()
 }
 
-func apiPromoteServer(server models.Server, param martini.Params) (int, string) {
+// apiPromoteServer promotes a slave, options are in the query, e.g.
+//
+//	?catch_up=5000&force=1
+func apiPromoteServer(server models.Server, r *http.Request) (int, string) {
+	opts := &models.PromoteOptions{}
+	if s := r.FormValue("catch_up"); s != "" {
+		ms, err := strconv.Atoi(s)
+		if err != nil || ms < 0 {
+			return 500, fmt.Sprintf("invalid catch_up = %s", s)
+		}
+		opts.CatchUp = time.Duration(ms) * time.Millisecond
+	}
+	opts.Force = r.FormValue("force") == "1"
+
 	lock := utils.GetZkLock(safeZkConn, globalEnv.ProductName())
 	if err := lock.LockWithTimeout(0, fmt.Sprintf("promote server %+v", server)); err != nil {
 		return 500, err.Error()
@@ -362,13 +625,13 @@ func apiPromoteServer(server models.Server, param martini.Params) (int, string)
 		log.ErrorErrorf(err, "get group %d failed", server.GroupId)
 		return 500, err.Error()
 	}
-	err = group.Promote(safeZkConn, server.Addr, globalEnv.Password())
+	report, err := group.Promote(safeZkConn, server.Addr, globalEnv.Password(), opts)
+	b, _ := json.MarshalIndent(report, " ", "  ")
 	if err != nil {
 		log.ErrorErrorf(err, "promote group %d failed", server.GroupId)
-		return 500, err.Error()
+		return 500, err.Error() + "\n" + string(b)
 	}
-
-	return jsonRetSucc()
+	return 200, string(b)
 }
 
 func apiRemoveServerFromGroup(server models.Server, param martini.Params) (int, string) {
@@ -0,0 +1,193 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// periodic dumps of slots, stored on zk and run by dashboard
+type DumpSchedule struct {
+	Id       string `json:"id"`
+	Slots    []int  `json:"slots"`
+	Interval int    `json:"interval"` // in seconds
+	Dir      string `json:"dir"`
+	Keep     int    `json:"keep"`
+
+	LastRun   int64  `json:"last_run"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (s *DumpSchedule) validate() error {
+	if len(s.Slots) == 0 {
+		return errors.New("no slots to dump")
+	}
+	for _, id := range s.Slots {
+		if id < 0 || id >= models.DEFAULT_SLOT_NUM {
+			return errors.Errorf("invalid slot id = %d", id)
+		}
+	}
+	if s.Interval <= 0 {
+		return errors.Errorf("invalid interval = %d", s.Interval)
+	}
+	if s.Dir == "" {
+		return errors.New("dir is required")
+	}
+	if s.Keep < 0 {
+		return errors.Errorf("invalid keep = %d", s.Keep)
+	}
+	return nil
+}
+
+type DumpScheduler struct {
+	zkConn      zkhelper.Conn
+	productName string
+}
+
+func getDumpSchedulesPath(product string) string {
+	return fmt.Sprintf("/zk/codis/db_%s/dump_schedules", product)
+}
+
+func NewDumpScheduler(zkConn zkhelper.Conn, pn string) *DumpScheduler {
+	d := &DumpScheduler{
+		zkConn:      zkConn,
+		productName: pn,
+	}
+	zkhelper.CreateRecursive(d.zkConn, getDumpSchedulesPath(d.productName), "", 0, zkhelper.DefaultDirACLs())
+	go d.loop()
+	return d
+}
+
+func (d *DumpScheduler) Add(s *DumpSchedule) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	s.LastRun, s.LastError = 0, ""
+	b, _ := json.Marshal(s)
+	p, err := d.zkConn.Create(getDumpSchedulesPath(d.productName)+"/", b, zk.FlagSequence, zkhelper.DefaultFileACLs())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, s.Id = path.Split(p)
+	return nil
+}
+
+func (d *DumpScheduler) Remove(id string) error {
+	return errors.Trace(d.zkConn.Delete(getDumpSchedulesPath(d.productName)+"/"+id, -1))
+}
+
+func (d *DumpScheduler) Schedules() []DumpSchedule {
+	var res []DumpSchedule
+	ids, _, _ := d.zkConn.Children(getDumpSchedulesPath(d.productName))
+	sort.Strings(ids)
+	for _, id := range ids {
+		data, _, err := d.zkConn.Get(getDumpSchedulesPath(d.productName) + "/" + id)
+		if err != nil {
+			continue
+		}
+		s := DumpSchedule{}
+		json.Unmarshal(data, &s)
+		s.Id = id
+		res = append(res, s)
+	}
+	return res
+}
+
+func (d *DumpScheduler) loop() {
+	for {
+		time.Sleep(time.Second)
+		now := time.Now()
+		for _, s := range d.Schedules() {
+			if now.Unix()-s.LastRun < int64(s.Interval) {
+				continue
+			}
+			s.LastRun, s.LastError = now.Unix(), ""
+			if err := d.run(&s, now); err != nil {
+				log.ErrorErrorf(err, "dump schedule %s failed", s.Id)
+				s.LastError = err.Error()
+			}
+			b, _ := json.Marshal(s)
+			// the schedule may have been removed while running
+			d.zkConn.Set(getDumpSchedulesPath(d.productName)+"/"+s.Id, b, -1)
+		}
+	}
+}
+
+func dumpFileName(dir string, slot int, t time.Time) string {
+	return filepath.Join(dir, fmt.Sprintf("slot_%04d_%s.dump", slot, t.Format("20060102150405")))
+}
+
+// run dumps the slots grouped by their masters, so the keys on each master
+// are scanned only once.
+func (d *DumpScheduler) run(s *DumpSchedule, now time.Time) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return errors.Trace(err)
+	}
+	files := make(map[string]map[int]string)
+	for _, id := range s.Slots {
+		slot, err := models.GetSlot(d.zkConn, d.productName, id)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if slot.State.Status != models.SLOT_STATUS_ONLINE {
+			return errors.Errorf("slot %d is not online, status = %s", id, slot.State.Status)
+		}
+		group, err := models.GetGroup(d.zkConn, d.productName, slot.GroupId)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		master, err := group.Master(d.zkConn)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if master == nil {
+			return errors.Errorf("group %d of slot %d has no master", slot.GroupId, id)
+		}
+		if files[master.Addr] == nil {
+			files[master.Addr] = make(map[int]string)
+		}
+		files[master.Addr][id] = dumpFileName(s.Dir, id, now)
+	}
+	for addr, m := range files {
+		counts, err := dumpSlots(addr, globalEnv.Password(), m)
+		if err != nil {
+			return err
+		}
+		log.Infof("dump schedule %s: %d slots dumped from %s, keys = %v", s.Id, len(m), addr, counts)
+	}
+	if s.Keep > 0 {
+		for _, id := range s.Slots {
+			pruneDumpFiles(s.Dir, id, s.Keep)
+		}
+	}
+	return nil
+}
+
+// pruneDumpFiles removes the oldest dumps of the slot, only keep are left.
+func pruneDumpFiles(dir string, slot int, keep int) {
+	files, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("slot_%04d_*.dump", slot)))
+	if err != nil {
+		return
+	}
+	sort.Strings(files)
+	for len(files) > keep {
+		if err := os.Remove(files[0]); err != nil && !os.IsNotExist(err) {
+			log.WarnErrorf(err, "remove dump %s failed", files[0])
+		}
+		files = files[1:]
+	}
+}
@@ -5,20 +5,31 @@ package main
 
 import (
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/c4pt0r/cfg"
 
 	"github.com/wandoulabs/zkhelper"
 
+	"github.com/CodisLabs/codis/pkg/utils/consulzk"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/fszk"
 	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
 )
 
 type Env interface {
 	ProductName() string
 	Password() string
 	DashboardAddr() string
+	MigrateConcurrency() int
+	MigrateGroupConcurrency() int
+	MigrateLatencyBudget() time.Duration
+	FailoverProbeInterval() time.Duration
+	FailoverDownAfter() int
+	FailoverQuorum() int
 	NewZkConn() (zkhelper.Conn, error)
 }
 
@@ -28,6 +39,14 @@ type CodisEnv struct {
 	dashboardAddr string
 	productName   string
 	provider      string
+
+	migrateConcurrency      int
+	migrateGroupConcurrency int
+	migrateLatencyBudget    time.Duration
+
+	failoverProbeInterval time.Duration
+	failoverDownAfter     int
+	failoverQuorum        int
 }
 
 func LoadCodisEnv(cfg *cfg.Cfg) Env {
@@ -58,15 +77,43 @@ func LoadCodisEnv(cfg *cfg.Cfg) Env {
 
 	passwd, _ := cfg.ReadString("password", "")
 
+	migrateConcurrency := loadEnvInt(cfg, "migrate_concurrency", 1, 1)
+	migrateGroupConcurrency := loadEnvInt(cfg, "migrate_group_concurrency", 1, 1)
+	migrateLatencyBudget := loadEnvInt(cfg, "migrate_latency_budget", 0, 0)
+
+	failoverProbeInterval := loadEnvInt(cfg, "failover_probe_interval", 0, 0)
+	failoverDownAfter := loadEnvInt(cfg, "failover_down_after", 3, 1)
+	failoverQuorum := loadEnvInt(cfg, "failover_quorum", 0, 0)
+
 	return &CodisEnv{
 		zkAddr:        zkAddr,
 		passwd:        passwd,
 		dashboardAddr: dashboardAddr,
 		productName:   productName,
 		provider:      provider,
+
+		migrateConcurrency:      migrateConcurrency,
+		migrateGroupConcurrency: migrateGroupConcurrency,
+		migrateLatencyBudget:    time.Duration(migrateLatencyBudget) * time.Millisecond,
+
+		failoverProbeInterval: time.Duration(failoverProbeInterval) * time.Millisecond,
+		failoverDownAfter:     failoverDownAfter,
+		failoverQuorum:        failoverQuorum,
 	}
 }
 
+func loadEnvInt(cfg *cfg.Cfg, key string, defval int, minval int) int {
+	s, _ := cfg.ReadString(key, "")
+	if s == "" {
+		return defval
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < minval {
+		log.Panicf("config: '%s' should be an integer >= %d, but got %s", key, minval, s)
+	}
+	return n
+}
+
 func (e *CodisEnv) ProductName() string {
 	return e.productName
 }
@@ -79,6 +126,41 @@ func (e *CodisEnv) DashboardAddr() string {
 	return e.dashboardAddr
 }
 
+// MigrateConcurrency returns the max number of slots being migrated at the same time.
+func (e *CodisEnv) MigrateConcurrency() int {
+	return e.migrateConcurrency
+}
+
+// MigrateGroupConcurrency returns the max number of slots being migrated from or to
+// the same group at the same time.
+func (e *CodisEnv) MigrateGroupConcurrency() int {
+	return e.migrateGroupConcurrency
+}
+
+// MigrateLatencyBudget returns the latency of group masters that migrations should
+// hold by adjusting their speed, 0 means disabled.
+func (e *CodisEnv) MigrateLatencyBudget() time.Duration {
+	return e.migrateLatencyBudget
+}
+
+// FailoverProbeInterval returns the interval of probing group masters for failover,
+// 0 means failover is disabled.
+func (e *CodisEnv) FailoverProbeInterval() time.Duration {
+	return e.failoverProbeInterval
+}
+
+// FailoverDownAfter returns the number of consecutive failed probes before a master
+// is taken as down.
+func (e *CodisEnv) FailoverDownAfter() int {
+	return e.failoverDownAfter
+}
+
+// FailoverQuorum returns the number of observers, the dashboard and slaves, that must
+// agree on a master being down, 0 means the majority.
+func (e *CodisEnv) FailoverQuorum() int {
+	return e.failoverQuorum
+}
+
 func (e *CodisEnv) NewZkConn() (zkhelper.Conn, error) {
 	switch e.provider {
 	case "zookeeper":
@@ -89,6 +171,12 @@ func (e *CodisEnv) NewZkConn() (zkhelper.Conn, error) {
 			addr = "http://" + addr
 		}
 		return zkhelper.NewEtcdConn(addr, 30)
+	case "memory":
+		return memzk.Connect(e.zkAddr, 30)
+	case "filesystem":
+		return fszk.Connect(e.zkAddr, 30)
+	case "consul":
+		return consulzk.Connect(e.zkAddr, 30)
 	}
 	return nil, errors.Errorf("need coordinator in config file, %s", e)
 }
@@ -0,0 +1,483 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// steps of failovers in the audit log
+const (
+	FAILOVER_STEP_DETECT  = "detect"
+	FAILOVER_STEP_SKIP    = "skip"
+	FAILOVER_STEP_PROMOTE = "promote"
+	FAILOVER_STEP_REPOINT = "repoint"
+	FAILOVER_STEP_FENCE   = "fence"
+	FAILOVER_STEP_UNFENCE = "unfence"
+)
+
+const (
+	failoverProbeTimeout = time.Second
+	failoverMaxAudits    = 200
+
+	// a slave whose link went down so long before the master was found down
+	// has missed writes, it's not promoted
+	failoverStaleLink = time.Second * 10
+)
+
+func getFailoverPath(product string) string {
+	return fmt.Sprintf("/zk/codis/db_%s/ha", product)
+}
+
+func getNoFailoverPath(product string) string {
+	return getFailoverPath(product) + "/no_failover"
+}
+
+func getFailoverFencePath(product string) string {
+	return getFailoverPath(product) + "/fence"
+}
+
+func getFailoverAuditPath(product string) string {
+	return getFailoverPath(product) + "/audit"
+}
+
+type FailoverAudit struct {
+	Id      string `json:"id"`
+	Ts      int64  `json:"ts"`
+	GroupId int    `json:"group_id"`
+	Step    string `json:"step"`
+	Addr    string `json:"addr"`
+	Message string `json:"message"`
+	Error   string `json:"error,omitempty"`
+}
+
+// FailoverFence is an old master taken over by a slave, it's demoted to a
+// slave of the new master once it's back.
+type FailoverFence struct {
+	Addr    string `json:"addr"`
+	GroupId int    `json:"group_id"`
+	Ts      int64  `json:"ts"`
+}
+
+type FailoverStatus struct {
+	Enabled    bool            `json:"enabled"`
+	NoFailover []int           `json:"no_failover"`
+	Fences     []FailoverFence `json:"fences"`
+}
+
+// slaveView is a slave of a group whose master may be down.
+type slaveView struct {
+	Addr      string
+	Reachable bool
+	Slave     bool // role is slave
+	LinkUp    bool // master_link_status is up
+	Syncing   bool // master_sync_in_progress, the dataset is partial
+	Offset    int64
+
+	LinkDown time.Duration // how long the link is down, -1 if unknown
+}
+
+// countFailoverVotes returns the votes for the master being down and the
+// quorum. The dashboard and every slave are observers, a slave votes if its
+// link to master is down, quorum <= 0 means the majority of observers.
+func countFailoverVotes(slaves []slaveView, quorum int) (int, int) {
+	votes := 1
+	for _, s := range slaves {
+		if s.Reachable && !s.LinkUp {
+			votes++
+		}
+	}
+	if quorum <= 0 {
+		quorum = (len(slaves)+1)/2 + 1
+	}
+	return votes, quorum
+}
+
+// chooseFailoverSlave returns the reachable slave with the largest replication
+// offset, ties are broken by addr, or nil if there is none. Slaves in a full
+// sync, or with links down for longer than maxLinkDown, are excluded, and why
+// is returned.
+func chooseFailoverSlave(slaves []slaveView, maxLinkDown time.Duration) (*slaveView, []string) {
+	var best *slaveView
+	var excluded []string
+	for i := range slaves {
+		s := &slaves[i]
+		if !s.Reachable || !s.Slave {
+			continue
+		}
+		if s.Syncing {
+			excluded = append(excluded, fmt.Sprintf("%s is in a full sync", s.Addr))
+			continue
+		}
+		if s.LinkDown > maxLinkDown {
+			excluded = append(excluded, fmt.Sprintf("link of %s is down for %v", s.Addr, s.LinkDown))
+			continue
+		}
+		if best == nil || s.Offset > best.Offset || (s.Offset == best.Offset && s.Addr < best.Addr) {
+			best = s
+		}
+	}
+	return best, excluded
+}
+
+func getSlaveView(addr, passwd string) slaveView {
+	v := slaveView{Addr: addr, LinkDown: -1}
+	info, err := utils.GetReplicationInfo(addr, passwd)
+	if err != nil {
+		return v
+	}
+	v.Reachable = true
+	v.Slave = info.IsSlave()
+	v.LinkUp = info.MasterLinkUp
+	v.Syncing = info.MasterSyncing
+	v.Offset = info.SlaveReplOffset
+	if info.MasterDownSeconds >= 0 {
+		v.LinkDown = time.Duration(info.MasterDownSeconds) * time.Second
+	}
+	return v
+}
+
+func pingRedis(addr, passwd string) error {
+	c, err := utils.DialToTimeout(addr, passwd, failoverProbeTimeout, failoverProbeTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Do("PING")
+	return errors.Trace(err)
+}
+
+type masterProbe struct {
+	addr     string
+	failures int
+	since    time.Time // the first failed probe
+	reported string    // the last reason of not failing over, audited once
+}
+
+// FailoverManager probes group masters and promotes the best slave of a group
+// when its master is down.
+type FailoverManager struct {
+	mu          sync.Mutex
+	zkConn      zkhelper.Conn
+	productName string
+	passwd      string
+
+	interval  time.Duration // 0 means disabled
+	downAfter int           // consecutive failed probes before a master is down
+	quorum    int
+
+	probes map[int]*masterProbe
+}
+
+func NewFailoverManager(zkConn zkhelper.Conn, pn string, interval time.Duration, downAfter, quorum int) *FailoverManager {
+	f := &FailoverManager{
+		zkConn:      zkConn,
+		productName: pn,
+		passwd:      globalEnv.Password(),
+		interval:    interval,
+		downAfter:   downAfter,
+		quorum:      quorum,
+		probes:      make(map[int]*masterProbe),
+	}
+	for _, p := range []string{getNoFailoverPath(pn), getFailoverFencePath(pn), getFailoverAuditPath(pn)} {
+		zkhelper.CreateRecursive(f.zkConn, p, "", 0, zkhelper.DefaultDirACLs())
+	}
+	if f.interval > 0 {
+		go f.loop()
+	}
+	return f
+}
+
+func (f *FailoverManager) loop() {
+	for {
+		time.Sleep(f.interval)
+		if err := f.probe(); err != nil {
+			log.ErrorErrorf(err, "probe group masters failed")
+		}
+		f.retryFences()
+	}
+}
+
+func (f *FailoverManager) audit(groupId int, step, addr string, err error, format string, args ...interface{}) {
+	a := &FailoverAudit{
+		Ts:      time.Now().Unix(),
+		GroupId: groupId,
+		Step:    step,
+		Addr:    addr,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if err != nil {
+		a.Error = err.Error()
+		log.ErrorErrorf(err, "failover group %d, %s %s: %s", groupId, step, addr, a.Message)
+	} else {
+		log.Warnf("failover group %d, %s %s: %s", groupId, step, addr, a.Message)
+	}
+	b, _ := json.Marshal(a)
+	root := getFailoverAuditPath(f.productName)
+	if _, err := f.zkConn.Create(root+"/", b, zk.FlagSequence, zkhelper.DefaultFileACLs()); err != nil {
+		log.ErrorErrorf(err, "save failover audit failed")
+		return
+	}
+	ids, _, err := f.zkConn.Children(root)
+	if err != nil {
+		return
+	}
+	sort.Strings(ids)
+	for i := 0; i < len(ids)-failoverMaxAudits; i++ {
+		f.zkConn.Delete(root+"/"+ids[i], -1)
+	}
+}
+
+func (f *FailoverManager) Audits() []FailoverAudit {
+	var res []FailoverAudit
+	root := getFailoverAuditPath(f.productName)
+	ids, _, _ := f.zkConn.Children(root)
+	sort.Strings(ids)
+	for _, id := range ids {
+		data, _, err := f.zkConn.Get(root + "/" + id)
+		if err != nil {
+			continue
+		}
+		a := FailoverAudit{}
+		json.Unmarshal(data, &a)
+		a.Id = id
+		res = append(res, a)
+	}
+	return res
+}
+
+func (f *FailoverManager) NoFailover(groupId int) (bool, error) {
+	ok, err := zkhelper.NodeExists(f.zkConn, path.Join(getNoFailoverPath(f.productName), strconv.Itoa(groupId)))
+	return ok, errors.Trace(err)
+}
+
+// SetNoFailover sets or clears the flag that keeps the group from failover.
+func (f *FailoverManager) SetNoFailover(groupId int, on bool) error {
+	p := path.Join(getNoFailoverPath(f.productName), strconv.Itoa(groupId))
+	if on {
+		_, err := zkhelper.CreateOrUpdate(f.zkConn, p, "", 0, zkhelper.DefaultFileACLs(), true)
+		return errors.Trace(err)
+	}
+	if err := f.zkConn.Delete(p, -1); err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (f *FailoverManager) Fences() []FailoverFence {
+	var res []FailoverFence
+	root := getFailoverFencePath(f.productName)
+	addrs, _, _ := f.zkConn.Children(root)
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		data, _, err := f.zkConn.Get(root + "/" + addr)
+		if err != nil {
+			continue
+		}
+		fence := FailoverFence{}
+		json.Unmarshal(data, &fence)
+		res = append(res, fence)
+	}
+	return res
+}
+
+func (f *FailoverManager) Status() (*FailoverStatus, error) {
+	s := &FailoverStatus{Enabled: f.interval > 0, NoFailover: []int{}, Fences: f.Fences()}
+	ids, _, err := f.zkConn.Children(getNoFailoverPath(f.productName))
+	if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return nil, errors.Trace(err)
+	}
+	for _, id := range ids {
+		if n, err := strconv.Atoi(id); err == nil {
+			s.NoFailover = append(s.NoFailover, n)
+		}
+	}
+	sort.Ints(s.NoFailover)
+	if s.Fences == nil {
+		s.Fences = []FailoverFence{}
+	}
+	return s, nil
+}
+
+// probe pings the master of each group, a master is down after downAfter
+// consecutive failures.
+func (f *FailoverManager) probe() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	groups, err := models.ServerGroups(f.zkConn, f.productName)
+	if err != nil {
+		if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+			return nil
+		}
+		return errors.Trace(err)
+	}
+	seen := make(map[int]bool)
+	for _, g := range groups {
+		master, err := g.Master(f.zkConn)
+		if err != nil || master == nil {
+			continue
+		}
+		seen[g.Id] = true
+		p := f.probes[g.Id]
+		if p == nil || p.addr != master.Addr {
+			p = &masterProbe{addr: master.Addr}
+			f.probes[g.Id] = p
+		}
+		if err := pingRedis(master.Addr, f.passwd); err == nil {
+			p.failures, p.reported = 0, ""
+			continue
+		}
+		if p.failures == 0 {
+			p.since = time.Now()
+		}
+		p.failures++
+		if p.failures < f.downAfter {
+			log.Warnf("master %s of group %d failed %d probes", master.Addr, g.Id, p.failures)
+			continue
+		}
+		f.mayFailover(g, p)
+	}
+	for id := range f.probes {
+		if !seen[id] {
+			delete(f.probes, id)
+		}
+	}
+	return nil
+}
+
+// skip audits why the group is not failed over, once until the reason changes.
+func (f *FailoverManager) skip(g *models.ServerGroup, p *masterProbe, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if p.reported != msg {
+		p.reported = msg
+		f.audit(g.Id, FAILOVER_STEP_SKIP, p.addr, nil, "%s", msg)
+	}
+}
+
+func (f *FailoverManager) mayFailover(g *models.ServerGroup, p *masterProbe) {
+	no, err := f.NoFailover(g.Id)
+	if err != nil {
+		log.ErrorErrorf(err, "get no failover flag of group %d failed", g.Id)
+		return
+	}
+	if no {
+		f.skip(g, p, "master is down, but failover of the group is disabled")
+		return
+	}
+
+	var slaves []slaveView
+	for _, s := range g.Servers {
+		if s.Type == models.SERVER_TYPE_SLAVE {
+			slaves = append(slaves, getSlaveView(s.Addr, f.passwd))
+		}
+	}
+	votes, quorum := countFailoverVotes(slaves, f.quorum)
+	if votes < quorum {
+		f.skip(g, p, "master is down for dashboard, but only %d of %d observers agree, quorum is %d", votes, len(slaves)+1, quorum)
+		return
+	}
+	// slaves may notice the master is down a probe interval earlier
+	maxLinkDown := time.Since(p.since) + f.interval + failoverStaleLink
+	best, excluded := chooseFailoverSlave(slaves, maxLinkDown)
+	if best == nil {
+		msg := "master is down, but no slave is available"
+		if len(excluded) != 0 {
+			msg += ", " + strings.Join(excluded, ", ")
+		}
+		f.skip(g, p, "%s", msg)
+		return
+	}
+
+	lock := utils.GetZkLock(f.zkConn, f.productName)
+	if err := lock.LockWithTimeout(0, fmt.Sprintf("failover group %d", g.Id)); err != nil {
+		log.WarnErrorf(err, "lock for failover of group %d failed, try again later", g.Id)
+		return
+	}
+	defer func() {
+		if err := lock.Unlock(); err != nil && err != zk.ErrNoNode {
+			log.ErrorErrorf(err, "unlock node failed")
+		}
+	}()
+	f.failover(g, p.addr, best, excluded, slaves, votes, quorum)
+	delete(f.probes, g.Id)
+}
+
+func (f *FailoverManager) failover(g *models.ServerGroup, master string, best *slaveView, excluded []string, slaves []slaveView, votes, quorum int) {
+	f.audit(g.Id, FAILOVER_STEP_DETECT, master, nil, "master is down after %d probes, %d of %d observers agree, quorum is %d",
+		f.downAfter, votes, len(slaves)+1, quorum)
+	for _, reason := range excluded {
+		f.audit(g.Id, FAILOVER_STEP_SKIP, master, nil, "slave excluded, %s", reason)
+	}
+
+	r, err := g.Promote(f.zkConn, best.Addr, f.passwd, nil)
+	f.audit(g.Id, FAILOVER_STEP_PROMOTE, best.Addr, err, "promote slave with offset %d", best.Offset)
+	if err != nil {
+		return
+	}
+	for _, step := range r.Steps {
+		if step.Step != models.PROMOTE_STEP_REPOINT {
+			continue
+		}
+		var err error
+		if step.Error != "" {
+			err = errors.New(step.Error)
+		}
+		f.audit(g.Id, FAILOVER_STEP_REPOINT, step.Addr, err, "%s", step.Message)
+	}
+
+	fence := &FailoverFence{Addr: master, GroupId: g.Id, Ts: time.Now().Unix()}
+	b, _ := json.Marshal(fence)
+	_, err = zkhelper.CreateOrUpdate(f.zkConn, path.Join(getFailoverFencePath(f.productName), master), string(b), 0, zkhelper.DefaultFileACLs(), true)
+	f.audit(g.Id, FAILOVER_STEP_FENCE, master, errors.Trace(err), "old master is offline, it will be a slave of %s once it's back", best.Addr)
+}
+
+// retryFences demotes the old masters that are back to slaves of the current
+// masters, so they don't take writes. Fences are dropped once the servers are
+// slaves, or masters of their groups again by hand.
+func (f *FailoverManager) retryFences() {
+	for _, fence := range f.Fences() {
+		p := path.Join(getFailoverFencePath(f.productName), fence.Addr)
+		g, err := models.GetGroup(f.zkConn, f.productName, fence.GroupId)
+		if err != nil {
+			if ok, err := models.GroupExists(f.zkConn, f.productName, fence.GroupId); err == nil && !ok {
+				f.zkConn.Delete(p, -1)
+			}
+			continue
+		}
+		master, err := g.Master(f.zkConn)
+		if err != nil || master == nil {
+			continue
+		}
+		if master.Addr != fence.Addr {
+			info, err := utils.GetReplicationInfo(fence.Addr, f.passwd)
+			if err != nil {
+				continue
+			}
+			if info.IsMaster() {
+				err = utils.SlaveOf(fence.Addr, f.passwd, master.Addr)
+				f.audit(fence.GroupId, FAILOVER_STEP_UNFENCE, fence.Addr, err, "old master is back, slaveof %s", master.Addr)
+				if err != nil {
+					continue
+				}
+			}
+		}
+		f.zkConn.Delete(p, -1)
+	}
+}
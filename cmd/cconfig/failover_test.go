@@ -0,0 +1,84 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
+)
+
+func TestFailoverVotes(t *testing.T) {
+	slaves := []slaveView{
+		{Addr: "s1", Reachable: true, Slave: true, LinkUp: false, Offset: 100},
+		{Addr: "s2", Reachable: true, Slave: true, LinkUp: true, Offset: 200},
+		{Addr: "s3", Reachable: false},
+	}
+	votes, quorum := countFailoverVotes(slaves, 0)
+	assert.Must(votes == 2 && quorum == 3)
+	votes, quorum = countFailoverVotes(slaves, 2)
+	assert.Must(votes == 2 && quorum == 2)
+	votes, quorum = countFailoverVotes(nil, 0)
+	assert.Must(votes == 1 && quorum == 1)
+
+	choose := func(slaves []slaveView) (string, int) {
+		best, excluded := chooseFailoverSlave(slaves, time.Minute)
+		if best == nil {
+			return "", len(excluded)
+		}
+		return best.Addr, len(excluded)
+	}
+	best, n := choose(slaves)
+	assert.Must(best == "s2" && n == 0)
+	slaves[0].Offset = 200
+	best, _ = choose(slaves)
+	assert.Must(best == "s1")
+	slaves[0].Slave = false
+	best, _ = choose(slaves)
+	assert.Must(best == "s2")
+	best, _ = choose(slaves[2:])
+	assert.Must(best == "")
+
+	// a slave in a full sync or with a stale link is never promoted, even
+	// if it's the only one
+	slaves[1].Syncing = true
+	best, n = choose(slaves[1:])
+	assert.Must(best == "" && n == 1)
+	slaves[1].Syncing, slaves[1].LinkDown = false, time.Hour
+	best, n = choose(slaves[1:])
+	assert.Must(best == "" && n == 1)
+	slaves[1].LinkDown = time.Second * 30
+	best, n = choose(slaves[1:])
+	assert.Must(best == "s2" && n == 0)
+}
+
+func TestFailoverManager(t *testing.T) {
+	globalEnv = &CodisEnv{productName: testProductName}
+	f := NewFailoverManager(memzk.NewConn(), testProductName, 0, 3, 0)
+
+	assert.MustNoError(f.SetNoFailover(2, true))
+	assert.MustNoError(f.SetNoFailover(1, true))
+	no, err := f.NoFailover(2)
+	assert.MustNoError(err)
+	assert.Must(no)
+	assert.MustNoError(f.SetNoFailover(2, false))
+	assert.MustNoError(f.SetNoFailover(2, false))
+	no, err = f.NoFailover(2)
+	assert.MustNoError(err)
+	assert.Must(!no)
+
+	s, err := f.Status()
+	assert.MustNoError(err)
+	assert.Must(!s.Enabled && len(s.NoFailover) == 1 && s.NoFailover[0] == 1 && len(s.Fences) == 0)
+
+	for i := 0; i < failoverMaxAudits+10; i++ {
+		f.audit(1, FAILOVER_STEP_SKIP, "localhost:6379", nil, "skip %d", i)
+	}
+	audits := f.Audits()
+	assert.Must(len(audits) == failoverMaxAudits)
+	assert.Must(audits[0].Message == "skip 10")
+	assert.Must(audits[len(audits)-1].Message == "skip 209")
+}
@@ -0,0 +1,365 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/rdb"
+)
+
+func cmdImport(argv []string) (err error) {
+	usage := `usage:
+	codis-config import rdb <file> [--db=<db>] [--batch=<n>] [--resume]
+
+options:
+	--db=<db>      import keys of this db only [default: 0]
+	--batch=<n>    max number of pipelined commands for each group [default: 256]
+	--resume       continue from the progress saved in <file>.progress
+`
+	args, err := docopt.Parse(usage, argv, true, "", false)
+	if err != nil {
+		log.ErrorErrorf(err, "parse args failed")
+		return errors.Trace(err)
+	}
+	log.Debugf("parse args = {%+v}", args)
+
+	db, err := strconv.Atoi(args["--db"].(string))
+	if err != nil || db < 0 {
+		log.ErrorErrorf(err, "parse <db> failed")
+		return errors.Errorf("invalid db = %s", args["--db"])
+	}
+	batch, err := strconv.Atoi(args["--batch"].(string))
+	if err != nil || batch <= 0 {
+		log.ErrorErrorf(err, "parse <batch> failed")
+		return errors.Errorf("invalid batch = %s", args["--batch"])
+	}
+
+	if args["rdb"].(bool) {
+		return errors.Trace(runImportRdb(args["<file>"].(string), uint32(db), batch, args["--resume"].(bool)))
+	}
+	return nil
+}
+
+// loadSlotMasters returns the address of the group master serving each slot,
+// all slots must be online.
+func loadSlotMasters() ([]string, error) {
+	slots, masters, err := loadSlotsAndMasters()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, models.DEFAULT_SLOT_NUM)
+	for _, s := range slots {
+		if s.State.Status != models.SLOT_STATUS_ONLINE {
+			return nil, errors.Errorf("slot %d is not online, status = %s", s.Id, s.State.Status)
+		}
+		addr := masters[s.GroupId]
+		if addr == "" {
+			return nil, errors.Errorf("group %d of slot %d has no master", s.GroupId, s.Id)
+		}
+		addrs[s.Id] = addr
+	}
+	return addrs, nil
+}
+
+// loadSlotsAndMasters returns all slots ordered by id, and the master of each
+// group from dashboard.
+func loadSlotsAndMasters() ([]*models.Slot, map[int]string, error) {
+	var slots []*models.Slot
+	if err := callApi(METHOD_GET, "/api/slots", nil, &slots); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	var groups []*models.ServerGroup
+	if err := callApi(METHOD_GET, "/api/server_groups", nil, &groups); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	masters := make(map[int]string)
+	for _, g := range groups {
+		for _, s := range g.Servers {
+			if s.Type == models.SERVER_TYPE_MASTER {
+				masters[g.Id] = s.Addr
+			}
+		}
+	}
+	if len(slots) != models.DEFAULT_SLOT_NUM {
+		return nil, nil, errors.Errorf("slots are not initialized, got %d slots", len(slots))
+	}
+	sorted := make([]*models.Slot, models.DEFAULT_SLOT_NUM)
+	for _, s := range slots {
+		if s.Id < 0 || s.Id >= len(sorted) || sorted[s.Id] != nil {
+			return nil, nil, errors.Errorf("invalid slot id = %d", s.Id)
+		}
+		sorted[s.Id] = s
+	}
+	return sorted, masters, nil
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type importConn struct {
+	redis.Conn
+	addr    string
+	pending int
+}
+
+type rdbImporter struct {
+	slots  []string
+	conns  map[string]*importConn
+	batch  int
+	passwd string
+
+	// error replies are counted instead of failing the import
+	skipErrors bool
+
+	keys    int64
+	skipped int64
+	errors  atomic2.Int64
+}
+
+func (p *rdbImporter) getConn(addr string) (*importConn, error) {
+	if c := p.conns[addr]; c != nil {
+		return c, nil
+	}
+	c, err := utils.DialToTimeout(addr, p.passwd, time.Minute, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[addr] = &importConn{Conn: c, addr: addr}
+	return p.conns[addr], nil
+}
+
+func (p *rdbImporter) flush(c *importConn) error {
+	if c.pending == 0 {
+		return nil
+	}
+	if err := c.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	for ; c.pending != 0; c.pending-- {
+		if _, err := c.Receive(); err != nil {
+			if _, ok := err.(redis.Error); !ok || !p.skipErrors {
+				return errors.Trace(err)
+			}
+			log.WarnErrorf(err, "write to %s failed", c.addr)
+			p.errors.Incr()
+		}
+	}
+	return nil
+}
+
+func (p *rdbImporter) flushAll() error {
+	for _, c := range p.conns {
+		if err := p.flush(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *rdbImporter) Close() {
+	for _, c := range p.conns {
+		c.Close()
+	}
+}
+
+const importChunkSize = 512
+
+// entryCommands returns the commands rebuilding the entry, the key is deleted
+// first so that importing the same entry twice gives the same result.
+func entryCommands(e *rdb.Entry) [][]interface{} {
+	var cmds [][]interface{}
+	chunked := func(cmd string, n int, args func(i int) []interface{}) {
+		for beg := 0; beg < n; beg += importChunkSize {
+			c := []interface{}{cmd, e.Key}
+			for i := beg; i < n && i < beg+importChunkSize; i++ {
+				c = append(c, args(i)...)
+			}
+			cmds = append(cmds, c)
+		}
+	}
+	if e.Type != rdb.TypeString {
+		cmds = append(cmds, []interface{}{"DEL", e.Key})
+	}
+	switch e.Type {
+	case rdb.TypeString:
+		cmds = append(cmds, []interface{}{"SET", e.Key, e.Value})
+	case rdb.TypeList:
+		chunked("RPUSH", len(e.Values), func(i int) []interface{} {
+			return []interface{}{e.Values[i]}
+		})
+	case rdb.TypeSet:
+		chunked("SADD", len(e.Values), func(i int) []interface{} {
+			return []interface{}{e.Values[i]}
+		})
+	case rdb.TypeZSet:
+		chunked("ZADD", len(e.Members), func(i int) []interface{} {
+			m := e.Members[i]
+			return []interface{}{strconv.FormatFloat(m.Score, 'g', -1, 64), m.Member}
+		})
+	case rdb.TypeHash:
+		chunked("HMSET", len(e.Fields), func(i int) []interface{} {
+			f := e.Fields[i]
+			return []interface{}{f.Field, f.Value}
+		})
+	}
+	if e.ExpireAt != 0 {
+		cmds = append(cmds, []interface{}{"PEXPIREAT", e.Key, e.ExpireAt})
+	}
+	return cmds
+}
+
+func (p *rdbImporter) write(e *rdb.Entry) error {
+	if e.ExpireAt != 0 && e.ExpireAt <= time.Now().UnixNano()/int64(time.Millisecond) {
+		p.skipped++
+		return nil
+	}
+	for _, cmd := range entryCommands(e) {
+		if err := p.send(e.Key, cmd[0].(string), cmd[1:]...); err != nil {
+			return err
+		}
+	}
+	p.keys++
+	return nil
+}
+
+// send pipelines the command to the master serving the key.
+func (p *rdbImporter) send(key []byte, cmd string, args ...interface{}) error {
+	c, err := p.getConn(p.slots[router.HashSlot(key)])
+	if err != nil {
+		return err
+	}
+	if err := c.Send(cmd, args...); err != nil {
+		return errors.Trace(err)
+	}
+	c.pending++
+	if c.pending >= p.batch {
+		return p.flush(c)
+	}
+	return nil
+}
+
+func loadImportProgress(file string) (int64, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Trace(err)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid progress file %s", file)
+	}
+	return n, nil
+}
+
+func saveImportProgress(file string, n int64) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(n, 10)+"\n"), 0644); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, file))
+}
+
+func runImportRdb(file string, db uint32, batch int, resume bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	progressFile := file + ".progress"
+	var start int64
+	if resume {
+		if start, err = loadImportProgress(progressFile); err != nil {
+			return err
+		}
+		log.Infof("resume importing %s from entry %d", file, start)
+	}
+
+	slots, err := loadSlotMasters()
+	if err != nil {
+		return err
+	}
+	p := &rdbImporter{
+		slots:  slots,
+		conns:  make(map[string]*importConn),
+		batch:  batch,
+		passwd: globalEnv.Password(),
+	}
+	defer p.Close()
+
+	cr := &countReader{r: f}
+	r := rdb.NewReader(cr)
+	var n int64
+	var lastReport = time.Now()
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		n++
+		if n <= start || e.DB != db {
+			continue
+		}
+		if err := p.write(e); err != nil {
+			return err
+		}
+		if time.Since(lastReport) >= time.Second*5 {
+			if err := p.flushAll(); err != nil {
+				return err
+			}
+			if err := saveImportProgress(progressFile, n); err != nil {
+				return err
+			}
+			log.Infof("import %s: %d entries read, %d keys written, %d expired, %.1f%%",
+				file, n, p.keys, p.skipped, float64(cr.n)*100/float64(fi.Size()+1))
+			lastReport = time.Now()
+		}
+	}
+	if err := p.flushAll(); err != nil {
+		return err
+	}
+	os.Remove(progressFile)
+
+	fmt.Println(jsonify(map[string]interface{}{
+		"file":    file,
+		"version": r.Version(),
+		"entries": n,
+		"keys":    p.keys,
+		"expired": p.skipped,
+		"resumed": start,
+	}))
+	return nil
+}
@@ -50,6 +50,11 @@ commands:
 	dashboard
 	action
 	proxy
+	import
+	sync
+	check
+	apply
+	topology
 `
 
 func init() {
@@ -89,6 +94,16 @@ func runCommand(cmd string, args []string) (err error) {
 		return errors.Trace(cmdProxy(argv))
 	case "slot":
 		return errors.Trace(cmdSlot(argv))
+	case "import":
+		return errors.Trace(cmdImport(argv))
+	case "sync":
+		return errors.Trace(cmdSync(argv))
+	case "check":
+		return errors.Trace(cmdCheck(argv))
+	case "apply":
+		return errors.Trace(cmdApply(argv))
+	case "topology":
+		return errors.Trace(cmdTopology(argv))
 	}
 	return errors.Errorf("%s is not a valid command. See 'codis-config -h'", cmd)
 }
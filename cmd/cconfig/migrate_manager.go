@@ -8,11 +8,15 @@ import (
 	"fmt"
 	"path"
 	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/wandoulabs/go-zookeeper/zk"
 	"github.com/wandoulabs/zkhelper"
 
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
 
@@ -25,6 +29,15 @@ const (
 	MIGRATE_TASK_MIGRATING string = "migrating"
 	MIGRATE_TASK_FINISHED  string = "finished"
 	MIGRATE_TASK_ERR       string = "error"
+	MIGRATE_TASK_PAUSED    string = "paused"
+
+	// keys are migrated, but don't match the manifest
+	MIGRATE_TASK_VERIFY_FAILED string = "verify_failed"
+)
+
+var (
+	ErrMigrateTaskPaused   = errors.New("migrate task is paused")
+	ErrMigrateTaskNotFound = errors.New("migrate task not found")
 )
 
 // check if migrate task is valid
@@ -32,71 +45,334 @@ type MigrateTaskCheckFunc func(t *MigrateTask) (bool, error)
 
 // migrate task will store on zk
 type MigrateManager struct {
-	runningTask *MigrateTask
+	mu          sync.Mutex
+	running     map[string]*MigrateTask
 	zkConn      zkhelper.Conn
 	productName string
+
+	// max number of running tasks, in total and for each source or target group
+	concurrency      int
+	groupConcurrency int
 }
 
 func getMigrateTasksPath(product string) string {
 	return fmt.Sprintf("/zk/codis/db_%s/migrate_tasks", product)
 }
 
-func NewMigrateManager(zkConn zkhelper.Conn, pn string) *MigrateManager {
+func NewMigrateManager(zkConn zkhelper.Conn, pn string, concurrency, groupConcurrency int) *MigrateManager {
 	m := &MigrateManager{
-		zkConn:      zkConn,
-		productName: pn,
+		running:          make(map[string]*MigrateTask),
+		zkConn:           zkConn,
+		productName:      pn,
+		concurrency:      concurrency,
+		groupConcurrency: groupConcurrency,
 	}
 	zkhelper.CreateRecursive(m.zkConn, getMigrateTasksPath(m.productName), "", 0, zkhelper.DefaultDirACLs())
-	m.mayRecover()
+	if err := m.mayRecover(); err != nil {
+		log.ErrorErrorf(err, "recover migration failed")
+	}
 	go m.loop()
 	return m
 }
 
-// if there are tasks that is not pending, process them.
+// mayRecover repairs the migrations interrupted by a crash of dashboard, it's
+// idempotent and must be called before any task is started.
+//   - tasks left in migrating are pending again, they continue from where they
+//     stopped, since migrating a slot in migrate status is resumable.
+//   - slots left in pre_migrate are rolled back to online, no keys are moved
+//     before a slot is in migrate status.
+//   - slots left in migrate without any task get a new task to finish them.
+//   - manifests of tasks that are gone are removed.
 func (m *MigrateManager) mayRecover() error {
-	// It may be not need to do anything now.
+	tasks := m.Tasks()
+	owned := make(map[int]bool)
+	exists := make(map[string]bool)
+	for _, info := range tasks {
+		owned[info.SlotId] = true
+		exists[info.Id] = true
+		if info.Status != MIGRATE_TASK_MIGRATING {
+			continue
+		}
+		_, err := updateMigrateTask(m.zkConn, m.productName, info.Id, func(info *MigrateTaskInfo) error {
+			if info.Status == MIGRATE_TASK_MIGRATING {
+				info.Status = MIGRATE_TASK_PENDING
+			}
+			return nil
+		})
+		if err != nil && !errors.Equal(err, ErrMigrateTaskNotFound) {
+			return err
+		}
+		log.Warnf("recover migrate task %s of slot %d, status is pending again", info.Id, info.SlotId)
+	}
+
+	manifests, _, err := m.zkConn.Children(getMigrateManifestsPath(m.productName))
+	if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return errors.Trace(err)
+	}
+	for _, id := range manifests {
+		if exists[id] {
+			continue
+		}
+		if err := removeSlotManifest(m.zkConn, m.productName, id); err != nil {
+			return err
+		}
+		log.Warnf("remove manifest of task %s, the task is gone", id)
+	}
+
+	slots, err := models.GetMigratingSlots(m.zkConn, m.productName)
+	if err != nil {
+		if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+			return nil
+		}
+		return errors.Trace(err)
+	}
+	for _, s := range slots {
+		switch s.State.Status {
+		case models.SLOT_STATUS_PRE_MIGRATE:
+			s.State.Status = models.SLOT_STATUS_ONLINE
+			if err := s.Update(m.zkConn); err != nil {
+				return errors.Trace(err)
+			}
+			log.Warnf("recover slot %d from pre_migrate to online", s.Id)
+		case models.SLOT_STATUS_MIGRATE:
+			if owned[s.Id] {
+				continue
+			}
+			info := &MigrateTaskInfo{
+				SlotId:     s.Id,
+				NewGroupId: s.State.MigrateStatus.To,
+				Status:     MIGRATE_TASK_PENDING,
+				CreateAt:   strconv.FormatInt(time.Now().Unix(), 10),
+			}
+			if err := m.PostTask(info); err != nil {
+				return err
+			}
+			owned[s.Id] = true
+			log.Warnf("recover slot %d in migrate status by new task %s", s.Id, info.Id)
+		}
+	}
 	return nil
 }
 
 //add a new task to zk
-func (m *MigrateManager) PostTask(info *MigrateTaskInfo) {
+func (m *MigrateManager) PostTask(info *MigrateTaskInfo) error {
 	b, _ := json.Marshal(info)
-	p, _ := safeZkConn.Create(getMigrateTasksPath(m.productName)+"/", b, zk.FlagSequence, zkhelper.DefaultFileACLs())
+	p, err := m.zkConn.Create(getMigrateTasksPath(m.productName)+"/", b, zk.FlagSequence, zkhelper.DefaultFileACLs())
+	if err != nil {
+		return errors.Trace(err)
+	}
 	_, info.Id = path.Split(p)
+	return nil
 }
 
 func (m *MigrateManager) loop() error {
 	for {
 		time.Sleep(time.Second)
-		info := m.NextTask()
-		if info == nil {
+		for _, t := range m.nextTasks() {
+			go m.runTask(t)
+		}
+	}
+}
+
+func (m *MigrateManager) runTask(t *MigrateTask) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.running, t.Id)
+		m.mu.Unlock()
+	}()
+	if err := t.preMigrateCheck(m.ownedSlots()); err != nil {
+		log.ErrorErrorf(err, "pre migrate check failed")
+		t.UpdateStatus(MIGRATE_TASK_ERR)
+		return
+	}
+	if err := t.run(); err != nil {
+		log.ErrorErrorf(err, "migrate failed")
+	}
+}
+
+// sourceGroup returns the group which the slot is migrated from.
+func (m *MigrateManager) sourceGroup(slotId int) (int, error) {
+	s, err := models.GetSlot(m.zkConn, m.productName, slotId)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if s.State.Status == models.SLOT_STATUS_MIGRATE {
+		return s.State.MigrateStatus.From, nil
+	}
+	return s.GroupId, nil
+}
+
+// firstTasks returns the first submitted task of each slot. Tasks of a slot
+// run in the order of submission whatever their priorities are, or a later
+// task would take over a slot left half migrated by an earlier one.
+func firstTasks(tasks Tasks) map[int]MigrateTaskInfo {
+	first := make(map[int]MigrateTaskInfo)
+	for _, info := range tasks {
+		if f, ok := first[info.SlotId]; !ok || info.Id < f.Id {
+			first[info.SlotId] = info
+		}
+	}
+	return first
+}
+
+// nextTasks returns the tasks to be started. Tasks of the same slot run in the
+// order of submission, tasks of different slots in the order of priority, and
+// the number of running tasks is limited.
+func (m *MigrateManager) nextTasks() []*MigrateTask {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fromCnt, toCnt := make(map[int]int), make(map[int]int)
+	for _, t := range m.running {
+		fromCnt[t.fromGroup]++
+		toCnt[t.NewGroupId]++
+	}
+	var tasks []*MigrateTask
+	all := m.Tasks()
+	first := firstTasks(all)
+	for _, info := range all {
+		if len(m.running) >= m.concurrency {
+			break
+		}
+		if first[info.SlotId].Id != info.Id {
 			continue
 		}
-		t := GetMigrateTask(*info)
-		err := t.preMigrateCheck()
+		if m.running[info.Id] != nil || info.Status == MIGRATE_TASK_PAUSED || info.Status == MIGRATE_TASK_VERIFY_FAILED {
+			continue
+		}
+		from, err := m.sourceGroup(info.SlotId)
 		if err != nil {
-			log.ErrorErrorf(err, "pre migrate check failed")
+			log.ErrorErrorf(err, "get source group of slot %d failed", info.SlotId)
+			continue
+		}
+		if fromCnt[from] >= m.groupConcurrency || toCnt[info.NewGroupId] >= m.groupConcurrency {
+			continue
+		}
+		fromCnt[from]++
+		toCnt[info.NewGroupId]++
+		t := GetMigrateTask(info)
+		t.fromGroup = from
+		m.running[info.Id] = t
+		tasks = append(tasks, t)
+	}
+	return tasks
+}
+
+// ownedSlots returns the target group of each slot that has a task, slots may be
+// left half migrated by paused or failed tasks, and they will be finished later.
+func (m *MigrateManager) ownedSlots() map[int]int {
+	slots := make(map[int]int)
+	for slotId, info := range firstTasks(m.Tasks()) {
+		slots[slotId] = info.NewGroupId
+	}
+	return slots
+}
+
+func (m *MigrateManager) RunningTasks() []MigrateTaskInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := Tasks{}
+	for _, t := range m.running {
+		res = append(res, t.MigrateTaskInfo)
+	}
+	sort.Sort(res)
+	return res
+}
+
+func getMigrateTask(zkConn zkhelper.Conn, product string, id string) (*MigrateTaskInfo, int, error) {
+	data, stat, err := zkConn.Get(getMigrateTasksPath(product) + "/" + id)
+	if err != nil {
+		if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+			return nil, 0, errors.Trace(ErrMigrateTaskNotFound)
 		}
-		err = t.run()
+		return nil, 0, errors.Trace(err)
+	}
+	info := new(MigrateTaskInfo)
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	info.Id = id
+	return info, stat.Version(), nil
+}
+
+// updateMigrateTask applies f to the task stored on zk, it retries if the task
+// is modified by others at the same time.
+func updateMigrateTask(zkConn zkhelper.Conn, product string, id string, f func(info *MigrateTaskInfo) error) (*MigrateTaskInfo, error) {
+	for {
+		info, version, err := getMigrateTask(zkConn, product, id)
 		if err != nil {
-			log.ErrorErrorf(err, "migrate failed")
+			return nil, err
+		}
+		if err := f(info); err != nil {
+			return nil, err
+		}
+		b, _ := json.Marshal(info)
+		_, err = zkConn.Set(getMigrateTasksPath(product)+"/"+id, b, int32(version))
+		if err == nil {
+			return info, nil
+		}
+		if !zkhelper.ZkErrorEqual(err, zk.ErrBadVersion) {
+			return nil, errors.Trace(err)
 		}
 	}
 }
 
-func (m *MigrateManager) NextTask() *MigrateTaskInfo {
-	ts := m.Tasks()
-	if len(ts) == 0 {
+// Pause stops the task, a running task stops after the current batch of keys
+// and its slot stays in migrate status until the task is resumed.
+func (m *MigrateManager) Pause(id string) (*MigrateTaskInfo, error) {
+	return updateMigrateTask(m.zkConn, m.productName, id, func(info *MigrateTaskInfo) error {
+		info.Status = MIGRATE_TASK_PAUSED
+		return nil
+	})
+}
+
+func (m *MigrateManager) Resume(id string) (*MigrateTaskInfo, error) {
+	return updateMigrateTask(m.zkConn, m.productName, id, func(info *MigrateTaskInfo) error {
+		if info.Status != MIGRATE_TASK_PAUSED {
+			return errors.Errorf("task %s is not paused, status = %s", id, info.Status)
+		}
+		info.Status = MIGRATE_TASK_PENDING
+		return nil
+	})
+}
+
+func (m *MigrateManager) SetPriority(id string, priority int) (*MigrateTaskInfo, error) {
+	return updateMigrateTask(m.zkConn, m.productName, id, func(info *MigrateTaskInfo) error {
+		info.Priority = priority
 		return nil
+	})
+}
+
+// Cancel removes a task that is not running, tasks that have started to move
+// keys must be finished, otherwise the slot is left half migrated.
+func (m *MigrateManager) Cancel(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running[id] != nil {
+		return errors.Errorf("task %s is running, pause it first", id)
 	}
-	return &ts[0]
+	info, version, err := getMigrateTask(m.zkConn, m.productName, id)
+	if err != nil {
+		return err
+	}
+	s, err := models.GetSlot(m.zkConn, m.productName, info.SlotId)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if s.State.Status == models.SLOT_STATUS_MIGRATE && s.State.MigrateStatus.To == info.NewGroupId {
+		return errors.Errorf("slot %d is half migrated by task %s, resume it to finish", info.SlotId, id)
+	}
+	if err := m.zkConn.Delete(getMigrateTasksPath(m.productName)+"/"+id, int32(version)); err != nil {
+		return errors.Trace(err)
+	}
+	return removeSlotManifest(m.zkConn, m.productName, id)
 }
 
 func (m *MigrateManager) Tasks() []MigrateTaskInfo {
 	res := Tasks{}
-	tasks, _, _ := safeZkConn.Children(getMigrateTasksPath(m.productName))
+	tasks, _, _ := m.zkConn.Children(getMigrateTasksPath(m.productName))
 	for _, id := range tasks {
-		data, _, _ := safeZkConn.Get(getMigrateTasksPath(m.productName) + "/" + id)
+		data, _, _ := m.zkConn.Get(getMigrateTasksPath(m.productName) + "/" + id)
 		info := new(MigrateTaskInfo)
 		json.Unmarshal(data, info)
 		info.Id = id
@@ -113,7 +389,10 @@ func (t Tasks) Len() int {
 }
 
 func (t Tasks) Less(i, j int) bool {
-	return t[i].Id <= t[j].Id
+	if t[i].Priority != t[j].Priority {
+		return t[i].Priority > t[j].Priority
+	}
+	return t[i].Id < t[j].Id
 }
 
 func (t Tasks) Swap(i, j int) {
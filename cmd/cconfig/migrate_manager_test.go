@@ -0,0 +1,170 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
+)
+
+const testProductName = "unit_test"
+
+func newTestMigrateManager() *MigrateManager {
+	conn := memzk.NewConn()
+	safeZkConn = conn
+	globalEnv = &CodisEnv{productName: testProductName}
+
+	assert.MustNoError(models.InitSlotSet(conn, testProductName, 16))
+	for _, id := range []int{1, 2} {
+		assert.MustNoError(models.NewServerGroup(testProductName, id).Create(conn))
+	}
+	assert.MustNoError(models.SetSlotRange(conn, testProductName, 0, 15, 1, models.SLOT_STATUS_ONLINE))
+
+	m := &MigrateManager{
+		running:          make(map[string]*MigrateTask),
+		zkConn:           conn,
+		productName:      testProductName,
+		concurrency:      4,
+		groupConcurrency: 4,
+	}
+	zkhelper.CreateRecursive(conn, getMigrateTasksPath(testProductName), "", 0, zkhelper.DefaultDirACLs())
+	return m
+}
+
+func postTestTask(m *MigrateManager, slotId int, status string) *MigrateTaskInfo {
+	info := &MigrateTaskInfo{SlotId: slotId, NewGroupId: 2, Status: status}
+	assert.MustNoError(m.PostTask(info))
+	return info
+}
+
+func getTestSlot(m *MigrateManager, slotId int) *models.Slot {
+	s, err := models.GetSlot(m.zkConn, m.productName, slotId)
+	assert.MustNoError(err)
+	return s
+}
+
+// crash points of a migration, in the order of MigrateTask.run
+func TestMigrateRecover(t *testing.T) {
+	m := newTestMigrateManager()
+
+	// 0: posted but never started
+	postTestTask(m, 0, MIGRATE_TASK_PENDING)
+
+	// 1: started, the slot is not changed yet
+	postTestTask(m, 1, MIGRATE_TASK_MIGRATING)
+
+	// 2: the slot is in pre_migrate
+	postTestTask(m, 2, MIGRATE_TASK_MIGRATING)
+	s := getTestSlot(m, 2)
+	s.State.Status = models.SLOT_STATUS_PRE_MIGRATE
+	assert.MustNoError(s.Update(m.zkConn))
+
+	// 3: keys are being moved, the manifest is saved
+	info := postTestTask(m, 3, MIGRATE_TASK_MIGRATING)
+	assert.MustNoError(saveSlotManifest(m.zkConn, m.productName, info.Id, slotManifest{}))
+	assert.MustNoError(getTestSlot(m, 3).SetMigrateStatus(m.zkConn, 1, 2))
+
+	// 4: the slot is online again, but the task is not removed
+	postTestTask(m, 4, MIGRATE_TASK_MIGRATING)
+	s = getTestSlot(m, 4)
+	assert.MustNoError(s.SetMigrateStatus(m.zkConn, 1, 2))
+	s.State.Status = models.SLOT_STATUS_ONLINE
+	s.State.MigrateStatus.From = models.INVALID_ID
+	s.State.MigrateStatus.To = models.INVALID_ID
+	assert.MustNoError(s.Update(m.zkConn))
+
+	// 5: the slot is in migrate without any task
+	assert.MustNoError(getTestSlot(m, 5).SetMigrateStatus(m.zkConn, 1, 2))
+
+	// the task is removed, but not its manifest
+	assert.MustNoError(saveSlotManifest(m.zkConn, m.productName, "9999999999", slotManifest{}))
+
+	// recovery is idempotent
+	for i := 0; i < 2; i++ {
+		assert.MustNoError(m.mayRecover())
+
+		tasks := m.Tasks()
+		assert.Must(len(tasks) == 6)
+		for _, info := range tasks {
+			assert.Must(info.Status == MIGRATE_TASK_PENDING)
+			assert.Must(info.NewGroupId == 2)
+		}
+		assert.Must(tasks[5].SlotId == 5)
+
+		for _, id := range []int{0, 1, 2} {
+			s := getTestSlot(m, id)
+			assert.Must(s.State.Status == models.SLOT_STATUS_ONLINE && s.GroupId == 1)
+		}
+		for _, id := range []int{3, 5} {
+			s := getTestSlot(m, id)
+			assert.Must(s.State.Status == models.SLOT_STATUS_MIGRATE && s.GroupId == 2)
+			assert.Must(s.State.MigrateStatus.From == 1)
+		}
+		s := getTestSlot(m, 4)
+		assert.Must(s.State.Status == models.SLOT_STATUS_ONLINE && s.GroupId == 2)
+
+		manifests, _, err := m.zkConn.Children(getMigrateManifestsPath(m.productName))
+		assert.MustNoError(err)
+		assert.Must(len(manifests) == 1 && manifests[0] == info.Id)
+	}
+
+	// half migrated slots continue from the source group
+	m.groupConcurrency = 1
+	next := m.nextTasks()
+	assert.Must(len(next) == 1)
+	assert.Must(next[0].SlotId == 0 && next[0].fromGroup == 1)
+	m.running = make(map[string]*MigrateTask)
+	m.concurrency, m.groupConcurrency = 16, 16
+	for _, t := range m.nextTasks() {
+		if t.SlotId == 3 || t.SlotId == 5 {
+			assert.Must(t.fromGroup == 1)
+		}
+		if t.SlotId == 4 {
+			assert.Must(t.fromGroup == 2)
+			// nothing to move, the task is finished
+			assert.MustNoError(t.run())
+			_, _, err := getMigrateTask(m.zkConn, m.productName, t.Id)
+			assert.Must(err != nil)
+		}
+	}
+}
+
+func TestMigrateRecoverEmpty(t *testing.T) {
+	m := newTestMigrateManager()
+	assert.MustNoError(m.mayRecover())
+	assert.Must(len(m.Tasks()) == 0)
+}
+
+func TestNextTasksOrder(t *testing.T) {
+	m := newTestMigrateManager()
+	m.concurrency = 1
+
+	// the first task of slot 0 is paused with the slot half migrated
+	first := postTestTask(m, 0, MIGRATE_TASK_PAUSED)
+	assert.MustNoError(getTestSlot(m, 0).SetMigrateStatus(m.zkConn, 1, 2))
+	later := &MigrateTaskInfo{SlotId: 0, NewGroupId: 1, Status: MIGRATE_TASK_PENDING, Priority: 10}
+	assert.MustNoError(m.PostTask(later))
+	other := &MigrateTaskInfo{SlotId: 1, NewGroupId: 2, Status: MIGRATE_TASK_PENDING, Priority: 5}
+	assert.MustNoError(m.PostTask(other))
+	postTestTask(m, 2, MIGRATE_TASK_PENDING)
+
+	// the later task of slot 0 waits for the paused one despite its priority
+	owned := m.ownedSlots()
+	assert.Must(owned[0] == 2)
+	next := m.nextTasks()
+	assert.Must(len(next) == 1 && next[0].Id == other.Id)
+
+	m.running = make(map[string]*MigrateTask)
+	_, err := m.SetPriority(first.Id, 1)
+	assert.MustNoError(err)
+	m.concurrency = 16
+	for _, t := range m.nextTasks() {
+		assert.Must(t.SlotId != 0)
+	}
+}
@@ -4,7 +4,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"time"
 
@@ -23,7 +22,13 @@ type MigrateTaskInfo struct {
 	CreateAt   string `json:"create_at"`
 	Percent    int    `json:"percent"`
 	Status     string `json:"status"`
-	Id         string `json:"-"`
+	Priority   int    `json:"priority"`
+	Id         string `json:"id,omitempty"`
+
+	Throttle *ThrottleStatus `json:"throttle,omitempty"`
+
+	Verify       string            `json:"verify,omitempty"`
+	Verification *SlotVerifyResult `json:"verification,omitempty"`
 }
 
 type SlotMigrateProgress struct {
@@ -42,6 +47,9 @@ type MigrateTask struct {
 	zkConn       zkhelper.Conn
 	productName  string
 	progressChan chan SlotMigrateProgress
+	fromGroup    int
+	lastCheck    time.Time
+	manifest     slotManifest
 }
 
 func GetMigrateTask(info MigrateTaskInfo) *MigrateTask {
@@ -52,15 +60,53 @@ func GetMigrateTask(info MigrateTaskInfo) *MigrateTask {
 	}
 }
 
-func (t *MigrateTask) UpdateStatus(status string) {
-	t.Status = status
-	b, _ := json.Marshal(t.MigrateTaskInfo)
-	t.zkConn.Set(getMigrateTasksPath(t.productName)+"/"+t.Id, b, -1)
+func (t *MigrateTask) UpdateStatus(status string) error {
+	info, err := updateMigrateTask(t.zkConn, t.productName, t.Id, func(info *MigrateTaskInfo) error {
+		// a paused task can't be restarted by itself
+		if info.Status == MIGRATE_TASK_PAUSED && status == MIGRATE_TASK_MIGRATING {
+			return errors.Trace(ErrMigrateTaskPaused)
+		}
+		info.Status = status
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.MigrateTaskInfo = *info
+	return nil
+}
+
+// syncStatus saves the progress and returns ErrMigrateTaskPaused if the task
+// has been paused, zk is accessed at most once per second.
+func (t *MigrateTask) syncStatus(throttle *migrateThrottle) error {
+	if time.Since(t.lastCheck) < time.Second {
+		return nil
+	}
+	t.lastCheck = time.Now()
+	info, err := updateMigrateTask(t.zkConn, t.productName, t.Id, func(info *MigrateTaskInfo) error {
+		if info.Status == MIGRATE_TASK_PAUSED {
+			return errors.Trace(ErrMigrateTaskPaused)
+		}
+		info.Percent = t.Percent
+		if throttle != nil {
+			status := throttle.status
+			info.Throttle = &status
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.MigrateTaskInfo = *info
+	return nil
 }
 
 func (t *MigrateTask) UpdateFinish() {
 	t.Status = MIGRATE_TASK_FINISHED
 	t.zkConn.Delete(getMigrateTasksPath(t.productName)+"/"+t.Id, -1)
+	if err := removeSlotManifest(t.zkConn, t.productName, t.Id); err != nil {
+		log.WarnErrorf(err, "remove manifest of task %s failed", t.Id)
+	}
 }
 func (t *MigrateTask) migrateSingleSlot(slotId int, to int) error {
 	// set slot status
@@ -103,6 +149,13 @@ func (t *MigrateTask) migrateSingleSlot(slotId int, to int) error {
 		return nil
 	}
 
+	if t.Verify != MIGRATE_VERIFY_NONE {
+		if err := t.prepareManifest(s, from); err != nil {
+			log.ErrorErrorf(err, "prepare manifest of slot %d failed", slotId)
+			return err
+		}
+	}
+
 	// modify slot status
 	if err := s.SetMigrateStatus(t.zkConn, from, to); err != nil {
 		log.ErrorErrorf(err, "set migrate status failed")
@@ -131,22 +184,126 @@ func (t *MigrateTask) migrateSingleSlot(slotId int, to int) error {
 	return nil
 }
 
+// prepareManifest takes the manifest of the slot before any key is moved, and
+// saves it with the task. A resumed task reuses the saved one, since some keys
+// have been moved to the target.
+func (t *MigrateTask) prepareManifest(s *models.Slot, from int) error {
+	m, err := loadSavedManifest(t.zkConn, t.productName, t.Id)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		if s.State.Status == models.SLOT_STATUS_MIGRATE {
+			log.Warnf("manifest of task %s is not found, keys of slot %d moved to group %d are not verified",
+				t.Id, s.Id, s.State.MigrateStatus.To)
+		}
+		addr, err := groupMasterAddr(t.zkConn, t.productName, from)
+		if err != nil {
+			return err
+		}
+		sample := verifySampleSize
+		if t.Verify == MIGRATE_VERIFY_FULL {
+			sample = 0
+		}
+		if m, err = buildSlotManifest(addr, globalEnv.Password(), s.Id, sample); err != nil {
+			return err
+		}
+		if err := saveSlotManifest(t.zkConn, t.productName, t.Id, m); err != nil {
+			return err
+		}
+	}
+	t.manifest, t.fromGroup = m, from
+	return nil
+}
+
 func (t *MigrateTask) run() error {
 	log.Infof("migration start: %+v", t.MigrateTaskInfo)
 	to := t.NewGroupId
-	t.UpdateStatus(MIGRATE_TASK_MIGRATING)
+	if err := t.UpdateStatus(MIGRATE_TASK_MIGRATING); err != nil {
+		if errors.Equal(err, ErrMigrateTaskPaused) {
+			return nil
+		}
+		return err
+	}
 	err := t.migrateSingleSlot(t.SlotId, to)
+	if errors.Equal(err, ErrMigrateTaskPaused) {
+		log.Infof("migration paused: %+v", t.MigrateTaskInfo)
+		return nil
+	}
 	if err != nil {
 		log.ErrorErrorf(err, "migrate single slot failed")
 		t.UpdateStatus(MIGRATE_TASK_ERR)
 		t.rollbackPremigrate()
 		return err
 	}
+	if t.manifest != nil {
+		if err := t.verify(); err != nil {
+			log.ErrorErrorf(err, "verify slot %d failed", t.SlotId)
+			t.UpdateStatus(MIGRATE_TASK_VERIFY_FAILED)
+			return err
+		}
+	}
 	t.UpdateFinish()
 	log.Infof("migration finished: %+v", t.MigrateTaskInfo)
 	return nil
 }
 
+// verify records the result in the task, a task failed to verify is kept
+// until it's cancelled. Clients keep writing the slot during the migration, so
+// missing or mismatched keys are only warned, the task fails if keys of the
+// slot are left on the source.
+func (t *MigrateTask) verify() error {
+	from, err := groupMasterAddr(t.zkConn, t.productName, t.fromGroup)
+	if err != nil {
+		return err
+	}
+	to, err := groupMasterAddr(t.zkConn, t.productName, t.NewGroupId)
+	if err != nil {
+		return err
+	}
+	r, err := verifySlot(t.SlotId, to, []string{from}, t.manifest)
+	if err != nil {
+		return err
+	}
+	info, err := updateMigrateTask(t.zkConn, t.productName, t.Id, func(info *MigrateTaskInfo) error {
+		info.Percent = 100
+		info.Verification = r
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.MigrateTaskInfo = *info
+	log.Infof("verify slot %d: %+v", t.SlotId, r)
+	return checkMigrateVerification(t.SlotId, r)
+}
+
+func checkMigrateVerification(slot int, r *SlotVerifyResult) error {
+	if r.SourceKeys != 0 {
+		return errors.Errorf("slot %d is not verified, %d keys left on source", slot, r.SourceKeys)
+	}
+	if !r.Passed {
+		log.Warnf("slot %d is migrated with %d keys missing and %d mismatched, which may be written during the migration: %v",
+			slot, r.Missing, r.Mismatched, r.BadKeys)
+	}
+	return nil
+}
+
+func groupMasterAddr(zkConn zkhelper.Conn, productName string, groupId int) (string, error) {
+	g, err := models.GetGroup(zkConn, productName, groupId)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	master, err := g.Master(zkConn)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if master == nil {
+		return "", errors.Trace(ErrGroupMasterNotFound)
+	}
+	return master.Addr, nil
+}
+
 func (t *MigrateTask) rollbackPremigrate() {
 	if s, err := models.GetSlot(t.zkConn, t.productName, t.SlotId); err == nil && s.State.Status == models.SLOT_STATUS_PRE_MIGRATE {
 		s.State.Status = models.SLOT_STATUS_ONLINE
@@ -193,16 +350,31 @@ func (task *MigrateTask) Migrate(slot *models.Slot, fromGroup, toGroup int, onPr
 
 	defer c.Close()
 
-	_, remain, err := utils.SlotsMgrtTagSlot(c, slot.Id, toMaster.Addr)
+	var throttle *migrateThrottle
+	if budget := globalEnv.MigrateLatencyBudget(); budget > 0 && task.Delay == 0 {
+		throttle = newMigrateThrottle(slot.Id, fromMaster.Addr, toMaster.Addr, budget)
+		defer throttle.Close()
+	}
+
+	succ, remain, err := utils.SlotsMgrtTagSlot(c, slot.Id, toMaster.Addr)
 	if err != nil {
 		return err
 	}
+	total := succ + remain
 
 	for remain > 0 {
-		if task.Delay > 0 {
+		if total > 0 && remain <= total {
+			task.Percent = (total - remain) * 100 / total
+		}
+		if err := task.syncStatus(throttle); err != nil {
+			return err
+		}
+		if throttle != nil {
+			throttle.wait(succ)
+		} else if task.Delay > 0 {
 			time.Sleep(time.Duration(task.Delay) * time.Millisecond)
 		}
-		_, remain, err = utils.SlotsMgrtTagSlot(c, slot.Id, toMaster.Addr)
+		succ, remain, err = utils.SlotsMgrtTagSlot(c, slot.Id, toMaster.Addr)
 		if remain >= 0 {
 			onProgress(SlotMigrateProgress{
 				SlotId:    slot.Id,
@@ -218,19 +390,25 @@ func (task *MigrateTask) Migrate(slot *models.Slot, fromGroup, toGroup int, onPr
 	return nil
 }
 
-func (t *MigrateTask) preMigrateCheck() error {
+// preMigrateCheck makes sure that other migrating slots are owned by running
+// tasks, slots left half migrated must be finished first.
+func (t *MigrateTask) preMigrateCheck(running map[int]int) error {
 	slots, err := models.GetMigratingSlots(safeZkConn, t.productName)
-
 	if err != nil {
 		return errors.Trace(err)
 	}
-	// check if there is migrating slot
-	if len(slots) > 1 {
-		return errors.Errorf("more than one slots are migrating, unknown error")
+	if err := models.CheckMigratingSlots(slots); err != nil {
+		return errors.Trace(err)
 	}
-	if len(slots) == 1 {
-		slot := slots[0]
-		if t.NewGroupId != slot.State.MigrateStatus.To || t.SlotId != slot.Id {
+	for _, slot := range slots {
+		if slot.Id == t.SlotId {
+			if slot.State.Status == models.SLOT_STATUS_MIGRATE && t.NewGroupId != slot.State.MigrateStatus.To {
+				return errors.Errorf("there is a migrating slot %+v, finish it first", slot)
+			}
+			continue
+		}
+		to, ok := running[slot.Id]
+		if !ok || (slot.State.Status == models.SLOT_STATUS_MIGRATE && to != slot.State.MigrateStatus.To) {
 			return errors.Errorf("there is a migrating slot %+v, finish it first", slot)
 		}
 	}
@@ -0,0 +1,232 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+const (
+	throttleMinDelay     = time.Microsecond * 100
+	throttleMaxDelay     = time.Second
+	throttleMaxErrorRate = 0.01
+
+	throttleAdjustPeriod = time.Second
+	throttleProxyPeriod  = time.Second * 5
+)
+
+// ThrottleStatus is shown in the status of migrate tasks.
+type ThrottleStatus struct {
+	Budget      int64   `json:"budget_us"`
+	Delay       int64   `json:"delay_us"`
+	Rate        int64   `json:"rate"` // keys migrated per second
+	FromLatency int64   `json:"from_latency_us"`
+	ToLatency   int64   `json:"to_latency_us"`
+	FromOps     int64   `json:"from_ops"`
+	ToOps       int64   `json:"to_ops"`
+	ErrorRate   float64 `json:"error_rate"`
+}
+
+type throttleProbe struct {
+	addr string
+	conn redis.Conn
+}
+
+// latency returns the average round trip time of a few PINGs, and the ops of
+// the server reported by INFO.
+func (p *throttleProbe) latency() (time.Duration, int64, error) {
+	if p.conn == nil {
+		c, err := utils.DialToTimeout(p.addr, globalEnv.Password(), time.Second*5, time.Second*5)
+		if err != nil {
+			return 0, 0, err
+		}
+		p.conn = c
+	}
+	var total time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if _, err := p.conn.Do("PING"); err != nil {
+			p.close()
+			return 0, 0, err
+		}
+		total += time.Since(start)
+	}
+	info, err := redis.String(p.conn.Do("INFO", "stats"))
+	if err != nil {
+		p.close()
+		return 0, 0, err
+	}
+	var ops int64
+	for _, line := range strings.Split(info, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(kv) == 2 && kv[0] == "instantaneous_ops_per_sec" {
+			ops, _ = strconv.ParseInt(kv[1], 10, 64)
+		}
+	}
+	return total / 3, ops, nil
+}
+
+func (p *throttleProbe) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// migrateThrottle adapts the delay between SLOTSMGRTTAGSLOT calls to hold the
+// latency of both masters within budget.
+type migrateThrottle struct {
+	slot   int
+	budget time.Duration
+	delay  time.Duration
+	status ThrottleStatus
+
+	from, to *throttleProbe
+
+	keys       int64
+	lastAdjust time.Time
+
+	errorRate   float64
+	lastProxies time.Time
+	proxyStats  map[string][2]int64 // migrate calls & errors of each proxy
+}
+
+func newMigrateThrottle(slot int, from, to string, budget time.Duration) *migrateThrottle {
+	return &migrateThrottle{
+		slot:       slot,
+		budget:     budget,
+		from:       &throttleProbe{addr: from},
+		to:         &throttleProbe{addr: to},
+		lastAdjust: time.Now(),
+		proxyStats: make(map[string][2]int64),
+	}
+}
+
+func (t *migrateThrottle) Close() {
+	t.from.close()
+	t.to.close()
+}
+
+// adjust doubles the delay if the latency is over budget or proxies fail to
+// migrate keys on demand, and shortens it gradually if there is enough room.
+func (t *migrateThrottle) adjust(latency time.Duration, errorRate float64) {
+	switch {
+	case latency > t.budget || errorRate > throttleMaxErrorRate:
+		t.delay *= 2
+		if t.delay < throttleMinDelay {
+			t.delay = throttleMinDelay
+		}
+		if t.delay > throttleMaxDelay {
+			t.delay = throttleMaxDelay
+		}
+	case latency < t.budget/2:
+		t.delay = t.delay * 3 / 4
+		if t.delay < throttleMinDelay {
+			t.delay = 0
+		}
+	}
+}
+
+// slotMigrateStats returns the migrate calls & errors of the slot in the
+// debug vars of a proxy.
+func slotMigrateStats(vars map[string]interface{}, slot int) (int64, int64) {
+	router, ok := vars["router"].(map[string]interface{})
+	if !ok {
+		return 0, 0
+	}
+	slots, ok := router["slots"].(map[string]interface{})
+	if !ok {
+		return 0, 0
+	}
+	m, ok := slots[strconv.Itoa(slot)].(map[string]interface{})
+	if !ok {
+		return 0, 0
+	}
+	calls, _ := m["migrate_calls"].(float64)
+	errs, _ := m["migrate_errors"].(float64)
+	return int64(calls), int64(errs)
+}
+
+// updateErrorRate collects the migrate error rate of the slot from proxies.
+func (t *migrateThrottle) updateErrorRate() {
+	proxies, err := models.ProxyList(safeZkConn, globalEnv.ProductName(), nil)
+	if err != nil {
+		log.WarnErrorf(err, "get proxy list failed")
+		return
+	}
+	var calls, errs int64
+	for _, p := range proxies {
+		vars, err := p.DebugVars()
+		if err != nil {
+			continue
+		}
+		c, e := slotMigrateStats(vars, t.slot)
+		last := t.proxyStats[p.Id]
+		if c >= last[0] && e >= last[1] {
+			calls += c - last[0]
+			errs += e - last[1]
+		}
+		t.proxyStats[p.Id] = [2]int64{c, e}
+	}
+	t.errorRate = 0
+	if calls != 0 {
+		t.errorRate = float64(errs) / float64(calls)
+	}
+}
+
+func (t *migrateThrottle) probe() {
+	now := time.Now()
+	if now.Sub(t.lastProxies) >= throttleProxyPeriod {
+		t.lastProxies = now
+		t.updateErrorRate()
+	}
+	fromLatency, fromOps, err := t.from.latency()
+	if err != nil {
+		log.WarnErrorf(err, "probe %s failed", t.from.addr)
+		fromLatency = throttleMaxDelay
+	}
+	toLatency, toOps, err := t.to.latency()
+	if err != nil {
+		log.WarnErrorf(err, "probe %s failed", t.to.addr)
+		toLatency = throttleMaxDelay
+	}
+	latency := fromLatency
+	if toLatency > latency {
+		latency = toLatency
+	}
+	t.adjust(latency, t.errorRate)
+
+	t.status = ThrottleStatus{
+		Budget:      int64(t.budget / time.Microsecond),
+		Delay:       int64(t.delay / time.Microsecond),
+		Rate:        int64(float64(t.keys) / now.Sub(t.lastAdjust).Seconds()),
+		FromLatency: int64(fromLatency / time.Microsecond),
+		ToLatency:   int64(toLatency / time.Microsecond),
+		FromOps:     fromOps,
+		ToOps:       toOps,
+		ErrorRate:   t.errorRate,
+	}
+	t.keys = 0
+	t.lastAdjust = now
+}
+
+// wait is called before each SLOTSMGRTTAGSLOT, n is the number of keys moved
+// by the previous call.
+func (t *migrateThrottle) wait(n int) {
+	t.keys += int64(n)
+	if time.Since(t.lastAdjust) >= throttleAdjustPeriod {
+		t.probe()
+	}
+	if t.delay > 0 {
+		time.Sleep(t.delay)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestThrottleAdjust(t *testing.T) {
+	budget := time.Millisecond * 2
+	throttle := newMigrateThrottle(0, "", "", budget)
+	assert.Must(throttle.delay == 0)
+
+	// over budget, slow down until the max delay
+	throttle.adjust(budget*2, 0)
+	assert.Must(throttle.delay == throttleMinDelay)
+	throttle.adjust(budget*2, 0)
+	assert.Must(throttle.delay == throttleMinDelay*2)
+	for i := 0; i < 32; i++ {
+		throttle.adjust(budget*2, 0)
+	}
+	assert.Must(throttle.delay == throttleMaxDelay)
+
+	// within budget, hold the speed
+	throttle.adjust(budget*3/4, 0)
+	assert.Must(throttle.delay == throttleMaxDelay)
+
+	// proxies fail to migrate keys
+	throttle.delay = time.Millisecond
+	throttle.adjust(0, throttleMaxErrorRate*2)
+	assert.Must(throttle.delay == time.Millisecond*2)
+
+	// enough room, speed up until no delay
+	for i := 0; i < 64; i++ {
+		throttle.adjust(budget/4, 0)
+	}
+	assert.Must(throttle.delay == 0)
+}
+
+func TestSlotMigrateStats(t *testing.T) {
+	var vars map[string]interface{}
+	b := []byte(`{"router": {"ops": 10, "slots": {"7": {"migrate_calls": 100, "migrate_errors": 3}}}}`)
+	assert.MustNoError(json.Unmarshal(b, &vars))
+
+	calls, errs := slotMigrateStats(vars, 7)
+	assert.Must(calls == 100 && errs == 3)
+	calls, errs = slotMigrateStats(vars, 8)
+	assert.Must(calls == 0 && errs == 0)
+	calls, errs = slotMigrateStats(map[string]interface{}{}, 7)
+	assert.Must(calls == 0 && errs == 0)
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"sort"
 	"strconv"
 	"time"
 
@@ -19,6 +20,7 @@ type NodeInfo struct {
 	GroupId   int
 	CurSlots  []int
 	MaxMemory int64
+	Addr      string
 }
 
 func getLivingNodeInfos(zkConn zkhelper.Conn) ([]*NodeInfo, error) {
@@ -57,6 +59,7 @@ func getLivingNodeInfos(zkConn zkhelper.Conn) ([]*NodeInfo, error) {
 			GroupId:   g.Id,
 			CurSlots:  slotMap[g.Id],
 			MaxMemory: maxMem,
+			Addr:      master.Addr,
 		}
 		ret = append(ret, node)
 	}
@@ -70,68 +73,332 @@ func getLivingNodeInfos(zkConn zkhelper.Conn) ([]*NodeInfo, error) {
 	return ret, nil
 }
 
-func getQuotaMap(zkConn zkhelper.Conn) (map[int]int, error) {
-	nodes, err := getLivingNodeInfos(zkConn)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-
+// getQuotaMap divides slots in proportion to the weights of groups.
+func getQuotaMap(nodes []*NodeInfo, weights map[int]int64) map[int]int {
 	ret := make(map[int]int)
-	var totalMem int64
+	var totalWeight int64
 	totalQuota := 0
 	for _, node := range nodes {
-		totalMem += node.MaxMemory
+		totalWeight += weights[node.GroupId]
 	}
 
 	for _, node := range nodes {
-		quota := int(models.DEFAULT_SLOT_NUM * node.MaxMemory * 1.0 / totalMem)
+		quota := int(models.DEFAULT_SLOT_NUM * weights[node.GroupId] / totalWeight)
 		ret[node.GroupId] = quota
 		totalQuota += quota
 	}
 
 	// round up
-	if totalQuota < models.DEFAULT_SLOT_NUM {
-		for k, _ := range ret {
-			ret[k] += models.DEFAULT_SLOT_NUM - totalQuota
-			break
-		}
+	if totalQuota < models.DEFAULT_SLOT_NUM && len(nodes) != 0 {
+		ret[nodes[0].GroupId] += models.DEFAULT_SLOT_NUM - totalQuota
 	}
+	return ret
+}
+
+const (
+	REBALANCE_BY_SLOTS = "slots"
+	REBALANCE_BY_LOAD  = "load"
+)
+
+type RebalanceOptions struct {
+	Strategy  string
+	Weights   map[int]int64 // maxmemory of the group by default
+	Tolerance float64       // of the load strategy, in percent
+	Sample    time.Duration // how long the qps of slots are sampled
+}
+
+func DefaultRebalanceOptions() *RebalanceOptions {
+	return &RebalanceOptions{
+		Strategy:  REBALANCE_BY_SLOTS,
+		Tolerance: 10,
+		Sample:    time.Second * 3,
+	}
+}
 
+func (o *RebalanceOptions) weights(nodes []*NodeInfo) (map[int]int64, error) {
+	ret := make(map[int]int64)
+	for _, node := range nodes {
+		ret[node.GroupId] = node.MaxMemory
+	}
+	for id, w := range o.Weights {
+		if _, ok := ret[id]; !ok {
+			return nil, errors.Errorf("group %d does not exist", id)
+		}
+		if w <= 0 {
+			return nil, errors.Errorf("invalid weight = %d of group %d", w, id)
+		}
+		ret[id] = w
+	}
 	return ret, nil
 }
 
-// experimental simple auto rebalance :)
-func Rebalance() error {
-	targetQuota, err := getQuotaMap(safeZkConn)
-	if err != nil {
-		return errors.Trace(err)
+// RebalanceMove moves a slot between groups, keys, bytes and qps are estimated
+// when the plan is made.
+type RebalanceMove struct {
+	SlotId    int   `json:"slot_id"`
+	FromGroup int   `json:"from_group"`
+	ToGroup   int   `json:"to_group"`
+	Keys      int64 `json:"keys"`
+	Bytes     int64 `json:"bytes"`
+	QPS       int64 `json:"qps"`
+}
+
+// RebalanceGroup is the expected balance of a group before and after the plan.
+type RebalanceGroup struct {
+	GroupId     int     `json:"group_id"`
+	MaxMemory   int64   `json:"maxmemory"`
+	Weight      int64   `json:"weight"`
+	Quota       int     `json:"quota,omitempty"`
+	SlotsBefore int     `json:"slots_before"`
+	SlotsAfter  int     `json:"slots_after"`
+	KeysBefore  int64   `json:"keys_before"`
+	KeysAfter   int64   `json:"keys_after"`
+	BytesBefore int64   `json:"bytes_before"`
+	BytesAfter  int64   `json:"bytes_after"`
+	QPSBefore   int64   `json:"qps_before"`
+	QPSAfter    int64   `json:"qps_after"`
+	UsageAfter  float64 `json:"usage_after"` // bytes after / maxmemory
+}
+
+type RebalancePlan struct {
+	Strategy string            `json:"strategy"`
+	Moves    []*RebalanceMove  `json:"moves"`
+	Groups   []*RebalanceGroup `json:"groups"`
+	Keys     int64             `json:"keys"`  // keys to be migrated
+	Bytes    int64             `json:"bytes"` // bytes to be migrated
+}
+
+func newRebalancePlan(strategy string, nodes []*NodeInfo, weights map[int]int64, loads map[int]slotLoad) *RebalancePlan {
+	plan := &RebalancePlan{Strategy: strategy, Moves: []*RebalanceMove{}}
+	for _, node := range nodes {
+		g := &RebalanceGroup{
+			GroupId:     node.GroupId,
+			MaxMemory:   node.MaxMemory,
+			Weight:      weights[node.GroupId],
+			SlotsBefore: len(node.CurSlots),
+		}
+		for _, id := range node.CurSlots {
+			g.KeysBefore += loads[id].keys
+			g.BytesBefore += loads[id].bytes
+			g.QPSBefore += loads[id].qps
+		}
+		g.SlotsAfter = g.SlotsBefore
+		g.KeysAfter, g.BytesAfter, g.QPSAfter = g.KeysBefore, g.BytesBefore, g.QPSBefore
+		plan.Groups = append(plan.Groups, g)
 	}
-	livingNodes, err := getLivingNodeInfos(safeZkConn)
-	if err != nil {
-		return errors.Trace(err)
-	}
-	log.Infof("start rebalance")
-	for _, node := range livingNodes {
-		for len(node.CurSlots) > targetQuota[node.GroupId] {
-			for _, dest := range livingNodes {
-				if dest.GroupId != node.GroupId && len(dest.CurSlots) < targetQuota[dest.GroupId] && len(node.CurSlots) > targetQuota[node.GroupId] {
-					slot := node.CurSlots[len(node.CurSlots)-1]
-					// create a migration task
-					info := &MigrateTaskInfo{
-						Delay:      0,
-						SlotId:     slot,
-						NewGroupId: dest.GroupId,
-						Status:     MIGRATE_TASK_PENDING,
-						CreateAt:   strconv.FormatInt(time.Now().Unix(), 10),
-					}
-					globalMigrateManager.PostTask(info)
-
-					node.CurSlots = node.CurSlots[0 : len(node.CurSlots)-1]
-					dest.CurSlots = append(dest.CurSlots, slot)
+	return plan
+}
+
+func (p *RebalancePlan) move(id int, src, dest *RebalanceGroup, l slotLoad) {
+	p.Moves = append(p.Moves, &RebalanceMove{
+		SlotId:    id,
+		FromGroup: src.GroupId,
+		ToGroup:   dest.GroupId,
+		Keys:      l.keys,
+		Bytes:     l.bytes,
+		QPS:       l.qps,
+	})
+	p.Keys += l.keys
+	p.Bytes += l.bytes
+	src.SlotsAfter--
+	src.KeysAfter -= l.keys
+	src.BytesAfter -= l.bytes
+	src.QPSAfter -= l.qps
+	dest.SlotsAfter++
+	dest.KeysAfter += l.keys
+	dest.BytesAfter += l.bytes
+	dest.QPSAfter += l.qps
+}
+
+func (p *RebalancePlan) finish() {
+	for _, g := range p.Groups {
+		if g.MaxMemory > 0 {
+			g.UsageAfter = float64(g.BytesAfter) / float64(g.MaxMemory)
+		}
+	}
+}
+
+// slotLoad is the number of keys, the estimated bytes and the qps of a slot.
+type slotLoad struct {
+	keys  int64
+	bytes int64
+	qps   int64
+}
+
+// getSlotLoads collects the keys of each slot by SLOTSINFO. SLOTSINFO has no
+// size of slots, so the used memory of the master is shared by its slots in
+// proportion to their keys.
+func getSlotLoads(nodes []*NodeInfo) (map[int]slotLoad, error) {
+	loads := make(map[int]slotLoad)
+	for _, node := range nodes {
+		infos, err := utils.SlotsInfo(node.Addr, globalEnv.Password(), 0, models.DEFAULT_SLOT_NUM-1)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		stat, err := utils.GetRedisStat(node.Addr, globalEnv.Password())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		used, _ := strconv.ParseInt(stat["used_memory"], 10, 64)
+		var total int64
+		for _, id := range node.CurSlots {
+			total += int64(infos[id])
+		}
+		for _, id := range node.CurSlots {
+			l := slotLoad{keys: int64(infos[id])}
+			if total != 0 {
+				l.bytes = int64(float64(used) * float64(l.keys) / float64(total))
+			}
+			loads[id] = l
+		}
+	}
+	return loads, nil
+}
+
+type slotsByKeys struct {
+	slots []int
+	loads map[int]slotLoad
+}
+
+func (s *slotsByKeys) Len() int {
+	return len(s.slots)
+}
+
+func (s *slotsByKeys) Less(i, j int) bool {
+	a, b := s.loads[s.slots[i]].keys, s.loads[s.slots[j]].keys
+	if a != b {
+		return a > b
+	}
+	return s.slots[i] < s.slots[j]
+}
+
+func (s *slotsByKeys) Swap(i, j int) {
+	s.slots[i], s.slots[j] = s.slots[j], s.slots[i]
+}
+
+// planRebalance moves slots from groups over quota to groups under quota, the
+// slots with the fewest keys are moved first to migrate as little as possible.
+func planRebalance(nodes []*NodeInfo, weights map[int]int64, quota map[int]int, loads map[int]slotLoad) *RebalancePlan {
+	plan := newRebalancePlan(REBALANCE_BY_SLOTS, nodes, weights, loads)
+	slots := make(map[int][]int)
+	for i, node := range nodes {
+		plan.Groups[i].Quota = quota[node.GroupId]
+		// the lightest slot is the last one
+		s := &slotsByKeys{append([]int{}, node.CurSlots...), loads}
+		sort.Sort(s)
+		slots[node.GroupId] = s.slots
+	}
+
+	for _, src := range plan.Groups {
+		for len(slots[src.GroupId]) > src.Quota {
+			moved := false
+			for _, dest := range plan.Groups {
+				if dest.GroupId == src.GroupId || len(slots[dest.GroupId]) >= dest.Quota || len(slots[src.GroupId]) <= src.Quota {
+					continue
 				}
+				s := slots[src.GroupId]
+				id := s[len(s)-1]
+				slots[src.GroupId] = s[:len(s)-1]
+				slots[dest.GroupId] = append(slots[dest.GroupId], id)
+				plan.move(id, src, dest, loads[id])
+				moved = true
+			}
+			if !moved {
+				break
 			}
 		}
 	}
+	plan.finish()
+	return plan
+}
+
+// PlanRebalance makes the plan of rebalance without migrating any slot.
+func PlanRebalance(zkConn zkhelper.Conn, opts *RebalanceOptions) (*RebalancePlan, error) {
+	livingNodes, err := getLivingNodeInfos(zkConn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	weights, err := opts.weights(livingNodes)
+	if err != nil {
+		return nil, err
+	}
+	loads, err := getSlotLoads(livingNodes)
+	if err != nil {
+		return nil, err
+	}
+	switch opts.Strategy {
+	case REBALANCE_BY_SLOTS:
+		return planRebalance(livingNodes, weights, getQuotaMap(livingNodes, weights), loads), nil
+	case REBALANCE_BY_LOAD:
+		if err := sampleSlotQPS(loads, opts.Sample); err != nil {
+			return nil, err
+		}
+		return planLoadRebalance(livingNodes, weights, loads, opts.Tolerance/100), nil
+	default:
+		return nil, errors.Errorf("invalid rebalance strategy = %s", opts.Strategy)
+	}
+}
+
+// SubmitRebalancePlan posts the moves of a plan as a batch. The plan may be
+// edited by hand, so all moves are checked against the current slots before
+// any task is posted.
+func SubmitRebalancePlan(zkConn zkhelper.Conn, moves []*RebalanceMove, delay int) error {
+	if len(globalMigrateManager.Tasks()) > 0 {
+		return errors.New("there are migration tasks running, you should wait them done")
+	}
+	seen := make(map[int]bool)
+	for _, m := range moves {
+		if m.SlotId < 0 || m.SlotId >= models.DEFAULT_SLOT_NUM {
+			return errors.Errorf("invalid slot id = %d", m.SlotId)
+		}
+		if seen[m.SlotId] {
+			return errors.Errorf("slot %d is moved more than once", m.SlotId)
+		}
+		seen[m.SlotId] = true
+		slot, err := models.GetSlot(zkConn, globalEnv.ProductName(), m.SlotId)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if slot.State.Status != models.SLOT_STATUS_ONLINE {
+			return errors.Errorf("slot %d is not online, status = %s", m.SlotId, slot.State.Status)
+		}
+		if slot.GroupId != m.FromGroup {
+			return errors.Errorf("slot %d belongs to group %d, not group %d", m.SlotId, slot.GroupId, m.FromGroup)
+		}
+		if m.ToGroup == m.FromGroup {
+			return errors.Errorf("slot %d is already in group %d", m.SlotId, m.ToGroup)
+		}
+		if ok, err := models.GroupExists(zkConn, globalEnv.ProductName(), m.ToGroup); err != nil {
+			return errors.Trace(err)
+		} else if !ok {
+			return errors.Errorf("group %d does not exist", m.ToGroup)
+		}
+	}
+	for _, m := range moves {
+		info := &MigrateTaskInfo{
+			Delay:      delay,
+			SlotId:     m.SlotId,
+			NewGroupId: m.ToGroup,
+			Status:     MIGRATE_TASK_PENDING,
+			CreateAt:   strconv.FormatInt(time.Now().Unix(), 10),
+		}
+		if err := globalMigrateManager.PostTask(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// experimental simple auto rebalance :)
+func Rebalance(opts *RebalanceOptions) error {
+	plan, err := PlanRebalance(safeZkConn, opts)
+	if err != nil {
+		return err
+	}
+	log.Infof("start rebalance, %d slots to move", len(plan.Moves))
+	if err := SubmitRebalancePlan(safeZkConn, plan.Moves, 0); err != nil {
+		return err
+	}
 	log.Infof("rebalance tasks submit finish")
 	return nil
 }
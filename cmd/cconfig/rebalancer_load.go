@@ -0,0 +1,239 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// dimensions of load balanced by planLoadRebalance
+const (
+	loadBytes = iota
+	loadQPS
+	loadDims
+)
+
+// moves whose results differ less than this are taken as equal, and the one
+// keeps slot ranges contiguous is preferred
+const rebalanceContiguityEpsilon = 0.01
+
+// proxySlotCalls returns the requests of each slot in the debug vars of a proxy.
+func proxySlotCalls(vars map[string]interface{}) map[int]int64 {
+	ret := make(map[int]int64)
+	router, ok := vars["router"].(map[string]interface{})
+	if !ok {
+		return ret
+	}
+	slots, ok := router["slots"].(map[string]interface{})
+	if !ok {
+		return ret
+	}
+	for k, v := range slots {
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		if m, ok := v.(map[string]interface{}); ok {
+			calls, _ := m["calls"].(float64)
+			ret[id] = int64(calls)
+		}
+	}
+	return ret
+}
+
+// sampleSlotQPS sums up the qps of each slot on all proxies during d.
+func sampleSlotQPS(loads map[int]slotLoad, d time.Duration) error {
+	if d <= 0 {
+		return errors.Errorf("invalid sample duration = %s", d)
+	}
+	start := time.Now()
+	before := getAllProxyDebugVars()
+	if before == nil {
+		return errors.New("get proxy debug vars failed")
+	}
+	time.Sleep(d)
+	after := getAllProxyDebugVars()
+	secs := time.Since(start).Seconds()
+
+	for id, vars := range after {
+		if vars == nil || before[id] == nil {
+			continue
+		}
+		last := proxySlotCalls(before[id])
+		for slot, calls := range proxySlotCalls(vars) {
+			if n := calls - last[slot]; n > 0 {
+				if l, ok := loads[slot]; ok {
+					l.qps += int64(float64(n) / secs)
+					loads[slot] = l
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type loadGroup struct {
+	*RebalanceGroup
+	slots  map[int]bool
+	target [loadDims]float64 // share of the total expected by weight
+	load   [loadDims]float64 // share of the total
+}
+
+func (l slotLoad) shares(totals [loadDims]float64) [loadDims]float64 {
+	var s [loadDims]float64
+	if totals[loadBytes] != 0 {
+		s[loadBytes] = float64(l.bytes) / totals[loadBytes]
+	}
+	if totals[loadQPS] != 0 {
+		s[loadQPS] = float64(l.qps) / totals[loadQPS]
+	}
+	return s
+}
+
+// ratio is the max load / target of all dimensions, 1 means balanced.
+func ratio(load, target [loadDims]float64) float64 {
+	var r float64
+	for d := 0; d < loadDims; d++ {
+		if x := load[d] / target[d]; x > r {
+			r = x
+		}
+	}
+	return r
+}
+
+// contiguity scores a move by the slot ranges of both groups: moving a slot
+// at the edge of a range of src does not split it, and moving a slot next to
+// a range of dest extends it.
+func contiguity(id int, src, dest *loadGroup) int {
+	score := 0
+	if !src.slots[id-1] || !src.slots[id+1] {
+		score++
+	}
+	if dest.slots[id-1] || dest.slots[id+1] {
+		score++
+	}
+	return score
+}
+
+// planLoadRebalance balances the memory and the qps of groups in proportion
+// to their weights. It moves slots from the most loaded group greedily, every
+// move takes the slot and the destination which minimize the load of both,
+// so big slots are moved first and the plan has as few moves as possible.
+// It stops when all groups are within tolerance, or no move helps.
+func planLoadRebalance(nodes []*NodeInfo, weights map[int]int64, loads map[int]slotLoad, tolerance float64) *RebalancePlan {
+	plan := newRebalancePlan(REBALANCE_BY_LOAD, nodes, weights, loads)
+
+	var totals [loadDims]float64
+	var totalWeight float64
+	for _, l := range loads {
+		totals[loadBytes] += float64(l.bytes)
+		totals[loadQPS] += float64(l.qps)
+	}
+	for _, node := range nodes {
+		totalWeight += float64(weights[node.GroupId])
+	}
+	if totals[loadBytes] == 0 && totals[loadQPS] == 0 {
+		plan.finish()
+		return plan
+	}
+
+	groups := make([]*loadGroup, len(nodes))
+	for i, node := range nodes {
+		g := &loadGroup{RebalanceGroup: plan.Groups[i], slots: make(map[int]bool)}
+		for d := 0; d < loadDims; d++ {
+			if totals[d] != 0 {
+				g.target[d] = float64(weights[node.GroupId]) / totalWeight
+			} else {
+				// nothing to balance, load / target is always 0
+				g.target[d] = 1
+			}
+		}
+		for _, id := range node.CurSlots {
+			g.slots[id] = true
+			s := loads[id].shares(totals)
+			for d := 0; d < loadDims; d++ {
+				g.load[d] += s[d]
+			}
+		}
+		groups[i] = g
+	}
+
+	moved := make(map[int]bool)
+	for len(plan.Moves) < models.DEFAULT_SLOT_NUM {
+		var src *loadGroup
+		for _, g := range groups {
+			if src == nil || ratio(g.load, g.target) > ratio(src.load, src.target) {
+				src = g
+			}
+		}
+		current := ratio(src.load, src.target)
+		if current <= 1+tolerance {
+			break
+		}
+
+		var best struct {
+			id    int
+			dest  *loadGroup
+			cost  float64
+			score int
+		}
+		best.id = -1
+		for id := 0; id < models.DEFAULT_SLOT_NUM; id++ {
+			if !src.slots[id] || moved[id] {
+				continue
+			}
+			s := loads[id].shares(totals)
+			var srcLoad [loadDims]float64
+			for d := 0; d < loadDims; d++ {
+				srcLoad[d] = src.load[d] - s[d]
+			}
+			for _, dest := range groups {
+				if dest == src {
+					continue
+				}
+				var destLoad [loadDims]float64
+				for d := 0; d < loadDims; d++ {
+					destLoad[d] = dest.load[d] + s[d]
+				}
+				cost := ratio(srcLoad, src.target)
+				if r := ratio(destLoad, dest.target); r > cost {
+					cost = r
+				}
+				if cost >= current {
+					continue
+				}
+				score := contiguity(id, src, dest)
+				switch {
+				case best.id < 0 || cost < best.cost-rebalanceContiguityEpsilon:
+				case cost > best.cost+rebalanceContiguityEpsilon:
+					continue
+				case score < best.score:
+					continue
+				case score == best.score && (cost > best.cost || (cost == best.cost && id > best.id)):
+					continue
+				}
+				best.id, best.dest, best.cost, best.score = id, dest, cost, score
+			}
+		}
+		if best.id < 0 {
+			break
+		}
+
+		s := loads[best.id].shares(totals)
+		for d := 0; d < loadDims; d++ {
+			src.load[d] -= s[d]
+			best.dest.load[d] += s[d]
+		}
+		delete(src.slots, best.id)
+		best.dest.slots[best.id] = true
+		moved[best.id] = true
+		plan.move(best.id, src.RebalanceGroup, best.dest.RebalanceGroup, loads[best.id])
+	}
+	plan.finish()
+	return plan
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestPlanRebalance(t *testing.T) {
+	nodes := []*NodeInfo{
+		{GroupId: 1, CurSlots: []int{0, 1, 2, 3, 4, 5}, MaxMemory: 1000},
+		{GroupId: 2, CurSlots: []int{6, 7}, MaxMemory: 1000},
+		{GroupId: 3, CurSlots: []int{}, MaxMemory: 1000},
+	}
+	quota := map[int]int{1: 3, 2: 3, 3: 2}
+	loads := make(map[int]slotLoad)
+	for i := 0; i < 8; i++ {
+		loads[i] = slotLoad{keys: 10, bytes: 100}
+	}
+	loads[1] = slotLoad{keys: 1, bytes: 10}
+	loads[4] = slotLoad{keys: 2, bytes: 20}
+
+	weights := map[int]int64{1: 1000, 2: 1000, 3: 1000}
+	plan := planRebalance(nodes, weights, quota, loads)
+	assert.Must(len(plan.Moves) == 3)
+
+	// the lightest slots first, then the last one
+	moved := make(map[int]int)
+	for _, m := range plan.Moves {
+		assert.Must(m.FromGroup == 1)
+		moved[m.SlotId] = m.ToGroup
+	}
+	_, ok1 := moved[1]
+	_, ok4 := moved[4]
+	_, ok5 := moved[5]
+	assert.Must(ok1 && ok4 && ok5)
+	assert.Must(plan.Keys == 13 && plan.Bytes == 130)
+
+	for _, g := range plan.Groups {
+		assert.Must(g.SlotsAfter == g.Quota)
+	}
+	g := plan.Groups[0]
+	assert.Must(g.KeysBefore == 43 && g.KeysAfter == 30)
+	assert.Must(g.BytesAfter == 300 && g.UsageAfter == 0.3)
+}
+
+func TestQuotaMap(t *testing.T) {
+	nodes := []*NodeInfo{{GroupId: 1}, {GroupId: 2}, {GroupId: 3}}
+	quota := getQuotaMap(nodes, map[int]int64{1: 1, 2: 1, 3: 2})
+	assert.Must(quota[1] == 256 && quota[2] == 256 && quota[3] == 512)
+	quota = getQuotaMap(nodes, map[int]int64{1: 1, 2: 1, 3: 1})
+	assert.Must(quota[1]+quota[2]+quota[3] == models.DEFAULT_SLOT_NUM)
+	assert.Must(quota[1] == 342 && quota[2] == 341)
+}
+
+func newTestLoadNodes(groups int) ([]*NodeInfo, map[int]int64) {
+	var nodes []*NodeInfo
+	weights := make(map[int]int64)
+	per := models.DEFAULT_SLOT_NUM / groups
+	for i := 0; i < groups; i++ {
+		node := &NodeInfo{GroupId: i + 1, MaxMemory: 1 << 30}
+		for id := i * per; id < (i+1)*per; id++ {
+			node.CurSlots = append(node.CurSlots, id)
+		}
+		nodes = append(nodes, node)
+		weights[node.GroupId] = 1
+	}
+	return nodes, weights
+}
+
+func TestPlanLoadRebalance(t *testing.T) {
+	nodes, weights := newTestLoadNodes(2)
+	loads := make(map[int]slotLoad)
+	for id := 0; id < models.DEFAULT_SLOT_NUM; id++ {
+		loads[id] = slotLoad{keys: 100, bytes: 1000, qps: 10}
+	}
+
+	// balanced already
+	plan := planLoadRebalance(nodes, weights, loads, 0.1)
+	assert.Must(len(plan.Moves) == 0)
+
+	// a few hot slots of group 1 are moved, but not all of them
+	for id := 0; id < 4; id++ {
+		loads[id] = slotLoad{keys: 100, bytes: 1000, qps: 1000}
+	}
+	plan = planLoadRebalance(nodes, weights, loads, 0.1)
+	assert.Must(len(plan.Moves) >= 1 && len(plan.Moves) <= 2)
+	for _, m := range plan.Moves {
+		assert.Must(m.FromGroup == 1 && m.ToGroup == 2 && m.SlotId < 4)
+	}
+	g1, g2 := plan.Groups[0], plan.Groups[1]
+	assert.Must(g1.QPSAfter*100 <= (g1.QPSAfter+g2.QPSAfter)/2*110)
+
+	// big slots first, and the moved slots are contiguous and next to group 2
+	for id := 0; id < models.DEFAULT_SLOT_NUM; id++ {
+		loads[id] = slotLoad{keys: 100, bytes: 1000}
+	}
+	for id := 0; id < 512; id++ {
+		loads[id] = slotLoad{keys: 200, bytes: 2000}
+	}
+	plan = planLoadRebalance(nodes, weights, loads, 0.01)
+	assert.Must(len(plan.Moves) > 0 && len(plan.Moves) < 512)
+	for i, m := range plan.Moves {
+		assert.Must(m.FromGroup == 1 && m.Bytes == 2000)
+		assert.Must(m.SlotId == 511-i)
+	}
+	g1, g2 = plan.Groups[0], plan.Groups[1]
+	total := g1.BytesAfter + g2.BytesAfter
+	assert.Must(g1.BytesAfter*100 <= total/2*101 && g2.BytesAfter*100 <= total/2*101)
+
+	// weights are respected
+	weights[2] = 3
+	for id := 0; id < models.DEFAULT_SLOT_NUM; id++ {
+		loads[id] = slotLoad{keys: 100, bytes: 1000}
+	}
+	plan = planLoadRebalance(nodes, weights, loads, 0.05)
+	g1, g2 = plan.Groups[0], plan.Groups[1]
+	assert.Must(g1.SlotsAfter+g2.SlotsAfter == models.DEFAULT_SLOT_NUM)
+	assert.Must(g1.SlotsAfter <= 256*105/100 && g2.SlotsAfter >= 768*95/100)
+
+	// nothing is known about the load
+	plan = planLoadRebalance(nodes, weights, make(map[int]slotLoad), 0.1)
+	assert.Must(len(plan.Moves) == 0)
+}
+
+func TestProxySlotCalls(t *testing.T) {
+	var vars map[string]interface{}
+	b := []byte(`{"router": {"slots": {"7": {"calls": 100, "migrate_calls": 3}, "8": {"migrate_calls": 1}}}}`)
+	assert.MustNoError(json.Unmarshal(b, &vars))
+	calls := proxySlotCalls(vars)
+	assert.Must(len(calls) == 2 && calls[7] == 100 && calls[8] == 0)
+	assert.Must(len(proxySlotCalls(map[string]interface{}{})) == 0)
+}
+
+func TestSubmitRebalancePlan(t *testing.T) {
+	m := newTestMigrateManager()
+	globalMigrateManager = m
+
+	bad := [][]*RebalanceMove{
+		{{SlotId: models.DEFAULT_SLOT_NUM, FromGroup: 1, ToGroup: 2}},
+		{{SlotId: 0, FromGroup: 2, ToGroup: 1}},
+		{{SlotId: 0, FromGroup: 1, ToGroup: 1}},
+		{{SlotId: 0, FromGroup: 1, ToGroup: 3}},
+		{{SlotId: 0, FromGroup: 1, ToGroup: 2}, {SlotId: 0, FromGroup: 1, ToGroup: 2}},
+		// nothing is posted if any move is invalid
+		{{SlotId: 1, FromGroup: 1, ToGroup: 2}, {SlotId: 2, FromGroup: 2, ToGroup: 1}},
+	}
+	for _, moves := range bad {
+		assert.Must(SubmitRebalancePlan(m.zkConn, moves, 0) != nil)
+		assert.Must(len(m.Tasks()) == 0)
+	}
+
+	moves := []*RebalanceMove{
+		{SlotId: 1, FromGroup: 1, ToGroup: 2},
+		{SlotId: 2, FromGroup: 1, ToGroup: 2},
+	}
+	assert.MustNoError(SubmitRebalancePlan(m.zkConn, moves, 10))
+	tasks := m.Tasks()
+	assert.Must(len(tasks) == 2)
+	for i, info := range tasks {
+		assert.Must(info.SlotId == i+1 && info.NewGroupId == 2 && info.Delay == 10)
+	}
+
+	// only one batch at a time
+	assert.Must(SubmitRebalancePlan(m.zkConn, moves, 0) != nil)
+}
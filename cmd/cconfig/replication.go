@@ -0,0 +1,237 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+const (
+	replicationPollInterval = 5 * time.Second
+
+	// a slave is unhealthy if it's further behind its master than these, the
+	// master pings slaves every 10 seconds by default
+	replicationMaxLag        = 64 * 1024 * 1024
+	replicationMaxLastIOSecs = 60
+)
+
+type SlaveReplication struct {
+	Addr          string   `json:"addr"`
+	Reachable     bool     `json:"reachable"`
+	Master        string   `json:"master,omitempty"`
+	LinkUp        bool     `json:"link_up"`
+	Syncing       bool     `json:"syncing"` // a full resync is in progress
+	Offset        int64    `json:"offset"`
+	Lag           int64    `json:"lag"`             // bytes behind master, -1 if unknown
+	LastIOSeconds int64    `json:"last_io_seconds"` // -1 if unknown
+	Healthy       bool     `json:"healthy"`
+	Problems      []string `json:"problems,omitempty"`
+}
+
+type GroupReplication struct {
+	GroupId      int                 `json:"group_id"`
+	Master       string              `json:"master"`
+	MasterOffset int64               `json:"master_offset"` // -1 if the master is unreachable
+	Slaves       []*SlaveReplication `json:"slaves"`
+	Healthy      bool                `json:"healthy"`
+	UpdatedAt    int64               `json:"updated_at"`
+}
+
+type ReplicationReport struct {
+	Healthy bool                `json:"healthy"`
+	Groups  []*GroupReplication `json:"groups"`
+}
+
+// checkSlaveReplication compares a slave with its group master, masterOffset
+// is -1 if the master is unreachable.
+func checkSlaveReplication(master string, masterOffset int64, addr string, info *utils.ReplicationInfo) *SlaveReplication {
+	s := &SlaveReplication{
+		Addr:          addr,
+		Offset:        -1,
+		Lag:           -1,
+		LastIOSeconds: -1,
+	}
+	problem := func(format string, args ...interface{}) {
+		s.Problems = append(s.Problems, fmt.Sprintf(format, args...))
+	}
+	switch {
+	case info == nil:
+		problem("unreachable")
+	case !info.IsSlave():
+		s.Reachable = true
+		problem("role is %s", info.Role)
+	default:
+		s.Reachable = true
+		s.Master = info.MasterAddr
+		s.LinkUp = info.MasterLinkUp
+		s.Syncing = info.MasterSyncing
+		s.Offset = info.SlaveReplOffset
+		s.LastIOSeconds = info.MasterLastIOSeconds
+		if masterOffset >= 0 && s.LinkUp {
+			if s.Lag = masterOffset - s.Offset; s.Lag < 0 {
+				s.Lag = 0
+			}
+		}
+		if s.Master != master {
+			problem("replicates from %s, not the group master %s", s.Master, master)
+		}
+		if !s.LinkUp {
+			problem("link to master is down")
+		}
+		if s.Syncing {
+			problem("full resync in progress")
+		}
+		if s.Lag > replicationMaxLag {
+			problem("%d bytes behind master", s.Lag)
+		}
+		if s.LastIOSeconds > replicationMaxLastIOSecs {
+			problem("no data from master for %d seconds", s.LastIOSeconds)
+		}
+	}
+	s.Healthy = len(s.Problems) == 0
+	return s
+}
+
+func collectGroupReplication(g *models.ServerGroup, passwd string) *GroupReplication {
+	r := &GroupReplication{
+		GroupId:      g.Id,
+		MasterOffset: -1,
+		Slaves:       []*SlaveReplication{},
+		Healthy:      true,
+		UpdatedAt:    time.Now().Unix(),
+	}
+	var slaves []string
+	for _, s := range g.Servers {
+		switch s.Type {
+		case models.SERVER_TYPE_MASTER:
+			r.Master = s.Addr
+		case models.SERVER_TYPE_SLAVE:
+			slaves = append(slaves, s.Addr)
+		}
+	}
+	sort.Strings(slaves)
+	if r.Master == "" && len(slaves) != 0 {
+		r.Healthy = false
+	}
+	if r.Master != "" {
+		if info, err := utils.GetReplicationInfo(r.Master, passwd); err != nil {
+			log.WarnErrorf(err, "get replication info of master %s failed", r.Master)
+		} else {
+			r.MasterOffset = info.MasterReplOffset
+		}
+	}
+	for _, addr := range slaves {
+		info, err := utils.GetReplicationInfo(addr, passwd)
+		if err != nil {
+			log.WarnErrorf(err, "get replication info of slave %s failed", addr)
+		}
+		s := checkSlaveReplication(r.Master, r.MasterOffset, addr, info)
+		if !s.Healthy {
+			r.Healthy = false
+		}
+		r.Slaves = append(r.Slaves, s)
+	}
+	return r
+}
+
+// ReplicationMonitor polls the replication of all servers in groups.
+type ReplicationMonitor struct {
+	mu          sync.Mutex
+	zkConn      zkhelper.Conn
+	productName string
+	passwd      string
+	groups      []*GroupReplication
+}
+
+func NewReplicationMonitor(zkConn zkhelper.Conn, pn string) *ReplicationMonitor {
+	r := &ReplicationMonitor{
+		zkConn:      zkConn,
+		productName: pn,
+		passwd:      globalEnv.Password(),
+	}
+	go r.loop()
+	return r
+}
+
+func (r *ReplicationMonitor) loop() {
+	for {
+		if err := r.collect(); err != nil {
+			log.ErrorErrorf(err, "collect replication failed")
+		}
+		time.Sleep(replicationPollInterval)
+	}
+}
+
+func (r *ReplicationMonitor) collect() error {
+	groups, err := models.ServerGroups(r.zkConn, r.productName)
+	if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return errors.Trace(err)
+	}
+	var ids []int
+	byId := make(map[int]*models.ServerGroup)
+	for _, g := range groups {
+		ids = append(ids, g.Id)
+		byId[g.Id] = g
+	}
+	sort.Ints(ids)
+
+	res := make([]*GroupReplication, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, g *models.ServerGroup) {
+			defer wg.Done()
+			res[i] = collectGroupReplication(g, r.passwd)
+		}(i, byId[id])
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.groups = res
+	return nil
+}
+
+// Report returns the replication collected last time.
+func (r *ReplicationMonitor) Report() *ReplicationReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := &ReplicationReport{Healthy: true, Groups: []*GroupReplication{}}
+	for _, g := range r.groups {
+		if !g.Healthy {
+			report.Healthy = false
+		}
+		report.Groups = append(report.Groups, g)
+	}
+	return report
+}
+
+func runReplicationStatus() error {
+	var r ReplicationReport
+	if err := callApi(METHOD_GET, "/api/replication", nil, &r); err != nil {
+		return err
+	}
+	fmt.Println(jsonify(r))
+	if !r.Healthy {
+		var ids []int
+		for _, g := range r.Groups {
+			if !g.Healthy {
+				ids = append(ids, g.GroupId)
+			}
+		}
+		return errors.Errorf("replication of groups %v is unhealthy", ids)
+	}
+	return nil
+}
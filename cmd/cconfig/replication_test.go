@@ -0,0 +1,41 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestCheckSlaveReplication(t *testing.T) {
+	info := &utils.ReplicationInfo{
+		Role:                "slave",
+		MasterAddr:          "127.0.0.1:6379",
+		MasterLinkUp:        true,
+		MasterLastIOSeconds: 1,
+		SlaveReplOffset:     90,
+	}
+	s := checkSlaveReplication("127.0.0.1:6379", 100, "127.0.0.1:6380", info)
+	assert.Must(s.Healthy && s.Reachable && s.Lag == 10 && s.LastIOSeconds == 1)
+
+	// unknown lag if master is unreachable
+	s = checkSlaveReplication("127.0.0.1:6379", -1, "127.0.0.1:6380", info)
+	assert.Must(s.Healthy && s.Lag == -1)
+
+	info.SlaveReplOffset = 0
+	s = checkSlaveReplication("127.0.0.1:6379", replicationMaxLag+1, "127.0.0.1:6380", info)
+	assert.Must(!s.Healthy && len(s.Problems) == 1)
+
+	info.MasterAddr, info.MasterLinkUp, info.MasterSyncing = "127.0.0.1:6381", false, true
+	s = checkSlaveReplication("127.0.0.1:6379", 100, "127.0.0.1:6380", info)
+	assert.Must(!s.Healthy && s.Lag == -1 && len(s.Problems) == 3)
+
+	s = checkSlaveReplication("127.0.0.1:6379", 100, "127.0.0.1:6380", &utils.ReplicationInfo{Role: "master"})
+	assert.Must(!s.Healthy && s.Reachable)
+
+	s = checkSlaveReplication("127.0.0.1:6379", 100, "127.0.0.1:6380", nil)
+	assert.Must(!s.Healthy && !s.Reachable && s.Offset == -1)
+}
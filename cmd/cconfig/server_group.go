@@ -10,6 +10,7 @@ import (
 	"github.com/docopt/docopt-go"
 
 	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
 
@@ -18,11 +19,19 @@ import (
 func cmdServer(argv []string) (err error) {
 	usage := `usage:
 	codis-config server list
+	codis-config server replication
 	codis-config server add <group_id> <redis_addr> <role>
 	codis-config server remove <group_id> <redis_addr>
-	codis-config server promote <group_id> <redis_addr>
+	codis-config server promote <group_id> <redis_addr> [--catch-up=<ms>] [--force]
 	codis-config server add-group <group_id>
 	codis-config server remove-group <group_id>
+	codis-config server failover [--audit]
+	codis-config server disable-failover <group_id>
+	codis-config server enable-failover <group_id>
+
+options:
+	--catch-up=<ms>  wait at most <ms> for the slave to catch up with the master [default: 0]
+	--force          promote the slave even if it's behind the master
 `
 	args, err := docopt.Parse(usage, argv, true, "", false)
 	if err != nil {
@@ -34,6 +43,12 @@ func cmdServer(argv []string) (err error) {
 	if args["list"].(bool) {
 		return runListServerGroup()
 	}
+	if args["replication"].(bool) {
+		return runReplicationStatus()
+	}
+	if args["failover"].(bool) {
+		return runFailoverStatus(args["--audit"].(bool))
+	}
 
 	groupId, err := strconv.Atoi(args["<group_id>"].(string))
 	if err != nil {
@@ -47,6 +62,12 @@ func cmdServer(argv []string) (err error) {
 	if args["add-group"].(bool) {
 		return runAddServerGroup(groupId)
 	}
+	if args["disable-failover"].(bool) {
+		return runSetFailover(groupId, "disable")
+	}
+	if args["enable-failover"].(bool) {
+		return runSetFailover(groupId, "enable")
+	}
 
 	serverAddr := args["<redis_addr>"].(string)
 	if args["add"].(bool) {
@@ -57,7 +78,11 @@ func cmdServer(argv []string) (err error) {
 		return runRemoveServerFromGroup(groupId, serverAddr)
 	}
 	if args["promote"].(bool) {
-		return runPromoteServerToMaster(groupId, serverAddr)
+		catchUp, err := strconv.Atoi(args["--catch-up"].(string))
+		if err != nil || catchUp < 0 {
+			return errors.Errorf("invalid catch-up = %s", args["--catch-up"])
+		}
+		return runPromoteServerToMaster(groupId, serverAddr, catchUp, args["--force"].(bool))
 	}
 
 	return nil
@@ -74,13 +99,21 @@ func runAddServerGroup(groupId int) error {
 	return nil
 }
 
-func runPromoteServerToMaster(groupId int, addr string) error {
+func promoteApiPath(groupId int, catchUp int, force bool) string {
+	apiPath := fmt.Sprintf("/api/server_group/%d/promote?catch_up=%d", groupId, catchUp)
+	if force {
+		apiPath += "&force=1"
+	}
+	return apiPath
+}
+
+func runPromoteServerToMaster(groupId int, addr string, catchUp int, force bool) error {
 	s := models.Server{
 		Addr:    addr,
 		GroupId: groupId,
 	}
 	var v interface{}
-	err := callApi(METHOD_POST, fmt.Sprintf("/api/server_group/%d/promote", groupId), s, &v)
+	err := callApi(METHOD_POST, promoteApiPath(groupId, catchUp, force), s, &v)
 	if err != nil {
 		return err
 	}
@@ -128,3 +161,26 @@ func runRemoveServerFromGroup(groupId int, addr string) error {
 	fmt.Println(jsonify(v))
 	return nil
 }
+
+func runFailoverStatus(audit bool) error {
+	var v interface{}
+	apiPath := "/api/failover/status"
+	if audit {
+		apiPath = "/api/failover/audit"
+	}
+	if err := callApi(METHOD_GET, apiPath, nil, &v); err != nil {
+		return err
+	}
+	fmt.Println(jsonify(v))
+	return nil
+}
+
+func runSetFailover(groupId int, op string) error {
+	var v interface{}
+	err := callApi(METHOD_POST, fmt.Sprintf("/api/failover/group/%d/%s", groupId, op), nil, &v)
+	if err != nil {
+		return err
+	}
+	fmt.Println(jsonify(v))
+	return nil
+}
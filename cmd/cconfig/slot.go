@@ -4,11 +4,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"strconv"
 
 	"github.com/docopt/docopt-go"
 
+	"github.com/CodisLabs/codis/pkg/models"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
@@ -19,8 +23,31 @@ func cmdSlot(argv []string) (err error) {
 	codis-config slot info <slot_id>
 	codis-config slot set <slot_id> <group_id> <status>
 	codis-config slot range-set <slot_from> <slot_to> <group_id> <status>
-	codis-config slot migrate <slot_from> <slot_to> <group_id> [--delay=<delay_time_in_ms>]
-	codis-config slot rebalance [--delay=<delay_time_in_ms>]
+	codis-config slot migrate tasks
+	codis-config slot migrate pause [<task_id>]
+	codis-config slot migrate resume [<task_id>]
+	codis-config slot migrate cancel <task_id>
+	codis-config slot migrate priority <task_id> <priority>
+	codis-config slot migrate <slot_from> <slot_to> <group_id> [--delay=<delay_time_in_ms>] [--priority=<n>] [--verify=<mode>]
+	codis-config slot rebalance [--delay=<delay_time_in_ms>] [--dry-run] [--strategy=<name>] [--weights=<weights>] [--tolerance=<percent>] [--sample=<secs>]
+	codis-config slot rebalance --plan=<file> [--delay=<delay_time_in_ms>]
+	codis-config slot dump <slot_id> <file>
+	codis-config slot restore <slot_id> <file> [--replace] [--batch=<n>]
+	codis-config slot verify <slot_id> [--manifest=<file>] [--sample-keys=<n>]
+
+options:
+	--priority=<n>         tasks with higher priority run first
+	--verify=<mode>        verify the keys after migration, sample: compare 1000 keys at random, full: compare all keys
+	--dry-run              print the plan of rebalance without migrating
+	--plan=<file>          submit the moves of a plan, e.g. an edited output of --dry-run
+	--strategy=<name>      slots: divide slots by weights, load: balance memory and qps by weights [default: slots]
+	--weights=<weights>    weights of groups, e.g. 1:2,2:1, maxmemory of groups by default
+	--tolerance=<percent>  load strategy only, max imbalance of groups [default: 10]
+	--sample=<secs>        load strategy only, how long the qps of slots are sampled [default: 3]
+	--replace              overwrite the existing keys when restoring
+	--batch=<n>            max number of pipelined restores [default: 256]
+	--manifest=<file>      a dump of the slot taken before migration, keys on target are compared with it
+	--sample-keys=<n>      compare n keys of the manifest at random, all keys if 0 [default: 0]
 `
 
 	args, err := docopt.Parse(usage, argv, true, "", false)
@@ -33,6 +60,9 @@ func cmdSlot(argv []string) (err error) {
 	// no need to lock here
 	// locked in runmigratetask
 	if args["migrate"].(bool) {
+		if cmd := migrateTaskCommand(args); cmd != "" {
+			return errors.Trace(runMigrateTaskCommand(cmd, args))
+		}
 		delay := 0
 		groupId, err := strconv.Atoi(args["<group_id>"].(string))
 		if args["--delay"] != nil {
@@ -53,7 +83,19 @@ func cmdSlot(argv []string) (err error) {
 			log.ErrorErrorf(err, "parse <slot_to> failed")
 			return errors.Trace(err)
 		}
-		return runSlotMigrate(slotFrom, slotTo, groupId, delay)
+		priority := 0
+		if args["--priority"] != nil {
+			priority, err = strconv.Atoi(args["--priority"].(string))
+			if err != nil {
+				log.ErrorErrorf(err, "parse <priority> failed")
+				return errors.Trace(err)
+			}
+		}
+		verify, _ := args["--verify"].(string)
+		if !validVerifyMode(verify) {
+			return errors.Errorf("invalid verify mode = %s", verify)
+		}
+		return runSlotMigrate(slotFrom, slotTo, groupId, delay, priority, verify)
 	}
 	if args["rebalance"].(bool) {
 		delay := 0
@@ -64,7 +106,19 @@ func cmdSlot(argv []string) (err error) {
 				return errors.Trace(err)
 			}
 		}
-		return runRebalance(delay)
+		if file, ok := args["--plan"].(string); ok {
+			return errors.Trace(runSubmitRebalancePlan(file, delay))
+		}
+		query := url.Values{}
+		for _, opt := range []string{"strategy", "weights", "tolerance", "sample"} {
+			if v, ok := args["--"+opt].(string); ok {
+				query.Set(opt, v)
+			}
+		}
+		if args["--dry-run"].(bool) {
+			return errors.Trace(runRebalancePlan(query))
+		}
+		return runRebalance(query)
 	}
 
 	if args["init"].(bool) {
@@ -81,6 +135,30 @@ func cmdSlot(argv []string) (err error) {
 		return runSlotInfo(slotId)
 	}
 
+	if args["dump"].(bool) || args["restore"].(bool) || args["verify"].(bool) {
+		slotId, err := strconv.Atoi(args["<slot_id>"].(string))
+		if err != nil || slotId < 0 || slotId >= models.DEFAULT_SLOT_NUM {
+			return errors.Errorf("invalid slot id = %s", args["<slot_id>"])
+		}
+		if args["verify"].(bool) {
+			sample, err := strconv.Atoi(args["--sample-keys"].(string))
+			if err != nil || sample < 0 {
+				return errors.Errorf("invalid sample keys = %s", args["--sample-keys"])
+			}
+			manifest, _ := args["--manifest"].(string)
+			return errors.Trace(runSlotVerify(slotId, manifest, sample))
+		}
+		file := args["<file>"].(string)
+		if args["dump"].(bool) {
+			return errors.Trace(runSlotDump(slotId, file))
+		}
+		batch, err := strconv.Atoi(args["--batch"].(string))
+		if err != nil || batch <= 0 {
+			return errors.Errorf("invalid batch = %s", args["--batch"])
+		}
+		return errors.Trace(runSlotRestore(slotId, file, args["--replace"].(bool), batch))
+	}
+
 	groupId, err := strconv.Atoi(args["<group_id>"].(string))
 	if err != nil {
 		log.ErrorErrorf(err, "parse <group_id> failed")
@@ -159,12 +237,14 @@ func runSlotSet(slotId int, groupId int, status string) error {
 	return runSlotRangeSet(slotId, slotId, groupId, status)
 }
 
-func runSlotMigrate(fromSlotId, toSlotId int, newGroupId int, delay int) error {
+func runSlotMigrate(fromSlotId, toSlotId int, newGroupId int, delay int, priority int, verify string) error {
 	migrateInfo := &migrateTaskForm{
-		From:  fromSlotId,
-		To:    toSlotId,
-		Group: newGroupId,
-		Delay: delay,
+		From:     fromSlotId,
+		To:       toSlotId,
+		Group:    newGroupId,
+		Delay:    delay,
+		Priority: priority,
+		Verify:   verify,
 	}
 	var v interface{}
 	err := callApi(METHOD_POST, "/api/migrate", migrateInfo, &v)
@@ -175,12 +255,80 @@ func runSlotMigrate(fromSlotId, toSlotId int, newGroupId int, delay int) error {
 	return nil
 }
 
-func runRebalance(delay int) error {
+func migrateTaskCommand(args map[string]interface{}) string {
+	for _, cmd := range []string{"tasks", "pause", "resume", "cancel", "priority"} {
+		if args[cmd].(bool) {
+			return cmd
+		}
+	}
+	return ""
+}
+
+func runMigrateTaskCommand(cmd string, args map[string]interface{}) error {
 	var v interface{}
-	err := callApi(METHOD_POST, "/api/rebalance", nil, &v)
+	var err error
+	id, _ := args["<task_id>"].(string)
+	switch cmd {
+	case "tasks":
+		err = callApi(METHOD_GET, "/api/migrate/tasks", nil, &v)
+	case "pause", "resume":
+		if id == "" {
+			err = callApi(METHOD_POST, "/api/migrate/"+cmd, nil, &v)
+		} else {
+			err = callApi(METHOD_POST, fmt.Sprintf("/api/migrate/task/%s/%s", id, cmd), nil, &v)
+		}
+	case "cancel":
+		err = callApi(METHOD_DELETE, "/api/migrate/task/"+id, nil, &v)
+	case "priority":
+		priority, perr := strconv.Atoi(args["<priority>"].(string))
+		if perr != nil {
+			log.ErrorErrorf(perr, "parse <priority> failed")
+			return errors.Trace(perr)
+		}
+		form := &migratePriorityForm{Priority: priority}
+		err = callApi(METHOD_POST, fmt.Sprintf("/api/migrate/task/%s/priority", id), form, &v)
+	}
 	if err != nil {
 		return err
 	}
 	fmt.Println(jsonify(v))
 	return nil
 }
+
+func runRebalance(query url.Values) error {
+	var v interface{}
+	err := callApi(METHOD_POST, "/api/rebalance?"+query.Encode(), nil, &v)
+	if err != nil {
+		return err
+	}
+	fmt.Println(jsonify(v))
+	return nil
+}
+
+func runRebalancePlan(query url.Values) error {
+	var v interface{}
+	err := callApi(METHOD_GET, "/api/rebalance/plan?"+query.Encode(), nil, &v)
+	if err != nil {
+		return err
+	}
+	fmt.Println(jsonify(v))
+	return nil
+}
+
+func runSubmitRebalancePlan(file string, delay int) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	form := &rebalancePlanForm{}
+	if err := json.Unmarshal(b, form); err != nil {
+		return errors.Errorf("parse plan %s failed: %s", file, err)
+	}
+	form.Delay = delay
+	var v interface{}
+	if err := callApi(METHOD_POST, "/api/rebalance/plan", form, &v); err != nil {
+		return err
+	}
+	fmt.Println(jsonify(v))
+	return nil
+}
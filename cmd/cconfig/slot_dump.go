@@ -0,0 +1,407 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// A slot dump file is a sequence of resp arrays:
+//
+//	header  ["CODIS-SLOT-DUMP", version, slot, unixtime]
+//	entries [key, expireat in ms or 0, payload of DUMP]
+//	trailer ["EOF", number of entries]
+const (
+	slotDumpMagic   = "CODIS-SLOT-DUMP"
+	slotDumpVersion = 1
+	slotDumpEOF     = "EOF"
+
+	slotDumpScanCount = 1000
+)
+
+var ErrBadSlotDump = errors.New("bad slot dump file")
+
+func nowInMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+type slotDumpWriter struct {
+	f    *os.File
+	enc  *redis.Encoder
+	file string
+	keys int64
+}
+
+func newSlotDumpWriter(file string, slot int) (*slotDumpWriter, error) {
+	f, err := os.Create(file + ".tmp")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	w := &slotDumpWriter{f: f, enc: redis.NewEncoderSize(f, 1024*64), file: file}
+	header := redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes([]byte(slotDumpMagic)),
+		redis.NewInt([]byte(strconv.Itoa(slotDumpVersion))),
+		redis.NewInt([]byte(strconv.Itoa(slot))),
+		redis.NewInt([]byte(strconv.FormatInt(time.Now().Unix(), 10))),
+	})
+	if err := w.enc.Encode(header, false); err != nil {
+		w.abort()
+		return nil, errors.Trace(err)
+	}
+	return w, nil
+}
+
+func (w *slotDumpWriter) write(key []byte, expireAt int64, payload []byte) error {
+	w.keys++
+	return w.enc.Encode(redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes(key),
+		redis.NewInt([]byte(strconv.FormatInt(expireAt, 10))),
+		redis.NewBulkBytes(payload),
+	}), false)
+}
+
+// commit writes the trailer and renames the file, so an interrupted dump
+// never replaces a complete one.
+func (w *slotDumpWriter) commit() error {
+	trailer := redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes([]byte(slotDumpEOF)),
+		redis.NewInt([]byte(strconv.FormatInt(w.keys, 10))),
+	})
+	if err := w.enc.Encode(trailer, true); err != nil {
+		w.abort()
+		return errors.Trace(err)
+	}
+	if err := w.f.Sync(); err != nil {
+		w.abort()
+		return errors.Trace(err)
+	}
+	w.f.Close()
+	return errors.Trace(os.Rename(w.file+".tmp", w.file))
+}
+
+func (w *slotDumpWriter) abort() {
+	w.f.Close()
+	os.Remove(w.file + ".tmp")
+}
+
+// scanKeys calls fn with the keys of each SCAN, codis-server has no command
+// to scan the keys of a slot.
+func scanKeys(c redigo.Conn, fn func(keys [][]byte) error) error {
+	return scanKeysFrom(c, "0", func(cursor string, keys [][]byte) error {
+		return fn(keys)
+	})
+}
+
+// scanKeysFrom starts SCAN at cursor, fn is called with the cursor to continue
+// after the keys, "0" means all keys are scanned.
+func scanKeysFrom(c redigo.Conn, cursor string, fn func(cursor string, keys [][]byte) error) error {
+	for {
+		reply, err := redigo.Values(c.Do("SCAN", cursor, "COUNT", slotDumpScanCount))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(reply) != 2 {
+			return errors.New("invalid reply of scan")
+		}
+		if cursor, err = redigo.String(reply[0], nil); err != nil {
+			return errors.Trace(err)
+		}
+		keys, err := redigo.ByteSlices(reply[1], nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := fn(cursor, keys); err != nil {
+			return err
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// dumpSlots scans the keys on addr once and writes the keys of each slot
+// in files to the file of the slot, it returns the number of keys dumped.
+func dumpSlots(addr, passwd string, files map[int]string) (map[int]int64, error) {
+	c, err := utils.DialToTimeout(addr, passwd, time.Minute, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	writers := make(map[int]*slotDumpWriter)
+	defer func() {
+		for _, w := range writers {
+			w.abort()
+		}
+	}()
+	for slot, file := range files {
+		w, err := newSlotDumpWriter(file, slot)
+		if err != nil {
+			return nil, err
+		}
+		writers[slot] = w
+	}
+
+	err = scanKeys(c, func(keys [][]byte) error {
+		var matched [][]byte
+		for _, key := range keys {
+			if writers[router.HashSlot(key)] != nil {
+				matched = append(matched, key)
+			}
+		}
+		for _, key := range matched {
+			c.Send("PTTL", key)
+			c.Send("DUMP", key)
+		}
+		if err := c.Flush(); err != nil {
+			return errors.Trace(err)
+		}
+		now := nowInMs()
+		for _, key := range matched {
+			ttl, err := redigo.Int64(c.Receive())
+			if err != nil {
+				return errors.Trace(err)
+			}
+			payload, err := redigo.Bytes(c.Receive())
+			if err == redigo.ErrNil || ttl == -2 {
+				// deleted or expired during the scan
+				continue
+			} else if err != nil {
+				return errors.Trace(err)
+			}
+			var expireAt int64
+			if ttl >= 0 {
+				expireAt = now + ttl
+			}
+			if err := writers[router.HashSlot(key)].write(key, expireAt, payload); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[int]int64)
+	for slot, w := range writers {
+		delete(writers, slot)
+		if err := w.commit(); err != nil {
+			return nil, err
+		}
+		counts[slot] = w.keys
+	}
+	return counts, nil
+}
+
+type slotDumpReader struct {
+	dec  *redis.Decoder
+	slot int
+	time int64
+	keys int64
+}
+
+func respInt(r *redis.Resp) (int64, error) {
+	if r == nil || !r.IsInt() {
+		return 0, errors.Trace(ErrBadSlotDump)
+	}
+	n, err := strconv.ParseInt(string(r.Value), 10, 64)
+	if err != nil {
+		return 0, errors.Trace(ErrBadSlotDump)
+	}
+	return n, nil
+}
+
+func newSlotDumpReader(r io.Reader) (*slotDumpReader, error) {
+	d := &slotDumpReader{dec: redis.NewDecoderSize(r, 1024*64)}
+	header, err := d.dec.Decode()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !header.IsArray() || len(header.Array) != 4 || string(header.Array[0].Value) != slotDumpMagic {
+		return nil, errors.Trace(ErrBadSlotDump)
+	}
+	version, err := respInt(header.Array[1])
+	if err != nil {
+		return nil, err
+	}
+	if version != slotDumpVersion {
+		return nil, errors.Errorf("unsupported slot dump version = %d", version)
+	}
+	slot, err := respInt(header.Array[2])
+	if err != nil {
+		return nil, err
+	}
+	if d.time, err = respInt(header.Array[3]); err != nil {
+		return nil, err
+	}
+	d.slot = int(slot)
+	return d, nil
+}
+
+// next returns io.EOF after the trailer, a file without trailer is
+// treated as truncated.
+func (d *slotDumpReader) next() (key []byte, expireAt int64, payload []byte, err error) {
+	r, err := d.dec.Decode()
+	if err != nil {
+		if errors.Equal(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, nil, errors.Trace(err)
+	}
+	if !r.IsArray() {
+		return nil, 0, nil, errors.Trace(ErrBadSlotDump)
+	}
+	if len(r.Array) == 2 && string(r.Array[0].Value) == slotDumpEOF {
+		n, err := respInt(r.Array[1])
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if n != d.keys {
+			return nil, 0, nil, errors.Errorf("slot dump has %d keys, but trailer says %d", d.keys, n)
+		}
+		return nil, 0, nil, io.EOF
+	}
+	if len(r.Array) != 3 || !r.Array[0].IsBulkBytes() || !r.Array[2].IsBulkBytes() {
+		return nil, 0, nil, errors.Trace(ErrBadSlotDump)
+	}
+	if expireAt, err = respInt(r.Array[1]); err != nil {
+		return nil, 0, nil, err
+	}
+	d.keys++
+	return r.Array[0].Value, expireAt, r.Array[2].Value, nil
+}
+
+type slotRestoreStats struct {
+	Keys    int64 `json:"keys"`
+	Expired int64 `json:"expired"`
+	Exists  int64 `json:"exists"`
+	Errors  int64 `json:"errors"`
+}
+
+// restoreSlot restores keys from the dump file to addr. Existing keys are
+// kept unless replace is set, SLOTSRESTORE is used to overwrite them.
+func restoreSlot(addr, passwd string, slot int, file string, replace bool, batch int) (*slotRestoreStats, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	d, err := newSlotDumpReader(f)
+	if err != nil {
+		return nil, err
+	}
+	if d.slot != slot {
+		return nil, errors.Errorf("%s is a dump of slot %d, not slot %d", file, d.slot, slot)
+	}
+
+	c, err := utils.DialToTimeout(addr, passwd, time.Minute, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	stats := &slotRestoreStats{}
+	var pending int
+	flush := func() error {
+		if err := c.Flush(); err != nil {
+			return errors.Trace(err)
+		}
+		for ; pending != 0; pending-- {
+			_, err := c.Receive()
+			if err == nil {
+				stats.Keys++
+				continue
+			}
+			if _, ok := err.(redigo.Error); !ok {
+				return errors.Trace(err)
+			}
+			if strings.Contains(err.Error(), "is busy") {
+				stats.Exists++
+			} else {
+				log.WarnErrorf(err, "restore to %s failed", addr)
+				stats.Errors++
+			}
+		}
+		return nil
+	}
+
+	for {
+		key, expireAt, payload, err := d.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if router.HashSlot(key) != slot {
+			return nil, errors.Errorf("key %q does not belong to slot %d", key, slot)
+		}
+		var ttl int64
+		if expireAt != 0 {
+			if ttl = expireAt - nowInMs(); ttl <= 0 {
+				stats.Expired++
+				continue
+			}
+		}
+		cmd := "RESTORE"
+		if replace {
+			cmd = "SLOTSRESTORE"
+		}
+		if err := c.Send(cmd, key, ttl, payload); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if pending++; pending >= batch {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func runSlotDump(slotId int, file string) error {
+	masters, err := loadSlotMasters()
+	if err != nil {
+		return err
+	}
+	counts, err := dumpSlots(masters[slotId], globalEnv.Password(), map[int]string{slotId: file})
+	if err != nil {
+		return err
+	}
+	fmt.Println(jsonify(map[string]interface{}{
+		"slot": slotId,
+		"file": file,
+		"keys": counts[slotId],
+	}))
+	return nil
+}
+
+func runSlotRestore(slotId int, file string, replace bool, batch int) error {
+	masters, err := loadSlotMasters()
+	if err != nil {
+		return err
+	}
+	stats, err := restoreSlot(masters[slotId], globalEnv.Password(), slotId, file, replace, batch)
+	if err != nil {
+		return err
+	}
+	fmt.Println(jsonify(stats))
+	return nil
+}
@@ -0,0 +1,385 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// verify modes of migrate tasks
+const (
+	MIGRATE_VERIFY_NONE   = ""
+	MIGRATE_VERIFY_SAMPLE = "sample"
+	MIGRATE_VERIFY_FULL   = "full"
+)
+
+const (
+	verifySampleSize = 1000
+	verifyBatch      = 256
+	verifyMaxBadKeys = 10
+
+	// zk refuses nodes larger than 1MB
+	manifestChunkSize = 512 * 1024
+)
+
+func validVerifyMode(mode string) bool {
+	switch mode {
+	case MIGRATE_VERIFY_NONE, MIGRATE_VERIFY_SAMPLE, MIGRATE_VERIFY_FULL:
+		return true
+	}
+	return false
+}
+
+type slotManifestEntry struct {
+	digest   [sha1.Size]byte
+	expireAt int64 // in ms, 0 means no ttl
+}
+
+// slotManifest is the digests of keys in a slot, taken before the slot is
+// migrated. The digest is the sha1 of DUMP, which doesn't include the ttl.
+type slotManifest map[string]slotManifestEntry
+
+// keySampler keeps n keys at random, or all keys if n <= 0.
+type keySampler struct {
+	n    int
+	seen int64
+	keys []string
+}
+
+func (s *keySampler) add(key string) {
+	s.seen++
+	if s.n <= 0 || len(s.keys) < s.n {
+		s.keys = append(s.keys, key)
+	} else if i := rand.Int63n(s.seen); i < int64(s.n) {
+		s.keys[i] = key
+	}
+}
+
+// digestKeys calls fn with the digest of each key on c, fn is not called for
+// keys that don't exist.
+func digestKeys(c redigo.Conn, keys []string, fn func(key string, e slotManifestEntry)) error {
+	for len(keys) != 0 {
+		batch := keys
+		if len(batch) > verifyBatch {
+			batch = batch[:verifyBatch]
+		}
+		keys = keys[len(batch):]
+		for _, key := range batch {
+			c.Send("PTTL", key)
+			c.Send("DUMP", key)
+		}
+		if err := c.Flush(); err != nil {
+			return errors.Trace(err)
+		}
+		now := nowInMs()
+		for _, key := range batch {
+			ttl, err := redigo.Int64(c.Receive())
+			if err != nil {
+				return errors.Trace(err)
+			}
+			payload, err := redigo.Bytes(c.Receive())
+			if err == redigo.ErrNil || ttl == -2 {
+				continue
+			} else if err != nil {
+				return errors.Trace(err)
+			}
+			e := slotManifestEntry{digest: sha1.Sum(payload)}
+			if ttl >= 0 {
+				e.expireAt = now + ttl
+			}
+			fn(key, e)
+		}
+	}
+	return nil
+}
+
+// buildSlotManifest takes the digests of the keys of slot on addr, sample
+// keys are taken at random if sample > 0.
+func buildSlotManifest(addr, passwd string, slot int, sample int) (slotManifest, error) {
+	c, err := utils.DialToTimeout(addr, passwd, time.Minute, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	s := &keySampler{n: sample}
+	err = scanKeys(c, func(keys [][]byte) error {
+		for _, key := range keys {
+			if router.HashSlot(key) == slot {
+				s.add(string(key))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m := make(slotManifest)
+	if err := digestKeys(c, s.keys, func(key string, e slotManifestEntry) {
+		m[key] = e
+	}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// loadSlotManifest takes the digests of the keys in a slot dump file.
+func loadSlotManifest(file string, slot int, sample int) (slotManifest, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	d, err := newSlotDumpReader(f)
+	if err != nil {
+		return nil, err
+	}
+	if d.slot != slot {
+		return nil, errors.Errorf("%s is a dump of slot %d, not slot %d", file, d.slot, slot)
+	}
+	all := make(slotManifest)
+	s := &keySampler{n: sample}
+	for {
+		key, expireAt, payload, err := d.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		all[string(key)] = slotManifestEntry{digest: sha1.Sum(payload), expireAt: expireAt}
+		s.add(string(key))
+	}
+	m := make(slotManifest)
+	for _, key := range s.keys {
+		m[key] = all[key]
+	}
+	return m, nil
+}
+
+func getMigrateManifestsPath(product string) string {
+	return fmt.Sprintf("/zk/codis/db_%s/migrate_manifests", product)
+}
+
+type slotManifestRecord struct {
+	Key      []byte `json:"key"`
+	Digest   []byte `json:"digest"`
+	ExpireAt int64  `json:"expire_at,omitempty"`
+}
+
+// saveSlotManifest stores the manifest of a migrate task in chunks, the number
+// of chunks is set on the parent node after all of them are stored.
+func saveSlotManifest(zkConn zkhelper.Conn, product, id string, m slotManifest) error {
+	if err := removeSlotManifest(zkConn, product, id); err != nil {
+		return err
+	}
+	p := getMigrateManifestsPath(product) + "/" + id
+	if _, err := zkhelper.CreateRecursive(zkConn, p, "", 0, zkhelper.DefaultDirACLs()); err != nil {
+		return errors.Trace(err)
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var chunk []slotManifestRecord
+	n, size := 0, 0
+	flush := func() error {
+		b, err := json.Marshal(chunk)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := zkConn.Create(fmt.Sprintf("%s/%d", p, n), b, 0, zkhelper.DefaultFileACLs()); err != nil {
+			return errors.Trace(err)
+		}
+		n, size, chunk = n+1, 0, chunk[:0]
+		return nil
+	}
+	for _, key := range keys {
+		e := m[key]
+		chunk = append(chunk, slotManifestRecord{Key: []byte(key), Digest: e.digest[:], ExpireAt: e.expireAt})
+		// keys and digests are encoded in base64
+		if size += len(key)*4/3 + 64; size >= manifestChunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(chunk) != 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	_, err := zkConn.Set(p, []byte(strconv.Itoa(n)), -1)
+	return errors.Trace(err)
+}
+
+// loadSavedManifest returns nil if the manifest of the task is not saved, or
+// not saved completely.
+func loadSavedManifest(zkConn zkhelper.Conn, product, id string) (slotManifest, error) {
+	p := getMigrateManifestsPath(product) + "/" + id
+	data, _, err := zkConn.Get(p)
+	if err != nil {
+		if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	n, err := strconv.Atoi(string(data))
+	if err != nil {
+		return nil, nil
+	}
+	m := make(slotManifest)
+	for i := 0; i < n; i++ {
+		b, _, err := zkConn.Get(fmt.Sprintf("%s/%d", p, i))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		var chunk []slotManifestRecord
+		if err := json.Unmarshal(b, &chunk); err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, r := range chunk {
+			e := slotManifestEntry{expireAt: r.ExpireAt}
+			if copy(e.digest[:], r.Digest) != sha1.Size {
+				return nil, errors.Errorf("bad digest of key %q in manifest of task %s", r.Key, id)
+			}
+			m[string(r.Key)] = e
+		}
+	}
+	return m, nil
+}
+
+func removeSlotManifest(zkConn zkhelper.Conn, product, id string) error {
+	err := zkhelper.DeleteRecursive(zkConn, getMigrateManifestsPath(product)+"/"+id, -1)
+	if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+type SlotVerifyResult struct {
+	SourceKeys int64    `json:"source_keys"` // keys of the slot left on sources
+	TargetKeys int64    `json:"target_keys"`
+	Checked    int64    `json:"checked"`
+	Missing    int64    `json:"missing"`
+	Mismatched int64    `json:"mismatched"`
+	Expired    int64    `json:"expired"`
+	BadKeys    []string `json:"bad_keys,omitempty"` // the first few missing or mismatched keys
+	Passed     bool     `json:"passed"`
+}
+
+func (r *SlotVerifyResult) badKey(kind, key string) {
+	if len(r.BadKeys) < verifyMaxBadKeys {
+		r.BadKeys = append(r.BadKeys, fmt.Sprintf("%s: %q", kind, key))
+	}
+}
+
+// verifySlot makes sure that no keys of slot are left on sources, and compares
+// the keys on target with the manifest. Keys written or deleted since the
+// manifest are reported as mismatched or missing, keys expired are ignored.
+func verifySlot(slot int, target string, sources []string, manifest slotManifest) (*SlotVerifyResult, error) {
+	r := &SlotVerifyResult{}
+	for _, addr := range sources {
+		infos, err := utils.SlotsInfo(addr, globalEnv.Password(), slot, slot)
+		if err != nil {
+			return nil, err
+		}
+		r.SourceKeys += int64(infos[slot])
+	}
+	infos, err := utils.SlotsInfo(target, globalEnv.Password(), slot, slot)
+	if err != nil {
+		return nil, err
+	}
+	r.TargetKeys = int64(infos[slot])
+
+	if len(manifest) != 0 {
+		c, err := utils.DialToTimeout(target, globalEnv.Password(), time.Minute, time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+
+		keys := make([]string, 0, len(manifest))
+		for key := range manifest {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		found := make(map[string]bool)
+		err = digestKeys(c, keys, func(key string, e slotManifestEntry) {
+			found[key] = true
+			if e.digest != manifest[key].digest {
+				r.Mismatched++
+				r.badKey("mismatched", key)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		now := nowInMs()
+		for _, key := range keys {
+			r.Checked++
+			if found[key] {
+				continue
+			}
+			if e := manifest[key]; e.expireAt != 0 && e.expireAt <= now {
+				r.Expired++
+			} else {
+				r.Missing++
+				r.badKey("missing", key)
+			}
+		}
+	}
+	r.Passed = r.SourceKeys == 0 && r.Missing == 0 && r.Mismatched == 0
+	return r, nil
+}
+
+// runSlotVerify checks that the slot has no keys on other masters, and compares
+// its keys with a dump taken before the migration if manifest is given.
+func runSlotVerify(slotId int, manifestFile string, sample int) error {
+	masters, err := loadSlotMasters()
+	if err != nil {
+		return err
+	}
+	target := masters[slotId]
+	var sources []string
+	seen := map[string]bool{target: true}
+	for _, addr := range masters {
+		if !seen[addr] {
+			seen[addr] = true
+			sources = append(sources, addr)
+		}
+	}
+	var manifest slotManifest
+	if manifestFile != "" {
+		if manifest, err = loadSlotManifest(manifestFile, slotId, sample); err != nil {
+			return err
+		}
+	}
+	r, err := verifySlot(slotId, target, sources, manifest)
+	if err != nil {
+		return err
+	}
+	fmt.Println(jsonify(r))
+	if !r.Passed {
+		return errors.Errorf("verify slot %d failed", slotId)
+	}
+	return nil
+}
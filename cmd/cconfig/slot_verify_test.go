@@ -0,0 +1,120 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
+)
+
+func TestKeySampler(t *testing.T) {
+	s := &keySampler{n: 10}
+	for i := 0; i < 1000; i++ {
+		s.add(fmt.Sprint(i))
+	}
+	assert.Must(s.seen == 1000 && len(s.keys) == 10)
+	seen := make(map[string]bool)
+	for _, key := range s.keys {
+		assert.Must(!seen[key])
+		seen[key] = true
+	}
+
+	s = &keySampler{}
+	for i := 0; i < 1000; i++ {
+		s.add(fmt.Sprint(i))
+	}
+	assert.Must(len(s.keys) == 1000)
+}
+
+func TestLoadSlotManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codis-verify")
+	assert.MustNoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "slot.dump")
+	w, err := newSlotDumpWriter(file, 7)
+	assert.MustNoError(err)
+	for i := 0; i < 100; i++ {
+		assert.MustNoError(w.write([]byte(fmt.Sprint("key", i)), int64(i), []byte(fmt.Sprint("payload", i))))
+	}
+	assert.MustNoError(w.commit())
+
+	m, err := loadSlotManifest(file, 7, 0)
+	assert.MustNoError(err)
+	assert.Must(len(m) == 100)
+	e := m["key42"]
+	assert.Must(e.expireAt == 42 && e.digest == sha1.Sum([]byte("payload42")))
+
+	m, err = loadSlotManifest(file, 7, 10)
+	assert.MustNoError(err)
+	assert.Must(len(m) == 10)
+
+	_, err = loadSlotManifest(file, 8, 0)
+	assert.Must(err != nil)
+}
+
+func TestSaveSlotManifest(t *testing.T) {
+	conn := memzk.NewConn()
+	defer conn.Close()
+
+	m, err := loadSavedManifest(conn, testProductName, "0000000001")
+	assert.MustNoError(err)
+	assert.Must(m == nil)
+
+	// large enough to be saved in chunks, keys may be binary
+	m = make(slotManifest)
+	for i := 0; i < 20000; i++ {
+		m[fmt.Sprint("key\xff", i)] = slotManifestEntry{digest: sha1.Sum([]byte(fmt.Sprint(i))), expireAt: int64(i)}
+	}
+	assert.MustNoError(saveSlotManifest(conn, testProductName, "0000000001", m))
+	p := getMigrateManifestsPath(testProductName) + "/0000000001"
+	chunks, _, err := conn.Children(p)
+	assert.MustNoError(err)
+	assert.Must(len(chunks) > 1)
+
+	saved, err := loadSavedManifest(conn, testProductName, "0000000001")
+	assert.MustNoError(err)
+	assert.Must(len(saved) == len(m))
+	for key, e := range m {
+		assert.Must(saved[key] == e)
+	}
+
+	// an empty manifest is still a manifest
+	assert.MustNoError(saveSlotManifest(conn, testProductName, "0000000002", slotManifest{}))
+	saved, err = loadSavedManifest(conn, testProductName, "0000000002")
+	assert.MustNoError(err)
+	assert.Must(saved != nil && len(saved) == 0)
+
+	// a manifest is not loaded until all chunks are saved
+	_, err = conn.Set(p, nil, -1)
+	assert.MustNoError(err)
+	saved, err = loadSavedManifest(conn, testProductName, "0000000001")
+	assert.MustNoError(err)
+	assert.Must(saved == nil)
+
+	assert.MustNoError(removeSlotManifest(conn, testProductName, "0000000001"))
+	assert.MustNoError(removeSlotManifest(conn, testProductName, "0000000001"))
+	ok, _, err := conn.Exists(p)
+	assert.MustNoError(err)
+	assert.Must(!ok)
+}
+
+func TestCheckMigrateVerification(t *testing.T) {
+	r := &SlotVerifyResult{TargetKeys: 10, Checked: 10, Passed: true}
+	assert.MustNoError(checkMigrateVerification(1, r))
+
+	// keys written by clients during the migration
+	r = &SlotVerifyResult{TargetKeys: 10, Checked: 10, Missing: 1, Mismatched: 2}
+	assert.MustNoError(checkMigrateVerification(1, r))
+
+	r = &SlotVerifyResult{SourceKeys: 1, TargetKeys: 10, Checked: 10}
+	assert.Must(checkMigrateVerification(1, r) != nil)
+}
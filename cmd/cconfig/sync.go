@@ -0,0 +1,419 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/rdb"
+	"github.com/CodisLabs/codis/pkg/utils/replica"
+)
+
+func cmdSync(argv []string) (err error) {
+	usage := `usage:
+	codis-config sync <source_addr> [--auth=<passwd>] [--db=<db>] [--batch=<n>]
+
+Replicate a standalone redis into codis: load the snapshot of the source and
+then apply the replicated commands until a cutover is requested by
+http://<host>:10086/sync/cutover[?pause=<ms>], the progress and the lag are
+shown by http://<host>:10086/sync/status. Commands writing to keys of different
+slots can't be applied to codis, they are ignored and counted in the status,
+so are error replies from codis.
+
+options:
+	--auth=<passwd>  password of the source redis
+	--db=<db>        replicate keys of this db only [default: 0]
+	--batch=<n>      max number of pipelined commands for each group [default: 256]
+`
+	args, err := docopt.Parse(usage, argv, true, "", false)
+	if err != nil {
+		log.ErrorErrorf(err, "parse args failed")
+		return errors.Trace(err)
+	}
+	log.Debugf("parse args = {%+v}", args)
+
+	db, err := strconv.Atoi(args["--db"].(string))
+	if err != nil || db < 0 {
+		return errors.Errorf("invalid db = %s", args["--db"])
+	}
+	batch, err := strconv.Atoi(args["--batch"].(string))
+	if err != nil || batch <= 0 {
+		return errors.Errorf("invalid batch = %s", args["--batch"])
+	}
+	var auth string
+	if s, ok := args["--auth"].(string); ok {
+		auth = s
+	}
+	return errors.Trace(runSync(args["<source_addr>"].(string), auth, db, batch))
+}
+
+type syncer struct {
+	*rdbImporter
+
+	source string
+	auth   string
+	db     int
+	curdb  int
+
+	replica *replica.Replica
+
+	stage    atomic2.Int64
+	applied  atomic2.Int64 // replication offset written to codis
+	master   atomic2.Int64 // replication offset of source
+	commands atomic2.Int64
+	ignored  atomic2.Int64
+	cutover  atomic2.Bool
+	done     chan struct{}
+}
+
+const (
+	syncStageSnapshot = iota
+	syncStageStream
+	syncStageCutover
+)
+
+func (s *syncer) status() map[string]interface{} {
+	stage := "snapshot"
+	switch s.stage.Get() {
+	case syncStageStream:
+		stage = "stream"
+	case syncStageCutover:
+		stage = "cutover"
+	}
+	lag := s.master.Get() - s.applied.Get()
+	if lag < 0 || s.stage.Get() == syncStageSnapshot {
+		lag = 0
+	}
+	return map[string]interface{}{
+		"source":         s.source,
+		"stage":          stage,
+		"master_offset":  s.master.Get(),
+		"applied_offset": s.applied.Get(),
+		"lag":            lag,
+		"commands":       s.commands.Get(),
+		"ignored":        s.ignored.Get(),
+		"errors":         s.errors.Get(),
+	}
+}
+
+// multiKeys returns the keys of op if it's a command writing to multiple keys,
+// keys is empty if the arguments are invalid.
+func multiKeys(op string, args []interface{}) (keys []interface{}, ok bool) {
+	numKeys := func(i int) []interface{} {
+		if i >= len(args) {
+			return nil
+		}
+		n, err := strconv.Atoi(string(args[i].([]byte)))
+		if err != nil || n <= 0 || i+1+n > len(args) {
+			return nil
+		}
+		return args[i+1 : i+1+n]
+	}
+	switch op {
+	case "RENAME", "RENAMENX", "SMOVE", "RPOPLPUSH", "BRPOPLPUSH":
+		if len(args) >= 2 {
+			keys = args[:2]
+		}
+	case "SUNIONSTORE", "SINTERSTORE", "SDIFFSTORE", "PFMERGE":
+		keys = args
+	case "ZUNIONSTORE", "ZINTERSTORE":
+		if src := numKeys(1); src != nil {
+			keys = append([]interface{}{args[0]}, src...)
+		}
+	case "BITOP":
+		if len(args) >= 2 {
+			keys = args[1:]
+		}
+	case "EVAL", "EVALSHA":
+		keys = numKeys(1)
+	default:
+		return nil, false
+	}
+	return keys, true
+}
+
+// apply writes a replicated command to the owner of its key, commands with
+// multiple keys are split if possible, or applied if all keys are in the same
+// slot.
+func (s *syncer) apply(resp *redis.Resp) error {
+	if !resp.IsArray() || len(resp.Array) == 0 {
+		s.ignored.Incr()
+		return nil
+	}
+	args := make([]interface{}, len(resp.Array)-1)
+	for i, x := range resp.Array[1:] {
+		args[i] = x.Value
+	}
+	op := strings.ToUpper(string(resp.Array[0].Value))
+	switch op {
+	case "PING", "REPLCONF", "MULTI", "EXEC":
+		return nil
+	case "SELECT":
+		if len(args) == 1 {
+			db, err := strconv.Atoi(string(args[0].([]byte)))
+			if err != nil {
+				return errors.Trace(err)
+			}
+			s.curdb = db
+		}
+		return nil
+	}
+	if s.curdb != s.db {
+		return nil
+	}
+	s.commands.Incr()
+
+	switch op {
+	case "FLUSHDB", "FLUSHALL":
+		log.Warnf("ignore %s from source", op)
+		s.ignored.Incr()
+		return nil
+	case "DEL":
+		for _, key := range args {
+			if err := s.send(key.([]byte), op, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "MSET", "MSETNX":
+		for i := 0; i+1 < len(args); i += 2 {
+			if err := s.send(args[i].([]byte), "SET", args[i], args[i+1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if keys, ok := multiKeys(op, args); ok {
+		if len(keys) == 0 {
+			log.Warnf("ignore %s without keys from source", op)
+			s.ignored.Incr()
+			return nil
+		}
+		slot := router.HashSlot(keys[0].([]byte))
+		for _, key := range keys[1:] {
+			if router.HashSlot(key.([]byte)) != slot {
+				log.Warnf("ignore %s of keys in different slots from source", op)
+				s.ignored.Incr()
+				return nil
+			}
+		}
+		return s.send(keys[0].([]byte), op, args...)
+	}
+	if len(args) == 0 {
+		log.Warnf("ignore %s without keys from source", op)
+		s.ignored.Incr()
+		return nil
+	}
+	return s.send(args[0].([]byte), op, args...)
+}
+
+func (s *syncer) loadSnapshot(snapshot io.Reader) error {
+	r := rdb.NewReader(snapshot)
+	var lastReport = time.Now()
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		if e.DB != uint32(s.db) {
+			continue
+		}
+		if err := s.write(e); err != nil {
+			return err
+		}
+		if time.Since(lastReport) >= time.Second*5 {
+			log.Infof("sync %s: %d keys loaded from snapshot", s.source, s.keys)
+			lastReport = time.Now()
+		}
+	}
+	// drain the rest of the snapshot, if any
+	if _, err := io.Copy(ioutil.Discard, snapshot); err != nil {
+		return errors.Trace(err)
+	}
+	return s.flushAll()
+}
+
+func (s *syncer) loopStream() error {
+	for {
+		resp, err := s.replica.Next()
+		if err != nil {
+			if s.cutover.Get() {
+				return nil
+			}
+			return errors.Trace(err)
+		}
+		if err := s.apply(resp); err != nil {
+			return err
+		}
+		// flush when there is nothing else to be applied right now
+		if s.replica.Buffered() == 0 {
+			if err := s.flushAll(); err != nil {
+				return err
+			}
+			s.applied.Set(s.replica.Offset())
+		}
+	}
+}
+
+func (s *syncer) masterOffset() (int64, error) {
+	m, err := utils.GetRedisStat(s.source, s.auth)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(m["master_repl_offset"], 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid master_repl_offset = %s", m["master_repl_offset"])
+	}
+	return n, nil
+}
+
+func (s *syncer) loopMonitor() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var lastReport = time.Now()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if s.stage.Get() == syncStageSnapshot {
+			continue
+		}
+		if err := s.replica.Ack(); err != nil {
+			log.WarnErrorf(err, "ack to source %s failed", s.source)
+		}
+		n, err := s.masterOffset()
+		if err != nil {
+			log.WarnErrorf(err, "get offset of source %s failed", s.source)
+			continue
+		}
+		s.master.Set(n)
+		if s.stage.Get() == syncStageCutover && s.applied.Get() >= n {
+			log.Infof("sync %s: caught up at offset %d, stop replicating", s.source, n)
+			s.replica.Close()
+			return
+		}
+		if time.Since(lastReport) >= time.Second*5 {
+			log.Infof("sync %s: %s", s.source, jsonify(s.status()))
+			lastReport = time.Now()
+		}
+	}
+}
+
+// startCutover pauses the clients of source if possible, the replication
+// stops as soon as all commands from source have been applied.
+func (s *syncer) startCutover(pause int) {
+	if !s.cutover.CompareAndSwap(false, true) {
+		return
+	}
+	if pause > 0 {
+		c, err := utils.DialTo(s.source, s.auth)
+		if err == nil {
+			_, err = c.Do("CLIENT", "PAUSE", pause)
+			c.Close()
+		}
+		if err != nil {
+			log.WarnErrorf(err, "pause clients of source %s failed, make sure no more writes to it", s.source)
+		}
+	}
+	s.stage.Set(syncStageCutover)
+	log.Infof("sync %s: cutover started", s.source)
+}
+
+func runSync(source, auth string, db, batch int) error {
+	slots, err := loadSlotMasters()
+	if err != nil {
+		return err
+	}
+	s := &syncer{
+		rdbImporter: &rdbImporter{
+			slots:  slots,
+			conns:  make(map[string]*importConn),
+			batch:  batch,
+			passwd: globalEnv.Password(),
+			// a command failed on codis must not stop the replication
+			skipErrors: true,
+		},
+		source: source,
+		auth:   auth,
+		db:     db,
+		done:   make(chan struct{}),
+	}
+	defer s.Close()
+
+	http.HandleFunc("/sync/status", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := json.MarshalIndent(s.status(), "", "  ")
+		w.Write(b)
+	})
+	http.HandleFunc("/sync/cutover", func(w http.ResponseWriter, r *http.Request) {
+		if s.stage.Get() == syncStageSnapshot {
+			http.Error(w, "snapshot is still being loaded", http.StatusServiceUnavailable)
+			return
+		}
+		r.ParseForm()
+		pause := 10000
+		if v := r.FormValue("pause"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid pause", http.StatusBadRequest)
+				return
+			}
+			pause = n
+		}
+		s.startCutover(pause)
+		fmt.Fprintln(w, "OK")
+	})
+
+	s.replica, err = replica.Dial(source, auth, time.Second*5)
+	if err != nil {
+		return err
+	}
+	defer s.replica.Close()
+
+	log.Infof("sync %s: waiting for snapshot", source)
+	snapshot, err := s.replica.Sync(0)
+	if err != nil {
+		return err
+	}
+	if !s.replica.PSync() {
+		// the lag is unknown without the replication offset of the snapshot
+		return errors.Errorf("source %s doesn't support PSYNC, redis 2.8 or later is required", source)
+	}
+	if err := s.loadSnapshot(snapshot); err != nil {
+		return err
+	}
+	log.Infof("sync %s: %d keys loaded from snapshot, start streaming at offset %d", source, s.keys, s.replica.Offset())
+	s.applied.Set(s.replica.Offset())
+	s.stage.Set(syncStageStream)
+
+	go s.loopMonitor()
+	err = s.loopStream()
+	close(s.done)
+	if err != nil {
+		return err
+	}
+	if err := s.flushAll(); err != nil {
+		return err
+	}
+	fmt.Println(jsonify(s.status()))
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func syncArgs(s string) []interface{} {
+	var args []interface{}
+	for _, f := range strings.Fields(s) {
+		args = append(args, []byte(f))
+	}
+	return args
+}
+
+func TestMultiKeys(t *testing.T) {
+	for _, c := range []struct {
+		op, args, keys string
+	}{
+		{"RENAME", "a b", "a b"},
+		{"SMOVE", "a b m", "a b"},
+		{"SUNIONSTORE", "d a b", "d a b"},
+		{"ZINTERSTORE", "d 2 a b WEIGHTS 1 2", "d a b"},
+		{"BITOP", "AND d a b", "d a b"},
+		{"EVAL", "script 2 a b x", "a b"},
+		{"EVAL", "script 0 x", ""},
+		{"ZUNIONSTORE", "d 3 a b", ""},
+		{"RENAME", "a", ""},
+	} {
+		keys, ok := multiKeys(c.op, syncArgs(c.args))
+		assert.Must(ok)
+		expect := syncArgs(c.keys)
+		assert.Must(len(keys) == len(expect))
+		for i := range keys {
+			assert.Must(string(keys[i].([]byte)) == string(expect[i].([]byte)))
+		}
+	}
+	_, ok := multiKeys("SET", syncArgs("a b"))
+	assert.Must(!ok)
+}
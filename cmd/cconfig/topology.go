@@ -0,0 +1,207 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// types of topology violations of migrate tasks
+const (
+	TOPOLOGY_SLOT_NO_TASK  = "slot_no_task"
+	TOPOLOGY_TASK_INVALID  = "task_invalid"
+	TOPOLOGY_TASK_MISMATCH = "task_mismatch"
+	TOPOLOGY_TASK_STUCK    = "task_stuck"
+)
+
+type TopologyReport struct {
+	Healthy    bool                        `json:"healthy"`
+	Violations []*models.TopologyViolation `json:"violations"`
+}
+
+func newTaskViolation(typ, target string, repairable bool, format string, args ...interface{}) *models.TopologyViolation {
+	return &models.TopologyViolation{
+		Type:       typ,
+		Target:     target,
+		Message:    fmt.Sprintf(format, args...),
+		Repairable: repairable,
+	}
+}
+
+// repairTask applies fn to v if repair is set, failures are kept in the
+// message of v, the rest of the check goes on.
+func repairTask(v *models.TopologyViolation, repair bool, fn func() error) {
+	if !repair || !v.Repairable {
+		return
+	}
+	if err := fn(); err != nil {
+		log.ErrorErrorf(err, "repair %s of %s failed", v.Type, v.Target)
+		v.Message += fmt.Sprintf(", repair failed: %s", err)
+		return
+	}
+	log.Warnf("repaired %s of %s: %s", v.Type, v.Target, v.Message)
+	v.Repaired = true
+}
+
+// checkTasks checks migrate tasks against slots. The lock is held, so no task
+// is started or finished meanwhile, and a task migrating but not running has
+// been left by a dead dashboard.
+//   - tasks of invalid slots or groups are removed if they are not running.
+//   - tasks stuck in migrating are pending again.
+//   - slots in migrate without any task get a new task to finish them.
+//   - slots in pre_migrate without a running task are rolled back to online.
+//   - the next task of a slot migrating to another group can't be repaired.
+func (m *MigrateManager) checkTasks(repair bool) ([]*models.TopologyViolation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	slots, err := models.Slots(m.zkConn, m.productName)
+	if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return nil, errors.Trace(err)
+	}
+	groups, err := models.ServerGroups(m.zkConn, m.productName)
+	if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return nil, errors.Trace(err)
+	}
+	exists := make(map[int]bool)
+	for _, g := range groups {
+		exists[g.Id] = true
+	}
+
+	var vs []*models.TopologyViolation
+	next := make(map[int]MigrateTaskInfo)
+	for _, info := range m.Tasks() {
+		id, target := info.Id, "task_"+info.Id
+		running := m.running[id] != nil
+		switch {
+		case info.SlotId < 0 || info.SlotId >= models.DEFAULT_SLOT_NUM || !exists[info.NewGroupId]:
+			v := newTaskViolation(TOPOLOGY_TASK_INVALID, target, !running,
+				"task %s migrates slot %d to group %d, which doesn't exist", id, info.SlotId, info.NewGroupId)
+			repairTask(v, repair, func() error {
+				err := m.zkConn.Delete(getMigrateTasksPath(m.productName)+"/"+id, -1)
+				if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+					return errors.Trace(err)
+				}
+				return removeSlotManifest(m.zkConn, m.productName, id)
+			})
+			vs = append(vs, v)
+			continue
+		case info.Status == MIGRATE_TASK_MIGRATING && !running:
+			v := newTaskViolation(TOPOLOGY_TASK_STUCK, target, true,
+				"task %s of slot %d is migrating, but not running", id, info.SlotId)
+			repairTask(v, repair, func() error {
+				_, err := updateMigrateTask(m.zkConn, m.productName, id, func(info *MigrateTaskInfo) error {
+					if info.Status == MIGRATE_TASK_MIGRATING {
+						info.Status = MIGRATE_TASK_PENDING
+					}
+					return nil
+				})
+				return err
+			})
+			vs = append(vs, v)
+		}
+		if _, ok := next[info.SlotId]; !ok {
+			next[info.SlotId] = info
+		}
+	}
+
+	for _, s := range slots {
+		s, target := s, fmt.Sprintf("slot_%d", s.Id)
+		info, owned := next[s.Id]
+		switch s.State.Status {
+		case models.SLOT_STATUS_MIGRATE:
+			to := s.State.MigrateStatus.To
+			if !owned {
+				v := newTaskViolation(TOPOLOGY_SLOT_NO_TASK, target, exists[to],
+					"slot %d is migrating to group %d without any task", s.Id, to)
+				repairTask(v, repair, func() error {
+					return m.PostTask(&MigrateTaskInfo{
+						SlotId:     s.Id,
+						NewGroupId: to,
+						Status:     MIGRATE_TASK_PENDING,
+						CreateAt:   strconv.FormatInt(time.Now().Unix(), 10),
+					})
+				})
+				vs = append(vs, v)
+			} else if info.NewGroupId != to {
+				vs = append(vs, newTaskViolation(TOPOLOGY_TASK_MISMATCH, "task_"+info.Id, false,
+					"slot %d is migrating to group %d, but the next task %s migrates it to group %d",
+					s.Id, to, info.Id, info.NewGroupId))
+			}
+		case models.SLOT_STATUS_PRE_MIGRATE:
+			if owned && m.running[info.Id] != nil {
+				continue
+			}
+			v := newTaskViolation(TOPOLOGY_SLOT_NO_TASK, target, true,
+				"slot %d is pre_migrate without a running task", s.Id)
+			repairTask(v, repair, func() error {
+				s.State.Status = models.SLOT_STATUS_ONLINE
+				return errors.Trace(s.Update(m.zkConn))
+			})
+			vs = append(vs, v)
+		}
+	}
+	return vs, nil
+}
+
+// checkTopology checks the invariants of the models and migrate tasks, and
+// repairs the safe ones if repair is set.
+func checkTopology(repair bool) (*TopologyReport, error) {
+	vs, err := models.CheckTopology(safeZkConn, globalEnv.ProductName())
+	if err != nil {
+		return nil, err
+	}
+	if repair {
+		if err := models.RepairTopology(safeZkConn, globalEnv.ProductName(), vs); err != nil {
+			return nil, err
+		}
+	}
+	tvs, err := globalMigrateManager.checkTasks(repair)
+	if err != nil {
+		return nil, err
+	}
+	r := &TopologyReport{Healthy: true, Violations: append(vs, tvs...)}
+	if r.Violations == nil {
+		r.Violations = []*models.TopologyViolation{}
+	}
+	for _, v := range r.Violations {
+		if !v.Repaired {
+			r.Healthy = false
+		}
+	}
+	return r, nil
+}
+
+func runCheckTopology(repair bool) error {
+	var r TopologyReport
+	var err error
+	if repair {
+		err = callApi(METHOD_POST, "/api/topology/repair", nil, &r)
+	} else {
+		err = callApi(METHOD_GET, "/api/topology/check", nil, &r)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(jsonify(r))
+	if !r.Healthy {
+		var left int
+		for _, v := range r.Violations {
+			if !v.Repaired {
+				left++
+			}
+		}
+		return errors.Errorf("%d topology violations are left", left)
+	}
+	return nil
+}
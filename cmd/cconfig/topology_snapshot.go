@@ -0,0 +1,364 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+const topologySnapshotVersion = 1
+
+// nodes under the product root that are not exported: locks, actions and
+// proxies only make sense to the processes that created them, manifests are
+// saved by ids of tasks, which are changed when restored. The dashboard node
+// is kept in the snapshot, but not restored.
+var topologySkippedNodes = map[string]bool{
+	"LOCK":              true,
+	"actions":           true,
+	"ActionResponse":    true,
+	"proxy":             true,
+	"fence":             true,
+	"dashboard":         true,
+	"migrate_manifests": true,
+}
+
+// children of these nodes are sequence nodes, they are created again in
+// order when restored, so that new sequence nodes sort after them.
+var topologySequenceNodes = map[string]bool{
+	"migrate_tasks":  true,
+	"dump_schedules": true,
+	"ha/audit":       true,
+}
+
+type TopologyNode struct {
+	Path string `json:"path"` // relative to /zk/codis/db_<product>
+	Data string `json:"data"`
+}
+
+type TopologySnapshot struct {
+	Version   int             `json:"version"`
+	Product   string          `json:"product"`
+	CreatedAt int64           `json:"created_at"`
+	Dashboard string          `json:"dashboard,omitempty"`
+	Nodes     []*TopologyNode `json:"nodes"`
+}
+
+func getProductPath(product string) string {
+	return fmt.Sprintf("/zk/codis/db_%s", product)
+}
+
+// exportTopology walks the tree of product in preorder, parents come before
+// their children.
+func exportTopology(zkConn zkhelper.Conn, product string) (*TopologySnapshot, error) {
+	root := getProductPath(product)
+	if ok, err := zkhelper.NodeExists(zkConn, root); err != nil {
+		return nil, errors.Trace(err)
+	} else if !ok {
+		return nil, errors.Errorf("product %s doesn't exist", product)
+	}
+	snap := &TopologySnapshot{
+		Version:   topologySnapshotVersion,
+		Product:   product,
+		CreatedAt: time.Now().Unix(),
+		Nodes:     []*TopologyNode{},
+	}
+	if data, _, err := zkConn.Get(path.Join(root, "dashboard")); err == nil {
+		snap.Dashboard = string(data)
+	} else if !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return nil, errors.Trace(err)
+	}
+
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		children, _, err := zkConn.Children(path.Join(root, rel))
+		if err != nil {
+			if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+				return nil
+			}
+			return errors.Trace(err)
+		}
+		sort.Strings(children)
+		for _, name := range children {
+			p := path.Join(rel, name)
+			if rel == "" && topologySkippedNodes[name] {
+				continue
+			}
+			data, _, err := zkConn.Get(path.Join(root, p))
+			if err != nil {
+				if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+					continue
+				}
+				return errors.Trace(err)
+			}
+			snap.Nodes = append(snap.Nodes, &TopologyNode{Path: p, Data: string(data)})
+			if err := walk(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// validate checks the snapshot before it's restored, slots, groups and
+// migrate tasks must be parsable and consistent with each other.
+func (snap *TopologySnapshot) validate() error {
+	if snap.Version != topologySnapshotVersion {
+		return errors.Errorf("unsupported snapshot version %d, expect %d", snap.Version, topologySnapshotVersion)
+	}
+	nodes := make(map[string]*TopologyNode)
+	for _, n := range snap.Nodes {
+		if n == nil || n.Path == "" || path.Clean(n.Path) != n.Path || path.IsAbs(n.Path) || strings.HasPrefix(n.Path, "..") {
+			return errors.Errorf("invalid node path in snapshot")
+		}
+		if nodes[n.Path] != nil {
+			return errors.Errorf("duplicate node %s in snapshot", n.Path)
+		}
+		if topologySkippedNodes[strings.Split(n.Path, "/")[0]] {
+			return errors.Errorf("node %s can't be restored", n.Path)
+		}
+		nodes[n.Path] = n
+	}
+
+	groups := make(map[int]bool)
+	masters := make(map[int]string)
+	for _, n := range snap.Nodes {
+		dir, name := path.Split(n.Path)
+		switch {
+		case dir == "servers/" && strings.HasPrefix(name, "group_"):
+			id, err := strconv.Atoi(strings.TrimPrefix(name, "group_"))
+			if err != nil || id < 0 {
+				return errors.Errorf("invalid group node %s", n.Path)
+			}
+			groups[id] = true
+		case strings.HasPrefix(dir, "servers/group_"):
+			var s models.Server
+			if err := json.Unmarshal([]byte(n.Data), &s); err != nil {
+				return errors.Errorf("invalid server node %s, %s", n.Path, err)
+			}
+			if s.Addr != name || "servers/group_"+strconv.Itoa(s.GroupId)+"/" != dir {
+				return errors.Errorf("server node %s doesn't match its data", n.Path)
+			}
+			if s.Type == models.SERVER_TYPE_MASTER {
+				if m, ok := masters[s.GroupId]; ok {
+					return errors.Errorf("group %d has two masters %s and %s", s.GroupId, m, s.Addr)
+				}
+				masters[s.GroupId] = s.Addr
+			}
+		}
+	}
+
+	var slots []*models.Slot
+	for _, n := range snap.Nodes {
+		if dir, name := path.Split(n.Path); dir == "slots/" {
+			s := &models.Slot{}
+			if err := json.Unmarshal([]byte(n.Data), s); err != nil {
+				return errors.Errorf("invalid slot node %s, %s", n.Path, err)
+			}
+			if name != fmt.Sprintf("slot_%d", s.Id) || s.Id < 0 || s.Id >= models.DEFAULT_SLOT_NUM {
+				return errors.Errorf("slot node %s doesn't match its data", n.Path)
+			}
+			slots = append(slots, s)
+		}
+	}
+	if len(slots) != 0 && len(slots) != models.DEFAULT_SLOT_NUM {
+		return errors.Errorf("snapshot has %d slots, expect %d", len(slots), models.DEFAULT_SLOT_NUM)
+	}
+	var migrating []*models.Slot
+	for _, s := range slots {
+		switch s.State.Status {
+		case models.SLOT_STATUS_OFFLINE:
+			continue
+		case models.SLOT_STATUS_MIGRATE, models.SLOT_STATUS_PRE_MIGRATE:
+			migrating = append(migrating, s)
+		case models.SLOT_STATUS_ONLINE:
+		default:
+			return errors.Errorf("slot %d has unknown status %s", s.Id, s.State.Status)
+		}
+		if !groups[s.GroupId] {
+			return errors.Errorf("slot %d belongs to group %d, which is not in snapshot", s.Id, s.GroupId)
+		}
+	}
+	if err := models.CheckMigratingSlots(migrating); err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, n := range snap.Nodes {
+		if dir, _ := path.Split(n.Path); dir == "migrate_tasks/" {
+			var info MigrateTaskInfo
+			if err := json.Unmarshal([]byte(n.Data), &info); err != nil {
+				return errors.Errorf("invalid migrate task %s, %s", n.Path, err)
+			}
+			if info.SlotId < 0 || info.SlotId >= models.DEFAULT_SLOT_NUM || !groups[info.NewGroupId] {
+				return errors.Errorf("migrate task %s moves slot %d to group %d, which is invalid", n.Path, info.SlotId, info.NewGroupId)
+			}
+		}
+	}
+	return nil
+}
+
+// cloneNodeData rewrites the product name of json objects, e.g. slots.
+func cloneNodeData(data string, product string) string {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return data
+	}
+	if _, ok := m["product_name"].(string); !ok {
+		return data
+	}
+	m["product_name"] = product
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+// importTopology restores the snapshot as product, which must be empty, i.e.
+// without any slots or server groups.
+func importTopology(zkConn zkhelper.Conn, snap *TopologySnapshot, product string) error {
+	if err := snap.validate(); err != nil {
+		return err
+	}
+	root := getProductPath(product)
+	for _, p := range []string{"slots", "servers", "migrate_tasks"} {
+		children, _, err := zkConn.Children(path.Join(root, p))
+		if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+			return errors.Trace(err)
+		}
+		if len(children) != 0 {
+			return errors.Errorf("product %s is not empty, %s has %d nodes", product, p, len(children))
+		}
+	}
+
+	for _, n := range snap.Nodes {
+		data := n.Data
+		if product != snap.Product {
+			data = cloneNodeData(data, product)
+		}
+		dir, _ := path.Split(n.Path)
+		if topologySequenceNodes[strings.TrimSuffix(dir, "/")] {
+			if _, err := zkConn.Create(path.Join(root, dir)+"/", []byte(data), zk.FlagSequence, zkhelper.DefaultFileACLs()); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+		if _, err := zkhelper.CreateOrUpdate(zkConn, path.Join(root, n.Path), data, 0, zkhelper.DefaultFileACLs(), true); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func cmdTopology(argv []string) (err error) {
+	usage := `usage:
+	codis-config topology export [-o <file>]
+	codis-config topology import <file> [--product=<name>]
+
+options:
+	-o <file>          write the snapshot to <file> instead of stdout
+	--product=<name>   restore as another product, the product in config is used by default
+`
+	args, err := docopt.Parse(usage, argv, true, "", false)
+	if err != nil {
+		log.ErrorErrorf(err, "parse args failed")
+		return errors.Trace(err)
+	}
+	log.Debugf("parse args = {%+v}", args)
+
+	if args["export"].(bool) {
+		file, _ := args["-o"].(string)
+		return errors.Trace(runExportTopology(file))
+	}
+	if args["import"].(bool) {
+		product, _ := args["--product"].(string)
+		if product == "" {
+			product = globalEnv.ProductName()
+		}
+		return errors.Trace(runImportTopology(args["<file>"].(string), product))
+	}
+	return nil
+}
+
+func runExportTopology(file string) error {
+	zkConn, err := globalEnv.NewZkConn()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer zkConn.Close()
+
+	// hold the lock so that dashboard won't change the topology meanwhile
+	product := globalEnv.ProductName()
+	if ok, err := zkhelper.NodeExists(zkConn, getProductPath(product)); err != nil {
+		return errors.Trace(err)
+	} else if !ok {
+		return errors.Errorf("product %s doesn't exist", product)
+	}
+	lock := utils.GetZkLock(zkConn, product)
+	if err := lock.LockWithTimeout(0, "export topology"); err != nil {
+		return errors.Trace(err)
+	}
+	defer func() {
+		err := lock.Unlock()
+		if err != nil && err != zk.ErrNoNode {
+			log.ErrorErrorf(err, "unlock node failed")
+		}
+	}()
+
+	snap, err := exportTopology(zkConn, product)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(snap, "", "    ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if file == "" {
+		fmt.Println(string(b))
+		return nil
+	}
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	log.Infof("exported %d nodes of product %s to %s", len(snap.Nodes), product, file)
+	return nil
+}
+
+func runImportTopology(file string, product string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	snap := &TopologySnapshot{}
+	if err := json.Unmarshal(b, snap); err != nil {
+		return errors.Errorf("parse %s failed, %s", file, err)
+	}
+	zkConn, err := globalEnv.NewZkConn()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer zkConn.Close()
+
+	if err := importTopology(zkConn, snap, product); err != nil {
+		return err
+	}
+	log.Infof("imported %d nodes of product %s as product %s", len(snap.Nodes), snap.Product, product)
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
+)
+
+func TestTopologySnapshot(t *testing.T) {
+	conn := memzk.NewConn()
+	globalEnv = &CodisEnv{productName: testProductName}
+	root := getProductPath(testProductName)
+
+	assert.MustNoError(models.InitSlotSet(conn, testProductName, models.DEFAULT_SLOT_NUM))
+	for _, id := range []int{1, 2} {
+		g := models.NewServerGroup(testProductName, id)
+		assert.MustNoError(g.Create(conn))
+		assert.MustNoError(g.AddServer(conn, models.NewServer(models.SERVER_TYPE_MASTER, fmt.Sprintf("localhost:100%d", id)), ""))
+	}
+	assert.MustNoError(models.SetSlotRange(conn, testProductName, 0, models.DEFAULT_SLOT_NUM-1, 1, models.SLOT_STATUS_ONLINE))
+	s, err := models.GetSlot(conn, testProductName, 7)
+	assert.MustNoError(err)
+	assert.MustNoError(s.SetMigrateStatus(conn, 1, 2))
+
+	for _, p := range []string{getMigrateTasksPath(testProductName), getNoFailoverPath(testProductName) + "/1", getFailoverAuditPath(testProductName)} {
+		_, err := zkhelper.CreateRecursive(conn, p, "", 0, zkhelper.DefaultDirACLs())
+		assert.MustNoError(err)
+	}
+	for _, slot := range []int{7, 8} {
+		b, _ := json.Marshal(&MigrateTaskInfo{SlotId: slot, NewGroupId: 2, Status: MIGRATE_TASK_PENDING})
+		_, err := conn.Create(getMigrateTasksPath(testProductName)+"/", b, zk.FlagSequence, zkhelper.DefaultFileACLs())
+		assert.MustNoError(err)
+	}
+	_, err = conn.Create(path.Join(root, "dashboard"), []byte(`{"addr": "localhost:18087"}`), 0, zkhelper.DefaultFileACLs())
+	assert.MustNoError(err)
+	_, err = models.CreateProxyInfo(conn, testProductName, &models.ProxyInfo{Id: "proxy_1", State: models.PROXY_STATE_ONLINE})
+	assert.MustNoError(err)
+
+	snap, err := exportTopology(conn, testProductName)
+	assert.MustNoError(err)
+	assert.Must(snap.Version == topologySnapshotVersion && snap.Product == testProductName)
+	assert.Must(snap.Dashboard == `{"addr": "localhost:18087"}`)
+	paths := make(map[string]bool)
+	for _, n := range snap.Nodes {
+		paths[n.Path] = true
+	}
+	assert.Must(paths["slots/slot_0"] && paths["slots/slot_1023"])
+	assert.Must(paths["servers/group_2/localhost:1002"] && paths["ha/no_failover/1"])
+	assert.Must(!paths["dashboard"] && !paths["actions"] && !paths["proxy"] && !paths["LOCK"])
+	assert.MustNoError(snap.validate())
+
+	b, err := json.Marshal(snap)
+	assert.MustNoError(err)
+	restored := &TopologySnapshot{}
+	assert.MustNoError(json.Unmarshal(b, restored))
+
+	// clone into another product
+	const clone = "unit_test_clone"
+	assert.MustNoError(importTopology(conn, restored, clone))
+	slots, err := models.Slots(conn, clone)
+	assert.MustNoError(err)
+	assert.Must(len(slots) == models.DEFAULT_SLOT_NUM)
+	for _, s := range slots {
+		assert.Must(s.ProductName == clone && s.GroupId == 1 || s.Id == 7)
+	}
+	s, err = models.GetSlot(conn, clone, 7)
+	assert.MustNoError(err)
+	assert.Must(s.State.Status == models.SLOT_STATUS_MIGRATE && s.GroupId == 2)
+	group, err := models.GetGroup(conn, clone, 2)
+	assert.MustNoError(err)
+	assert.Must(len(group.Servers) == 1 && group.Servers[0].Addr == "localhost:1002")
+	tasks, _, err := conn.Children(getMigrateTasksPath(clone))
+	assert.MustNoError(err)
+	assert.Must(len(tasks) == 2)
+	exists, _, err := conn.Exists(path.Join(getProductPath(clone), "dashboard"))
+	assert.MustNoError(err)
+	assert.Must(!exists)
+
+	// the clone is not empty anymore
+	assert.Must(importTopology(conn, restored, clone) != nil)
+
+	restored.Version = 0
+	assert.Must(importTopology(conn, restored, "unit_test_empty") != nil)
+	restored.Version = topologySnapshotVersion
+	for _, n := range restored.Nodes {
+		if n.Path == "servers/group_2" {
+			n.Path = "servers/group_3"
+		}
+	}
+	assert.Must(restored.validate() != nil)
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestCheckTopology(t *testing.T) {
+	m := newTestMigrateManager()
+	globalMigrateManager = m
+	for _, id := range []int{1, 2} {
+		g := models.NewServerGroup(testProductName, id)
+		assert.MustNoError(g.AddServer(m.zkConn, models.NewServer(models.SERVER_TYPE_MASTER, fmt.Sprintf("localhost:100%d", id)), ""))
+	}
+
+	r, err := checkTopology(false)
+	assert.MustNoError(err)
+	assert.Must(r.Healthy && len(r.Violations) == 0)
+
+	// left in migrating by a dead dashboard
+	stuck := postTestTask(m, 0, MIGRATE_TASK_MIGRATING)
+
+	// pre_migrate without any task
+	s := getTestSlot(m, 1)
+	s.State.Status = models.SLOT_STATUS_PRE_MIGRATE
+	assert.MustNoError(s.Update(m.zkConn))
+
+	// migrate without any task
+	assert.MustNoError(getTestSlot(m, 2).SetMigrateStatus(m.zkConn, 1, 2))
+
+	// migrate to group 2, but the task migrates it back to group 1
+	assert.MustNoError(getTestSlot(m, 3).SetMigrateStatus(m.zkConn, 1, 2))
+	mismatch := &MigrateTaskInfo{SlotId: 3, NewGroupId: 1, Status: MIGRATE_TASK_PENDING}
+	assert.MustNoError(m.PostTask(mismatch))
+
+	// a task to a group that doesn't exist
+	invalid := &MigrateTaskInfo{SlotId: 5, NewGroupId: 9, Status: MIGRATE_TASK_PENDING}
+	assert.MustNoError(m.PostTask(invalid))
+
+	// pre_migrate by a running task is fine
+	running := postTestTask(m, 4, MIGRATE_TASK_MIGRATING)
+	m.running[running.Id] = GetMigrateTask(*running)
+	s = getTestSlot(m, 4)
+	s.State.Status = models.SLOT_STATUS_PRE_MIGRATE
+	assert.MustNoError(s.Update(m.zkConn))
+
+	r, err = checkTopology(true)
+	assert.MustNoError(err)
+	assert.Must(!r.Healthy)
+	targets := make(map[string]*models.TopologyViolation)
+	for _, v := range r.Violations {
+		targets[v.Target] = v
+	}
+	assert.Must(len(r.Violations) == 5)
+	assert.Must(targets["task_"+stuck.Id].Type == TOPOLOGY_TASK_STUCK && targets["task_"+stuck.Id].Repaired)
+	assert.Must(targets["slot_1"].Type == TOPOLOGY_SLOT_NO_TASK && targets["slot_1"].Repaired)
+	assert.Must(targets["slot_2"].Type == TOPOLOGY_SLOT_NO_TASK && targets["slot_2"].Repaired)
+	assert.Must(targets["task_"+mismatch.Id].Type == TOPOLOGY_TASK_MISMATCH && !targets["task_"+mismatch.Id].Repairable)
+	assert.Must(targets["task_"+invalid.Id].Type == TOPOLOGY_TASK_INVALID && targets["task_"+invalid.Id].Repaired)
+
+	assert.Must(getTestSlot(m, 1).State.Status == models.SLOT_STATUS_ONLINE)
+	owned := m.ownedSlots()
+	assert.Must(owned[2] == 2)
+	_, ok := owned[5]
+	assert.Must(!ok)
+	info, _, err := getMigrateTask(m.zkConn, testProductName, stuck.Id)
+	assert.MustNoError(err)
+	assert.Must(info.Status == MIGRATE_TASK_PENDING)
+
+	r, err = checkTopology(false)
+	assert.MustNoError(err)
+	assert.Must(!r.Healthy && len(r.Violations) == 1)
+	assert.Must(r.Violations[0].Type == TOPOLOGY_TASK_MISMATCH)
+}
@@ -11,6 +11,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -31,6 +32,7 @@ var (
 	addr       = ":9000"
 	httpAddr   = ":9001"
 	configFile = "config.ini"
+	captureDir = ""
 )
 
 var usage = `usage: proxy [-c <config_file>] [-L <log_file>] [--log-level=<loglevel>] [--log-filesize=<filesize>] [--cpu=<cpu_num>] [--addr=<proxy_listen_addr>] [--http-addr=<debug_http_server_addr>]
@@ -91,6 +93,58 @@ func handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
 	setLogLevel(r.Form.Get("level"))
 }
 
+func handleStartCapture(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if captureDir == "" {
+		http.Error(w, "capture_dir is not set", http.StatusForbidden)
+		return
+	}
+	// the debug server is not authenticated, files are kept in captureDir
+	name := r.Form.Get("file")
+	if name == "" || strings.Contains(name, "/") || strings.Contains(name, "..") {
+		http.Error(w, "invalid file", http.StatusBadRequest)
+		return
+	}
+	file := filepath.Join(captureDir, name)
+	var err error
+	var rate float64 = 1
+	if s := r.Form.Get("rate"); s != "" {
+		if rate, err = strconv.ParseFloat(s, 64); err != nil || rate < 0 || rate > 1 {
+			http.Error(w, "invalid rate", http.StatusBadRequest)
+			return
+		}
+	}
+	var duration time.Duration
+	if s := r.Form.Get("duration"); s != "" {
+		if duration, err = time.ParseDuration(s); err != nil {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+	}
+	var maxSize int64 = bytesize.MB * 256
+	if s := r.Form.Get("maxsize"); s != "" {
+		if maxSize, err = bytesize.Parse(s); err != nil {
+			http.Error(w, "invalid maxsize", http.StatusBadRequest)
+			return
+		}
+	}
+	var maxFiles = 8
+	if s := r.Form.Get("maxfiles"); s != "" {
+		if maxFiles, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "invalid maxfiles", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := router.StartCapture(file, rate, maxSize, maxFiles, duration); err != nil {
+		log.WarnErrorf(err, "start capturing requests to %s failed", file)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func handleStopCapture(w http.ResponseWriter, r *http.Request) {
+	router.StopCapture()
+}
+
 func checkUlimit(min int) {
 	ulimitN, err := exec.Command("/bin/sh", "-c", "ulimit -n").Output()
 	if err != nil {
@@ -165,16 +219,20 @@ func main() {
 	checkUlimit(1024)
 	runtime.GOMAXPROCS(cpus)
 
+	conf, err := proxy.LoadConf(configFile)
+	if err != nil {
+		log.PanicErrorf(err, "load config failed")
+	}
+	captureDir = conf.CaptureDir()
+
 	http.HandleFunc("/setloglevel", handleSetLogLevel)
+	http.HandleFunc("/capture/start", handleStartCapture)
+	http.HandleFunc("/capture/stop", handleStopCapture)
 	go func() {
 		err := http.ListenAndServe(httpAddr, nil)
 		log.PanicError(err, "http debug server quit")
 	}()
 	log.Info("running on ", addr)
-	conf, err := proxy.LoadConf(configFile)
-	if err != nil {
-		log.PanicErrorf(err, "load config failed")
-	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, os.Kill)
@@ -186,6 +244,12 @@ func main() {
 		var m = make(map[string]interface{})
 		m["ops"] = router.OpCounts()
 		m["cmds"] = router.GetAllOpStats()
+		m["memory"] = router.GetMemStats()
+		m["coalesce"] = router.GetFlightStats()
+		m["nearcache"] = router.GetNearCacheStats()
+		m["mirror"] = router.GetMirrorStats()
+		m["capture"] = router.GetCaptureStats()
+		m["slots"] = router.GetSlotStats()
 		m["info"] = s.Info()
 		m["build"] = map[string]interface{}{
 			"version": utils.Version,
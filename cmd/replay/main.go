@@ -0,0 +1,309 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+var usage = `usage: codis-replay [options] --target=<addr> <capture_file>...
+
+Replay requests recorded by codis-proxy, requests of each session are sent
+in order over a connection of its own. Rotated files must be given from the
+oldest to the newest, e.g. capture.log.2 capture.log.1 capture.log
+
+A session falling too far behind holds back the replay, unless --drop is
+given, and a session is closed if it has no requests for --idle seconds of
+the capture.
+
+options:
+   --target=<addr>    address of the proxy or redis server, e.g. 127.0.0.1:19000
+   --auth=<passwd>    password of the target
+   --speed=<scale>    replay speed relative to the capture, 2 means twice as fast [default: 1]
+   --max-speed        replay as fast as possible, ignoring timestamps in the capture
+   --timeout=<secs>   read and write timeout of each request [default: 30]
+   --idle=<secs>      close sessions idle for so long in the capture [default: 60]
+   --drop             drop requests of a session falling behind instead of waiting, not with --max-speed
+`
+
+type replayStats struct {
+	mu   sync.Mutex
+	lats []int64
+
+	requests atomic2.Int64
+	errors   atomic2.Int64
+	failures atomic2.Int64
+	dropped  atomic2.Int64
+	sessions atomic2.Int64
+}
+
+func (s *replayStats) record(usecs int64) {
+	s.mu.Lock()
+	s.lats = append(s.lats, usecs)
+	s.mu.Unlock()
+}
+
+func (s *replayStats) report(elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sort.Sort(int64Slice(s.lats))
+	percentile := func(p float64) time.Duration {
+		if len(s.lats) == 0 {
+			return 0
+		}
+		i := int(float64(len(s.lats)-1) * p)
+		return time.Duration(s.lats[i]) * time.Microsecond
+	}
+	var qps float64
+	if elapsed > 0 {
+		qps = float64(s.requests.Get()) / elapsed.Seconds()
+	}
+	fmt.Printf("elapsed:  %v\n", elapsed)
+	fmt.Printf("sessions: %d\n", s.sessions.Get())
+	fmt.Printf("requests: %d (%.1f/s)\n", s.requests.Get(), qps)
+	fmt.Printf("errors:   %d error replies, %d failed requests, %d dropped\n", s.errors.Get(), s.failures.Get(), s.dropped.Get())
+	fmt.Printf("latency:  p50 = %v, p90 = %v, p99 = %v, max = %v\n",
+		percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+}
+
+type int64Slice []int64
+
+func (p int64Slice) Len() int           { return len(p) }
+func (p int64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+type replayer struct {
+	target  string
+	auth    string
+	timeout time.Duration
+	idle    int64 // usecs
+	drop    bool
+
+	stats replayStats
+	wait  sync.WaitGroup
+}
+
+func (r *replayer) dial() (*redis.Conn, error) {
+	c, err := redis.DialTimeout(r.target, 1024*64, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	c.ReaderTimeout = r.timeout
+	c.WriterTimeout = r.timeout
+	if r.auth != "" {
+		auth := redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("AUTH")),
+			redis.NewBulkBytes([]byte(r.auth)),
+		})
+		if err := c.Writer.Encode(auth, true); err != nil {
+			c.Close()
+			return nil, err
+		}
+		resp, err := c.Reader.Decode()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if resp.IsError() {
+			c.Close()
+			return nil, errors.Errorf("auth failed: %s", resp.Value)
+		}
+	}
+	return c, nil
+}
+
+// session sends requests of one captured session in order, waiting for each reply.
+func (r *replayer) session(input <-chan *redis.Resp) {
+	defer r.wait.Done()
+	var c *redis.Conn
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+	for req := range input {
+		if c == nil {
+			var err error
+			if c, err = r.dial(); err != nil {
+				log.WarnErrorf(err, "connect to %s failed", r.target)
+				r.stats.failures.Incr()
+				continue
+			}
+		}
+		start := time.Now()
+		err := c.Writer.Encode(req, true)
+		var resp *redis.Resp
+		if err == nil {
+			resp, err = c.Reader.Decode()
+		}
+		r.stats.requests.Incr()
+		if err != nil {
+			log.WarnErrorf(err, "replay request to %s failed", r.target)
+			r.stats.failures.Incr()
+			c.Close()
+			c = nil
+			continue
+		}
+		r.stats.record(int64(time.Since(start) / time.Microsecond))
+		if resp.IsError() {
+			r.stats.errors.Incr()
+		}
+	}
+}
+
+const replaySessionQueue = 1024
+
+type replaySession struct {
+	input chan *redis.Resp
+	last  int64 // usecs in the capture
+}
+
+func (r *replayer) replay(files []string, speed float64) error {
+	sessions := make(map[int64]*replaySession)
+	defer func() {
+		for _, s := range sessions {
+			close(s.input)
+		}
+		r.wait.Wait()
+	}()
+
+	var first, lastSweep int64 = -1, 0
+	var start = time.Now()
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		cr := router.NewCaptureReader(f)
+		for {
+			x, err := cr.Read()
+			if err == io.EOF {
+				break
+			} else if errors.Equal(err, io.ErrUnexpectedEOF) {
+				// the last record is cut off if the proxy is still writing
+				log.Warnf("%s is truncated, skip the last record", file)
+				break
+			} else if err != nil {
+				f.Close()
+				return errors.Trace(err)
+			}
+			if first < 0 {
+				first, lastSweep = x.Usecs, x.Usecs
+			}
+			if speed > 0 {
+				offset := time.Duration(float64(x.Usecs-first)/speed) * time.Microsecond
+				if d := offset - time.Since(start); d > 0 {
+					time.Sleep(d)
+				}
+			}
+			if x.Usecs-lastSweep >= r.idle {
+				for id, s := range sessions {
+					if x.Usecs-s.last >= r.idle {
+						close(s.input)
+						delete(sessions, id)
+					}
+				}
+				lastSweep = x.Usecs
+			}
+			s := sessions[x.Session]
+			if s == nil {
+				s = &replaySession{input: make(chan *redis.Resp, replaySessionQueue)}
+				sessions[x.Session] = s
+				r.stats.sessions.Incr()
+				r.wait.Add(1)
+				go r.session(s.input)
+			}
+			s.last = x.Usecs
+			if !r.drop {
+				s.input <- x.Resp
+				continue
+			}
+			// a slow session must not hold back the others
+			select {
+			case s.input <- x.Resp:
+			default:
+				r.stats.dropped.Incr()
+			}
+		}
+		f.Close()
+	}
+	return nil
+}
+
+func main() {
+	args, err := docopt.Parse(usage, nil, true, utils.Version, true)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	log.SetLevel(log.LEVEL_WARN)
+
+	r := &replayer{target: args["--target"].(string)}
+	if s, ok := args["--auth"].(string); ok {
+		r.auth = s
+	}
+
+	timeout, err := strconv.Atoi(args["--timeout"].(string))
+	if err != nil || timeout <= 0 {
+		log.Panicf("invalid timeout = %s", args["--timeout"])
+	}
+	r.timeout = time.Second * time.Duration(timeout)
+
+	idle, err := strconv.Atoi(args["--idle"].(string))
+	if err != nil || idle <= 0 {
+		log.Panicf("invalid idle = %s", args["--idle"])
+	}
+	r.idle = int64(time.Second*time.Duration(idle)) / int64(time.Microsecond)
+
+	r.drop = args["--drop"].(bool)
+
+	var speed float64
+	if args["--max-speed"].(bool) {
+		if r.drop {
+			log.Panicf("--drop can't be used with --max-speed")
+		}
+	} else {
+		speed, err = strconv.ParseFloat(args["--speed"].(string), 64)
+		if err != nil || speed <= 0 {
+			log.Panicf("invalid speed = %s", args["--speed"])
+		}
+	}
+
+	start := time.Now()
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second * 5)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				fmt.Printf("replayed %d requests, %d errors, %d failures, %d dropped\n",
+					r.stats.requests.Get(), r.stats.errors.Get(), r.stats.failures.Get(), r.stats.dropped.Get())
+			}
+		}
+	}()
+
+	err = r.replay(args["<capture_file>"].([]string), speed)
+	close(stop)
+	r.stats.report(time.Since(start))
+	if err != nil {
+		log.PanicErrorf(err, "replay failed")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"path"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,6 +16,8 @@ import (
 	"github.com/CodisLabs/codis/pkg/utils/assert"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
+	"github.com/wandoulabs/go-zookeeper/zk"
 	"github.com/wandoulabs/zkhelper"
 )
 
@@ -33,7 +36,7 @@ func waitForProxyMarkOffline(zkConn zkhelper.Conn, proxyName string) {
 
 func TestProxyOfflineInWaitActionReceiver(t *testing.T) {
 	log.Infof("test proxy offline when waiting action response")
-	fakeZkConn := zkhelper.NewConn()
+	fakeZkConn := memzk.NewConn()
 
 	for i := 1; i <= 4; i++ {
 		CreateProxyInfo(fakeZkConn, productName, &ProxyInfo{
@@ -66,7 +69,7 @@ func TestProxyOfflineInWaitActionReceiver(t *testing.T) {
 }
 
 func TestNewAction(t *testing.T) {
-	fakeZkConn := zkhelper.NewConn()
+	fakeZkConn := memzk.NewConn()
 	err := NewAction(fakeZkConn, productName, ACTION_TYPE_SLOT_CHANGED, nil, "desc", false)
 	assert.MustNoError(err)
 
@@ -75,12 +78,12 @@ func TestNewAction(t *testing.T) {
 	assert.MustNoError(err)
 	assert.Must(exist)
 
-	//test if response node exists
-	d, _, err := fakeZkConn.Get(prefix + "/0000000001")
+	//test if response node exists, sequence numbers start from 0 in a new dir
+	d, _, err := fakeZkConn.Get(prefix + "/0000000000")
 	assert.MustNoError(err)
 
 	//test get action data
-	d, _, err = fakeZkConn.Get(GetActionResponsePath(productName) + "/0000000001")
+	d, _, err = fakeZkConn.Get(GetActionResponsePath(productName) + "/0000000000")
 	assert.MustNoError(err)
 
 	var action Action
@@ -90,8 +93,55 @@ func TestNewAction(t *testing.T) {
 	assert.Must(action.Type == ACTION_TYPE_SLOT_CHANGED)
 }
 
+// confirmActions responds to every action of the product until the session
+// of zkConn ends.
+func confirmActions(zkConn zkhelper.Conn, pi *ProxyInfo) {
+	for {
+		seqs, _, ch, err := zkConn.ChildrenW(GetWatchActionPath(productName))
+		if err != nil {
+			return
+		}
+		for _, seq := range seqs {
+			doResponseForTest(zkConn, seq, pi)
+		}
+		if e := <-ch; e.Type == zk.EventNotWatching {
+			return
+		}
+	}
+}
+
+func TestNewActionFence(t *testing.T) {
+	store := memzk.NewStore()
+	dashboard, proxy := store.NewConn(), store.NewConn()
+
+	pi := &ProxyInfo{Id: "proxy_1", Addr: "localhost:1234", State: PROXY_STATE_ONLINE}
+	_, err := CreateProxyInfo(proxy, productName, pi)
+	assert.MustNoError(err)
+	_, err = CreateProxyFenceNode(proxy, productName, pi)
+	assert.MustNoError(err)
+	assert.MustNoError(CreateActionRootPath(dashboard, GetWatchActionPath(productName)))
+	go confirmActions(proxy, pi)
+
+	err = NewActionWithTimeout(dashboard, productName, ACTION_TYPE_SLOT_CHANGED, nil, "", true, 5000)
+	assert.MustNoError(err)
+	_, _, err = dashboard.Get(GetActionResponsePath(productName) + "/0000000000/proxy_1")
+	assert.MustNoError(err)
+
+	// the fence of an expired proxy blocks actions until it is removed
+	proxy.Expire()
+	err = NewActionWithTimeout(dashboard, productName, ACTION_TYPE_SLOT_CHANGED, nil, "", true, 5000)
+	assert.Must(err != nil && strings.Contains(err.Error(), "localhost:1234"))
+
+	assert.MustNoError(ForceRemoveDeadFence(dashboard, productName))
+	ok, _, err := dashboard.Exists(GetProxyFencePath(productName) + "/localhost:1234")
+	assert.MustNoError(err)
+	assert.Must(!ok)
+	err = NewActionWithTimeout(dashboard, productName, ACTION_TYPE_SLOT_CHANGED, nil, "", true, 5000)
+	assert.MustNoError(err)
+}
+
 func TestWaitForReceiverTimeout(t *testing.T) {
-	fakeZkConn := zkhelper.NewConn()
+	fakeZkConn := memzk.NewConn()
 	proxies := []ProxyInfo{}
 	for i := 0; i < 5; i++ {
 		proxies = append(proxies, ProxyInfo{
@@ -144,7 +194,7 @@ func TestWaitForReceiverTimeout(t *testing.T) {
 }
 
 func TestWaitForReceiver(t *testing.T) {
-	fakeZkConn := zkhelper.NewConn()
+	fakeZkConn := memzk.NewConn()
 	proxies := []ProxyInfo{}
 	for i := 0; i < 5; i++ {
 		proxies = append(proxies, ProxyInfo{
@@ -211,7 +261,7 @@ func doResponseForTest(conn zkhelper.Conn, seq string, pi *ProxyInfo) error {
 }
 
 func TestForceRemoveLock(t *testing.T) {
-	fakeZkConn := zkhelper.NewConn()
+	fakeZkConn := memzk.NewConn()
 	zkLock := utils.GetZkLock(fakeZkConn, productName)
 	assert.Must(zkLock != nil)
 
@@ -7,11 +7,11 @@ import (
 	"testing"
 
 	"github.com/CodisLabs/codis/pkg/utils/assert"
-	"github.com/wandoulabs/zkhelper"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
 )
 
 func TestProxy(t *testing.T) {
-	fakeZkConn := zkhelper.NewConn()
+	fakeZkConn := memzk.NewConn()
 	path := GetSlotBasePath(productName)
 	children, _, _ := fakeZkConn.Children(path)
 	assert.Must(len(children) == 0)
@@ -66,3 +66,26 @@ func TestProxy(t *testing.T) {
 	assert.MustNoError(err)
 	assert.Must(p.State == PROXY_STATE_ONLINE)
 }
+
+func TestProxySessionExpired(t *testing.T) {
+	store := memzk.NewStore()
+	dashboard, proxy := store.NewConn(), store.NewConn()
+
+	_, err := CreateProxyInfo(proxy, productName, &ProxyInfo{Id: "proxy_1", State: PROXY_STATE_ONLINE})
+	assert.MustNoError(err)
+	_, err = CreateProxyFenceNode(proxy, productName, &ProxyInfo{Addr: "localhost:1234"})
+	assert.MustNoError(err)
+
+	ps, err := ProxyList(dashboard, productName, nil)
+	assert.MustNoError(err)
+	assert.Must(len(ps) == 1)
+
+	// the proxy is gone with its session, but the fence node is left
+	proxy.Expire()
+	ps, err = ProxyList(dashboard, productName, nil)
+	assert.MustNoError(err)
+	assert.Must(len(ps) == 0)
+	ok, _, err := dashboard.Exists(GetProxyFencePath(productName) + "/localhost:1234")
+	assert.MustNoError(err)
+	assert.Must(ok)
+}
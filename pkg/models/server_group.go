@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/CodisLabs/codis/pkg/utils"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
@@ -202,45 +203,184 @@ func (self *ServerGroup) RemoveServer(zkConn zkhelper.Conn, addr string) error {
 	return errors.Trace(err)
 }
 
-func (self *ServerGroup) Promote(conn zkhelper.Conn, addr, passwd string) error {
+// steps of promote in PromoteReport
+const (
+	PROMOTE_STEP_CHECK   = "check"
+	PROMOTE_STEP_CATCHUP = "catch_up"
+	PROMOTE_STEP_SLAVEOF = "slaveof_no_one"
+	PROMOTE_STEP_UPDATE  = "update"
+	PROMOTE_STEP_REPOINT = "repoint"
+)
+
+type PromoteOptions struct {
+	// wait at most CatchUp for the candidate to catch up with the master
+	CatchUp time.Duration
+	// promote the candidate even if it's behind the master
+	Force bool
+}
+
+type PromoteStep struct {
+	Step    string `json:"step"`
+	Addr    string `json:"addr"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type PromoteReport struct {
+	GroupId      int            `json:"group_id"`
+	Addr         string         `json:"addr"`
+	OldMaster    string         `json:"old_master,omitempty"`
+	MasterOffset int64          `json:"master_offset"` // -1 if the old master is unreachable
+	SlaveOffset  int64          `json:"slave_offset"`
+	Steps        []*PromoteStep `json:"steps"`
+}
+
+func (r *PromoteReport) step(step, addr string, err error, format string, args ...interface{}) {
+	s := &PromoteStep{Step: step, Addr: addr, Message: fmt.Sprintf(format, args...)}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	r.Steps = append(r.Steps, s)
+}
+
+func getMasterOffset(addr, passwd string) (int64, error) {
+	info, err := utils.GetReplicationInfo(addr, passwd)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsMaster() {
+		return 0, errors.Errorf("%s is not a master, role = %s", addr, info.Role)
+	}
+	return info.MasterReplOffset, nil
+}
+
+// checkCandidate makes sure that the candidate replicates from the master and
+// has caught up with its offset, it waits at most opts.CatchUp.
+func checkCandidate(r *PromoteReport, passwd string, opts *PromoteOptions) error {
+	var masterAddr string
+	if r.OldMaster != "" {
+		offset, err := getMasterOffset(r.OldMaster, passwd)
+		if err == nil {
+			masterAddr, r.MasterOffset = r.OldMaster, offset
+		} else {
+			r.step(PROMOTE_STEP_CHECK, r.OldMaster, err, "master is unreachable, offsets are not checked")
+		}
+	}
+
+	deadline := time.Now().Add(opts.CatchUp)
+	for {
+		state, err := utils.GetReplicationInfo(r.Addr, passwd)
+		if err == nil && !state.IsSlave() {
+			err = errors.Errorf("%s is not a slave, role = %s", r.Addr, state.Role)
+		}
+		if err != nil {
+			r.step(PROMOTE_STEP_CHECK, r.Addr, err, "candidate is not available")
+			return err
+		}
+		r.SlaveOffset = state.SlaveReplOffset
+		if masterAddr == "" {
+			r.step(PROMOTE_STEP_CHECK, r.Addr, nil, "candidate offset is %d", state.SlaveReplOffset)
+			return nil
+		}
+
+		var behind error
+		switch {
+		case state.MasterAddr != masterAddr:
+			behind = errors.Errorf("candidate is a slave of %s, not %s", state.MasterAddr, masterAddr)
+		case !state.MasterLinkUp:
+			behind = errors.Errorf("candidate's link to master is down")
+		case state.SlaveReplOffset < r.MasterOffset:
+			behind = errors.Errorf("candidate is %d bytes behind master", r.MasterOffset-state.SlaveReplOffset)
+		}
+		if behind == nil {
+			r.step(PROMOTE_STEP_CHECK, r.Addr, nil, "candidate offset %d has caught up with master offset %d", state.SlaveReplOffset, r.MasterOffset)
+			return nil
+		}
+		if time.Now().Before(deadline) && state.MasterAddr == masterAddr {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if opts.Force {
+			r.step(PROMOTE_STEP_CATCHUP, r.Addr, behind, "promote anyway, forced")
+			return nil
+		}
+		r.step(PROMOTE_STEP_CATCHUP, r.Addr, behind, "waited %s", opts.CatchUp)
+		return behind
+	}
+}
+
+// Promote makes the slave addr the master of the group. If the old master is
+// reachable, the slave must have caught up with it, unless opts.Force is set.
+// Other slaves are pointed to the new master afterwards, failures of that are
+// in the report only. The report is returned even if it fails.
+func (self *ServerGroup) Promote(conn zkhelper.Conn, addr, passwd string, opts *PromoteOptions) (*PromoteReport, error) {
+	if opts == nil {
+		opts = &PromoteOptions{}
+	}
+	r := &PromoteReport{GroupId: self.Id, Addr: addr, MasterOffset: -1, SlaveOffset: -1, Steps: []*PromoteStep{}}
+
 	var s *Server
-	exists := false
 	for i := 0; i < len(self.Servers); i++ {
 		if self.Servers[i].Addr == addr {
 			s = self.Servers[i]
-			exists = true
 			break
 		}
 	}
-
-	if !exists {
-		return errors.Errorf("no such addr %s", addr)
+	if s == nil {
+		return r, errors.Errorf("no such addr %s", addr)
 	}
 
-	err := utils.SlaveNoOne(s.Addr, passwd)
+	// old master may be nil
+	master, err := self.Master(conn)
 	if err != nil {
-		return errors.Trace(err)
+		return r, errors.Trace(err)
+	}
+	if master != nil {
+		if master.Addr == addr {
+			return r, errors.Errorf("%s is the master of group %d already", addr, self.Id)
+		}
+		r.OldMaster = master.Addr
 	}
 
-	// set origin master offline
-	master, err := self.Master(conn)
+	if err := checkCandidate(r, passwd, opts); err != nil {
+		return r, err
+	}
+
+	err = utils.SlaveNoOne(s.Addr, passwd)
+	r.step(PROMOTE_STEP_SLAVEOF, s.Addr, err, "")
 	if err != nil {
-		return errors.Trace(err)
+		return r, errors.Trace(err)
 	}
 
-	// old master may be nil
+	// set origin master offline
 	if master != nil {
 		master.Type = SERVER_TYPE_OFFLINE
 		err = self.AddServer(conn, master, passwd)
+		r.step(PROMOTE_STEP_UPDATE, master.Addr, err, "set offline")
 		if err != nil {
-			return errors.Trace(err)
+			return r, errors.Trace(err)
 		}
 	}
 
 	// promote new server to master
 	s.Type = SERVER_TYPE_MASTER
 	err = self.AddServer(conn, s, passwd)
-	return errors.Trace(err)
+	r.step(PROMOTE_STEP_UPDATE, s.Addr, err, "set master")
+	if err != nil {
+		return r, errors.Trace(err)
+	}
+
+	for _, slave := range self.Servers {
+		if slave.Type != SERVER_TYPE_SLAVE || slave.Addr == s.Addr {
+			continue
+		}
+		err := utils.SlaveOf(slave.Addr, passwd, s.Addr)
+		if err != nil {
+			log.WarnErrorf(err, "repoint slave %s to %s failed", slave.Addr, s.Addr)
+		}
+		r.step(PROMOTE_STEP_REPOINT, slave.Addr, err, "slaveof %s", s.Addr)
+	}
+	return r, nil
 }
 
 func (self *ServerGroup) Create(zkConn zkhelper.Conn) error {
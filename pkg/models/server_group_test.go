@@ -5,12 +5,18 @@ package models
 
 import (
 	"bufio"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
 	"github.com/wandoulabs/zkhelper"
 )
 
@@ -19,6 +25,47 @@ var (
 	conn zkhelper.Conn
 )
 
+// replies of INFO of fake redis servers by addr
+var fakeRedisInfo = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+func setFakeRedisInfo(addr string, lines ...string) {
+	fakeRedisInfo.Lock()
+	defer fakeRedisInfo.Unlock()
+	fakeRedisInfo.m[addr] = strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n <= 0 {
+		return nil, errors.Errorf("bad request %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// runFakeRedisSrv replies INFO with the info set by setFakeRedisInfo, and +OK
+// to other commands.
 func runFakeRedisSrv(addr string) {
 	l, err := net.Listen("tcp", addr)
 	assert.MustNoError(err)
@@ -29,18 +76,33 @@ func runFakeRedisSrv(addr string) {
 		}
 
 		go func(c net.Conn) {
-			w := bufio.NewWriter(c)
-			w.WriteString("+OK\r\n")
-			w.Flush()
+			defer c.Close()
+			r, w := bufio.NewReader(c), bufio.NewWriter(c)
+			for {
+				args, err := readFakeRedisCommand(r)
+				if err != nil {
+					return
+				}
+				if strings.ToUpper(args[0]) == "INFO" {
+					fakeRedisInfo.Lock()
+					info := fakeRedisInfo.m[addr]
+					fakeRedisInfo.Unlock()
+					fmt.Fprintf(w, "$%d\r\n%s\r\n", len(info), info)
+				} else {
+					w.WriteString("+OK\r\n")
+				}
+				w.Flush()
+			}
 		}(c)
 	}
 }
 
 func resetEnv() {
-	conn = zkhelper.NewConn()
+	conn = memzk.NewConn()
 	once.Do(func() {
 		go runFakeRedisSrv("127.0.0.1:1111")
 		go runFakeRedisSrv("127.0.0.1:2222")
+		go runFakeRedisSrv("127.0.0.1:3333")
 		time.Sleep(1 * time.Second)
 	})
 }
@@ -91,10 +153,70 @@ func TestServerGroup(t *testing.T) {
 	g.AddServer(conn, s2, "")
 	assert.Must(len(g.Servers) == 2)
 
-	err = g.Promote(conn, s2.Addr, "")
+	setFakeRedisInfo(s1.Addr, "role:master", "master_repl_offset:100")
+	setFakeRedisInfo(s2.Addr, "role:slave", "master_host:127.0.0.1", "master_port:1111",
+		"master_link_status:up", "slave_repl_offset:100")
+	_, err = g.Promote(conn, s2.Addr, "", nil)
 	assert.MustNoError(err)
 
 	s, err := g.Master(conn)
 	assert.MustNoError(err)
 	assert.Must(s.Addr == s2.Addr)
 }
+
+func TestPromote(t *testing.T) {
+	resetEnv()
+
+	g := NewServerGroup(productName, 1)
+	assert.MustNoError(g.Create(conn))
+	assert.MustNoError(g.AddServer(conn, NewServer(SERVER_TYPE_MASTER, "127.0.0.1:1111"), ""))
+	assert.MustNoError(g.AddServer(conn, NewServer(SERVER_TYPE_SLAVE, "127.0.0.1:2222"), ""))
+	assert.MustNoError(g.AddServer(conn, NewServer(SERVER_TYPE_SLAVE, "127.0.0.1:3333"), ""))
+
+	setFakeRedisInfo("127.0.0.1:1111", "role:master", "master_repl_offset:100")
+	setFakeRedisInfo("127.0.0.1:2222", "role:slave", "master_host:127.0.0.1", "master_port:1111",
+		"master_link_status:up", "slave_repl_offset:90")
+
+	// behind the master
+	r, err := g.Promote(conn, "127.0.0.1:2222", "", nil)
+	assert.Must(err != nil)
+	assert.Must(r.MasterOffset == 100 && r.SlaveOffset == 90)
+	assert.Must(r.Steps[len(r.Steps)-1].Step == PROMOTE_STEP_CATCHUP)
+	s, err := g.Master(conn)
+	assert.MustNoError(err)
+	assert.Must(s.Addr == "127.0.0.1:1111")
+
+	// caught up while waiting
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		setFakeRedisInfo("127.0.0.1:2222", "role:slave", "master_host:127.0.0.1", "master_port:1111",
+			"master_link_status:up", "slave_repl_offset:100")
+	}()
+	r, err = g.Promote(conn, "127.0.0.1:2222", "", &PromoteOptions{CatchUp: 5 * time.Second})
+	assert.MustNoError(err)
+	assert.Must(r.OldMaster == "127.0.0.1:1111" && r.SlaveOffset == 100)
+
+	steps := make(map[string][]string)
+	for _, step := range r.Steps {
+		assert.Must(step.Error == "")
+		steps[step.Step] = append(steps[step.Step], step.Addr)
+	}
+	assert.Must(len(steps[PROMOTE_STEP_SLAVEOF]) == 1 && steps[PROMOTE_STEP_SLAVEOF][0] == "127.0.0.1:2222")
+	assert.Must(len(steps[PROMOTE_STEP_REPOINT]) == 1 && steps[PROMOTE_STEP_REPOINT][0] == "127.0.0.1:3333")
+
+	s, err = g.Master(conn)
+	assert.MustNoError(err)
+	assert.Must(s.Addr == "127.0.0.1:2222")
+
+	// a slave of another master can only be forced
+	setFakeRedisInfo("127.0.0.1:3333", "role:slave", "master_host:127.0.0.1", "master_port:1111",
+		"master_link_status:down", "slave_repl_offset:0")
+	setFakeRedisInfo("127.0.0.1:2222", "role:master", "master_repl_offset:100")
+	_, err = g.Promote(conn, "127.0.0.1:3333", "", &PromoteOptions{CatchUp: 5 * time.Second})
+	assert.Must(err != nil)
+	_, err = g.Promote(conn, "127.0.0.1:3333", "", &PromoteOptions{Force: true})
+	assert.MustNoError(err)
+	s, err = g.Master(conn)
+	assert.MustNoError(err)
+	assert.Must(s.Addr == "127.0.0.1:3333")
+}
@@ -107,6 +107,35 @@ func GetMigratingSlots(conn zkhelper.Conn, productName string) ([]*Slot, error)
 	return migrateSlots, nil
 }
 
+// CheckMigratingSlots verifies the states of slots being migrated at the same time,
+// each of them must be moving from one group to another on its own.
+func CheckMigratingSlots(slots []*Slot) error {
+	seen := make(map[int]bool)
+	for _, s := range slots {
+		if seen[s.Id] {
+			return errors.Errorf("slot %d is migrated twice", s.Id)
+		}
+		seen[s.Id] = true
+		switch s.State.Status {
+		case SLOT_STATUS_PRE_MIGRATE:
+			if s.GroupId < 0 {
+				return errors.Errorf("slot %d is pre_migrate without group", s.Id)
+			}
+		case SLOT_STATUS_MIGRATE:
+			from, to := s.State.MigrateStatus.From, s.State.MigrateStatus.To
+			if from < 0 || to < 0 || from == to {
+				return errors.Errorf("slot %d has invalid migrate status, from %d, to %d", s.Id, from, to)
+			}
+			if s.GroupId != to {
+				return errors.Errorf("slot %d is migrating to group %d, but served by group %d", s.Id, to, s.GroupId)
+			}
+		default:
+			return errors.Errorf("slot %d is not migrating, status = %s", s.Id, s.State.Status)
+		}
+	}
+	return nil
+}
+
 func Slots(zkConn zkhelper.Conn, productName string) ([]*Slot, error) {
 	zkPath := GetSlotBasePath(productName)
 	children, _, err := zkConn.Children(zkPath)
@@ -7,11 +7,11 @@ import (
 	"testing"
 
 	"github.com/CodisLabs/codis/pkg/utils/assert"
-	"github.com/wandoulabs/zkhelper"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
 )
 
 func TestSlots(t *testing.T) {
-	fakeZkConn := zkhelper.NewConn()
+	fakeZkConn := memzk.NewConn()
 	path := GetSlotBasePath(productName)
 	children, _, _ := fakeZkConn.Children(path)
 	assert.Must(len(children) == 0)
@@ -50,3 +50,33 @@ func TestSlots(t *testing.T) {
 	assert.Must(s.GroupId == 2)
 	assert.Must(s.State.Status == SLOT_STATUS_MIGRATE)
 }
+
+func TestCheckMigratingSlots(t *testing.T) {
+	fakeZkConn := memzk.NewConn()
+	err := InitSlotSet(fakeZkConn, productName, 16)
+	assert.MustNoError(err)
+	for _, id := range []int{1, 2} {
+		g := NewServerGroup(productName, id)
+		assert.MustNoError(g.Create(fakeZkConn))
+	}
+	err = SetSlotRange(fakeZkConn, productName, 0, 15, 1, SLOT_STATUS_ONLINE)
+	assert.MustNoError(err)
+
+	for _, id := range []int{3, 4, 5} {
+		s, err := GetSlot(fakeZkConn, productName, id)
+		assert.MustNoError(err)
+		assert.MustNoError(s.SetMigrateStatus(fakeZkConn, 1, 2))
+	}
+	slots, err := GetMigratingSlots(fakeZkConn, productName)
+	assert.MustNoError(err)
+	assert.Must(len(slots) == 3)
+	assert.MustNoError(CheckMigratingSlots(slots))
+
+	bad := *slots[0]
+	bad.GroupId = 1
+	assert.Must(CheckMigratingSlots([]*Slot{&bad}) != nil)
+	bad = *slots[0]
+	bad.State.MigrateStatus.From = 2
+	assert.Must(CheckMigratingSlots([]*Slot{&bad}) != nil)
+	assert.Must(CheckMigratingSlots([]*Slot{slots[0], slots[0]}) != nil)
+}
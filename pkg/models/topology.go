@@ -0,0 +1,193 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package models
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+)
+
+// types of topology violations
+const (
+	TOPOLOGY_GROUP_NO_MASTER     = "group_no_master"
+	TOPOLOGY_GROUP_MULTI_MASTERS = "group_multi_masters"
+	TOPOLOGY_SLOT_INVALID_GROUP  = "slot_invalid_group"
+	TOPOLOGY_SLOT_MIGRATE_GROUP  = "slot_migrate_group"
+	TOPOLOGY_DEAD_FENCE          = "dead_fence"
+)
+
+type TopologyViolation struct {
+	Type       string `json:"type"`
+	Target     string `json:"target"`
+	Message    string `json:"message"`
+	Repairable bool   `json:"repairable"`
+	Repaired   bool   `json:"repaired"`
+}
+
+func newViolation(typ, target string, repairable bool, format string, args ...interface{}) *TopologyViolation {
+	return &TopologyViolation{
+		Type:       typ,
+		Target:     target,
+		Message:    fmt.Sprintf(format, args...),
+		Repairable: repairable,
+	}
+}
+
+// topology is a snapshot of groups, slots and proxies of a product.
+type topology struct {
+	groups  map[int]*ServerGroup
+	slots   []*Slot
+	proxies map[string]*ProxyInfo
+	fences  map[string]bool
+}
+
+func loadTopology(zkConn zkhelper.Conn, productName string) (*topology, error) {
+	t := &topology{
+		groups:  make(map[int]*ServerGroup),
+		proxies: make(map[string]*ProxyInfo),
+	}
+	groups, err := ServerGroups(zkConn, productName)
+	if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return nil, errors.Trace(err)
+	}
+	for _, g := range groups {
+		t.groups[g.Id] = g
+	}
+	if t.slots, err = Slots(zkConn, productName); err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return nil, errors.Trace(err)
+	}
+	proxies, err := ProxyList(zkConn, productName, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for i := range proxies {
+		t.proxies[proxies[i].Addr] = &proxies[i]
+	}
+	if t.fences, err = GetFenceProxyMap(zkConn, productName); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return t, nil
+}
+
+func (t *topology) checkGroups() []*TopologyViolation {
+	serving := make(map[int]bool)
+	for _, s := range t.slots {
+		if s.State.Status != SLOT_STATUS_OFFLINE {
+			serving[s.GroupId] = true
+		}
+	}
+	var ids []int
+	for id := range t.groups {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var vs []*TopologyViolation
+	for _, id := range ids {
+		var masters []string
+		for _, s := range t.groups[id].Servers {
+			if s.Type == SERVER_TYPE_MASTER {
+				masters = append(masters, s.Addr)
+			}
+		}
+		target := fmt.Sprintf("group_%d", id)
+		switch {
+		case len(masters) > 1:
+			vs = append(vs, newViolation(TOPOLOGY_GROUP_MULTI_MASTERS, target, false,
+				"group %d has %d masters %v", id, len(masters), masters))
+		case len(masters) == 0 && (len(t.groups[id].Servers) != 0 || serving[id]):
+			vs = append(vs, newViolation(TOPOLOGY_GROUP_NO_MASTER, target, false,
+				"group %d has %d servers but no master", id, len(t.groups[id].Servers)))
+		}
+	}
+	return vs
+}
+
+func (t *topology) checkSlots() []*TopologyViolation {
+	var vs []*TopologyViolation
+	for _, s := range t.slots {
+		target := fmt.Sprintf("slot_%d", s.Id)
+		if s.State.Status != SLOT_STATUS_OFFLINE && t.groups[s.GroupId] == nil {
+			vs = append(vs, newViolation(TOPOLOGY_SLOT_INVALID_GROUP, target, false,
+				"slot %d is %s on group %d, which doesn't exist", s.Id, s.State.Status, s.GroupId))
+		}
+		if s.State.Status != SLOT_STATUS_MIGRATE {
+			continue
+		}
+		from, to := s.State.MigrateStatus.From, s.State.MigrateStatus.To
+		switch {
+		case t.groups[from] == nil || t.groups[to] == nil:
+			vs = append(vs, newViolation(TOPOLOGY_SLOT_MIGRATE_GROUP, target, false,
+				"slot %d is migrating from group %d to group %d, which doesn't exist", s.Id, from, to))
+		case from == to || s.GroupId != to:
+			vs = append(vs, newViolation(TOPOLOGY_SLOT_MIGRATE_GROUP, target, false,
+				"slot %d has invalid migrate status, from %d, to %d, served by group %d", s.Id, from, to, s.GroupId))
+		}
+	}
+	return vs
+}
+
+// checkFences reports fences of proxies that are not online, they block all
+// actions. Fences of proxies that are gone are safe to remove, a proxy that
+// is still registered may be alive.
+func (t *topology) checkFences() []*TopologyViolation {
+	var addrs []string
+	for addr := range t.fences {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var vs []*TopologyViolation
+	for _, addr := range addrs {
+		p := t.proxies[addr]
+		switch {
+		case p == nil:
+			vs = append(vs, newViolation(TOPOLOGY_DEAD_FENCE, addr, true,
+				"fence of proxy %s is left, the proxy is gone", addr))
+		case p.State != PROXY_STATE_ONLINE:
+			vs = append(vs, newViolation(TOPOLOGY_DEAD_FENCE, addr, false,
+				"fence of proxy %s is left, the proxy %s is %s", addr, p.Id, p.State))
+		}
+	}
+	return vs
+}
+
+// CheckTopology checks the invariants of groups, slots and proxy fences that
+// are assumed everywhere but never enforced.
+func CheckTopology(zkConn zkhelper.Conn, productName string) ([]*TopologyViolation, error) {
+	t, err := loadTopology(zkConn, productName)
+	if err != nil {
+		return nil, err
+	}
+	var vs []*TopologyViolation
+	vs = append(vs, t.checkGroups()...)
+	vs = append(vs, t.checkSlots()...)
+	vs = append(vs, t.checkFences()...)
+	return vs, nil
+}
+
+// RepairTopology repairs the repairable violations found by CheckTopology.
+func RepairTopology(zkConn zkhelper.Conn, productName string, vs []*TopologyViolation) error {
+	for _, v := range vs {
+		if !v.Repairable || v.Repaired {
+			continue
+		}
+		switch v.Type {
+		case TOPOLOGY_DEAD_FENCE:
+			fencePath := path.Join(GetProxyFencePath(productName), v.Target)
+			log.Warnf("removing dead fence: %s", fencePath)
+			if err := zkhelper.DeleteRecursive(zkConn, fencePath, -1); err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+				return errors.Trace(err)
+			}
+			v.Repaired = true
+		}
+	}
+	return nil
+}
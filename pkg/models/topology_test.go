@@ -0,0 +1,73 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
+	"github.com/wandoulabs/zkhelper"
+)
+
+func TestCheckTopology(t *testing.T) {
+	fakeZkConn := memzk.NewConn()
+	assert.MustNoError(InitSlotSet(fakeZkConn, productName, 16))
+	for _, id := range []int{1, 2, 3} {
+		assert.MustNoError(NewServerGroup(productName, id).Create(fakeZkConn))
+	}
+	g1 := NewServerGroup(productName, 1)
+	assert.MustNoError(g1.AddServer(fakeZkConn, NewServer(SERVER_TYPE_MASTER, "localhost:1111"), ""))
+	g2 := NewServerGroup(productName, 2)
+	assert.MustNoError(g2.AddServer(fakeZkConn, NewServer(SERVER_TYPE_MASTER, "localhost:2222"), ""))
+	assert.MustNoError(SetSlotRange(fakeZkConn, productName, 0, 15, 1, SLOT_STATUS_ONLINE))
+
+	vs, err := CheckTopology(fakeZkConn, productName)
+	assert.MustNoError(err)
+	assert.Must(len(vs) == 0)
+
+	// a second master written behind the back of AddServer
+	b, _ := json.Marshal(&Server{Type: SERVER_TYPE_MASTER, GroupId: 2, Addr: "localhost:2223"})
+	_, err = zkhelper.CreateOrUpdate(fakeZkConn, fmt.Sprintf("/zk/codis/db_%s/servers/group_2/localhost:2223", productName),
+		string(b), 0, zkhelper.DefaultFileACLs(), true)
+	assert.MustNoError(err)
+
+	s, err := GetSlot(fakeZkConn, productName, 1)
+	assert.MustNoError(err)
+	s.GroupId = 4
+	assert.MustNoError(s.Update(fakeZkConn))
+	s, err = GetSlot(fakeZkConn, productName, 2)
+	assert.MustNoError(err)
+	assert.MustNoError(s.SetMigrateStatus(fakeZkConn, 1, 5))
+
+	pi := &ProxyInfo{Id: "proxy_1", Addr: "localhost:1234", State: PROXY_STATE_OFFLINE}
+	_, err = CreateProxyInfo(fakeZkConn, productName, pi)
+	assert.MustNoError(err)
+	_, err = CreateProxyFenceNode(fakeZkConn, productName, pi)
+	assert.MustNoError(err)
+	_, err = CreateProxyFenceNode(fakeZkConn, productName, &ProxyInfo{Addr: "localhost:4321"})
+	assert.MustNoError(err)
+
+	vs, err = CheckTopology(fakeZkConn, productName)
+	assert.MustNoError(err)
+	types := make(map[string]int)
+	for _, v := range vs {
+		types[v.Type]++
+	}
+	assert.Must(len(vs) == 6)
+	assert.Must(types[TOPOLOGY_GROUP_MULTI_MASTERS] == 1)
+	assert.Must(types[TOPOLOGY_SLOT_INVALID_GROUP] == 2)
+	assert.Must(types[TOPOLOGY_SLOT_MIGRATE_GROUP] == 1)
+	assert.Must(types[TOPOLOGY_DEAD_FENCE] == 2)
+
+	assert.MustNoError(RepairTopology(fakeZkConn, productName, vs))
+	fences, err := GetFenceProxyMap(fakeZkConn, productName)
+	assert.MustNoError(err)
+	assert.Must(len(fences) == 1 && fences["localhost:1234"])
+	for _, v := range vs {
+		assert.Must(v.Repaired == (v.Target == "localhost:4321"))
+	}
+}
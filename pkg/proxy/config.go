@@ -4,9 +4,11 @@
 package proxy
 
 import (
+	"strconv"
 	"strings"
 
 	"github.com/c4pt0r/cfg"
+	"github.com/CodisLabs/codis/pkg/utils/bytesize"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
 
@@ -25,6 +27,33 @@ type Config struct {
 	maxBufSize       int
 	maxPipeline      int
 	zkSessionTimeout int
+
+	maxSessionBufMem int64 // bytes
+	maxProxyBufMem   int64 // bytes
+
+	coalesceCmds    []string
+	coalesceMaxKeys int
+
+	nearCacheRules    []string
+	nearCacheTTL      int // milliseconds
+	nearCacheMaxBytes int64
+
+	mirrorAddr    string
+	mirrorAuth    string
+	mirrorRate    float64
+	mirrorCmds    []string
+	mirrorCompare bool
+
+	captureFile     string
+	captureRate     float64
+	captureMaxSize  int64
+	captureMaxFiles int
+	captureDir      string
+}
+
+// CaptureDir returns where files captured by the http debug server are kept.
+func (conf *Config) CaptureDir() string {
+	return conf.captureDir
 }
 
 func LoadConf(configFile string) (*Config, error) {
@@ -70,6 +99,73 @@ func LoadConf(configFile string) (*Config, error) {
 	conf.maxBufSize = loadConfInt("session_max_bufsize", 131072)
 	conf.maxPipeline = loadConfInt("session_max_pipeline", 1024)
 	conf.zkSessionTimeout = loadConfInt("zk_session_timeout", 30000)
+
+	loadConfBytes := func(entry string, defval string) int64 {
+		s, _ := c.ReadString(entry, defval)
+		v, err := bytesize.Parse(s)
+		if err != nil || v < 0 {
+			log.Panicf("invalid config: read %s = %s", entry, s)
+		}
+		return v
+	}
+
+	conf.maxSessionBufMem = loadConfBytes("session_max_bufmem", "0")
+	conf.maxProxyBufMem = loadConfBytes("proxy_max_bufmem", "0")
+
+	if cmds, _ := c.ReadString("read_coalesce_cmds", ""); len(cmds) != 0 {
+		for _, s := range strings.Split(cmds, ",") {
+			if s = strings.TrimSpace(s); len(s) != 0 {
+				conf.coalesceCmds = append(conf.coalesceCmds, s)
+			}
+		}
+	}
+	conf.coalesceMaxKeys = loadConfInt("read_coalesce_max_keys", 10000)
+
+	if rules, _ := c.ReadString("nearcache_rules", ""); len(rules) != 0 {
+		for _, s := range strings.Split(rules, ",") {
+			if s = strings.TrimSpace(s); len(s) != 0 {
+				conf.nearCacheRules = append(conf.nearCacheRules, s)
+			}
+		}
+	}
+	conf.nearCacheTTL = loadConfInt("nearcache_ttl", 1000)
+	conf.nearCacheMaxBytes = loadConfBytes("nearcache_max_bytes", "64mb")
+
+	conf.mirrorAddr, _ = c.ReadString("mirror_addr", "")
+	conf.mirrorAddr = strings.TrimSpace(conf.mirrorAddr)
+	conf.mirrorAuth, _ = c.ReadString("mirror_auth", "")
+	loadConfRate := func(entry string, defval string) float64 {
+		s, _ := c.ReadString(entry, defval)
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || v < 0 || v > 1 {
+			log.Panicf("invalid config: read %s = %s", entry, s)
+		}
+		return v
+	}
+
+	conf.mirrorRate = loadConfRate("mirror_rate", "1")
+	if cmds, _ := c.ReadString("mirror_cmds", ""); len(cmds) != 0 {
+		for _, s := range strings.Split(cmds, ",") {
+			if s = strings.TrimSpace(s); len(s) != 0 {
+				conf.mirrorCmds = append(conf.mirrorCmds, s)
+			}
+		}
+	}
+	compare, _ := c.ReadString("mirror_compare", "false")
+	if v, err := strconv.ParseBool(strings.TrimSpace(compare)); err != nil {
+		log.Panicf("invalid config: read mirror_compare = %s", compare)
+	} else {
+		conf.mirrorCompare = v
+	}
+
+	conf.captureFile, _ = c.ReadString("capture_file", "")
+	conf.captureFile = strings.TrimSpace(conf.captureFile)
+	conf.captureRate = loadConfRate("capture_rate", "1")
+	conf.captureMaxSize = loadConfBytes("capture_max_size", "256mb")
+	conf.captureMaxFiles = loadConfInt("capture_max_files", 8)
+	conf.captureDir, _ = c.ReadString("capture_dir", "")
+	conf.captureDir = strings.TrimSpace(conf.captureDir)
+
 	if conf.zkSessionTimeout <= 100 {
 		conf.zkSessionTimeout *= 1000
 		log.Warn("zkSessionTimeout is to small, it is ms not second")
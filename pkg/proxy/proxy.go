@@ -75,6 +75,15 @@ func New(addr string, debugVarAddr string, conf *Config) *Server {
 		s.listener = l
 	}
 	s.router = router.NewWithAuth(conf.passwd)
+	router.SetMaxBufferedMemory(conf.maxProxyBufMem)
+	s.router.SetReadCoalescing(conf.coalesceCmds, conf.coalesceMaxKeys)
+	s.router.SetNearCache(conf.nearCacheRules, time.Millisecond*time.Duration(conf.nearCacheTTL), conf.nearCacheMaxBytes)
+	s.router.SetMirror(conf.mirrorAddr, conf.mirrorAuth, conf.mirrorRate, conf.mirrorCmds, conf.mirrorCompare)
+	if len(conf.captureFile) != 0 {
+		if err := router.StartCapture(conf.captureFile, conf.captureRate, conf.captureMaxSize, conf.captureMaxFiles, 0); err != nil {
+			log.PanicErrorf(err, "start capturing requests to %s failed", conf.captureFile)
+		}
+	}
 	s.evtbus = make(chan interface{}, 1024)
 
 	s.register()
@@ -133,6 +142,7 @@ func (s *Server) handleConns() {
 	go func() {
 		for c := range ch {
 			x := router.NewSessionSize(c, s.conf.passwd, s.conf.maxBufSize, s.conf.maxTimeout)
+			x.SetMaxBufferedMemory(s.conf.maxSessionBufMem)
 			go x.Serve(s.router, s.conf.maxPipeline)
 		}
 	}()
@@ -173,6 +183,7 @@ func (s *Server) close() {
 		if s.router != nil {
 			s.router.Close()
 		}
+		router.StopCapture()
 		close(s.kill)
 	})
 }
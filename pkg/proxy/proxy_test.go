@@ -15,6 +15,7 @@ import (
 
 	"github.com/CodisLabs/codis/pkg/models"
 	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
 )
 
 var (
@@ -26,12 +27,14 @@ var (
 )
 
 func init() {
-	conn = zkhelper.NewConn()
+	// the proxy has a session of its own, as if it were another process
+	store := memzk.NewStore()
+	conn = store.NewConn()
 	conf = &Config{
 		proxyId:     "proxy_test",
 		productName: "test",
 		zkAddr:      "localhost:2181",
-		fact:        func(string, int) (zkhelper.Conn, error) { return conn, nil },
+		fact:        func(string, int) (zkhelper.Conn, error) { return store.NewConn(), nil },
 		proto:       "tcp4",
 	}
 
@@ -0,0 +1,297 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// CaptureRecord is a request captured from a client session. In capture files
+// a record is stored as a RESP array of the timestamp in microseconds, the
+// session id and the request itself.
+type CaptureRecord struct {
+	Usecs   int64
+	Session int64
+	Resp    *redis.Resp
+}
+
+func (x *CaptureRecord) encode() *redis.Resp {
+	return redis.NewArray([]*redis.Resp{
+		redis.NewInt([]byte(strconv.FormatInt(x.Usecs, 10))),
+		redis.NewInt([]byte(strconv.FormatInt(x.Session, 10))),
+		x.Resp,
+	})
+}
+
+var ErrBadCaptureRecord = errors.New("bad capture record")
+
+func decodeCaptureRecord(resp *redis.Resp) (*CaptureRecord, error) {
+	if !resp.IsArray() || len(resp.Array) != 3 {
+		return nil, errors.Trace(ErrBadCaptureRecord)
+	}
+	a := resp.Array
+	if !a[0].IsInt() || !a[1].IsInt() || !a[2].IsArray() {
+		return nil, errors.Trace(ErrBadCaptureRecord)
+	}
+	usecs, err := strconv.ParseInt(string(a[0].Value), 10, 64)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	session, err := strconv.ParseInt(string(a[1].Value), 10, 64)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &CaptureRecord{Usecs: usecs, Session: session, Resp: a[2]}, nil
+}
+
+type CaptureReader struct {
+	*redis.Decoder
+}
+
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{redis.NewDecoderSize(r, 1024*64)}
+}
+
+// Read returns the next record, or io.EOF at the end of the capture.
+func (r *CaptureReader) Read() (*CaptureRecord, error) {
+	resp, err := r.Decode()
+	if err != nil {
+		if errors.Equal(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return decodeCaptureRecord(resp)
+}
+
+var capturestats struct {
+	records atomic2.Int64
+	dropped atomic2.Int64
+	bytes   atomic2.Int64
+	rotated atomic2.Int64
+	errors  atomic2.Int64
+}
+
+func GetCaptureStats() map[string]interface{} {
+	m := map[string]interface{}{
+		"records": capturestats.records.Get(),
+		"dropped": capturestats.dropped.Get(),
+		"bytes":   capturestats.bytes.Get(),
+		"rotated": capturestats.rotated.Get(),
+		"errors":  capturestats.errors.Get(),
+	}
+	capturer.RLock()
+	if c := capturer.c; c != nil {
+		m["file"] = c.path
+		m["rate"] = c.rate
+		m["start"] = c.start.Unix()
+	}
+	capturer.RUnlock()
+	return m
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Capture writes sampled client requests to a file. When the file grows above
+// maxSize it is rotated, keeping at most maxFiles old files named path.1, path.2
+// and so on, path.1 being the newest one.
+type Capture struct {
+	path     string
+	rate     float64
+	maxSize  int64
+	maxFiles int
+	start    time.Time
+
+	input chan *CaptureRecord
+	exit  chan struct{}
+	once  sync.Once
+
+	file *os.File
+	cw   *countWriter
+	enc  *redis.Encoder
+}
+
+func NewCapture(path string, rate float64, maxSize int64, maxFiles int) (*Capture, error) {
+	c := &Capture{
+		path: path, rate: rate,
+		maxSize: maxSize, maxFiles: maxFiles,
+		start: time.Now(),
+		input: make(chan *CaptureRecord, 4096),
+		exit:  make(chan struct{}),
+	}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	go c.loopWriter()
+	return c, nil
+}
+
+func (c *Capture) open() error {
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	c.file = f
+	c.cw = &countWriter{w: f, n: fi.Size()}
+	c.enc = redis.NewEncoderSize(c.cw, 1024*64)
+	return nil
+}
+
+func (c *Capture) rotate() error {
+	if err := c.file.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	if c.maxFiles <= 0 {
+		if err := os.Remove(c.path); err != nil {
+			return errors.Trace(err)
+		}
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", c.path, c.maxFiles))
+		for i := c.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i+1))
+		}
+		if err := os.Rename(c.path, c.path+".1"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	capturestats.rotated.Incr()
+	return c.open()
+}
+
+func (c *Capture) loopWriter() {
+	defer close(c.exit)
+	defer func() {
+		if c.file != nil {
+			c.enc.Flush()
+			c.file.Close()
+		}
+	}()
+	for x := range c.input {
+		if c.enc == nil {
+			continue
+		}
+		before := c.cw.n + int64(c.enc.Buffered())
+		if err := c.enc.Encode(x.encode(), len(c.input) == 0); err != nil {
+			log.WarnErrorf(err, "capture to %s failed, stop capturing", c.path)
+			capturestats.errors.Incr()
+			c.file.Close()
+			c.file, c.enc = nil, nil
+			continue
+		}
+		capturestats.records.Incr()
+		capturestats.bytes.Add(c.cw.n + int64(c.enc.Buffered()) - before)
+
+		if c.maxSize > 0 && c.cw.n+int64(c.enc.Buffered()) >= c.maxSize {
+			err := c.enc.Flush()
+			if err == nil {
+				err = c.rotate()
+			}
+			if err != nil {
+				log.WarnErrorf(err, "rotate capture file %s failed, stop capturing", c.path)
+				capturestats.errors.Incr()
+				c.file, c.enc = nil, nil
+			}
+		}
+	}
+}
+
+func (c *Capture) push(session int64, r *Request) {
+	if c.rate < 1 && rand.Float64() >= c.rate {
+		return
+	}
+	x := &CaptureRecord{Usecs: r.Start, Session: session, Resp: r.Resp}
+	select {
+	case c.input <- x:
+	default:
+		capturestats.dropped.Incr()
+	}
+}
+
+func (c *Capture) Close() {
+	c.once.Do(func() {
+		close(c.input)
+	})
+	<-c.exit
+}
+
+var capturer struct {
+	sync.RWMutex
+	c *Capture
+}
+
+// StartCapture starts capturing client requests to the given file, a running
+// capture is stopped first. If duration is positive, the capture stops after it.
+func StartCapture(path string, rate float64, maxSize int64, maxFiles int, duration time.Duration) error {
+	c, err := NewCapture(path, rate, maxSize, maxFiles)
+	if err != nil {
+		return err
+	}
+	capturer.Lock()
+	last := capturer.c
+	capturer.c = c
+	capturer.Unlock()
+	if last != nil {
+		last.Close()
+	}
+	log.Infof("start capturing requests to %s, rate = %v, duration = %v", path, rate, duration)
+	if duration > 0 {
+		time.AfterFunc(duration, func() {
+			capturer.Lock()
+			stop := capturer.c == c
+			if stop {
+				capturer.c = nil
+			}
+			capturer.Unlock()
+			if stop {
+				c.Close()
+				log.Infof("stop capturing requests to %s", path)
+			}
+		})
+	}
+	return nil
+}
+
+func StopCapture() {
+	capturer.Lock()
+	c := capturer.c
+	capturer.c = nil
+	capturer.Unlock()
+	if c != nil {
+		c.Close()
+		log.Infof("stop capturing requests to %s", c.path)
+	}
+}
+
+func captureRequest(session int64, r *Request) {
+	capturer.RLock()
+	if c := capturer.c; c != nil {
+		c.push(session, r)
+	}
+	capturer.RUnlock()
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func readCapture(file string) []*CaptureRecord {
+	f, err := os.Open(file)
+	assert.MustNoError(err)
+	defer f.Close()
+	var records []*CaptureRecord
+	r := NewCaptureReader(f)
+	for {
+		x, err := r.Read()
+		if err == io.EOF {
+			return records
+		}
+		assert.MustNoError(err)
+		records = append(records, x)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	assert.MustNoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "capture.log")
+	c, err := NewCapture(file, 1, 0, 0)
+	assert.MustNoError(err)
+	for i := 0; i < 100; i++ {
+		r := newGetRequest("key" + strconv.Itoa(i))
+		r.Start = int64(i)
+		c.push(int64(i%3), r)
+	}
+	c.Close()
+
+	records := readCapture(file)
+	assert.Must(len(records) == 100)
+	for i, x := range records {
+		assert.Must(x.Usecs == int64(i))
+		assert.Must(x.Session == int64(i%3))
+		assert.Must(string(x.Resp.Array[1].Value) == "key"+strconv.Itoa(i))
+	}
+}
+
+func TestCaptureRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	assert.MustNoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "capture.log")
+	c, err := NewCapture(file, 1, 256, 2)
+	assert.MustNoError(err)
+	for i := 0; i < 100; i++ {
+		c.push(1, newGetRequest("key"))
+	}
+	c.Close()
+
+	var total int
+	for _, name := range []string{file + ".2", file + ".1", file} {
+		total += len(readCapture(name))
+	}
+	assert.Must(total > 0 && total < 100)
+	_, err = os.Stat(file + ".3")
+	assert.Must(os.IsNotExist(err))
+}
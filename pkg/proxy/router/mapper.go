@@ -78,6 +78,12 @@ func getOpStr(resp *redis.Resp) (string, error) {
 	return string(upper[:len(op)]), nil
 }
 
+// HashSlot returns the slot of the key, a hash tag in braces is used instead of
+// the whole key if present.
+func HashSlot(key []byte) int {
+	return hashSlot(key)
+}
+
 func hashSlot(key []byte) int {
 	const (
 		TagBeg = '{'
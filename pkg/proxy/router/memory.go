@@ -0,0 +1,164 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+)
+
+// MemLimiter accounts the bytes held by buffered requests and blocks the
+// caller of Acquire while the usage is above the limit.
+type MemLimiter struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	limit atomic2.Int64
+	usage atomic2.Int64
+
+	throttled atomic2.Int64
+	waitUsecs atomic2.Int64
+	lastUnix  atomic2.Int64
+}
+
+func NewMemLimiter(limit int64) *MemLimiter {
+	m := &MemLimiter{}
+	m.cond = sync.NewCond(&m.mu)
+	m.limit.Set(limit)
+	return m
+}
+
+func (m *MemLimiter) Limit() int64 {
+	return m.limit.Get()
+}
+
+func (m *MemLimiter) SetLimit(limit int64) {
+	m.mu.Lock()
+	m.limit.Set(limit)
+	m.cond.Broadcast()
+	m.mu.Unlock()
+}
+
+func (m *MemLimiter) Usage() int64 {
+	return m.usage.Get()
+}
+
+func (m *MemLimiter) Throttled() int64 {
+	return m.throttled.Get()
+}
+
+func (m *MemLimiter) overLimit(n int64) bool {
+	limit, usage := m.limit.Get(), m.usage.Get()
+	if limit <= 0 || usage == 0 {
+		return false
+	}
+	return usage+n > limit
+}
+
+// Acquire charges n bytes, waiting until there is enough room under the limit.
+// A single request larger than the limit is admitted once the usage drops to
+// zero, so it can never block forever. Returns true if the caller was throttled.
+func (m *MemLimiter) Acquire(n int64) bool {
+	if !m.overLimit(n) {
+		m.usage.Add(n)
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.overLimit(n) {
+		m.usage.Add(n)
+		return false
+	}
+	start := microseconds()
+	m.throttled.Incr()
+	m.lastUnix.Set(start / 1e6)
+	for m.overLimit(n) {
+		m.cond.Wait()
+	}
+	m.usage.Add(n)
+	m.waitUsecs.Add(microseconds() - start)
+	return true
+}
+
+// Grow charges n bytes without waiting.
+func (m *MemLimiter) Grow(n int64) {
+	m.usage.Add(n)
+}
+
+func (m *MemLimiter) Release(n int64) {
+	if n == 0 {
+		return
+	}
+	m.usage.Sub(n)
+	if m.limit.Get() > 0 {
+		m.mu.Lock()
+		m.cond.Broadcast()
+		m.mu.Unlock()
+	}
+}
+
+func (m *MemLimiter) MarshalJSON() ([]byte, error) {
+	var o = make(map[string]interface{})
+	o["limit"] = m.limit.Get()
+	o["usage"] = m.usage.Get()
+	o["throttled"] = m.throttled.Get()
+	o["wait_usecs"] = m.waitUsecs.Get()
+	o["last_throttled"] = m.lastUnix.Get()
+	return json.Marshal(o)
+}
+
+var memstats struct {
+	global *MemLimiter
+
+	session struct {
+		throttled atomic2.Int64
+		waitUsecs atomic2.Int64
+		lastUnix  atomic2.Int64
+	}
+}
+
+func init() {
+	memstats.global = NewMemLimiter(0)
+}
+
+// SetMaxBufferedMemory sets the limit of bytes buffered by all sessions, 0 means unlimited.
+func SetMaxBufferedMemory(limit int64) {
+	memstats.global.SetLimit(limit)
+}
+
+func GlobalMemLimiter() *MemLimiter {
+	return memstats.global
+}
+
+func GetMemStats() map[string]interface{} {
+	return map[string]interface{}{
+		"global": memstats.global,
+		"session": map[string]interface{}{
+			"throttled":      memstats.session.throttled.Get(),
+			"wait_usecs":     memstats.session.waitUsecs.Get(),
+			"last_throttled": memstats.session.lastUnix.Get(),
+		},
+	}
+}
+
+func incrSessionThrottled(usecs int64) {
+	memstats.session.throttled.Incr()
+	memstats.session.waitUsecs.Add(usecs)
+	memstats.session.lastUnix.Set(time.Now().Unix())
+}
+
+func respSize(r *redis.Resp) int64 {
+	if r == nil {
+		return 0
+	}
+	var n = int64(len(r.Value)) + 16
+	for _, x := range r.Array {
+		n += respSize(x)
+	}
+	return n
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestMemLimiterUnlimited(t *testing.T) {
+	m := NewMemLimiter(0)
+	for i := 0; i < 100; i++ {
+		assert.Must(!m.Acquire(1024))
+	}
+	assert.Must(m.Usage() == 1024*100)
+	m.Release(1024 * 100)
+	assert.Must(m.Usage() == 0)
+	assert.Must(m.Throttled() == 0)
+}
+
+func TestMemLimiterThrottle(t *testing.T) {
+	m := NewMemLimiter(100)
+	assert.Must(!m.Acquire(60))
+	assert.Must(!m.Acquire(40))
+
+	done := make(chan bool)
+	go func() {
+		done <- m.Acquire(10)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("acquire should be blocked")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	m.Release(60)
+	assert.Must(<-done)
+	assert.Must(m.Usage() == 50)
+	assert.Must(m.Throttled() == 1)
+}
+
+func TestMemLimiterOversize(t *testing.T) {
+	m := NewMemLimiter(100)
+	assert.Must(!m.Acquire(1000))
+
+	done := make(chan bool)
+	go func() {
+		done <- m.Acquire(1000)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	m.Release(1000)
+	assert.Must(<-done)
+	assert.Must(m.Usage() == 1000)
+}
+
+func TestRespSize(t *testing.T) {
+	r := redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes([]byte("SET")),
+		redis.NewBulkBytes([]byte("key")),
+		redis.NewBulkBytes(make([]byte, 1024)),
+	})
+	assert.Must(respSize(r) > 1024)
+	assert.Must(respSize(nil) == 0)
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+)
+
+var mirrorstats struct {
+	sent       atomic2.Int64
+	dropped    atomic2.Int64
+	errors     atomic2.Int64
+	compared   atomic2.Int64
+	mismatches atomic2.Int64
+}
+
+func GetMirrorStats() map[string]int64 {
+	return map[string]int64{
+		"sent":       mirrorstats.sent.Get(),
+		"dropped":    mirrorstats.dropped.Get(),
+		"errors":     mirrorstats.errors.Get(),
+		"compared":   mirrorstats.compared.Get(),
+		"mismatches": mirrorstats.mismatches.Get(),
+	}
+}
+
+type mirrorCall struct {
+	primary *Request
+	shadow  *Request
+}
+
+// mirror copies sampled requests to a shadow target and discards the replies.
+// Requests are queued without blocking, they are dropped if the queue is full,
+// so a slow or broken shadow never delays the primary path.
+type mirror struct {
+	bc *BackendConn
+
+	rate    float64
+	cmds    map[string]bool
+	compare bool
+
+	queue   chan *mirrorCall
+	pending chan *mirrorCall
+	stop    chan struct{}
+	exit    chan struct{}
+	once    sync.Once
+}
+
+const mirrorQueueSize = 4096
+
+func newMirror(addr, auth string, rate float64, cmds []string, compare bool) *mirror {
+	m := &mirror{
+		bc:      NewBackendConn(addr, auth),
+		rate:    rate,
+		compare: compare,
+		queue:   make(chan *mirrorCall, mirrorQueueSize),
+		pending: make(chan *mirrorCall, mirrorQueueSize),
+		stop:    make(chan struct{}),
+		exit:    make(chan struct{}),
+	}
+	for _, s := range cmds {
+		if opstr := strings.ToUpper(strings.TrimSpace(s)); opstr != "" {
+			if m.cmds == nil {
+				m.cmds = make(map[string]bool)
+			}
+			m.cmds[opstr] = true
+		}
+	}
+	go m.loopSender()
+	go m.loopReceiver()
+	return m
+}
+
+func (m *mirror) Close() {
+	m.once.Do(func() {
+		close(m.stop)
+		<-m.exit
+		m.bc.Close()
+	})
+}
+
+func (m *mirror) isSampled(opstr string) bool {
+	if m.cmds != nil && !m.cmds[opstr] {
+		return false
+	}
+	return m.rate >= 1 || rand.Float64() < m.rate
+}
+
+func (m *mirror) dispatch(r *Request, forward func(r *Request) error) error {
+	if err := forward(r); err != nil {
+		return err
+	}
+	c := &mirrorCall{
+		shadow: &Request{
+			OpStr: r.OpStr,
+			Start: r.Start,
+			Resp:  r.Resp,
+			Wait:  &sync.WaitGroup{},
+		},
+	}
+	if m.compare {
+		// the reply of r is only read after r.Wait, as the session does
+		c.primary = r
+	}
+	m.push(c)
+	return nil
+}
+
+func (m *mirror) push(c *mirrorCall) {
+	select {
+	case m.queue <- c:
+	default:
+		mirrorstats.dropped.Incr()
+	}
+}
+
+func (m *mirror) loopSender() {
+	defer close(m.exit)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case c := <-m.queue:
+			m.bc.PushBack(c.shadow)
+			mirrorstats.sent.Incr()
+			select {
+			case <-m.stop:
+				return
+			case m.pending <- c:
+			}
+		}
+	}
+}
+
+func (m *mirror) loopReceiver() {
+	for {
+		select {
+		case <-m.stop:
+			return
+		case c := <-m.pending:
+			c.shadow.Wait.Wait()
+			if c.shadow.Response.Err != nil {
+				mirrorstats.errors.Incr()
+				continue
+			}
+			if c.primary == nil {
+				continue
+			}
+			c.primary.Wait.Wait()
+			if c.primary.Response.Err != nil {
+				continue
+			}
+			mirrorstats.compared.Incr()
+			if !respEqual(c.primary.Response.Resp, c.shadow.Response.Resp) {
+				mirrorstats.mismatches.Incr()
+			}
+		}
+	}
+}
+
+func respEqual(a, b *redis.Resp) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Type != b.Type || !bytes.Equal(a.Value, b.Value) || len(a.Array) != len(b.Array) {
+		return false
+	}
+	for i := range a.Array {
+		if !respEqual(a.Array[i], b.Array[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+)
+
+func waitMirrorStats(f func() bool) {
+	for i := 0; i < 100 && !f(); i++ {
+		time.Sleep(time.Millisecond * 20)
+	}
+	assert.Must(f())
+}
+
+func TestMirror(t *testing.T) {
+	var primary, shadow atomic2.Int64
+	l1 := newSlowBackend(0, &primary)
+	defer l1.Close()
+	l2 := newSlowBackend(time.Millisecond*50, &shadow)
+	defer l2.Close()
+
+	s := New()
+	defer s.Close()
+	s.SetMirror(l2.Addr().String(), "", 1, []string{"get"}, true)
+
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(s.FillSlot(i, l1.Addr().String(), "", false))
+	}
+
+	base := GetMirrorStats()
+	for i := 0; i < 10; i++ {
+		r := newGetRequest("key")
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		assert.Must(string(r.Response.Resp.Value) == "key")
+	}
+	assert.Must(primary.Get() == 10)
+
+	waitMirrorStats(func() bool {
+		return GetMirrorStats()["compared"]-base["compared"] == 10
+	})
+	assert.Must(shadow.Get() == 10)
+	assert.Must(GetMirrorStats()["mismatches"] == base["mismatches"])
+}
+
+func TestMirrorSampling(t *testing.T) {
+	m := &mirror{rate: 0, cmds: map[string]bool{"GET": true}}
+	assert.Must(!m.isSampled("GET"))
+	m.rate = 1
+	assert.Must(m.isSampled("GET"))
+	assert.Must(!m.isSampled("SET"))
+	m.cmds = nil
+	assert.Must(m.isSampled("SET"))
+}
+
+func TestRespEqual(t *testing.T) {
+	a := redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("a")), redis.NewInt([]byte("1"))})
+	b := redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("a")), redis.NewInt([]byte("1"))})
+	c := redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("a")), redis.NewString([]byte("1"))})
+	assert.Must(respEqual(a, b))
+	assert.Must(!respEqual(a, c))
+	assert.Must(!respEqual(a, nil))
+}
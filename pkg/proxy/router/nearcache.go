@@ -0,0 +1,284 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+)
+
+var cachestats struct {
+	hits          atomic2.Int64
+	misses        atomic2.Int64
+	fills         atomic2.Int64
+	invalidations atomic2.Int64
+	evictions     atomic2.Int64
+	entries       atomic2.Int64
+	bytes         atomic2.Int64
+}
+
+func GetNearCacheStats() map[string]interface{} {
+	hits, misses := cachestats.hits.Get(), cachestats.misses.Get()
+	var ratio float64
+	if hits+misses != 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	return map[string]interface{}{
+		"hits":          hits,
+		"misses":        misses,
+		"hit_ratio":     ratio,
+		"fills":         cachestats.fills.Get(),
+		"invalidations": cachestats.invalidations.Get(),
+		"evictions":     cachestats.evictions.Get(),
+		"entries":       cachestats.entries.Get(),
+		"bytes":         cachestats.bytes.Get(),
+	}
+}
+
+type cacheEntry struct {
+	key    string
+	slot   int
+	resp   *redis.Resp
+	size   int64
+	expire int64
+}
+
+// nearCache is a LRU cache of GET replies for keys matching the configured
+// rules. A key is invalidated by any write to it passing through the proxy,
+// and a whole slot is dropped when the slot is filled or reset.
+type nearCache struct {
+	mu sync.Mutex
+
+	rules    []string
+	ttl      int64 // usecs
+	maxBytes int64
+
+	lru    *list.List
+	keys   map[string]*list.Element
+	bySlot [MaxSlotNum]map[string]*list.Element
+	epoch  [MaxSlotNum]int64
+	size   int64
+}
+
+func newNearCache(rules []string, ttl time.Duration, maxBytes int64) *nearCache {
+	c := &nearCache{
+		ttl:      int64(ttl / time.Microsecond),
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		keys:     make(map[string]*list.Element),
+	}
+	for _, r := range rules {
+		if r = strings.TrimSpace(r); len(r) != 0 {
+			c.rules = append(c.rules, r)
+		}
+	}
+	return c
+}
+
+// globMatch supports '*' and '?' wildcards, a rule without wildcards is a prefix.
+func globMatch(pattern, s string) bool {
+	if !strings.ContainsAny(pattern, "*?") {
+		return strings.HasPrefix(s, pattern)
+	}
+	return wildcardMatch(pattern, s)
+}
+
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) != 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func (c *nearCache) isCacheable(opstr string, key []byte) bool {
+	if opstr != "GET" || len(key) == 0 {
+		return false
+	}
+	for _, r := range c.rules {
+		if globMatch(r, string(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *nearCache) lookup(r *Request, key []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.keys[string(key)]
+	if e == nil {
+		cachestats.misses.Incr()
+		return false
+	}
+	x := e.Value.(*cacheEntry)
+	if microseconds() > x.expire {
+		c.remove(e)
+		cachestats.misses.Incr()
+		return false
+	}
+	c.lru.MoveToFront(e)
+	r.Response.Resp = x.resp
+	cachestats.hits.Incr()
+	return true
+}
+
+func (c *nearCache) fill(r *Request, slot int, key []byte, forward func(r *Request) error) error {
+	c.mu.Lock()
+	epoch := c.epoch[slot]
+	c.mu.Unlock()
+
+	x := &Request{
+		OpStr:  r.OpStr,
+		Start:  r.Start,
+		Resp:   r.Resp,
+		Wait:   &sync.WaitGroup{},
+		Failed: r.Failed,
+	}
+	r.Wait.Add(1)
+	if err := forward(x); err != nil {
+		r.Wait.Done()
+		return err
+	}
+	go func() {
+		x.Wait.Wait()
+		resp, err := x.Response.Resp, x.Response.Err
+		if err == nil && resp != nil && resp.IsBulkBytes() {
+			c.store(slot, string(key), resp, epoch)
+		}
+		r.Response.Resp, r.Response.Err = resp, err
+		r.Wait.Done()
+	}()
+	return nil
+}
+
+func (c *nearCache) store(slot int, key string, resp *redis.Resp, epoch int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.epoch[slot] != epoch {
+		return
+	}
+	if e := c.keys[key]; e != nil {
+		c.remove(e)
+	}
+	x := &cacheEntry{
+		key:    key,
+		slot:   slot,
+		resp:   resp,
+		size:   respSize(resp) + int64(len(key)),
+		expire: microseconds() + c.ttl,
+	}
+	if c.maxBytes > 0 && x.size > c.maxBytes {
+		return
+	}
+	e := c.lru.PushFront(x)
+	c.keys[key] = e
+	if c.bySlot[slot] == nil {
+		c.bySlot[slot] = make(map[string]*list.Element)
+	}
+	c.bySlot[slot][key] = e
+	c.size += x.size
+	cachestats.fills.Incr()
+	cachestats.entries.Incr()
+	cachestats.bytes.Add(x.size)
+
+	for c.maxBytes > 0 && c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+		cachestats.evictions.Incr()
+	}
+}
+
+func (c *nearCache) remove(e *list.Element) {
+	x := c.lru.Remove(e).(*cacheEntry)
+	delete(c.keys, x.key)
+	delete(c.bySlot[x.slot], x.key)
+	c.size -= x.size
+	cachestats.entries.Decr()
+	cachestats.bytes.Sub(x.size)
+}
+
+func (c *nearCache) invalidate(slot int, key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch[slot]++
+	if e := c.keys[string(key)]; e != nil {
+		c.remove(e)
+		cachestats.invalidations.Incr()
+	}
+}
+
+// writtenKeys returns the keys written by a command other than its hash key.
+func writtenKeys(opstr string, resp *redis.Resp) [][]byte {
+	var keys [][]byte
+	add := func(i int) {
+		if i < len(resp.Array) {
+			keys = append(keys, resp.Array[i].Value)
+		}
+	}
+	switch opstr {
+	case "RENAME", "RENAMENX", "SMOVE", "RPOPLPUSH", "BRPOPLPUSH":
+		add(1)
+		add(2)
+	case "MSETNX":
+		for i := 1; i < len(resp.Array); i += 2 {
+			add(i)
+		}
+	case "SUNIONSTORE", "SINTERSTORE", "SDIFFSTORE", "ZUNIONSTORE", "ZINTERSTORE", "PFMERGE":
+		add(1)
+	case "BITOP":
+		add(2)
+	case "SORT":
+		for i := 2; i+1 < len(resp.Array); i++ {
+			if strings.EqualFold(string(resp.Array[i].Value), "STORE") {
+				add(i + 1)
+			}
+		}
+	}
+	return keys
+}
+
+// invalidateWrite drops the keys written by a command, scripts may write any
+// keys of the slot, so the whole slot is dropped.
+func (c *nearCache) invalidateWrite(r *Request, slot int, hkey []byte) {
+	switch r.OpStr {
+	case "EVAL", "EVALSHA":
+		c.purgeSlot(slot)
+		return
+	}
+	c.invalidate(slot, hkey)
+	for _, key := range writtenKeys(r.OpStr, r.Resp) {
+		c.invalidate(hashSlot(key), key)
+	}
+}
+
+func (c *nearCache) purgeSlot(slot int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch[slot]++
+	for _, e := range c.bySlot[slot] {
+		c.remove(e)
+		cachestats.invalidations.Incr()
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+)
+
+func TestGlobMatch(t *testing.T) {
+	assert.Must(globMatch("config:", "config:abc"))
+	assert.Must(!globMatch("config:", "conf"))
+	assert.Must(globMatch("config:*", "config:abc"))
+	assert.Must(globMatch("*:abc", "config:abc"))
+	assert.Must(globMatch("user:?:name", "user:1:name"))
+	assert.Must(!globMatch("user:?:name", "user:12:name"))
+	assert.Must(!globMatch("a*c", "abcd"))
+}
+
+func newNearCacheRouter(l string) *Router {
+	s := New()
+	s.SetNearCache([]string{"hot:*"}, time.Second, 0)
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(s.FillSlot(i, l, "", false))
+	}
+	return s
+}
+
+func dispatchAndWait(s *Router, r *Request) *redis.Resp {
+	assert.MustNoError(s.Dispatch(r))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+	return r.Response.Resp
+}
+
+func TestNearCache(t *testing.T) {
+	var calls atomic2.Int64
+	l := newSlowBackend(0, &calls)
+	defer l.Close()
+
+	s := newNearCacheRouter(l.Addr().String())
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		resp := dispatchAndWait(s, newGetRequest("hot:1"))
+		assert.Must(string(resp.Value) == "hot:1")
+	}
+	assert.Must(calls.Get() == 1)
+
+	dispatchAndWait(s, newGetRequest("cold:1"))
+	dispatchAndWait(s, newGetRequest("cold:1"))
+	assert.Must(calls.Get() == 3)
+
+	set := &Request{
+		OpStr: "SET",
+		Resp: redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("SET")),
+			redis.NewBulkBytes([]byte("hot:1")),
+			redis.NewBulkBytes([]byte("value")),
+		}),
+		Wait: &sync.WaitGroup{},
+	}
+	dispatchAndWait(s, set)
+	assert.Must(calls.Get() == 4)
+
+	dispatchAndWait(s, newGetRequest("hot:1"))
+	assert.Must(calls.Get() == 5)
+	dispatchAndWait(s, newGetRequest("hot:1"))
+	assert.Must(calls.Get() == 5)
+
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("hot:1")), l.Addr().String(), "", false))
+	assert.Must(len(s.cache.keys) == 0)
+	dispatchAndWait(s, newGetRequest("hot:1"))
+	assert.Must(calls.Get() == 6)
+}
+
+func newCacheTestRequest(args ...string) *Request {
+	array := make([]*redis.Resp, len(args))
+	for i, s := range args {
+		array[i] = redis.NewBulkBytes([]byte(s))
+	}
+	return &Request{OpStr: args[0], Resp: redis.NewArray(array), Wait: &sync.WaitGroup{}}
+}
+
+func TestNearCacheInvalidateWrite(t *testing.T) {
+	c := newNearCache([]string{"{t}"}, time.Second, 0)
+	slot := hashSlot([]byte("{t}a"))
+	store := func(keys ...string) {
+		for _, key := range keys {
+			c.store(slot, key, redis.NewBulkBytes([]byte("v")), c.epoch[slot])
+		}
+	}
+
+	store("{t}a", "{t}b", "{t}c")
+	c.invalidateWrite(newCacheTestRequest("RENAME", "{t}a", "{t}b"), slot, []byte("{t}a"))
+	assert.Must(c.keys["{t}a"] == nil && c.keys["{t}b"] == nil && c.keys["{t}c"] != nil)
+
+	// the hash key of ZUNIONSTORE is the first source
+	store("{t}a", "{t}b")
+	c.invalidateWrite(newCacheTestRequest("ZUNIONSTORE", "{t}a", "1", "{t}b"), slot, []byte("{t}b"))
+	assert.Must(c.keys["{t}a"] == nil && c.keys["{t}c"] != nil)
+
+	store("{t}a")
+	c.invalidateWrite(newCacheTestRequest("BITOP", "AND", "{t}a", "{t}b"), slot, []byte("AND"))
+	assert.Must(c.keys["{t}a"] == nil && c.keys["{t}c"] != nil)
+
+	store("{t}a")
+	c.invalidateWrite(newCacheTestRequest("MSETNX", "{t}x", "1", "{t}a", "2"), slot, []byte("{t}x"))
+	assert.Must(c.keys["{t}a"] == nil && c.keys["{t}c"] != nil)
+
+	store("{t}a")
+	c.invalidateWrite(newCacheTestRequest("SORT", "{t}l", "STORE", "{t}a"), slot, []byte("{t}l"))
+	assert.Must(c.keys["{t}a"] == nil && c.keys["{t}c"] != nil)
+
+	// keys written by scripts are unknown
+	store("{t}a")
+	c.invalidateWrite(newCacheTestRequest("EVAL", "return 1", "1", "{t}x"), slot, []byte("{t}x"))
+	assert.Must(len(c.keys) == 0)
+}
+
+func TestNearCacheEviction(t *testing.T) {
+	c := newNearCache([]string{"k"}, time.Second, 200)
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		c.store(hashSlot([]byte(key)), key, redis.NewBulkBytes(make([]byte, 50)), 0)
+	}
+	assert.Must(c.size <= 200)
+	assert.Must(c.keys["k1"] == nil)
+	assert.Must(c.keys["k4"] != nil)
+
+	c.store(0, "k5", redis.NewBulkBytes(make([]byte, 500)), 0)
+	assert.Must(c.keys["k5"] == nil)
+}
+
+func TestNearCacheExpire(t *testing.T) {
+	c := newNearCache([]string{"k"}, time.Millisecond*50, 0)
+	c.store(0, "k", redis.NewBulkBytes([]byte("v")), 0)
+	assert.Must(c.lookup(newGetRequest("k"), []byte("k")))
+	time.Sleep(time.Millisecond * 100)
+	assert.Must(!c.lookup(newGetRequest("k"), []byte("k")))
+	assert.Must(len(c.keys) == 0)
+}
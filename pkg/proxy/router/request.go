@@ -29,5 +29,7 @@ type Request struct {
 	Wait *sync.WaitGroup
 	slot *sync.WaitGroup
 
+	bufsize int64
+
 	Failed *atomic2.Bool
 }
@@ -6,6 +6,7 @@ package router
 import (
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/CodisLabs/codis/pkg/models"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
@@ -22,6 +23,10 @@ type Router struct {
 
 	slots [MaxSlotNum]*Slot
 
+	flight *flightGroup
+	cache  *nearCache
+	mirror *mirror
+
 	closed bool
 }
 
@@ -40,6 +45,50 @@ func NewWithAuth(auth string) *Router {
 	return s
 }
 
+// SetReadCoalescing enables merging of identical in-flight requests for the given
+// read-only commands, at most maxKeys distinct requests are tracked at the same time.
+// It must be called before the router starts to serve sessions.
+func (s *Router) SetReadCoalescing(cmds []string, maxKeys int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(cmds) == 0 {
+		s.flight = nil
+	} else {
+		s.flight = newFlightGroup(cmds, maxKeys)
+	}
+}
+
+// SetNearCache enables caching of GET replies for keys matching any of the rules,
+// a rule is either a glob pattern or a key prefix. Entries live at most ttl and
+// the cache holds at most maxBytes, 0 means unlimited.
+// It must be called before the router starts to serve sessions.
+func (s *Router) SetNearCache(rules []string, ttl time.Duration, maxBytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := newNearCache(rules, ttl, maxBytes)
+	if len(c.rules) == 0 || ttl <= 0 {
+		s.cache = nil
+	} else {
+		s.cache = c
+	}
+}
+
+// SetMirror copies a sampled part of the requests to a shadow target, either a
+// proxy or a redis server, rate is in [0, 1] and empty cmds means all commands.
+// If compare is true, replies from the shadow are compared with the primary ones.
+// It must be called before the router starts to serve sessions.
+func (s *Router) SetMirror(addr, auth string, rate float64, cmds []string, compare bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mirror != nil {
+		s.mirror.Close()
+		s.mirror = nil
+	}
+	if len(addr) != 0 && rate > 0 {
+		s.mirror = newMirror(addr, auth, rate, cmds, compare)
+	}
+}
+
 func (s *Router) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -49,6 +98,9 @@ func (s *Router) Close() error {
 	for i := 0; i < len(s.slots); i++ {
 		s.resetSlot(i)
 	}
+	if s.mirror != nil {
+		s.mirror.Close()
+	}
 	s.closed = true
 	return nil
 }
@@ -88,8 +140,38 @@ func (s *Router) KeepAlive() error {
 }
 
 func (s *Router) Dispatch(r *Request) error {
+	if m := s.mirror; m != nil && m.isSampled(r.OpStr) {
+		return m.dispatch(r, s.dispatch)
+	}
+	return s.dispatch(r)
+}
+
+func (s *Router) dispatch(r *Request) error {
 	hkey := getHashKey(r.Resp, r.OpStr)
-	slot := s.slots[hashSlot(hkey)]
+	i := hashSlot(hkey)
+	if c := s.cache; c != nil {
+		if c.isCacheable(r.OpStr, hkey) {
+			if c.lookup(r, hkey) {
+				return nil
+			}
+			return c.fill(r, i, hkey, func(r *Request) error {
+				return s.forward(r, i, hkey)
+			})
+		}
+		if !readOnlyCmds[r.OpStr] {
+			c.invalidateWrite(r, i, hkey)
+		}
+	}
+	return s.forward(r, i, hkey)
+}
+
+func (s *Router) forward(r *Request, i int, hkey []byte) error {
+	slot := s.slots[i]
+	if f := s.flight; f != nil && f.isEnabled(r.OpStr) {
+		return f.dispatch(r, func(r *Request) error {
+			return slot.forward(r, hkey)
+		})
+	}
 	return slot.forward(r, hkey)
 }
 
@@ -125,6 +207,10 @@ func (s *Router) resetSlot(i int) {
 	s.putBackendConn(slot.migrate.bc)
 	slot.reset()
 
+	if s.cache != nil {
+		s.cache.purgeSlot(i)
+	}
+
 	slot.unblock()
 }
 
@@ -139,6 +225,10 @@ func (s *Router) fillSlot(i int, addr, from string, lock bool) {
 	s.putBackendConn(slot.migrate.bc)
 	slot.reset()
 
+	if s.cache != nil {
+		s.cache.purgeSlot(i)
+	}
+
 	if len(addr) != 0 {
 		xx := strings.Split(addr, ":")
 		if len(xx) >= 1 {
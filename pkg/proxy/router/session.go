@@ -17,9 +17,12 @@ import (
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
 
+var sessionId atomic2.Int64
+
 type Session struct {
 	*redis.Conn
 
+	Id  int64
 	Ops int64
 
 	LastOpUnix int64
@@ -30,17 +33,24 @@ type Session struct {
 
 	quit   bool
 	failed atomic2.Bool
+
+	mem       *MemLimiter
+	throttled atomic2.Int64
 }
 
 func (s *Session) String() string {
 	o := &struct {
+		Id         int64  `json:"id"`
 		Ops        int64  `json:"ops"`
 		LastOpUnix int64  `json:"lastop"`
 		CreateUnix int64  `json:"create"`
 		RemoteAddr string `json:"remote"`
+		BufMemory  int64  `json:"bufmem"`
+		Throttled  int64  `json:"throttled"`
 	}{
-		s.Ops, s.LastOpUnix, s.CreateUnix,
+		s.Id, s.Ops, s.LastOpUnix, s.CreateUnix,
 		s.Conn.Sock.RemoteAddr().String(),
+		s.mem.Usage(), s.throttled.Get(),
 	}
 	b, _ := json.Marshal(o)
 	return string(b)
@@ -51,7 +61,7 @@ func NewSession(c net.Conn, auth string) *Session {
 }
 
 func NewSessionSize(c net.Conn, auth string, bufsize int, timeout int) *Session {
-	s := &Session{CreateUnix: time.Now().Unix(), auth: auth}
+	s := &Session{Id: sessionId.Incr(), CreateUnix: time.Now().Unix(), auth: auth, mem: NewMemLimiter(0)}
 	s.Conn = redis.NewConnSize(c, bufsize)
 	s.Conn.ReaderTimeout = time.Second * time.Duration(timeout)
 	s.Conn.WriterTimeout = time.Second * 30
@@ -63,6 +73,11 @@ func (s *Session) Close() error {
 	return s.Conn.Close()
 }
 
+// SetMaxBufferedMemory sets the limit of bytes buffered by this session, 0 means unlimited.
+func (s *Session) SetMaxBufferedMemory(limit int64) {
+	s.mem.SetLimit(limit)
+}
+
 func (s *Session) Serve(d Dispatcher, maxPipeline int) {
 	var errlist errors.ErrorList
 	defer func() {
@@ -77,7 +92,8 @@ func (s *Session) Serve(d Dispatcher, maxPipeline int) {
 	tasks := make(chan *Request, maxPipeline)
 	go func() {
 		defer func() {
-			for _ = range tasks {
+			for r := range tasks {
+				s.releaseMemory(r)
 			}
 		}()
 		if err := s.loopWriter(tasks); err != nil {
@@ -101,10 +117,15 @@ func (s *Session) loopReader(tasks chan<- *Request, d Dispatcher) error {
 		if err != nil {
 			return err
 		}
+		n := respSize(resp)
+		s.acquireMemory(n)
 		r, err := s.handleRequest(resp, d)
 		if err != nil {
+			memstats.global.Release(n)
+			s.mem.Release(n)
 			return err
 		} else {
+			r.bufsize = n
 			tasks <- r
 		}
 	}
@@ -119,16 +140,32 @@ func (s *Session) loopWriter(tasks <-chan *Request) error {
 	}
 	for r := range tasks {
 		resp, err := s.handleResponse(r)
-		if err != nil {
-			return err
+		if err == nil {
+			err = p.Encode(resp, len(tasks) == 0)
 		}
-		if err := p.Encode(resp, len(tasks) == 0); err != nil {
+		s.releaseMemory(r)
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func (s *Session) acquireMemory(n int64) {
+	start := microseconds()
+	if s.mem.Acquire(n) {
+		s.throttled.Incr()
+		incrSessionThrottled(microseconds() - start)
+	}
+	memstats.global.Acquire(n)
+}
+
+func (s *Session) releaseMemory(r *Request) {
+	memstats.global.Release(r.bufsize)
+	s.mem.Release(r.bufsize)
+	r.bufsize = 0
+}
+
 var ErrRespIsRequired = errors.New("resp is required")
 
 func (s *Session) handleResponse(r *Request) (*redis.Resp, error) {
@@ -145,6 +182,11 @@ func (s *Session) handleResponse(r *Request) (*redis.Resp, error) {
 	if resp == nil {
 		return nil, ErrRespIsRequired
 	}
+	if n := respSize(resp); n != 0 {
+		memstats.global.Grow(n)
+		s.mem.Grow(n)
+		r.bufsize += n
+	}
 	incrOpStats(r.OpStr, microseconds()-r.Start)
 	return resp, nil
 }
@@ -185,6 +227,8 @@ func (s *Session) handleRequest(resp *redis.Resp, d Dispatcher) (*Request, error
 		s.authorized = true
 	}
 
+	captureRequest(s.Id, r)
+
 	switch opstr {
 	case "SELECT":
 		return s.handleSelect(r)
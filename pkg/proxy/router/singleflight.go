@@ -0,0 +1,159 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+var readOnlyCmds = make(map[string]bool)
+
+func init() {
+	for _, s := range []string{
+		"GET", "MGET", "STRLEN", "GETRANGE", "GETBIT", "BITCOUNT", "EXISTS", "TYPE", "TTL", "PTTL",
+		"HGET", "HMGET", "HGETALL", "HEXISTS", "HLEN", "HKEYS", "HVALS",
+		"LINDEX", "LLEN", "LRANGE",
+		"SCARD", "SISMEMBER", "SMEMBERS", "SRANDMEMBER",
+		"ZCARD", "ZCOUNT", "ZRANGE", "ZRANGEBYSCORE", "ZRANK", "ZREVRANGE", "ZREVRANGEBYSCORE", "ZREVRANK", "ZSCORE",
+	} {
+		readOnlyCmds[s] = true
+	}
+}
+
+var flightstats struct {
+	leaders  atomic2.Int64
+	shared   atomic2.Int64
+	bypassed atomic2.Int64
+	inflight atomic2.Int64
+}
+
+func GetFlightStats() map[string]int64 {
+	return map[string]int64{
+		"leaders":  flightstats.leaders.Get(),
+		"shared":   flightstats.shared.Get(),
+		"bypassed": flightstats.bypassed.Get(),
+		"inflight": flightstats.inflight.Get(),
+	}
+}
+
+type flightCall struct {
+	leader  *Request
+	waiters []*Request
+}
+
+// flightGroup merges identical in-flight read-only requests, so that only
+// one of them is sent to backend and the reply is shared by all of them.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+
+	cmds    map[string]bool
+	maxKeys int
+}
+
+func newFlightGroup(cmds []string, maxKeys int) *flightGroup {
+	g := &flightGroup{
+		calls:   make(map[string]*flightCall),
+		cmds:    make(map[string]bool),
+		maxKeys: maxKeys,
+	}
+	for _, s := range cmds {
+		opstr := strings.ToUpper(strings.TrimSpace(s))
+		if opstr == "" {
+			continue
+		}
+		if !readOnlyCmds[opstr] {
+			log.Warnf("command <%s> is not read-only, ignore it in read coalescing", opstr)
+			continue
+		}
+		g.cmds[opstr] = true
+	}
+	return g
+}
+
+func (g *flightGroup) isEnabled(opstr string) bool {
+	return g.cmds[opstr]
+}
+
+func flightKey(r *Request) string {
+	var b bytes.Buffer
+	b.WriteString(r.OpStr)
+	for _, x := range r.Resp.Array[1:] {
+		b.WriteByte(' ')
+		b.WriteString(strconv.Itoa(len(x.Value)))
+		b.WriteByte(':')
+		b.Write(x.Value)
+	}
+	return b.String()
+}
+
+func (g *flightGroup) dispatch(r *Request, forward func(r *Request) error) error {
+	key := flightKey(r)
+
+	g.mu.Lock()
+	if c := g.calls[key]; c != nil {
+		r.Wait.Add(1)
+		c.waiters = append(c.waiters, r)
+		g.mu.Unlock()
+		flightstats.shared.Incr()
+		return nil
+	}
+	if g.maxKeys > 0 && len(g.calls) >= g.maxKeys {
+		g.mu.Unlock()
+		flightstats.bypassed.Incr()
+		return forward(r)
+	}
+	c := &flightCall{
+		leader: &Request{
+			OpStr: r.OpStr,
+			Start: r.Start,
+			Resp:  r.Resp,
+			Wait:  &sync.WaitGroup{},
+		},
+		waiters: []*Request{r},
+	}
+	r.Wait.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	flightstats.leaders.Incr()
+	flightstats.inflight.Incr()
+
+	if err := forward(c.leader); err != nil {
+		c.leader.Response.Err = err
+		g.finish(key, c, r)
+		return err
+	}
+	go func() {
+		c.leader.Wait.Wait()
+		g.finish(key, c, nil)
+	}()
+	return nil
+}
+
+func (g *flightGroup) finish(key string, c *flightCall, skip *Request) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	waiters := c.waiters
+	g.mu.Unlock()
+
+	flightstats.inflight.Decr()
+
+	resp, err := c.leader.Response.Resp, c.leader.Response.Err
+	for _, r := range waiters {
+		if r != skip {
+			r.Response.Resp, r.Response.Err = resp, err
+			if err != nil && r.Failed != nil {
+				r.Failed.Set(true)
+			}
+		}
+		r.Wait.Done()
+	}
+}
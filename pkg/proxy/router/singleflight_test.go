@@ -0,0 +1,118 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+)
+
+func newSlowBackend(delay time.Duration, calls *atomic2.Int64) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				conn := redis.NewConn(c)
+				for {
+					req, err := conn.Reader.Decode()
+					if err != nil {
+						return
+					}
+					calls.Incr()
+					time.Sleep(delay)
+					resp := redis.NewBulkBytes(req.Array[len(req.Array)-1].Value)
+					if err := conn.Writer.Encode(resp, true); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func newGetRequest(key string) *Request {
+	return &Request{
+		OpStr: "GET",
+		Resp: redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("GET")),
+			redis.NewBulkBytes([]byte(key)),
+		}),
+		Wait: &sync.WaitGroup{},
+	}
+}
+
+func TestReadCoalescing(t *testing.T) {
+	var calls atomic2.Int64
+	l := newSlowBackend(time.Millisecond*200, &calls)
+	defer l.Close()
+
+	s := New()
+	defer s.Close()
+	s.SetReadCoalescing([]string{"get", "set"}, 16)
+	assert.Must(s.flight.isEnabled("GET"))
+	assert.Must(!s.flight.isEnabled("SET"))
+
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(s.FillSlot(i, l.Addr().String(), "", false))
+	}
+
+	var reqs []*Request
+	for i := 0; i < 100; i++ {
+		r := newGetRequest("hotkey")
+		assert.MustNoError(s.Dispatch(r))
+		reqs = append(reqs, r)
+	}
+	other := newGetRequest("otherkey")
+	assert.MustNoError(s.Dispatch(other))
+
+	for _, r := range reqs {
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		assert.Must(string(r.Response.Resp.Value) == "hotkey")
+	}
+	other.Wait.Wait()
+	assert.Must(string(other.Response.Resp.Value) == "otherkey")
+
+	assert.Must(calls.Get() == 2)
+	assert.Must(len(s.flight.calls) == 0)
+}
+
+func TestReadCoalescingMaxKeys(t *testing.T) {
+	var calls atomic2.Int64
+	l := newSlowBackend(time.Millisecond*100, &calls)
+	defer l.Close()
+
+	s := New()
+	defer s.Close()
+	s.SetReadCoalescing([]string{"GET"}, 1)
+
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(s.FillSlot(i, l.Addr().String(), "", false))
+	}
+
+	var reqs []*Request
+	for _, key := range []string{"a", "b", "c", "a"} {
+		r := newGetRequest(key)
+		assert.MustNoError(s.Dispatch(r))
+		reqs = append(reqs, r)
+	}
+	for _, r := range reqs {
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+	assert.Must(calls.Get() == 3)
+}
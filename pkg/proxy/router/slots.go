@@ -59,6 +59,7 @@ func (s *Slot) reset() {
 }
 
 func (s *Slot) forward(r *Request, key []byte) error {
+	slotstats.calls[s.id].Incr()
 	s.lock.RLock()
 	bc, err := s.prepare(r, key)
 	s.lock.RUnlock()
@@ -78,6 +79,7 @@ func (s *Slot) prepare(r *Request, key []byte) (*SharedBackendConn, error) {
 		return nil, ErrSlotIsNotReady
 	}
 	if err := s.slotsmgrt(r, key); err != nil {
+		slotstats.migrateErrors[s.id].Incr()
 		log.Warnf("slot-%04d migrate from = %s to %s failed: key = %s, error = %s",
 			s.id, s.migrate.from, s.backend.addr, key, err)
 		return nil, err
@@ -92,6 +94,7 @@ func (s *Slot) slotsmgrt(r *Request, key []byte) error {
 	if len(key) == 0 || s.migrate.bc == nil {
 		return nil
 	}
+	slotstats.migrateCalls[s.id].Incr()
 	m := &Request{
 		Resp: redis.NewArray([]*redis.Resp{
 			redis.NewBulkBytes([]byte("SLOTSMGRTTAGONE")),
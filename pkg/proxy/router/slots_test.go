@@ -2,3 +2,126 @@
 // Licensed under the MIT (MIT-LICENSE.txt) license.
 
 package router
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+// newMigrateBackend replies SLOTSMGRTTAGONE with 1 and records the keys,
+// other commands are replied with their last argument.
+func newMigrateBackend(migrated *keySet) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				conn := redis.NewConn(c)
+				for {
+					req, err := conn.Reader.Decode()
+					if err != nil {
+						return
+					}
+					last := req.Array[len(req.Array)-1].Value
+					resp := redis.NewBulkBytes(last)
+					if string(req.Array[0].Value) == "SLOTSMGRTTAGONE" {
+						migrated.add(string(last))
+						resp = redis.NewInt([]byte("1"))
+					}
+					if err := conn.Writer.Encode(resp, true); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+type keySet struct {
+	sync.Mutex
+	keys map[string]int
+}
+
+func (s *keySet) add(key string) {
+	s.Lock()
+	defer s.Unlock()
+	s.keys[key]++
+}
+
+func (s *keySet) count(key string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.keys[key]
+}
+
+func TestMultiSlotsMigrating(t *testing.T) {
+	migrated := &keySet{keys: make(map[string]int)}
+	from := newMigrateBackend(migrated)
+	defer from.Close()
+	to := newMigrateBackend(migrated)
+	defer to.Close()
+
+	// keys of different slots
+	var keys []string
+	seen := make(map[int]bool)
+	for i := 0; len(keys) < 8; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if slot := HashSlot([]byte(key)); !seen[slot] {
+			seen[slot] = true
+			keys = append(keys, key)
+		}
+	}
+
+	s := New()
+	defer s.Close()
+	for _, key := range keys {
+		assert.MustNoError(s.FillSlot(HashSlot([]byte(key)), to.Addr().String(), from.Addr().String(), false))
+	}
+
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				resp := dispatchAndWait(s, newGetRequest(key))
+				assert.Must(string(resp.Value) == key)
+			}(key)
+		}
+	}
+	wg.Wait()
+	for _, key := range keys {
+		assert.Must(migrated.count(key) == 16)
+	}
+	slotStats := GetSlotStats()
+	for _, key := range keys {
+		m := slotStats[fmt.Sprint(HashSlot([]byte(key)))].(map[string]int64)
+		assert.Must(m["calls"] >= 16)
+		assert.Must(m["migrate_calls"] >= 16 && m["migrate_errors"] == 0)
+	}
+
+	// the first slot is done, the others still share the connection to source
+	assert.MustNoError(s.FillSlot(HashSlot([]byte(keys[0])), to.Addr().String(), "", false))
+	assert.Must(s.pool[from.Addr().String()] != nil)
+
+	dispatchAndWait(s, newGetRequest(keys[0]))
+	assert.Must(migrated.count(keys[0]) == 16)
+	dispatchAndWait(s, newGetRequest(keys[1]))
+	assert.Must(migrated.count(keys[1]) == 17)
+
+	for _, key := range keys[1:] {
+		assert.MustNoError(s.FillSlot(HashSlot([]byte(key)), to.Addr().String(), "", false))
+	}
+	assert.Must(s.pool[from.Addr().String()] == nil)
+}
@@ -5,6 +5,7 @@ package router
 
 import (
 	"encoding/json"
+	"strconv"
 	"sync"
 
 	"github.com/CodisLabs/codis/pkg/utils/atomic2"
@@ -95,3 +96,29 @@ func incrOpStats(opstr string, usecs int64) {
 	s.usecs.Add(usecs)
 	cmdstats.requests.Incr()
 }
+
+// slotstats counts the requests and the keys migrated on demand by SLOTSMGRTTAGONE
+// for each slot, dashboard uses the error rate to throttle the migration and the
+// requests to rebalance the load.
+var slotstats struct {
+	calls         [MaxSlotNum]atomic2.Int64
+	migrateCalls  [MaxSlotNum]atomic2.Int64
+	migrateErrors [MaxSlotNum]atomic2.Int64
+}
+
+func GetSlotStats() map[string]interface{} {
+	var m = make(map[string]interface{})
+	for i := 0; i < MaxSlotNum; i++ {
+		calls := slotstats.calls[i].Get()
+		migrateCalls := slotstats.migrateCalls[i].Get()
+		if calls == 0 && migrateCalls == 0 {
+			continue
+		}
+		m[strconv.Itoa(i)] = map[string]int64{
+			"calls":          calls,
+			"migrate_calls":  migrateCalls,
+			"migrate_errors": slotstats.migrateErrors[i].Get(),
+		}
+	}
+	return m
+}
@@ -10,8 +10,11 @@ import (
 	topo "github.com/wandoulabs/go-zookeeper/zk"
 
 	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/consulzk"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/fszk"
 	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
 	"github.com/wandoulabs/zkhelper"
 )
 
@@ -61,6 +64,12 @@ func NewTopo(ProductName string, zkAddr string, f ZkFactory, provider string, zk
 			t.fact = zkhelper.NewEtcdConn
 		case "zookeeper":
 			t.fact = zkhelper.ConnectToZk
+		case "memory":
+			t.fact = memzk.Connect
+		case "filesystem":
+			t.fact = fszk.Connect
+		case "consul":
+			t.fact = consulzk.Connect
 		default:
 			log.Panicf("coordinator not found in config")
 		}
@@ -143,6 +152,11 @@ func (top *Topology) DoResponse(seq int, pi *models.ProxyInfo) error {
 
 func (top *Topology) doWatch(evtch <-chan topo.Event, evtbus chan interface{}) {
 	e := <-evtch
+	if e.Type == topo.EventNotWatching && e.Err == topo.ErrClosing {
+		// the conn is closed by ourselves, e.g. marked offline
+		log.Warnf("stop watching: %+v", e)
+		return
+	}
 	if e.State == topo.StateExpired || e.Type == topo.EventNotWatching {
 		log.Panicf("session expired: %+v", e)
 	}
@@ -0,0 +1,89 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	topo "github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/memzk"
+)
+
+func newTestTopo() (*Topology, *memzk.Conn, *memzk.Conn) {
+	store := memzk.NewStore()
+	proxy := store.NewConn()
+	top := NewTopo("topo_test", "", func(string, int) (zkhelper.Conn, error) { return proxy, nil }, "memory", 30000)
+	return top, proxy, store.NewConn()
+}
+
+func TestTopoWatch(t *testing.T) {
+	top, _, dashboard := newTestTopo()
+	prefix := models.GetWatchActionPath(top.ProductName)
+	assert.MustNoError(models.CreateActionRootPath(dashboard, prefix))
+
+	evtbus := make(chan interface{}, 1)
+	children, err := top.WatchChildren(prefix, evtbus)
+	assert.MustNoError(err)
+	assert.Must(len(children) == 0)
+
+	_, err = dashboard.Create(prefix+"/0000000000", nil, 0, zkhelper.DefaultFileACLs())
+	assert.MustNoError(err)
+	select {
+	case e := <-evtbus:
+		assert.Must(top.IsChildrenChangedEvent(e))
+	case <-time.After(time.Second):
+		assert.Must(false)
+	}
+
+	// the watcher stops quietly when the proxy closes its own conn
+	pi := &models.ProxyInfo{Id: "proxy_1", Addr: "localhost:1234", State: models.PROXY_STATE_ONLINE}
+	_, err = top.CreateProxyInfo(pi)
+	assert.MustNoError(err)
+	_, err = top.CreateProxyFenceNode(pi)
+	assert.MustNoError(err)
+	_, err = top.WatchNode(prefix, evtbus)
+	assert.MustNoError(err)
+	top.Close(pi.Id)
+	select {
+	case e := <-evtbus:
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+	ps, err := models.ProxyList(dashboard, top.ProductName, nil)
+	assert.MustNoError(err)
+	assert.Must(len(ps) == 0)
+	fences, err := models.GetFenceProxyMap(dashboard, top.ProductName)
+	assert.MustNoError(err)
+	assert.Must(len(fences) == 0)
+}
+
+func TestTopoSessionExpired(t *testing.T) {
+	top, proxy, dashboard := newTestTopo()
+	pi := &models.ProxyInfo{Id: "proxy_1", Addr: "localhost:1234", State: models.PROXY_STATE_ONLINE}
+	_, err := top.CreateProxyInfo(pi)
+	assert.MustNoError(err)
+
+	prefix := models.GetWatchActionPath(top.ProductName)
+	assert.MustNoError(models.CreateActionRootPath(dashboard, prefix))
+
+	// doWatch exits the process on such an event, so the channel is read here
+	_, _, evtch, err := top.zkConn.ChildrenW(prefix)
+	assert.MustNoError(err)
+	proxy.Expire()
+	select {
+	case e := <-evtch:
+		assert.Must(e.Type == topo.EventNotWatching && e.Err == topo.ErrSessionExpired)
+	case <-time.After(time.Second):
+		assert.Must(false)
+	}
+	p, err := models.GetProxyInfo(dashboard, top.ProductName, pi.Id)
+	assert.Must(p == nil && err != nil)
+	_, err = top.GetProxyInfo(pi.Id)
+	assert.Must(err != nil)
+}
@@ -0,0 +1,851 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+// Package consulzk implements zkhelper.Conn over the KV HTTP API of consul.
+//
+// A node is a key under a prefix, "codis" unless the address is given as
+// host:port/prefix, and its value holds the data and stat of the node. A node
+// and its parent are changed in one transaction, so consul 0.7 or later is
+// required. Ephemeral nodes are locked by the session of the conn, which
+// deletes them once it's invalidated, and watches are blocking queries.
+package consulzk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+var _ zkhelper.Conn = &Conn{}
+
+const (
+	defaultPrefix = "codis"
+
+	// a blocking query waits for changes for at most blockWait
+	blockWait = "30s"
+
+	// transactions conflicting with others are retried at most maxRetries
+	maxRetries = 16
+)
+
+// kvPair is an entry of the consul KV store.
+type kvPair struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	Session     string `json:",omitempty"`
+	CreateIndex uint64
+	ModifyIndex uint64
+	LockIndex   uint64
+}
+
+type txnKV struct {
+	Verb    string
+	Key     string
+	Value   []byte `json:",omitempty"`
+	Index   uint64
+	Session string `json:",omitempty"`
+}
+
+type txnOp struct {
+	KV *txnKV
+}
+
+// meta is the value of a node.
+type meta struct {
+	Data           []byte   `json:"data"`
+	Acl            []zk.ACL `json:"acl"`
+	Ctime          int64    `json:"ctime"`
+	Mtime          int64    `json:"mtime"`
+	Version        int      `json:"version"`
+	Cversion       int      `json:"cversion"`
+	Aversion       int      `json:"aversion"`
+	EphemeralOwner int64    `json:"ephemeral_owner"`
+}
+
+type node struct {
+	createIndex uint64
+	modifyIndex uint64
+	meta        *meta
+}
+
+type stat struct {
+	n           *node
+	numChildren int
+}
+
+func msToTime(ms int64) time.Time {
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+func nowInMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (s *stat) Czxid() int64          { return int64(s.n.createIndex) }
+func (s *stat) Mzxid() int64          { return int64(s.n.modifyIndex) }
+func (s *stat) CTime() time.Time      { return msToTime(s.n.meta.Ctime) }
+func (s *stat) MTime() time.Time      { return msToTime(s.n.meta.Mtime) }
+func (s *stat) Version() int          { return s.n.meta.Version }
+func (s *stat) CVersion() int         { return s.n.meta.Cversion }
+func (s *stat) AVersion() int         { return s.n.meta.Aversion }
+func (s *stat) EphemeralOwner() int64 { return s.n.meta.EphemeralOwner }
+func (s *stat) DataLength() int       { return len(s.n.meta.Data) }
+func (s *stat) NumChildren() int      { return s.numChildren }
+func (s *stat) Pzxid() int64          { return int64(s.n.modifyIndex) }
+
+type watchType int
+
+const (
+	watchData watchType = iota
+	watchExist
+	watchChildren
+)
+
+type watcher struct {
+	typ  watchType
+	path string
+	ch   chan zk.Event
+
+	// the node and its children when the watch was set
+	createIndex uint64
+	version     int
+	cversion    int
+	children    []string
+}
+
+// Conn is a consul session, ephemeral nodes and watches of the conn are gone
+// once it's closed or the session is invalidated.
+type Conn struct {
+	addr    string
+	prefix  string
+	ttl     time.Duration
+	session string
+	id      int64
+
+	mu       sync.Mutex
+	err      error
+	watchers map[*watcher]bool
+	quit     chan struct{}
+}
+
+// Connect starts a session on the consul agent of addr, it's a zkhelper
+// factory like zkhelper.ConnectToZk.
+func Connect(addr string, timeout int) (zkhelper.Conn, error) {
+	c, err := NewConn(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewConn starts a session, timeout is the ttl of the session in seconds,
+// or in milliseconds if it's greater than 100, consul accepts 10s to 24h.
+func NewConn(addr string, timeout int) (*Conn, error) {
+	addr = strings.TrimPrefix(strings.TrimSpace(addr), "http://")
+	prefix := defaultPrefix
+	if i := strings.Index(addr, "/"); i >= 0 {
+		addr, prefix = addr[:i], strings.Trim(addr[i+1:], "/")
+	}
+	if addr == "" || prefix == "" {
+		return nil, errors.Errorf("invalid consul address %q", addr)
+	}
+
+	ttl := time.Duration(timeout) * time.Second
+	if timeout > 100 {
+		ttl = time.Duration(timeout) * time.Millisecond
+	}
+	if ttl < 10*time.Second {
+		ttl = 10 * time.Second
+	}
+	if ttl > 24*time.Hour {
+		ttl = 24 * time.Hour
+	}
+
+	c := &Conn{
+		addr:     "http://" + addr,
+		prefix:   prefix,
+		ttl:      ttl,
+		watchers: make(map[*watcher]bool),
+		quit:     make(chan struct{}),
+	}
+	req := map[string]string{
+		"Name":     "codis",
+		"TTL":      fmt.Sprintf("%ds", int(ttl/time.Second)),
+		"Behavior": "delete",
+		// ephemeral nodes of a restarted process may be created at once
+		"LockDelay": "0s",
+	}
+	var resp struct{ ID string }
+	if _, _, err := c.call("PUT", "/v1/session/create", nil, req, &resp, nil); err != nil {
+		return nil, err
+	}
+	if resp.ID == "" {
+		return nil, errors.Errorf("consul: create session failed")
+	}
+	c.session = resp.ID
+	h := fnv.New64a()
+	h.Write([]byte(resp.ID))
+	c.id = int64(h.Sum64() >> 1)
+
+	go c.renew()
+	return c, nil
+}
+
+func (c *Conn) SessionId() int64 {
+	return c.id
+}
+
+// call sends a request to consul and decodes the json response into v, the
+// status and index of the response are returned, 404 and 409 are not errors.
+func (c *Conn) call(method, p string, query url.Values, body, v interface{}, cancel <-chan struct{}) (int, uint64, error) {
+	var r *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		r = bytes.NewReader(b)
+	} else {
+		r = bytes.NewReader(nil)
+	}
+	u := c.addr + (&url.URL{Path: p}).String()
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	req.Cancel = cancel
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusConflict:
+		if v != nil && len(b) != 0 {
+			if err := json.Unmarshal(b, v); err != nil {
+				return 0, 0, errors.Trace(err)
+			}
+		}
+		fallthrough
+	case http.StatusNotFound:
+		return resp.StatusCode, index, nil
+	}
+	return 0, 0, errors.Errorf("consul: %s %s returns %d, %s", method, p, resp.StatusCode, strings.TrimSpace(string(b)))
+}
+
+func (c *Conn) key(p string) string {
+	if p == "/" {
+		return c.prefix
+	}
+	return c.prefix + p
+}
+
+// get returns the node of p or nil, the root always exists.
+func (c *Conn) get(p string) (*node, uint64, error) {
+	var pairs []*kvPair
+	status, index, err := c.call("GET", "/v1/kv/"+c.key(p), nil, nil, &pairs, c.quit)
+	if err != nil {
+		return nil, 0, err
+	}
+	if status == http.StatusNotFound || len(pairs) == 0 {
+		if p == "/" {
+			return &node{meta: &meta{Acl: zk.WorldACL(zk.PermAll)}}, index, nil
+		}
+		return nil, index, nil
+	}
+	m := &meta{}
+	if err := json.Unmarshal(pairs[0].Value, m); err != nil {
+		return nil, 0, errors.Errorf("consul: invalid node %s, %s", p, err)
+	}
+	return &node{createIndex: pairs[0].CreateIndex, modifyIndex: pairs[0].ModifyIndex, meta: m}, index, nil
+}
+
+func (c *Conn) children(p string) ([]string, uint64, error) {
+	dir := c.key(p) + "/"
+	var keys []string
+	query := url.Values{"keys": {""}, "separator": {"/"}}
+	status, index, err := c.call("GET", "/v1/kv/"+dir, query, nil, &keys, c.quit)
+	if err != nil {
+		return nil, 0, err
+	}
+	children := []string{}
+	if status == http.StatusNotFound {
+		return children, index, nil
+	}
+	for _, key := range keys {
+		// keys of grandchildren are folded into "dir/name/"
+		name := strings.TrimPrefix(key, dir)
+		if name != "" && !strings.Contains(name, "/") {
+			children = append(children, name)
+		}
+	}
+	sort.Strings(children)
+	return children, index, nil
+}
+
+// txn runs ops in a transaction, false is returned if it conflicts.
+func (c *Conn) txn(ops ...*txnKV) (bool, error) {
+	req := make([]txnOp, len(ops))
+	for i, op := range ops {
+		req[i] = txnOp{KV: op}
+	}
+	status, _, err := c.call("PUT", "/v1/txn", nil, req, nil, c.quit)
+	if err != nil {
+		return false, err
+	}
+	return status == http.StatusOK, nil
+}
+
+func (c *Conn) casOp(p string, m *meta, index uint64) (*txnKV, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &txnKV{Verb: "cas", Key: c.key(p), Value: b, Index: index}, nil
+}
+
+func (c *Conn) check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func validatePath(p string, sequence bool) error {
+	if sequence && strings.HasSuffix(p, "/") {
+		p += "0"
+	}
+	if p == "/" {
+		return nil
+	}
+	if !strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") {
+		return zk.ErrBadArguments
+	}
+	for _, name := range strings.Split(p[1:], "/") {
+		if name == "" || name == "." || name == ".." {
+			return zk.ErrBadArguments
+		}
+	}
+	return nil
+}
+
+func (c *Conn) Get(p string) ([]byte, zk.Stat, error) {
+	data, stat, _, err := c.getData(p, false)
+	return data, stat, err
+}
+
+func (c *Conn) GetW(p string) ([]byte, zk.Stat, <-chan zk.Event, error) {
+	return c.getData(p, true)
+}
+
+func (c *Conn) getData(p string, watch bool) ([]byte, zk.Stat, <-chan zk.Event, error) {
+	if err := c.check(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := validatePath(p, false); err != nil {
+		return nil, nil, nil, err
+	}
+	n, index, err := c.get(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if n == nil {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	children, _, err := c.children(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var ch <-chan zk.Event
+	if watch {
+		ch = c.addWatch(&watcher{typ: watchData, path: p}, n, nil, index)
+	}
+	return n.meta.Data, &stat{n: n, numChildren: len(children)}, ch, nil
+}
+
+func (c *Conn) Children(p string) ([]string, zk.Stat, error) {
+	children, stat, _, err := c.getChildren(p, false)
+	return children, stat, err
+}
+
+func (c *Conn) ChildrenW(p string) ([]string, zk.Stat, <-chan zk.Event, error) {
+	return c.getChildren(p, true)
+}
+
+func (c *Conn) getChildren(p string, watch bool) ([]string, zk.Stat, <-chan zk.Event, error) {
+	if err := c.check(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := validatePath(p, false); err != nil {
+		return nil, nil, nil, err
+	}
+	n, _, err := c.get(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if n == nil {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	children, index, err := c.children(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var ch <-chan zk.Event
+	if watch {
+		ch = c.addWatch(&watcher{typ: watchChildren, path: p}, n, children, index)
+	}
+	return children, &stat{n: n, numChildren: len(children)}, ch, nil
+}
+
+func (c *Conn) Exists(p string) (bool, zk.Stat, error) {
+	ok, stat, _, err := c.exists(p, false)
+	return ok, stat, err
+}
+
+func (c *Conn) ExistsW(p string) (bool, zk.Stat, <-chan zk.Event, error) {
+	return c.exists(p, true)
+}
+
+func (c *Conn) exists(p string, watch bool) (bool, zk.Stat, <-chan zk.Event, error) {
+	if err := c.check(); err != nil {
+		return false, nil, nil, err
+	}
+	if err := validatePath(p, false); err != nil {
+		return false, nil, nil, err
+	}
+	n, index, err := c.get(p)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	if n == nil {
+		var ch <-chan zk.Event
+		if watch {
+			ch = c.addWatch(&watcher{typ: watchExist, path: p}, nil, nil, index)
+		}
+		return false, nil, ch, nil
+	}
+	children, _, err := c.children(p)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	var ch <-chan zk.Event
+	if watch {
+		ch = c.addWatch(&watcher{typ: watchData, path: p}, n, nil, index)
+	}
+	return true, &stat{n: n, numChildren: len(children)}, ch, nil
+}
+
+func (c *Conn) Create(p string, value []byte, flags int32, aclv []zk.ACL) (string, error) {
+	if err := c.check(); err != nil {
+		return "", err
+	}
+	if err := validatePath(p, flags&zk.FlagSequence != 0); err != nil {
+		return "", err
+	}
+	if p == "/" {
+		return "", zk.ErrNodeExists
+	}
+	dir, name := path.Split(p)
+	dir = path.Clean(dir)
+	for i := 0; i < maxRetries; i++ {
+		parent, _, err := c.get(dir)
+		if err != nil {
+			return "", err
+		}
+		if parent == nil {
+			return "", zk.ErrNoNode
+		}
+		if parent.meta.EphemeralOwner != 0 {
+			return "", zk.ErrNoChildrenForEphemerals
+		}
+		target := p
+		if flags&zk.FlagSequence != 0 {
+			// the sequence number is the number of changes to children of
+			// the parent, as zookeeper does
+			target = path.Join(dir, name+c.Seq2Str(int64(parent.meta.Cversion)))
+		}
+		if n, _, err := c.get(target); err != nil {
+			return "", err
+		} else if n != nil {
+			return "", zk.ErrNodeExists
+		}
+
+		pm := *parent.meta
+		pm.Cversion++
+		parentOp, err := c.casOp(dir, &pm, parent.modifyIndex)
+		if err != nil {
+			return "", err
+		}
+		now := nowInMs()
+		m := &meta{Data: value, Acl: aclv, Ctime: now, Mtime: now}
+		if flags&zk.FlagEphemeral != 0 {
+			m.EphemeralOwner = c.id
+		}
+		op, err := c.casOp(target, m, 0)
+		if err != nil {
+			return "", err
+		}
+		ops := []*txnKV{parentOp, op}
+		if flags&zk.FlagEphemeral != 0 {
+			ops = append(ops, &txnKV{Verb: "lock", Key: op.Key, Value: op.Value, Session: c.session})
+		}
+		ok, err := c.txn(ops...)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return target, nil
+		}
+		if err := c.check(); err != nil {
+			return "", err
+		}
+	}
+	return "", errors.Errorf("consul: create %s conflicts too many times", p)
+}
+
+func (c *Conn) Set(p string, value []byte, version int32) (zk.Stat, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	if err := validatePath(p, false); err != nil {
+		return nil, err
+	}
+	for i := 0; i < maxRetries; i++ {
+		n, _, err := c.get(p)
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			return nil, zk.ErrNoNode
+		}
+		if version != -1 && int(version) != n.meta.Version {
+			return nil, zk.ErrBadVersion
+		}
+		m := *n.meta
+		m.Data = value
+		m.Version++
+		m.Mtime = nowInMs()
+		op, err := c.casOp(p, &m, n.modifyIndex)
+		if err != nil {
+			return nil, err
+		}
+		if ok, err := c.txn(op); err != nil {
+			return nil, err
+		} else if ok {
+			// a set keeps the lock of the session on the key
+			return c.stat(p)
+		}
+	}
+	return nil, errors.Errorf("consul: set %s conflicts too many times", p)
+}
+
+func (c *Conn) stat(p string) (zk.Stat, error) {
+	n, _, err := c.get(p)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, zk.ErrNoNode
+	}
+	children, _, err := c.children(p)
+	if err != nil {
+		return nil, err
+	}
+	return &stat{n: n, numChildren: len(children)}, nil
+}
+
+func (c *Conn) Delete(p string, version int32) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	if err := validatePath(p, false); err != nil {
+		return err
+	}
+	if p == "/" {
+		return zk.ErrBadArguments
+	}
+	dir := path.Dir(p)
+	for i := 0; i < maxRetries; i++ {
+		n, _, err := c.get(p)
+		if err != nil {
+			return err
+		}
+		if n == nil {
+			return zk.ErrNoNode
+		}
+		if version != -1 && int(version) != n.meta.Version {
+			return zk.ErrBadVersion
+		}
+		children, _, err := c.children(p)
+		if err != nil {
+			return err
+		}
+		if len(children) != 0 {
+			return zk.ErrNotEmpty
+		}
+		parent, _, err := c.get(dir)
+		if err != nil {
+			return err
+		}
+		if parent == nil {
+			return zk.ErrNoNode
+		}
+		pm := *parent.meta
+		pm.Cversion++
+		parentOp, err := c.casOp(dir, &pm, parent.modifyIndex)
+		if err != nil {
+			return err
+		}
+		op := &txnKV{Verb: "delete-cas", Key: c.key(p), Index: n.modifyIndex}
+		if ok, err := c.txn(op, parentOp); err != nil || ok {
+			return err
+		}
+	}
+	return errors.Errorf("consul: delete %s conflicts too many times", p)
+}
+
+func (c *Conn) GetACL(p string) ([]zk.ACL, zk.Stat, error) {
+	if err := c.check(); err != nil {
+		return nil, nil, err
+	}
+	if err := validatePath(p, false); err != nil {
+		return nil, nil, err
+	}
+	n, _, err := c.get(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n == nil {
+		return nil, nil, zk.ErrNoNode
+	}
+	children, _, err := c.children(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return n.meta.Acl, &stat{n: n, numChildren: len(children)}, nil
+}
+
+func (c *Conn) SetACL(p string, aclv []zk.ACL, version int32) (zk.Stat, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	if err := validatePath(p, false); err != nil {
+		return nil, err
+	}
+	for i := 0; i < maxRetries; i++ {
+		n, _, err := c.get(p)
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			return nil, zk.ErrNoNode
+		}
+		if version != -1 && int(version) != n.meta.Aversion {
+			return nil, zk.ErrBadVersion
+		}
+		m := *n.meta
+		m.Acl = aclv
+		m.Aversion++
+		op, err := c.casOp(p, &m, n.modifyIndex)
+		if err != nil {
+			return nil, err
+		}
+		if ok, err := c.txn(op); err != nil {
+			return nil, err
+		} else if ok {
+			return c.stat(p)
+		}
+	}
+	return nil, errors.Errorf("consul: set acl of %s conflicts too many times", p)
+}
+
+func (c *Conn) Seq2Str(seq int64) string {
+	return fmt.Sprintf("%0.10d", seq)
+}
+
+func (c *Conn) addWatch(w *watcher, n *node, children []string, index uint64) <-chan zk.Event {
+	w.ch = make(chan zk.Event, 1)
+	if n != nil {
+		w.createIndex = n.createIndex
+		w.version = n.meta.Version
+		w.cversion = n.meta.Cversion
+	}
+	w.children = children
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		// the watch is ended with the session at once
+		w.ch <- zk.Event{Type: zk.EventNotWatching, State: zk.StateDisconnected, Path: w.path, Err: c.err}
+		return w.ch
+	}
+	c.watchers[w] = true
+	go c.watch(w, index)
+	return w.ch
+}
+
+// watch waits for changes of the node by blocking queries, on the key for
+// data, or on the keys prefixed by it for children.
+func (c *Conn) watch(w *watcher, index uint64) {
+	query := url.Values{"wait": {blockWait}}
+	if w.typ == watchChildren {
+		query.Set("keys", "")
+	}
+	for {
+		query.Set("index", strconv.FormatUint(index, 10))
+		_, next, err := c.call("GET", "/v1/kv/"+c.key(w.path), query, nil, nil, c.quit)
+		if err == nil {
+			var e zk.Event
+			var ok bool
+			if e, ok, err = c.changed(w); err == nil && ok {
+				c.fire(w, e)
+				return
+			}
+		}
+		select {
+		case <-c.quit:
+			return
+		default:
+		}
+		if err != nil {
+			log.WarnErrorf(err, "consul: watch %s failed", w.path)
+			select {
+			case <-c.quit:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if next < index {
+			// the index went backwards, e.g. the consul cluster was restored
+			next = 0
+		}
+		index = next
+	}
+}
+
+// changed returns the event if the node of the watch has changed.
+func (c *Conn) changed(w *watcher) (zk.Event, bool, error) {
+	e := zk.Event{State: zk.StateSyncConnected, Path: w.path}
+	n, _, err := c.get(w.path)
+	if err != nil {
+		return e, false, err
+	}
+	switch {
+	case w.typ == watchExist:
+		e.Type = zk.EventNodeCreated
+		return e, n != nil, nil
+	case n == nil || n.createIndex != w.createIndex:
+		e.Type = zk.EventNodeDeleted
+	case w.typ == watchData && n.meta.Version != w.version:
+		e.Type = zk.EventNodeDataChanged
+	case w.typ == watchChildren:
+		if n.meta.Cversion == w.cversion {
+			// ephemeral nodes are deleted without changing the parent
+			children, _, err := c.children(w.path)
+			if err != nil || reflect.DeepEqual(children, w.children) {
+				return e, false, err
+			}
+		}
+		e.Type = zk.EventNodeChildrenChanged
+	default:
+		return e, false, nil
+	}
+	return e, true, nil
+}
+
+func (c *Conn) fire(w *watcher, e zk.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.watchers[w] {
+		delete(c.watchers, w)
+		w.ch <- e
+	}
+}
+
+// renew keeps the session alive, the conn is expired once consul doesn't
+// know the session or it isn't renewed in ttl.
+func (c *Conn) renew() {
+	lastRenew := time.Now()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-time.After(c.ttl / 3):
+		}
+		var ok bool
+		if lastRenew, ok = c.renewOnce(lastRenew); !ok {
+			return
+		}
+	}
+}
+
+// renewOnce renews the session, false is returned if it's expired.
+func (c *Conn) renewOnce(lastRenew time.Time) (time.Time, bool) {
+	status, _, err := c.call("PUT", "/v1/session/renew/"+c.session, nil, nil, nil, c.quit)
+	switch {
+	case err == nil && status == http.StatusOK:
+		return time.Now(), true
+	case err == nil && status == http.StatusNotFound:
+		log.Warnf("consul: session %s is invalidated", c.session)
+	case time.Since(lastRenew) >= c.ttl:
+		log.WarnErrorf(err, "consul: session %s is not renewed in %s", c.session, c.ttl)
+	default:
+		log.WarnErrorf(err, "consul: renew session %s failed", c.session)
+		return lastRenew, true
+	}
+	c.end(zk.ErrSessionExpired, zk.ErrSessionExpired, zk.StateExpired)
+	return lastRenew, false
+}
+
+// Close destroys the session, its ephemeral nodes are deleted, and its
+// watches receive an EventNotWatching with zk.ErrClosing as go-zookeeper
+// does.
+func (c *Conn) Close() {
+	if c.end(zk.ErrConnectionClosed, zk.ErrClosing, zk.StateDisconnected) {
+		if _, _, err := c.call("PUT", "/v1/session/destroy/"+c.session, nil, nil, nil, nil); err != nil {
+			log.WarnErrorf(err, "consul: destroy session %s failed", c.session)
+		}
+	}
+}
+
+// end ends the conn, err is returned by operations from now on, and watches
+// receive evtErr, false is returned if it's ended already.
+func (c *Conn) end(err, evtErr error, state zk.State) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return false
+	}
+	c.err = err
+	close(c.quit)
+	for w := range c.watchers {
+		w.ch <- zk.Event{Type: zk.EventNotWatching, State: state, Path: w.path, Err: evtErr}
+	}
+	c.watchers = nil
+	return true
+}
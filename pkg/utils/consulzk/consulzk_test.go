@@ -0,0 +1,175 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package consulzk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+var acl = zk.WorldACL(zk.PermAll)
+
+func mustEvent(ch <-chan zk.Event, t zk.EventType, p string) zk.Event {
+	select {
+	case e := <-ch:
+		assert.Must(e.Type == t && e.Path == p)
+		return e
+	case <-time.After(time.Second):
+		assert.Must(false)
+	}
+	return zk.Event{}
+}
+
+func mustConnect(f *fakeConsul) *Conn {
+	c, err := NewConn(f.Addr(), 30)
+	assert.MustNoError(err)
+	return c
+}
+
+func TestNodes(t *testing.T) {
+	f := newFakeConsul()
+	defer f.Close()
+	c := mustConnect(f)
+	defer c.Close()
+
+	_, err := c.Create("/a/b", nil, 0, acl)
+	assert.Must(err == zk.ErrNoNode)
+	_, err = c.Create("/a", []byte("x"), 0, acl)
+	assert.MustNoError(err)
+	_, err = c.Create("/a", nil, 0, acl)
+	assert.Must(err == zk.ErrNodeExists)
+
+	stat, err := c.Set("/a", []byte("yy"), 0)
+	assert.MustNoError(err)
+	assert.Must(stat.Version() == 1 && stat.DataLength() == 2)
+	_, err = c.Set("/a", []byte("z"), 0)
+	assert.Must(err == zk.ErrBadVersion)
+
+	for i := 0; i < 3; i++ {
+		p, err := c.Create("/a/n-", nil, zk.FlagSequence, acl)
+		assert.MustNoError(err)
+		assert.Must(p == "/a/n-"+c.Seq2Str(int64(i)))
+	}
+	_, err = zkhelper.CreateRecursive(c, "/a/n-0000000000/x/y:1", "v", 0, acl)
+	assert.MustNoError(err)
+	children, stat, err := c.Children("/a")
+	assert.MustNoError(err)
+	assert.Must(len(children) == 3 && children[0] == "n-0000000000" && stat.NumChildren() == 3)
+	data, _, err := c.Get("/a/n-0000000000/x/y:1")
+	assert.MustNoError(err)
+	assert.Must(string(data) == "v")
+
+	assert.Must(c.Delete("/a", -1) == zk.ErrNotEmpty)
+	assert.MustNoError(zkhelper.DeleteRecursive(c, "/a", -1))
+	ok, _, err := c.Exists("/a")
+	assert.MustNoError(err)
+	assert.Must(!ok)
+
+	// keys are stored under the prefix
+	_, err = c.Create("/b", []byte("x"), 0, acl)
+	assert.MustNoError(err)
+	assert.Must(f.get("codis/b") != nil)
+	other, err := NewConn(f.Addr()+"/other", 30)
+	assert.MustNoError(err)
+	defer other.Close()
+	ok, _, err = other.Exists("/b")
+	assert.MustNoError(err)
+	assert.Must(!ok)
+}
+
+func TestWatches(t *testing.T) {
+	f := newFakeConsul()
+	defer f.Close()
+	c1, c2 := mustConnect(f), mustConnect(f)
+	defer c1.Close()
+	defer c2.Close()
+
+	_, _, exist, err := c2.ExistsW("/a")
+	assert.MustNoError(err)
+	_, err = c1.Create("/a", nil, 0, acl)
+	assert.MustNoError(err)
+	mustEvent(exist, zk.EventNodeCreated, "/a")
+
+	_, _, data, err := c2.GetW("/a")
+	assert.MustNoError(err)
+	_, _, children, err := c2.ChildrenW("/a")
+	assert.MustNoError(err)
+	// a child doesn't change the data of its parent
+	_, err = c1.Create("/a/b", nil, 0, acl)
+	assert.MustNoError(err)
+	mustEvent(children, zk.EventNodeChildrenChanged, "/a")
+	_, err = c1.Set("/a", []byte("x"), -1)
+	assert.MustNoError(err)
+	mustEvent(data, zk.EventNodeDataChanged, "/a")
+
+	_, _, data, err = c2.GetW("/a/b")
+	assert.MustNoError(err)
+	assert.MustNoError(c1.Delete("/a/b", -1))
+	mustEvent(data, zk.EventNodeDeleted, "/a/b")
+
+	_, _, data, err = c2.GetW("/a")
+	assert.MustNoError(err)
+	c2.Close()
+	e := mustEvent(data, zk.EventNotWatching, "/a")
+	assert.Must(e.Err == zk.ErrClosing)
+	_, _, err = c2.Get("/a")
+	assert.Must(err == zk.ErrConnectionClosed)
+}
+
+func TestSessions(t *testing.T) {
+	f := newFakeConsul()
+	defer f.Close()
+	c1, c2 := mustConnect(f), mustConnect(f)
+	defer c1.Close()
+	defer c2.Close()
+
+	_, err := c1.Create("/proxy", nil, 0, acl)
+	assert.MustNoError(err)
+	_, err = c1.Create("/proxy/p1", []byte("x"), zk.FlagEphemeral, acl)
+	assert.MustNoError(err)
+	_, err = c1.Create("/proxy/p1/x", nil, 0, acl)
+	assert.Must(err == zk.ErrNoChildrenForEphemerals)
+	_, err = c1.Set("/proxy/p1", []byte("y"), -1)
+	assert.MustNoError(err)
+	_, stat, err := c2.Get("/proxy/p1")
+	assert.MustNoError(err)
+	assert.Must(stat.EphemeralOwner() == c1.SessionId())
+	assert.Must(f.get("codis/proxy/p1").Session == c1.session)
+
+	// ephemeral nodes are deleted with the session
+	_, _, children, err := c2.ChildrenW("/proxy")
+	assert.MustNoError(err)
+	f.invalidate(c1.session)
+	mustEvent(children, zk.EventNodeChildrenChanged, "/proxy")
+	ok, _, err := c2.Exists("/proxy/p1")
+	assert.MustNoError(err)
+	assert.Must(!ok)
+
+	_, err = c2.Create("/proxy/p2", nil, zk.FlagEphemeral, acl)
+	assert.MustNoError(err)
+	c2.Close()
+	c3 := mustConnect(f)
+	defer c3.Close()
+	ok, _, err = c3.Exists("/proxy/p2")
+	assert.MustNoError(err)
+	assert.Must(!ok)
+
+	// the conn finds the session invalidated when renewing it
+	_, _, data, err := c3.GetW("/proxy")
+	assert.MustNoError(err)
+	_, ok = c3.renewOnce(time.Now())
+	assert.Must(ok)
+	f.invalidate(c3.session)
+	_, ok = c3.renewOnce(time.Now())
+	assert.Must(!ok)
+	e := mustEvent(data, zk.EventNotWatching, "/proxy")
+	assert.Must(e.Err == zk.ErrSessionExpired && e.State == zk.StateExpired)
+	_, _, err = c3.Get("/proxy")
+	assert.Must(err == zk.ErrSessionExpired)
+}
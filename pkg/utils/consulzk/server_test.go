@@ -0,0 +1,265 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package consulzk
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeConsul emulates the KV, transaction and session endpoints of a consul
+// agent used by Conn. Blocking queries are woken up by any change.
+type fakeConsul struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	kvs      map[string]*kvPair
+	sessions map[string]bool
+}
+
+func newFakeConsul() *fakeConsul {
+	f := &fakeConsul{
+		index:    1,
+		changed:  make(chan struct{}),
+		kvs:      make(map[string]*kvPair),
+		sessions: make(map[string]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/kv/", f.handleKV)
+	mux.HandleFunc("/v1/txn", f.handleTxn)
+	mux.HandleFunc("/v1/session/", f.handleSession)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// Addr returns the address of the agent for Connect.
+func (f *fakeConsul) Addr() string {
+	return strings.TrimPrefix(f.URL, "http://")
+}
+
+// commit bumps the index and wakes up blocking queries, f must be locked.
+func (f *fakeConsul) commit() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) get(key string) *kvPair {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.kvs[key]
+}
+
+// invalidate invalidates a session as if its ttl expired, keys locked by it
+// are deleted.
+func (f *fakeConsul) invalidate(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.sessions, id)
+	for key, kv := range f.kvs {
+		if kv.Session == id {
+			delete(f.kvs, key)
+		}
+	}
+	f.commit()
+}
+
+func writeJson(w http.ResponseWriter, status int, index uint64, v interface{}) {
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func (f *fakeConsul) handleKV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not supported by the stand-in", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	q := r.URL.Query()
+
+	f.mu.Lock()
+	if s := q.Get("index"); s != "" {
+		index, _ := strconv.ParseUint(s, 10, 64)
+		wait, err := time.ParseDuration(q.Get("wait"))
+		if err != nil {
+			wait = 5 * time.Minute
+		}
+		timeout := time.After(wait)
+		for index >= f.index {
+			changed := f.changed
+			f.mu.Unlock()
+			select {
+			case <-changed:
+			case <-timeout:
+				f.mu.Lock()
+				index = 0
+				continue
+			}
+			f.mu.Lock()
+		}
+	}
+	defer f.mu.Unlock()
+
+	if _, ok := q["keys"]; ok {
+		sep := q.Get("separator")
+		seen := make(map[string]bool)
+		keys := []string{}
+		for k := range f.kvs {
+			if !strings.HasPrefix(k, key) {
+				continue
+			}
+			if sep != "" {
+				if i := strings.Index(k[len(key):], sep); i >= 0 {
+					k = k[:len(key)+i+len(sep)]
+				}
+			}
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			writeJson(w, http.StatusNotFound, f.index, nil)
+			return
+		}
+		sort.Strings(keys)
+		writeJson(w, http.StatusOK, f.index, keys)
+		return
+	}
+	kv := f.kvs[key]
+	if kv == nil {
+		writeJson(w, http.StatusNotFound, f.index, nil)
+		return
+	}
+	writeJson(w, http.StatusOK, f.index, []*kvPair{kv})
+}
+
+type txnError struct {
+	OpIndex int
+	What    string
+}
+
+func (f *fakeConsul) handleTxn(w http.ResponseWriter, r *http.Request) {
+	var ops []txnOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// ops are applied to a copy, which replaces the store if all succeed
+	kvs := make(map[string]*kvPair, len(f.kvs))
+	for k, v := range f.kvs {
+		kvs[k] = v
+	}
+	index := f.index + 1
+	for i, op := range ops {
+		kv, existing := op.KV, kvs[op.KV.Key]
+		fail := func(what string) {
+			writeJson(w, http.StatusConflict, f.index, map[string]interface{}{
+				"Results": nil, "Errors": []txnError{{OpIndex: i, What: what}},
+			})
+		}
+		switch kv.Verb {
+		case "cas", "lock":
+			if kv.Verb == "cas" {
+				if kv.Index == 0 && existing != nil {
+					fail(fmt.Sprintf("failed to set key %q, index is stale", kv.Key))
+					return
+				}
+				if kv.Index != 0 && (existing == nil || existing.ModifyIndex != kv.Index) {
+					fail(fmt.Sprintf("failed to set key %q, index is stale", kv.Key))
+					return
+				}
+			} else {
+				if !f.sessions[kv.Session] {
+					fail(fmt.Sprintf("failed to lock key %q, invalid session", kv.Key))
+					return
+				}
+				if existing != nil && existing.Session != "" && existing.Session != kv.Session {
+					fail(fmt.Sprintf("failed to lock key %q, lock is already held", kv.Key))
+					return
+				}
+			}
+			next := &kvPair{Key: kv.Key, Value: kv.Value, CreateIndex: index, ModifyIndex: index}
+			if existing != nil {
+				// a set retains the lock of the key
+				next.CreateIndex = existing.CreateIndex
+				next.Session = existing.Session
+				next.LockIndex = existing.LockIndex
+			}
+			if kv.Verb == "lock" && next.Session != kv.Session {
+				next.Session = kv.Session
+				next.LockIndex++
+			}
+			kvs[kv.Key] = next
+		case "delete-cas":
+			if existing == nil || existing.ModifyIndex != kv.Index {
+				fail(fmt.Sprintf("failed to delete key %q, index is stale", kv.Key))
+				return
+			}
+			delete(kvs, kv.Key)
+		default:
+			fail(fmt.Sprintf("verb %q is not supported by the stand-in", kv.Verb))
+			return
+		}
+	}
+	f.kvs = kvs
+	f.commit()
+	writeJson(w, http.StatusOK, f.index, map[string]interface{}{"Results": []interface{}{}, "Errors": nil})
+}
+
+func (f *fakeConsul) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "method not supported by the stand-in", http.StatusMethodNotAllowed)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/v1/session/")
+	switch {
+	case p == "create":
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req["Behavior"] != "delete" {
+			http.Error(w, "bad session", http.StatusBadRequest)
+			return
+		}
+		id := fmt.Sprintf("session-%d", f.index)
+		f.sessions[id] = true
+		f.commit()
+		writeJson(w, http.StatusOK, f.index, map[string]string{"ID": id})
+	case strings.HasPrefix(p, "renew/"):
+		id := strings.TrimPrefix(p, "renew/")
+		if !f.sessions[id] {
+			http.Error(w, fmt.Sprintf("Session id '%s' not found", id), http.StatusNotFound)
+			return
+		}
+		writeJson(w, http.StatusOK, f.index, []map[string]string{{"ID": id}})
+	case strings.HasPrefix(p, "destroy/"):
+		id := strings.TrimPrefix(p, "destroy/")
+		delete(f.sessions, id)
+		for key, kv := range f.kvs {
+			if kv.Session == id {
+				delete(f.kvs, key)
+			}
+		}
+		f.commit()
+		writeJson(w, http.StatusOK, f.index, true)
+	default:
+		http.NotFound(w, r)
+	}
+}
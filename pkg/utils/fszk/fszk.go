@@ -0,0 +1,916 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+// Package fszk implements zkhelper.Conn on a local directory, so that the
+// dashboard and proxies on a single host can share the topology without
+// zookeeper.
+//
+// A node is a directory holding its data and stat in a file named ".node",
+// its children are subdirectories, so node names may not start with a dot.
+// Operations of all processes are serialized by an exclusive flock on the
+// ".lock" file of the root, and files are replaced atomically by renaming.
+//
+// Sessions are recorded in ".sessions" with the pid of their processes, the
+// ephemeral nodes of dead processes are removed by sessions still alive.
+// Watches are implemented by polling.
+package fszk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+var _ zkhelper.Conn = &Conn{}
+
+var (
+	// changes made by other processes are noticed in pollInterval, and
+	// ephemeral nodes of dead processes are removed in sweepInterval
+	pollInterval  = 100 * time.Millisecond
+	sweepInterval = time.Second
+)
+
+const (
+	nodeFile    = ".node"
+	lockFile    = ".lock"
+	zxidFile    = ".zxid"
+	sessionsDir = ".sessions"
+)
+
+type meta struct {
+	Data           []byte   `json:"data"`
+	Acl            []zk.ACL `json:"acl"`
+	Czxid          int64    `json:"czxid"`
+	Mzxid          int64    `json:"mzxid"`
+	Pzxid          int64    `json:"pzxid"`
+	Ctime          int64    `json:"ctime"`
+	Mtime          int64    `json:"mtime"`
+	Version        int      `json:"version"`
+	Cversion       int      `json:"cversion"`
+	Aversion       int      `json:"aversion"`
+	EphemeralOwner int64    `json:"ephemeral_owner"`
+}
+
+type stat struct {
+	m           *meta
+	numChildren int
+}
+
+func msToTime(ms int64) time.Time {
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+func (s *stat) Czxid() int64          { return s.m.Czxid }
+func (s *stat) Mzxid() int64          { return s.m.Mzxid }
+func (s *stat) CTime() time.Time      { return msToTime(s.m.Ctime) }
+func (s *stat) MTime() time.Time      { return msToTime(s.m.Mtime) }
+func (s *stat) Version() int          { return s.m.Version }
+func (s *stat) CVersion() int         { return s.m.Cversion }
+func (s *stat) AVersion() int         { return s.m.Aversion }
+func (s *stat) EphemeralOwner() int64 { return s.m.EphemeralOwner }
+func (s *stat) DataLength() int       { return len(s.m.Data) }
+func (s *stat) NumChildren() int      { return s.numChildren }
+func (s *stat) Pzxid() int64          { return s.m.Pzxid }
+
+type session struct {
+	Pid        int      `json:"pid"`
+	Ephemerals []string `json:"ephemerals"`
+}
+
+// root is a directory shared by the conns of this process, mu serializes
+// them while the flock serializes processes.
+type root struct {
+	dir   string
+	mu    sync.Mutex
+	conns map[*Conn]bool
+}
+
+var roots = struct {
+	sync.Mutex
+	m map[string]*root
+}{m: make(map[string]*root)}
+
+func getRoot(dir string) *root {
+	roots.Lock()
+	defer roots.Unlock()
+	r := roots.m[dir]
+	if r == nil {
+		r = &root{dir: dir, conns: make(map[*Conn]bool)}
+		roots.m[dir] = r
+	}
+	return r
+}
+
+func (r *root) lock() (func(), error) {
+	r.mu.Lock()
+	f, err := os.OpenFile(filepath.Join(r.dir, lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		r.mu.Unlock()
+		return nil, errors.Trace(err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		r.mu.Unlock()
+		return nil, errors.Trace(err)
+	}
+	return func() {
+		// the flock is released on close
+		f.Close()
+		r.mu.Unlock()
+	}, nil
+}
+
+func (r *root) nodeDir(p string) string {
+	return filepath.Join(r.dir, filepath.FromSlash(p))
+}
+
+func (r *root) sessionFile(id int64) string {
+	return filepath.Join(r.dir, sessionsDir, strconv.FormatInt(id, 10))
+}
+
+// writeFile replaces name atomically.
+func writeFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, name))
+}
+
+func isNotExist(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	// a file stands in the way, e.g. the parent is a leftover of a crash
+	pe, ok := err.(*os.PathError)
+	return ok && pe.Err == syscall.ENOTDIR
+}
+
+// readMeta returns nil if the node doesn't exist, the root always exists.
+func (r *root) readMeta(p string) (*meta, error) {
+	b, err := ioutil.ReadFile(filepath.Join(r.nodeDir(p), nodeFile))
+	if err != nil {
+		if !isNotExist(err) {
+			return nil, errors.Trace(err)
+		}
+		if p == "/" {
+			return &meta{Acl: zk.WorldACL(zk.PermAll)}, nil
+		}
+		return nil, nil
+	}
+	m := &meta{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return m, nil
+}
+
+func (r *root) writeMeta(p string, m *meta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return writeFile(filepath.Join(r.nodeDir(p), nodeFile), b)
+}
+
+func (r *root) children(p string) ([]string, error) {
+	infos, err := ioutil.ReadDir(r.nodeDir(p))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var children []string
+	for _, info := range infos {
+		if !info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		// the directory of a node being created or removed
+		if _, err := os.Stat(filepath.Join(r.nodeDir(p), info.Name(), nodeFile)); err != nil {
+			continue
+		}
+		children = append(children, info.Name())
+	}
+	return children, nil
+}
+
+func (r *root) stat(p string, m *meta) (zk.Stat, error) {
+	children, err := r.children(p)
+	if err != nil {
+		return nil, err
+	}
+	return &stat{m: m, numChildren: len(children)}, nil
+}
+
+func (r *root) nextZxid() (int64, error) {
+	name := filepath.Join(r.dir, zxidFile)
+	var zxid int64
+	b, err := ioutil.ReadFile(name)
+	switch {
+	case err == nil:
+		if zxid, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err != nil {
+			return 0, errors.Trace(err)
+		}
+	case !os.IsNotExist(err):
+		return 0, errors.Trace(err)
+	}
+	zxid++
+	if err := writeFile(name, []byte(strconv.FormatInt(zxid, 10))); err != nil {
+		return 0, err
+	}
+	return zxid, nil
+}
+
+func (r *root) readSession(id int64) (*session, error) {
+	b, err := ioutil.ReadFile(r.sessionFile(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	s := &session{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return s, nil
+}
+
+func (r *root) writeSession(id int64, s *session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return writeFile(r.sessionFile(id), b)
+}
+
+// remove deletes a node without children.
+func (r *root) remove(p string) error {
+	if err := os.Remove(filepath.Join(r.nodeDir(p), nodeFile)); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.RemoveAll(r.nodeDir(p)); err != nil {
+		return errors.Trace(err)
+	}
+	return r.touchChildren(path.Dir(p))
+}
+
+func (r *root) touchChildren(p string) error {
+	m, err := r.readMeta(p)
+	if err != nil {
+		return err
+	}
+	zxid, err := r.nextZxid()
+	if err != nil {
+		return err
+	}
+	m.Cversion++
+	m.Pzxid = zxid
+	return r.writeMeta(p, m)
+}
+
+// removeSession deletes the ephemeral nodes of a session and the session.
+func (r *root) removeSession(id int64) error {
+	s, err := r.readSession(id)
+	if err != nil || s == nil {
+		return err
+	}
+	for _, p := range s.Ephemerals {
+		m, err := r.readMeta(p)
+		if err != nil {
+			return err
+		}
+		if m != nil && m.EphemeralOwner == id {
+			if err := r.remove(p); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(r.sessionFile(id)); err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// sweep removes the sessions of dead processes.
+func (r *root) sweep() error {
+	infos, err := ioutil.ReadDir(filepath.Join(r.dir, sessionsDir))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, info := range infos {
+		id, err := strconv.ParseInt(info.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		s, err := r.readSession(id)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			continue
+		}
+		if s.Pid == os.Getpid() || processAlive(s.Pid) {
+			continue
+		}
+		log.Warnf("fszk: remove session %d of dead process %d", id, s.Pid)
+		if err := r.removeSession(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kick makes conns of this process check their watches at once.
+func (r *root) kick() {
+	for c := range r.conns {
+		select {
+		case c.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+type watchType int
+
+const (
+	watchData watchType = iota
+	watchExist
+	watchChildren
+)
+
+type watcher struct {
+	typ  watchType
+	path string
+	ch   chan zk.Event
+
+	// czxid of the node, and mzxid or pzxid of it when the watch was set
+	czxid, zxid int64
+}
+
+// fire returns the event if the node m of the watch has changed, m is nil
+// if the node doesn't exist.
+func (w *watcher) fire(m *meta) (zk.Event, bool) {
+	e := zk.Event{State: zk.StateSyncConnected, Path: w.path}
+	switch {
+	case w.typ == watchExist:
+		e.Type = zk.EventNodeCreated
+		return e, m != nil
+	case m == nil || m.Czxid != w.czxid:
+		e.Type = zk.EventNodeDeleted
+	case w.typ == watchData && m.Mzxid != w.zxid:
+		e.Type = zk.EventNodeDataChanged
+	case w.typ == watchChildren && m.Pzxid != w.zxid:
+		e.Type = zk.EventNodeChildrenChanged
+	default:
+		return e, false
+	}
+	return e, true
+}
+
+// Connect starts a session on the directory addr, it's a zkhelper factory
+// like zkhelper.ConnectToZk.
+func Connect(addr string, timeout int) (zkhelper.Conn, error) {
+	c, err := NewConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewConn starts a session on dir, which is created if it doesn't exist.
+func NewConn(dir string) (*Conn, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, sessionsDir), 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return newConn(getRoot(dir))
+}
+
+func newConn(r *root) (*Conn, error) {
+	unlock, err := r.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	id, err := r.nextZxid()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.writeSession(id, &session{Pid: os.Getpid()}); err != nil {
+		return nil, err
+	}
+	c := &Conn{root: r, session: id, kick: make(chan struct{}, 1), quit: make(chan struct{})}
+	r.conns[c] = true
+	if err := r.sweep(); err != nil {
+		log.WarnErrorf(err, "fszk: sweep sessions failed")
+	}
+	go c.poll()
+	return c, nil
+}
+
+// Conn is a session on a directory, fields are guarded by the lock of the
+// root.
+type Conn struct {
+	root     *root
+	session  int64
+	err      error
+	watchers []*watcher
+
+	kick chan struct{}
+	quit chan struct{}
+}
+
+func (c *Conn) SessionId() int64 {
+	return c.session
+}
+
+// check returns the error of the session, the session is expired if its
+// file was removed, e.g. by a sweep of another process.
+func (c *Conn) check() error {
+	if c.err != nil {
+		return c.err
+	}
+	if _, err := os.Stat(c.root.sessionFile(c.session)); err != nil {
+		if !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+		c.end(zk.ErrSessionExpired, zk.ErrSessionExpired, zk.StateExpired)
+		return c.err
+	}
+	return nil
+}
+
+// do runs f with the root locked.
+func (c *Conn) do(f func(r *root) error) error {
+	unlock, err := c.root.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := c.check(); err != nil {
+		return err
+	}
+	return f(c.root)
+}
+
+func (c *Conn) poll() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	lastSweep := time.Now()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		case <-c.kick:
+		}
+		sweep := time.Since(lastSweep) >= sweepInterval
+		if sweep {
+			lastSweep = time.Now()
+		}
+		if err := c.refresh(sweep); err != nil {
+			log.WarnErrorf(err, "fszk: refresh session %d failed", c.session)
+		}
+	}
+}
+
+// refresh fires the watches on nodes which have changed.
+func (c *Conn) refresh(sweep bool) error {
+	return c.do(func(r *root) error {
+		if sweep {
+			if err := r.sweep(); err != nil {
+				return err
+			}
+		}
+		var rest []*watcher
+		for i, w := range c.watchers {
+			m, err := r.readMeta(w.path)
+			if err != nil {
+				c.watchers = append(rest, c.watchers[i:]...)
+				return err
+			}
+			if e, ok := w.fire(m); ok {
+				w.ch <- e
+			} else {
+				rest = append(rest, w)
+			}
+		}
+		c.watchers = rest
+		return nil
+	})
+}
+
+func (c *Conn) addWatch(typ watchType, p string, m *meta) <-chan zk.Event {
+	w := &watcher{typ: typ, path: p, ch: make(chan zk.Event, 1)}
+	if m != nil {
+		w.czxid = m.Czxid
+		switch typ {
+		case watchData:
+			w.zxid = m.Mzxid
+		case watchChildren:
+			w.zxid = m.Pzxid
+		}
+	}
+	c.watchers = append(c.watchers, w)
+	return w.ch
+}
+
+func validatePath(p string, sequence bool) error {
+	if sequence && strings.HasSuffix(p, "/") {
+		p += "0"
+	}
+	if p == "/" {
+		return nil
+	}
+	if !strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") {
+		return zk.ErrBadArguments
+	}
+	for _, name := range strings.Split(p[1:], "/") {
+		// names starting with a dot are kept for files of the store
+		if name == "" || strings.HasPrefix(name, ".") {
+			return zk.ErrBadArguments
+		}
+	}
+	return nil
+}
+
+func (c *Conn) Get(p string) ([]byte, zk.Stat, error) {
+	data, stat, _, err := c.get(p, false)
+	return data, stat, err
+}
+
+func (c *Conn) GetW(p string) ([]byte, zk.Stat, <-chan zk.Event, error) {
+	return c.get(p, true)
+}
+
+func (c *Conn) get(p string, watch bool) ([]byte, zk.Stat, <-chan zk.Event, error) {
+	var data []byte
+	var stat zk.Stat
+	var ch <-chan zk.Event
+	err := c.do(func(r *root) error {
+		if err := validatePath(p, false); err != nil {
+			return err
+		}
+		m, err := r.readMeta(p)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			return zk.ErrNoNode
+		}
+		if stat, err = r.stat(p, m); err != nil {
+			return err
+		}
+		if watch {
+			ch = c.addWatch(watchData, p, m)
+		}
+		data = m.Data
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return data, stat, ch, nil
+}
+
+func (c *Conn) Children(p string) ([]string, zk.Stat, error) {
+	children, stat, _, err := c.getChildren(p, false)
+	return children, stat, err
+}
+
+func (c *Conn) ChildrenW(p string) ([]string, zk.Stat, <-chan zk.Event, error) {
+	return c.getChildren(p, true)
+}
+
+func (c *Conn) getChildren(p string, watch bool) ([]string, zk.Stat, <-chan zk.Event, error) {
+	var children []string
+	var ch <-chan zk.Event
+	var m *meta
+	err := c.do(func(r *root) error {
+		if err := validatePath(p, false); err != nil {
+			return err
+		}
+		var err error
+		if m, err = r.readMeta(p); err != nil {
+			return err
+		}
+		if m == nil {
+			return zk.ErrNoNode
+		}
+		if children, err = r.children(p); err != nil {
+			return err
+		}
+		if watch {
+			ch = c.addWatch(watchChildren, p, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if children == nil {
+		children = []string{}
+	}
+	return children, &stat{m: m, numChildren: len(children)}, ch, nil
+}
+
+func (c *Conn) Exists(p string) (bool, zk.Stat, error) {
+	ok, stat, _, err := c.exists(p, false)
+	return ok, stat, err
+}
+
+func (c *Conn) ExistsW(p string) (bool, zk.Stat, <-chan zk.Event, error) {
+	return c.exists(p, true)
+}
+
+func (c *Conn) exists(p string, watch bool) (bool, zk.Stat, <-chan zk.Event, error) {
+	var stat zk.Stat
+	var ch <-chan zk.Event
+	err := c.do(func(r *root) error {
+		if err := validatePath(p, false); err != nil {
+			return err
+		}
+		m, err := r.readMeta(p)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			if watch {
+				ch = c.addWatch(watchExist, p, nil)
+			}
+			return nil
+		}
+		if stat, err = r.stat(p, m); err != nil {
+			return err
+		}
+		if watch {
+			ch = c.addWatch(watchData, p, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, nil, nil, err
+	}
+	return stat != nil, stat, ch, nil
+}
+
+func (c *Conn) Create(p string, value []byte, flags int32, aclv []zk.ACL) (string, error) {
+	err := c.do(func(r *root) error {
+		if err := validatePath(p, flags&zk.FlagSequence != 0); err != nil {
+			return err
+		}
+		if p == "/" {
+			return zk.ErrNodeExists
+		}
+		dir, name := path.Split(p)
+		dir = path.Clean(dir)
+		parent, err := r.readMeta(dir)
+		if err != nil {
+			return err
+		}
+		if parent == nil {
+			return zk.ErrNoNode
+		}
+		if parent.EphemeralOwner != 0 {
+			return zk.ErrNoChildrenForEphemerals
+		}
+		if flags&zk.FlagSequence != 0 {
+			// the sequence number is the number of changes to children of
+			// the parent, as zookeeper does
+			name += c.Seq2Str(int64(parent.Cversion))
+			p = path.Join(dir, name)
+		}
+		if m, err := r.readMeta(p); err != nil {
+			return err
+		} else if m != nil {
+			return zk.ErrNodeExists
+		}
+
+		zxid, err := r.nextZxid()
+		if err != nil {
+			return err
+		}
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		m := &meta{Data: value, Acl: aclv, Czxid: zxid, Mzxid: zxid, Pzxid: zxid, Ctime: now, Mtime: now}
+		if flags&zk.FlagEphemeral != 0 {
+			// record it in the session first, so it's never left behind
+			s, err := r.readSession(c.session)
+			if err != nil {
+				return err
+			}
+			s.Ephemerals = append(s.Ephemerals, p)
+			if err := r.writeSession(c.session, s); err != nil {
+				return err
+			}
+			m.EphemeralOwner = c.session
+		}
+		if err := os.Mkdir(r.nodeDir(p), 0755); err != nil && !os.IsExist(err) {
+			return errors.Trace(err)
+		}
+		if err := r.writeMeta(p, m); err != nil {
+			return err
+		}
+		if err := r.touchChildren(dir); err != nil {
+			return err
+		}
+		r.kick()
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+func (c *Conn) Set(p string, value []byte, version int32) (zk.Stat, error) {
+	var stat zk.Stat
+	err := c.do(func(r *root) error {
+		if err := validatePath(p, false); err != nil {
+			return err
+		}
+		m, err := r.readMeta(p)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			return zk.ErrNoNode
+		}
+		if version != -1 && int(version) != m.Version {
+			return zk.ErrBadVersion
+		}
+		zxid, err := r.nextZxid()
+		if err != nil {
+			return err
+		}
+		m.Data = value
+		m.Version++
+		m.Mzxid = zxid
+		m.Mtime = time.Now().UnixNano() / int64(time.Millisecond)
+		if err := r.writeMeta(p, m); err != nil {
+			return err
+		}
+		r.kick()
+		stat, err = r.stat(p, m)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stat, nil
+}
+
+func (c *Conn) Delete(p string, version int32) error {
+	return c.do(func(r *root) error {
+		if err := validatePath(p, false); err != nil {
+			return err
+		}
+		if p == "/" {
+			return zk.ErrBadArguments
+		}
+		m, err := r.readMeta(p)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			return zk.ErrNoNode
+		}
+		if version != -1 && int(version) != m.Version {
+			return zk.ErrBadVersion
+		}
+		children, err := r.children(p)
+		if err != nil {
+			return err
+		}
+		if len(children) != 0 {
+			return zk.ErrNotEmpty
+		}
+		if err := r.remove(p); err != nil {
+			return err
+		}
+		r.kick()
+		return nil
+	})
+}
+
+func (c *Conn) GetACL(p string) ([]zk.ACL, zk.Stat, error) {
+	var aclv []zk.ACL
+	var stat zk.Stat
+	err := c.do(func(r *root) error {
+		if err := validatePath(p, false); err != nil {
+			return err
+		}
+		m, err := r.readMeta(p)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			return zk.ErrNoNode
+		}
+		aclv = m.Acl
+		stat, err = r.stat(p, m)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return aclv, stat, nil
+}
+
+func (c *Conn) SetACL(p string, aclv []zk.ACL, version int32) (zk.Stat, error) {
+	var stat zk.Stat
+	err := c.do(func(r *root) error {
+		if err := validatePath(p, false); err != nil {
+			return err
+		}
+		m, err := r.readMeta(p)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			return zk.ErrNoNode
+		}
+		if version != -1 && int(version) != m.Aversion {
+			return zk.ErrBadVersion
+		}
+		m.Acl = aclv
+		m.Aversion++
+		if err := r.writeMeta(p, m); err != nil {
+			return err
+		}
+		stat, err = r.stat(p, m)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stat, nil
+}
+
+func (c *Conn) Seq2Str(seq int64) string {
+	return fmt.Sprintf("%0.10d", seq)
+}
+
+// Close ends the session, its ephemeral nodes are deleted, and its watches
+// receive an EventNotWatching with zk.ErrClosing as go-zookeeper does.
+func (c *Conn) Close() {
+	unlock, err := c.root.lock()
+	if err != nil {
+		log.WarnErrorf(err, "fszk: close session %d failed", c.session)
+		return
+	}
+	defer unlock()
+	c.end(zk.ErrConnectionClosed, zk.ErrClosing, zk.StateDisconnected)
+}
+
+// end ends the session with the root locked, err is returned by operations
+// from now on, and watches receive evtErr.
+func (c *Conn) end(err, evtErr error, state zk.State) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.quit)
+	r := c.root
+	delete(r.conns, c)
+	if err := r.removeSession(c.session); err != nil {
+		log.WarnErrorf(err, "fszk: remove session %d failed", c.session)
+	}
+	for _, w := range c.watchers {
+		w.ch <- zk.Event{Type: zk.EventNotWatching, State: state, Path: w.path, Err: evtErr}
+	}
+	c.watchers = nil
+	r.kick()
+}
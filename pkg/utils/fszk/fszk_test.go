@@ -0,0 +1,176 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package fszk
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+var acl = zk.WorldACL(zk.PermAll)
+
+func init() {
+	pollInterval = 10 * time.Millisecond
+	sweepInterval = 10 * time.Millisecond
+}
+
+func tempDir() string {
+	dir, err := ioutil.TempDir("", "fszk_test")
+	assert.MustNoError(err)
+	return dir
+}
+
+func mustEvent(ch <-chan zk.Event, t zk.EventType, p string) zk.Event {
+	select {
+	case e := <-ch:
+		assert.Must(e.Type == t && e.Path == p)
+		return e
+	case <-time.After(time.Second):
+		assert.Must(false)
+	}
+	return zk.Event{}
+}
+
+func TestNodes(t *testing.T) {
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	c, err := NewConn(dir)
+	assert.MustNoError(err)
+	defer c.Close()
+
+	_, err = c.Create("/a/b", nil, 0, acl)
+	assert.Must(err == zk.ErrNoNode)
+	_, err = c.Create("/.a", nil, 0, acl)
+	assert.Must(err == zk.ErrBadArguments)
+	_, err = c.Create("/a", []byte("x"), 0, acl)
+	assert.MustNoError(err)
+	_, err = c.Create("/a", nil, 0, acl)
+	assert.Must(err == zk.ErrNodeExists)
+
+	stat, err := c.Set("/a", []byte("yy"), 0)
+	assert.MustNoError(err)
+	assert.Must(stat.Version() == 1 && stat.DataLength() == 2)
+	_, err = c.Set("/a", []byte("z"), 0)
+	assert.Must(err == zk.ErrBadVersion)
+
+	for i := 0; i < 3; i++ {
+		p, err := c.Create("/a/n-", nil, zk.FlagSequence, acl)
+		assert.MustNoError(err)
+		assert.Must(p == "/a/n-"+c.Seq2Str(int64(i)))
+	}
+	children, stat, err := c.Children("/a")
+	assert.MustNoError(err)
+	assert.Must(len(children) == 3 && children[0] == "n-0000000000" && stat.NumChildren() == 3)
+
+	assert.Must(c.Delete("/a", -1) == zk.ErrNotEmpty)
+	assert.MustNoError(zkhelper.DeleteRecursive(c, "/a", -1))
+	ok, _, err := c.Exists("/a")
+	assert.MustNoError(err)
+	assert.Must(!ok)
+
+	// the tree is kept on disk
+	_, err = zkhelper.CreateRecursive(c, "/x/y:1", "v", 0, acl)
+	assert.MustNoError(err)
+	c2, err := NewConn(dir)
+	assert.MustNoError(err)
+	defer c2.Close()
+	data, _, err := c2.Get("/x/y:1")
+	assert.MustNoError(err)
+	assert.Must(string(data) == "v")
+}
+
+func TestWatches(t *testing.T) {
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	c, err := NewConn(dir)
+	assert.MustNoError(err)
+	defer c.Close()
+
+	// a root of its own polls the directory like another process
+	other, err := newConn(&root{dir: c.root.dir, conns: make(map[*Conn]bool)})
+	assert.MustNoError(err)
+	defer other.Close()
+
+	_, _, exist, err := other.ExistsW("/a")
+	assert.MustNoError(err)
+	_, err = c.Create("/a", nil, 0, acl)
+	assert.MustNoError(err)
+	mustEvent(exist, zk.EventNodeCreated, "/a")
+
+	_, _, data, err := other.GetW("/a")
+	assert.MustNoError(err)
+	_, _, children, err := other.ChildrenW("/a")
+	assert.MustNoError(err)
+	_, err = c.Set("/a", []byte("x"), -1)
+	assert.MustNoError(err)
+	mustEvent(data, zk.EventNodeDataChanged, "/a")
+	_, err = c.Create("/a/b", nil, 0, acl)
+	assert.MustNoError(err)
+	mustEvent(children, zk.EventNodeChildrenChanged, "/a")
+
+	_, _, data, err = c.GetW("/a/b")
+	assert.MustNoError(err)
+	assert.MustNoError(other.Delete("/a/b", -1))
+	mustEvent(data, zk.EventNodeDeleted, "/a/b")
+
+	_, _, data, err = c.GetW("/a")
+	assert.MustNoError(err)
+	c.Close()
+	e := mustEvent(data, zk.EventNotWatching, "/a")
+	assert.Must(e.Err == zk.ErrClosing)
+	_, _, err = c.Get("/a")
+	assert.Must(err == zk.ErrConnectionClosed)
+}
+
+func TestSessions(t *testing.T) {
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	c1, err := NewConn(dir)
+	assert.MustNoError(err)
+	defer c1.Close()
+	c2, err := NewConn(dir)
+	assert.MustNoError(err)
+	defer c2.Close()
+
+	_, err = c1.Create("/e1", nil, zk.FlagEphemeral, acl)
+	assert.MustNoError(err)
+	_, err = c1.Create("/e1/x", nil, 0, acl)
+	assert.Must(err == zk.ErrNoChildrenForEphemerals)
+	_, stat, err := c2.Get("/e1")
+	assert.MustNoError(err)
+	assert.Must(stat.EphemeralOwner() == c1.SessionId())
+
+	// closing a session removes its ephemeral nodes
+	_, err = c2.Create("/e2", nil, zk.FlagEphemeral, acl)
+	assert.MustNoError(err)
+	c2.Close()
+	ok, _, err := c1.Exists("/e2")
+	assert.MustNoError(err)
+	assert.Must(!ok)
+
+	// so does the death of its process
+	cmd := exec.Command("true")
+	assert.MustNoError(cmd.Run())
+	s, err := c1.root.readSession(c1.session)
+	assert.MustNoError(err)
+	s.Pid = cmd.Process.Pid
+	assert.MustNoError(c1.root.writeSession(c1.session, s))
+
+	c3, err := NewConn(dir)
+	assert.MustNoError(err)
+	defer c3.Close()
+	ok, _, err = c3.Exists("/e1")
+	assert.MustNoError(err)
+	assert.Must(!ok)
+	_, _, err = c1.Get("/")
+	assert.Must(err == zk.ErrSessionExpired)
+}
@@ -0,0 +1,517 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+// Package memzk implements zkhelper.Conn in memory, with the semantics of
+// zookeeper: versions, ephemeral and sequence nodes, one-shot watches and
+// sessions, which may be expired on purpose to test recovery.
+//
+// Conns connected to the same address share a tree within the process, so it
+// serves unit tests and single process demos, but not a real deployment.
+package memzk
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+)
+
+var _ zkhelper.Conn = &Conn{}
+
+type stat struct {
+	czxid, mzxid, pzxid int64
+	ctime, mtime        time.Time
+	version             int
+	cversion            int
+	aversion            int
+	ephemeralOwner      int64
+	dataLength          int
+	numChildren         int
+}
+
+func (s *stat) Czxid() int64          { return s.czxid }
+func (s *stat) Mzxid() int64          { return s.mzxid }
+func (s *stat) CTime() time.Time      { return s.ctime }
+func (s *stat) MTime() time.Time      { return s.mtime }
+func (s *stat) Version() int          { return s.version }
+func (s *stat) CVersion() int         { return s.cversion }
+func (s *stat) AVersion() int         { return s.aversion }
+func (s *stat) EphemeralOwner() int64 { return s.ephemeralOwner }
+func (s *stat) DataLength() int       { return s.dataLength }
+func (s *stat) NumChildren() int      { return s.numChildren }
+func (s *stat) Pzxid() int64          { return s.pzxid }
+
+type node struct {
+	path     string
+	data     []byte
+	acl      []zk.ACL
+	children map[string]*node
+	stat     stat
+}
+
+func (n *node) snapshot() zk.Stat {
+	s := n.stat
+	s.dataLength = len(n.data)
+	s.numChildren = len(n.children)
+	return &s
+}
+
+type watcher struct {
+	ch      chan zk.Event
+	session *Conn
+}
+
+// Store is a tree of nodes shared by sessions.
+type Store struct {
+	mu       sync.Mutex
+	root     *node
+	zxid     int64
+	sessions int64
+
+	// data watches are set by GetW and ExistsW on existing nodes, exist
+	// watches by ExistsW on missing nodes
+	dataWatches  map[string][]*watcher
+	existWatches map[string][]*watcher
+	childWatches map[string][]*watcher
+}
+
+func NewStore() *Store {
+	now := time.Now()
+	return &Store{
+		root: &node{
+			path:     "/",
+			acl:      zk.WorldACL(zk.PermAll),
+			children: make(map[string]*node),
+			stat:     stat{ctime: now, mtime: now},
+		},
+		dataWatches:  make(map[string][]*watcher),
+		existWatches: make(map[string][]*watcher),
+		childWatches: make(map[string][]*watcher),
+	}
+}
+
+var stores = struct {
+	sync.Mutex
+	m map[string]*Store
+}{m: make(map[string]*Store)}
+
+// GetStore returns the store of addr in this process, it's created on first
+// use.
+func GetStore(addr string) *Store {
+	stores.Lock()
+	defer stores.Unlock()
+	s := stores.m[addr]
+	if s == nil {
+		s = NewStore()
+		stores.m[addr] = s
+	}
+	return s
+}
+
+// Connect starts a session on the store of addr, it's a zkhelper factory
+// like zkhelper.ConnectToZk.
+func Connect(addr string, timeout int) (zkhelper.Conn, error) {
+	return GetStore(addr).NewConn(), nil
+}
+
+// NewConn starts a session on a store of its own.
+func NewConn() *Conn {
+	return NewStore().NewConn()
+}
+
+// NewConn starts a new session.
+func (s *Store) NewConn() *Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions++
+	return &Conn{store: s, session: s.sessions}
+}
+
+// Conn is a session on a store, ephemeral nodes and watches of the session
+// are gone once it's closed or expired.
+type Conn struct {
+	store   *Store
+	session int64
+	err     error
+}
+
+func (c *Conn) SessionId() int64 {
+	return c.session
+}
+
+func validatePath(p string, sequence bool) error {
+	if sequence && strings.HasSuffix(p, "/") {
+		p += "0"
+	}
+	if p == "/" {
+		return nil
+	}
+	if !strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") {
+		return zk.ErrBadArguments
+	}
+	for _, name := range strings.Split(p[1:], "/") {
+		if name == "" || name == "." || name == ".." {
+			return zk.ErrBadArguments
+		}
+	}
+	return nil
+}
+
+// find returns the node of p, the store must be locked.
+func (s *Store) find(p string) *node {
+	if p == "/" {
+		return s.root
+	}
+	n := s.root
+	for _, name := range strings.Split(p[1:], "/") {
+		if n = n.children[name]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func (s *Store) addWatch(m map[string][]*watcher, p string, c *Conn) <-chan zk.Event {
+	w := &watcher{ch: make(chan zk.Event, 1), session: c}
+	m[p] = append(m[p], w)
+	return w.ch
+}
+
+func (s *Store) fire(m map[string][]*watcher, p string, t zk.EventType) {
+	for _, w := range m[p] {
+		w.ch <- zk.Event{Type: t, State: zk.StateSyncConnected, Path: p}
+	}
+	delete(m, p)
+}
+
+// check returns the error of the session, the store must be locked.
+func (c *Conn) check() error {
+	return c.err
+}
+
+func (c *Conn) Get(p string) ([]byte, zk.Stat, error) {
+	data, stat, _, err := c.get(p, false)
+	return data, stat, err
+}
+
+func (c *Conn) GetW(p string) ([]byte, zk.Stat, <-chan zk.Event, error) {
+	return c.get(p, true)
+}
+
+func (c *Conn) get(p string, watch bool) ([]byte, zk.Stat, <-chan zk.Event, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := c.check(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := validatePath(p, false); err != nil {
+		return nil, nil, nil, err
+	}
+	n := s.find(p)
+	if n == nil {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	var ch <-chan zk.Event
+	if watch {
+		ch = s.addWatch(s.dataWatches, p, c)
+	}
+	data := make([]byte, len(n.data))
+	copy(data, n.data)
+	return data, n.snapshot(), ch, nil
+}
+
+func (c *Conn) Children(p string) ([]string, zk.Stat, error) {
+	children, stat, _, err := c.children(p, false)
+	return children, stat, err
+}
+
+func (c *Conn) ChildrenW(p string) ([]string, zk.Stat, <-chan zk.Event, error) {
+	return c.children(p, true)
+}
+
+func (c *Conn) children(p string, watch bool) ([]string, zk.Stat, <-chan zk.Event, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := c.check(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := validatePath(p, false); err != nil {
+		return nil, nil, nil, err
+	}
+	n := s.find(p)
+	if n == nil {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	var ch <-chan zk.Event
+	if watch {
+		ch = s.addWatch(s.childWatches, p, c)
+	}
+	children := make([]string, 0, len(n.children))
+	for name := range n.children {
+		children = append(children, name)
+	}
+	sort.Strings(children)
+	return children, n.snapshot(), ch, nil
+}
+
+func (c *Conn) Exists(p string) (bool, zk.Stat, error) {
+	ok, stat, _, err := c.exists(p, false)
+	return ok, stat, err
+}
+
+func (c *Conn) ExistsW(p string) (bool, zk.Stat, <-chan zk.Event, error) {
+	return c.exists(p, true)
+}
+
+func (c *Conn) exists(p string, watch bool) (bool, zk.Stat, <-chan zk.Event, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := c.check(); err != nil {
+		return false, nil, nil, err
+	}
+	if err := validatePath(p, false); err != nil {
+		return false, nil, nil, err
+	}
+	n := s.find(p)
+	if n == nil {
+		var ch <-chan zk.Event
+		if watch {
+			ch = s.addWatch(s.existWatches, p, c)
+		}
+		return false, nil, ch, nil
+	}
+	var ch <-chan zk.Event
+	if watch {
+		ch = s.addWatch(s.dataWatches, p, c)
+	}
+	return true, n.snapshot(), ch, nil
+}
+
+func (c *Conn) Create(p string, value []byte, flags int32, aclv []zk.ACL) (string, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := c.check(); err != nil {
+		return "", err
+	}
+	if err := validatePath(p, flags&zk.FlagSequence != 0); err != nil {
+		return "", err
+	}
+	if p == "/" {
+		return "", zk.ErrNodeExists
+	}
+	dir, name := path.Split(p)
+	parent := s.find(path.Clean(dir))
+	if parent == nil {
+		return "", zk.ErrNoNode
+	}
+	if parent.stat.ephemeralOwner != 0 {
+		return "", zk.ErrNoChildrenForEphemerals
+	}
+	if flags&zk.FlagSequence != 0 {
+		// the sequence number is the number of changes to children of the
+		// parent, as zookeeper does
+		name += c.Seq2Str(int64(parent.stat.cversion))
+		p = path.Join(dir, name)
+	}
+	if parent.children[name] != nil {
+		return "", zk.ErrNodeExists
+	}
+
+	s.zxid++
+	now := time.Now()
+	n := &node{
+		path:     p,
+		data:     append([]byte(nil), value...),
+		acl:      aclv,
+		children: make(map[string]*node),
+		stat:     stat{czxid: s.zxid, mzxid: s.zxid, pzxid: s.zxid, ctime: now, mtime: now},
+	}
+	if flags&zk.FlagEphemeral != 0 {
+		n.stat.ephemeralOwner = c.session
+	}
+	parent.children[name] = n
+	parent.stat.cversion++
+	parent.stat.pzxid = s.zxid
+
+	s.fire(s.existWatches, p, zk.EventNodeCreated)
+	s.fire(s.childWatches, parent.path, zk.EventNodeChildrenChanged)
+	return p, nil
+}
+
+func (c *Conn) Set(p string, value []byte, version int32) (zk.Stat, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	if err := validatePath(p, false); err != nil {
+		return nil, err
+	}
+	n := s.find(p)
+	if n == nil {
+		return nil, zk.ErrNoNode
+	}
+	if version != -1 && int(version) != n.stat.version {
+		return nil, zk.ErrBadVersion
+	}
+	s.zxid++
+	n.data = append([]byte(nil), value...)
+	n.stat.version++
+	n.stat.mzxid = s.zxid
+	n.stat.mtime = time.Now()
+
+	s.fire(s.dataWatches, p, zk.EventNodeDataChanged)
+	return n.snapshot(), nil
+}
+
+func (c *Conn) Delete(p string, version int32) error {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := c.check(); err != nil {
+		return err
+	}
+	if err := validatePath(p, false); err != nil {
+		return err
+	}
+	if p == "/" {
+		return zk.ErrBadArguments
+	}
+	n := s.find(p)
+	if n == nil {
+		return zk.ErrNoNode
+	}
+	if version != -1 && int(version) != n.stat.version {
+		return zk.ErrBadVersion
+	}
+	if len(n.children) != 0 {
+		return zk.ErrNotEmpty
+	}
+	s.remove(n)
+	return nil
+}
+
+// remove deletes a node without children, the store must be locked.
+func (s *Store) remove(n *node) {
+	dir, name := path.Split(n.path)
+	parent := s.find(path.Clean(dir))
+	delete(parent.children, name)
+	s.zxid++
+	parent.stat.cversion++
+	parent.stat.pzxid = s.zxid
+
+	s.fire(s.dataWatches, n.path, zk.EventNodeDeleted)
+	s.fire(s.childWatches, n.path, zk.EventNodeDeleted)
+	s.fire(s.childWatches, parent.path, zk.EventNodeChildrenChanged)
+}
+
+func (c *Conn) GetACL(p string) ([]zk.ACL, zk.Stat, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := c.check(); err != nil {
+		return nil, nil, err
+	}
+	if err := validatePath(p, false); err != nil {
+		return nil, nil, err
+	}
+	n := s.find(p)
+	if n == nil {
+		return nil, nil, zk.ErrNoNode
+	}
+	return append([]zk.ACL(nil), n.acl...), n.snapshot(), nil
+}
+
+func (c *Conn) SetACL(p string, aclv []zk.ACL, version int32) (zk.Stat, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	if err := validatePath(p, false); err != nil {
+		return nil, err
+	}
+	n := s.find(p)
+	if n == nil {
+		return nil, zk.ErrNoNode
+	}
+	if version != -1 && int(version) != n.stat.aversion {
+		return nil, zk.ErrBadVersion
+	}
+	n.acl = append([]zk.ACL(nil), aclv...)
+	n.stat.aversion++
+	return n.snapshot(), nil
+}
+
+func (c *Conn) Seq2Str(seq int64) string {
+	return fmt.Sprintf("%0.10d", seq)
+}
+
+// Close ends the session, its ephemeral nodes are deleted, and its watches
+// receive an EventNotWatching with zk.ErrClosing as go-zookeeper does.
+func (c *Conn) Close() {
+	c.end(zk.ErrConnectionClosed, zk.ErrClosing, zk.StateDisconnected)
+}
+
+// Expire simulates the expiry of the session: its ephemeral nodes are
+// deleted, its watches receive an EventNotWatching, and all operations fail
+// with zk.ErrSessionExpired from now on.
+func (c *Conn) Expire() {
+	c.end(zk.ErrSessionExpired, zk.ErrSessionExpired, zk.StateExpired)
+}
+
+// end ends the session, err is returned by operations from now on, and
+// watches receive evtErr.
+func (c *Conn) end(err, evtErr error, state zk.State) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+
+	var ephemerals []*node
+	var walk func(n *node)
+	walk = func(n *node) {
+		for _, child := range n.children {
+			if child.stat.ephemeralOwner == c.session {
+				ephemerals = append(ephemerals, child)
+			}
+			walk(child)
+		}
+	}
+	walk(s.root)
+	for _, n := range ephemerals {
+		s.remove(n)
+	}
+
+	for _, m := range []map[string][]*watcher{s.dataWatches, s.existWatches, s.childWatches} {
+		for p, ws := range m {
+			var rest []*watcher
+			for _, w := range ws {
+				if w.session == c {
+					w.ch <- zk.Event{Type: zk.EventNotWatching, State: state, Path: p, Err: evtErr}
+				} else {
+					rest = append(rest, w)
+				}
+			}
+			if len(rest) == 0 {
+				delete(m, p)
+			} else {
+				m[p] = rest
+			}
+		}
+	}
+}
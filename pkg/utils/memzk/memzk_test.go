@@ -0,0 +1,197 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package memzk
+
+import (
+	"testing"
+
+	"github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+var acl = zk.WorldACL(zk.PermAll)
+
+func mustEvent(ch <-chan zk.Event, t zk.EventType, p string) zk.Event {
+	select {
+	case e := <-ch:
+		assert.Must(e.Type == t && e.Path == p)
+		return e
+	default:
+		assert.Must(false)
+	}
+	return zk.Event{}
+}
+
+func mustNoEvent(ch <-chan zk.Event) {
+	select {
+	case <-ch:
+		assert.Must(false)
+	default:
+	}
+}
+
+func TestNodes(t *testing.T) {
+	c := NewConn()
+
+	_, err := c.Create("/a/b", nil, 0, acl)
+	assert.Must(err == zk.ErrNoNode)
+	_, err = c.Create("/a/", nil, 0, acl)
+	assert.Must(err == zk.ErrBadArguments)
+	p, err := c.Create("/a", []byte("x"), 0, acl)
+	assert.MustNoError(err)
+	assert.Must(p == "/a")
+	_, err = c.Create("/a", nil, 0, acl)
+	assert.Must(err == zk.ErrNodeExists)
+
+	data, stat, err := c.Get("/a")
+	assert.MustNoError(err)
+	assert.Must(string(data) == "x" && stat.Version() == 0 && stat.DataLength() == 1)
+
+	stat, err = c.Set("/a", []byte("yy"), 0)
+	assert.MustNoError(err)
+	assert.Must(stat.Version() == 1 && stat.DataLength() == 2)
+	_, err = c.Set("/a", []byte("z"), 0)
+	assert.Must(err == zk.ErrBadVersion)
+	_, err = c.Set("/a", []byte("z"), -1)
+	assert.MustNoError(err)
+
+	for i := 0; i < 3; i++ {
+		p, err := c.Create("/a/", nil, zk.FlagSequence, acl)
+		assert.MustNoError(err)
+		assert.Must(p == "/a/"+c.Seq2Str(int64(i)))
+	}
+	p, err = c.Create("/a/n-", nil, zk.FlagSequence, acl)
+	assert.MustNoError(err)
+	assert.Must(p == "/a/n-0000000003")
+
+	children, stat, err := c.Children("/a")
+	assert.MustNoError(err)
+	assert.Must(len(children) == 4 && children[0] == "0000000000" && stat.NumChildren() == 4 && stat.CVersion() == 4)
+
+	assert.Must(c.Delete("/a", -1) == zk.ErrNotEmpty)
+	assert.Must(c.Delete("/a/n-0000000003", 1) == zk.ErrBadVersion)
+	assert.MustNoError(zkhelper.DeleteRecursive(c, "/a", -1))
+	ok, _, err := c.Exists("/a")
+	assert.MustNoError(err)
+	assert.Must(!ok)
+
+	_, err = zkhelper.CreateRecursive(c, "/x/y/z", "v", 0, acl)
+	assert.MustNoError(err)
+	data, _, err = c.Get("/x/y/z")
+	assert.MustNoError(err)
+	assert.Must(string(data) == "v")
+
+	_, stat, err = c.GetACL("/x")
+	assert.MustNoError(err)
+	_, err = c.SetACL("/x", acl, int32(stat.AVersion()))
+	assert.MustNoError(err)
+	_, err = c.SetACL("/x", acl, 0)
+	assert.Must(err == zk.ErrBadVersion)
+}
+
+func TestWatches(t *testing.T) {
+	c := NewConn()
+
+	ok, _, exist, err := c.ExistsW("/a")
+	assert.MustNoError(err)
+	assert.Must(!ok)
+	_, _, root, err := c.ChildrenW("/")
+	assert.MustNoError(err)
+	_, err = c.Create("/a", nil, 0, acl)
+	assert.MustNoError(err)
+	mustEvent(exist, zk.EventNodeCreated, "/a")
+	mustEvent(root, zk.EventNodeChildrenChanged, "/")
+
+	_, _, data, err := c.GetW("/a")
+	assert.MustNoError(err)
+	_, _, children, err := c.ChildrenW("/a")
+	assert.MustNoError(err)
+	_, err = c.Set("/a", []byte("x"), -1)
+	assert.MustNoError(err)
+	mustEvent(data, zk.EventNodeDataChanged, "/a")
+	mustNoEvent(children)
+
+	// watches are one-shot
+	_, err = c.Set("/a", []byte("y"), -1)
+	assert.MustNoError(err)
+	mustNoEvent(data)
+
+	_, err = c.Create("/a/b", nil, 0, acl)
+	assert.MustNoError(err)
+	mustEvent(children, zk.EventNodeChildrenChanged, "/a")
+
+	ok, _, data, err = c.ExistsW("/a/b")
+	assert.MustNoError(err)
+	assert.Must(ok)
+	_, _, children, err = c.ChildrenW("/a/b")
+	assert.MustNoError(err)
+	assert.MustNoError(c.Delete("/a/b", -1))
+	mustEvent(data, zk.EventNodeDeleted, "/a/b")
+	mustEvent(children, zk.EventNodeDeleted, "/a/b")
+
+	_, _, _, err = c.GetW("/a/b")
+	assert.Must(err == zk.ErrNoNode)
+}
+
+func TestSessions(t *testing.T) {
+	s := NewStore()
+	c1, c2 := s.NewConn(), s.NewConn()
+	assert.Must(c1.SessionId() != c2.SessionId())
+
+	_, err := c1.Create("/a", nil, 0, acl)
+	assert.MustNoError(err)
+	_, err = c1.Create("/a/e", nil, zk.FlagEphemeral, acl)
+	assert.MustNoError(err)
+	_, err = c1.Create("/a/e/x", nil, 0, acl)
+	assert.Must(err == zk.ErrNoChildrenForEphemerals)
+
+	_, stat, err := c2.Get("/a/e")
+	assert.MustNoError(err)
+	assert.Must(stat.EphemeralOwner() == c1.SessionId())
+
+	_, _, mine, err := c1.GetW("/a")
+	assert.MustNoError(err)
+	_, _, theirs, err := c2.ChildrenW("/a")
+	assert.MustNoError(err)
+
+	c1.Expire()
+	e := mustEvent(mine, zk.EventNotWatching, "/a")
+	assert.Must(e.Err == zk.ErrSessionExpired && e.State == zk.StateExpired)
+	mustEvent(theirs, zk.EventNodeChildrenChanged, "/a")
+	_, _, err = c1.Get("/a")
+	assert.Must(err == zk.ErrSessionExpired)
+
+	ok, _, err := c2.Exists("/a/e")
+	assert.MustNoError(err)
+	assert.Must(!ok)
+	ok, _, err = c2.Exists("/a")
+	assert.MustNoError(err)
+	assert.Must(ok)
+
+	_, err = c2.Create("/a/e", nil, zk.FlagEphemeral, acl)
+	assert.MustNoError(err)
+	_, _, theirs, err = c2.GetW("/a")
+	assert.MustNoError(err)
+	c2.Close()
+	e = mustEvent(theirs, zk.EventNotWatching, "/a")
+	assert.Must(e.Err == zk.ErrClosing)
+	_, _, err = c2.Get("/a")
+	assert.Must(err == zk.ErrConnectionClosed)
+	ok, _, err = s.NewConn().Exists("/a/e")
+	assert.MustNoError(err)
+	assert.Must(!ok)
+
+	// conns of the same address share the store
+	x, err := Connect("memzk_test", 30)
+	assert.MustNoError(err)
+	_, err = x.Create("/shared", nil, 0, acl)
+	assert.MustNoError(err)
+	y, err := Connect("memzk_test", 30)
+	assert.MustNoError(err)
+	ok, _, err = y.Exists("/shared")
+	assert.MustNoError(err)
+	assert.Must(ok)
+}
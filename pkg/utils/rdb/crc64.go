@@ -0,0 +1,57 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rdb
+
+import "hash"
+
+// redis checksums rdb files and DUMP payloads with the reflected crc64 of the
+// Jones polynomial, without the initial and final inversion of hash/crc64
+var crcTable [256]uint64
+
+func init() {
+	const poly = 0x95ac9329ac4bc9b5
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		crcTable[i] = crc
+	}
+}
+
+func crc64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crcTable[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
+
+type digest struct {
+	crc uint64
+}
+
+// NewDigest returns a hash computing the same crc64 as redis.
+func NewDigest() hash.Hash64 {
+	return &digest{}
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	d.crc = crc64(d.crc, p)
+	return len(p), nil
+}
+
+func (d *digest) Sum(b []byte) []byte {
+	v := d.crc
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24),
+		byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+}
+
+func (d *digest) Sum64() uint64  { return d.crc }
+func (d *digest) Reset()         { d.crc = 0 }
+func (d *digest) Size() int      { return 8 }
+func (d *digest) BlockSize() int { return 1 }
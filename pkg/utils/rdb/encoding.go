@@ -0,0 +1,246 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+func lzfDecompress(in []byte, ulen int) ([]byte, error) {
+	// a back reference of 3 bytes expands to 264 bytes at most, ulen is not
+	// trusted for the allocation
+	size := ulen
+	if max := len(in) * 88; size > max {
+		size = max
+	}
+	out := make([]byte, 0, size)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, errors.Trace(ErrBadEncoding)
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errors.Trace(ErrBadEncoding)
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.Trace(ErrBadEncoding)
+		}
+		ref := len(out) - ((ctrl & 0x1f) << 8) - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errors.Trace(ErrBadEncoding)
+		}
+		// the back reference may overlap with the bytes being copied
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != ulen {
+		return nil, errors.Trace(ErrBadEncoding)
+	}
+	return out, nil
+}
+
+func parseZiplist(b []byte) ([][]byte, error) {
+	if len(b) < 11 {
+		return nil, errors.Trace(ErrBadEncoding)
+	}
+	n := int(binary.LittleEndian.Uint16(b[8:10]))
+	values := make([][]byte, 0, n)
+	i := 10
+	for {
+		if i >= len(b) {
+			return nil, errors.Trace(ErrBadEncoding)
+		}
+		if b[i] == 0xff {
+			return values, nil
+		}
+		// skip the length of previous entry
+		if b[i] < 254 {
+			i++
+		} else {
+			i += 5
+		}
+		if i >= len(b) {
+			return nil, errors.Trace(ErrBadEncoding)
+		}
+		v, size, err := parseZiplistEntry(b[i:])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		i += size
+	}
+}
+
+func parseZiplistEntry(b []byte) ([]byte, int, error) {
+	readInt := func(size int) (int64, error) {
+		if len(b) < 1+size {
+			return 0, errors.Trace(ErrBadEncoding)
+		}
+		p := b[1 : 1+size]
+		switch size {
+		case 1:
+			return int64(int8(p[0])), nil
+		case 2:
+			return int64(int16(binary.LittleEndian.Uint16(p))), nil
+		case 3:
+			v := int32(uint32(p[0])<<8|uint32(p[1])<<16|uint32(p[2])<<24) >> 8
+			return int64(v), nil
+		case 4:
+			return int64(int32(binary.LittleEndian.Uint32(p))), nil
+		default:
+			return int64(binary.LittleEndian.Uint64(p)), nil
+		}
+	}
+	readStr := func(hdr, n int) ([]byte, int, error) {
+		if n < 0 || len(b) < hdr+n {
+			return nil, 0, errors.Trace(ErrBadEncoding)
+		}
+		return b[hdr : hdr+n], hdr + n, nil
+	}
+
+	switch enc := b[0]; {
+	case enc>>6 == 0:
+		return readStr(1, int(enc&0x3f))
+	case enc>>6 == 1:
+		if len(b) < 2 {
+			return nil, 0, errors.Trace(ErrBadEncoding)
+		}
+		return readStr(2, int(enc&0x3f)<<8|int(b[1]))
+	case enc>>6 == 2:
+		if len(b) < 5 {
+			return nil, 0, errors.Trace(ErrBadEncoding)
+		}
+		return readStr(5, int(binary.BigEndian.Uint32(b[1:5])))
+	}
+
+	var v int64
+	var size int
+	var err error
+	switch enc := b[0]; {
+	case enc == 0xc0:
+		size = 2
+	case enc == 0xd0:
+		size = 4
+	case enc == 0xe0:
+		size = 8
+	case enc == 0xf0:
+		size = 3
+	case enc == 0xfe:
+		size = 1
+	case enc >= 0xf1 && enc <= 0xfd:
+		return []byte(strconv.Itoa(int(enc&0x0f) - 1)), 1, nil
+	default:
+		return nil, 0, errors.Trace(ErrBadEncoding)
+	}
+	if v, err = readInt(size); err != nil {
+		return nil, 0, err
+	}
+	return []byte(strconv.FormatInt(v, 10)), 1 + size, nil
+}
+
+func parseIntset(b []byte) ([][]byte, error) {
+	if len(b) < 8 {
+		return nil, errors.Trace(ErrBadEncoding)
+	}
+	size := int(binary.LittleEndian.Uint32(b[0:4]))
+	n := int(binary.LittleEndian.Uint32(b[4:8]))
+	if size != 2 && size != 4 && size != 8 || len(b) < 8+size*n {
+		return nil, errors.Trace(ErrBadEncoding)
+	}
+	values := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		p := b[8+i*size:]
+		var v int64
+		switch size {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(p))
+		}
+		values = append(values, []byte(strconv.FormatInt(v, 10)))
+	}
+	return values, nil
+}
+
+func parseZipmap(b []byte) ([]HashField, error) {
+	if len(b) < 1 {
+		return nil, errors.Trace(ErrBadEncoding)
+	}
+	i := 1
+	readLen := func() (int, bool, error) {
+		if i >= len(b) {
+			return 0, false, errors.Trace(ErrBadEncoding)
+		}
+		switch c := b[i]; {
+		case c < 254:
+			i++
+			return int(c), false, nil
+		case c == 254:
+			if i+5 > len(b) {
+				return 0, false, errors.Trace(ErrBadEncoding)
+			}
+			n := int(binary.LittleEndian.Uint32(b[i+1 : i+5]))
+			i += 5
+			return n, false, nil
+		}
+		return 0, true, nil
+	}
+	readStr := func(n int) ([]byte, error) {
+		if n < 0 || i+n > len(b) {
+			return nil, errors.Trace(ErrBadEncoding)
+		}
+		s := b[i : i+n]
+		i += n
+		return s, nil
+	}
+
+	var fields []HashField
+	for {
+		n, end, err := readLen()
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			return fields, nil
+		}
+		f, err := readStr(n)
+		if err != nil {
+			return nil, err
+		}
+		n, end, err = readLen()
+		if err != nil || end {
+			return nil, errors.Trace(ErrBadEncoding)
+		}
+		if i >= len(b) {
+			return nil, errors.Trace(ErrBadEncoding)
+		}
+		free := int(b[i])
+		i++
+		v, err := readStr(n)
+		if err != nil {
+			return nil, err
+		}
+		i += free
+		fields = append(fields, HashField{Field: f, Value: v})
+	}
+}
@@ -0,0 +1,580 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+const (
+	rdbTypeString  = 0
+	rdbTypeList    = 1
+	rdbTypeSet     = 2
+	rdbTypeZSet    = 3
+	rdbTypeHash    = 4
+	rdbTypeZSet2   = 5
+	rdbTypeZipmap  = 9
+	rdbTypeZiplist = 10
+	rdbTypeIntset  = 11
+	rdbTypeZSetZL  = 12
+	rdbTypeHashZL  = 13
+	rdbTypeQuick   = 14
+
+	rdbOpFreq         = 0xf9
+	rdbOpIdle         = 0xf8
+	rdbOpAux          = 0xfa
+	rdbOpResizeDB     = 0xfb
+	rdbOpExpireTimeMs = 0xfc
+	rdbOpExpireTime   = 0xfd
+	rdbOpSelectDB     = 0xfe
+	rdbOpEOF          = 0xff
+
+	rdbLen6Bit  = 0
+	rdbLen14Bit = 1
+	rdbLen32Bit = 0x80
+	rdbLen64Bit = 0x81
+	rdbEncVal   = 3
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+const MaxVersion = 9
+
+const (
+	maxStringLen  = 512 * 1024 * 1024 // proto-max-bulk-len of redis
+	readChunkSize = 1024 * 64
+)
+
+type ValueType int
+
+const (
+	TypeString ValueType = iota
+	TypeList
+	TypeSet
+	TypeZSet
+	TypeHash
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList:
+		return "list"
+	case TypeSet:
+		return "set"
+	case TypeZSet:
+		return "zset"
+	case TypeHash:
+		return "hash"
+	}
+	return "unknown"
+}
+
+type ZMember struct {
+	Member []byte
+	Score  float64
+}
+
+type HashField struct {
+	Field []byte
+	Value []byte
+}
+
+// Entry is a key with its value, only the field matching Type is set:
+// Value for strings, Values for lists and sets, Members for sorted sets
+// and Fields for hashes. ExpireAt is the unix time in milliseconds, 0 means
+// the key never expires.
+type Entry struct {
+	DB       uint32
+	Key      []byte
+	Type     ValueType
+	ExpireAt int64
+
+	Value   []byte
+	Values  [][]byte
+	Members []ZMember
+	Fields  []HashField
+}
+
+var (
+	ErrBadHeader      = errors.New("bad rdb header")
+	ErrBadVersion     = errors.New("unsupported rdb version")
+	ErrBadChecksum    = errors.New("bad rdb checksum")
+	ErrBadEncoding    = errors.New("bad rdb encoding")
+	ErrUnsupportedObj = errors.New("unsupported rdb object type")
+)
+
+type Reader struct {
+	r   *bufio.Reader
+	crc hash.Hash64
+
+	version int
+	db      uint32
+	done    bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 1024*64), crc: NewDigest()}
+}
+
+// Version returns the rdb version, it's valid after the first call of Next.
+func (r *Reader) Version() int {
+	return r.version
+}
+
+func (r *Reader) read(p []byte) error {
+	if _, err := io.ReadFull(r.r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.Trace(err)
+	}
+	r.crc.Write(p)
+	return nil
+}
+
+func (r *Reader) readByte() (byte, error) {
+	var b [1]byte
+	if err := r.read(b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readBytes reads n bytes, the buffer grows as data arrives, so a corrupt
+// length fails at the end of input instead of allocating it all at once.
+func (r *Reader) readBytes(n uint64) ([]byte, error) {
+	if n > maxStringLen {
+		return nil, errors.Errorf("bad length %d", n)
+	}
+	if n <= readChunkSize {
+		p := make([]byte, n)
+		if err := r.read(p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	p := make([]byte, 0, readChunkSize)
+	for uint64(len(p)) < n {
+		m := n - uint64(len(p))
+		if m > readChunkSize {
+			m = readChunkSize
+		}
+		p = append(p, make([]byte, m)...)
+		if err := r.read(p[uint64(len(p))-m:]); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (r *Reader) readUint32() (uint32, error) {
+	var b [4]byte
+	if err := r.read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b[:]), nil
+}
+
+func (r *Reader) readUint64() (uint64, error) {
+	var b [8]byte
+	if err := r.read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b[:]), nil
+}
+
+func (r *Reader) readHeader() error {
+	var b [9]byte
+	if err := r.read(b[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(b[:5], []byte("REDIS")) {
+		return errors.Trace(ErrBadHeader)
+	}
+	v, err := strconv.Atoi(string(b[5:]))
+	if err != nil {
+		return errors.Trace(ErrBadHeader)
+	}
+	if v < 1 || v > MaxVersion {
+		return errors.Errorf("%s: %d", ErrBadVersion, v)
+	}
+	r.version = v
+	return nil
+}
+
+// readLength returns the length, or the encoding type if encoded is true.
+func (r *Reader) readLength() (length uint64, encoded bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case rdbLen6Bit:
+		return uint64(b & 0x3f), false, nil
+	case rdbLen14Bit:
+		b2, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(b2), false, nil
+	case rdbEncVal:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case rdbLen32Bit:
+		var p [4]byte
+		if err := r.read(p[:]); err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p[:])), false, nil
+	case rdbLen64Bit:
+		var p [8]byte
+		if err := r.read(p[:]); err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p[:]), false, nil
+	}
+	return 0, false, errors.Trace(ErrBadEncoding)
+}
+
+func (r *Reader) readLen() (uint64, error) {
+	n, encoded, err := r.readLength()
+	if err == nil && encoded {
+		err = errors.Trace(ErrBadEncoding)
+	}
+	return n, err
+}
+
+func (r *Reader) readString() ([]byte, error) {
+	n, encoded, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return r.readBytes(n)
+	}
+	switch n {
+	case rdbEncInt8:
+		b, err := r.readBytes(1)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int8(b[0])))), nil
+	case rdbEncInt16:
+		b, err := r.readBytes(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b))))), nil
+	case rdbEncInt32:
+		b, err := r.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b))))), nil
+	case rdbEncLZF:
+		clen, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		if ulen > maxStringLen {
+			return nil, errors.Errorf("bad length %d", ulen)
+		}
+		b, err := r.readBytes(clen)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(b, int(ulen))
+	}
+	return nil, errors.Trace(ErrBadEncoding)
+}
+
+func (r *Reader) readDouble() (float64, error) {
+	n, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := r.readBytes(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(string(b), 64)
+	return f, errors.Trace(err)
+}
+
+func (r *Reader) readBinaryDouble() (float64, error) {
+	v, err := r.readUint64()
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(v), nil
+}
+
+// Next returns the next entry, or io.EOF after the last one.
+func (r *Reader) Next() (*Entry, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	if r.version == 0 {
+		if err := r.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+	var expireAt int64
+	for {
+		t, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case rdbOpEOF:
+			r.done = true
+			if err := r.verifyChecksum(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		case rdbOpSelectDB:
+			db, err := r.readLen()
+			if err != nil {
+				return nil, err
+			}
+			r.db = uint32(db)
+		case rdbOpResizeDB:
+			if _, err := r.readLen(); err != nil {
+				return nil, err
+			}
+			if _, err := r.readLen(); err != nil {
+				return nil, err
+			}
+		case rdbOpAux:
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+		case rdbOpExpireTime:
+			v, err := r.readUint32()
+			if err != nil {
+				return nil, err
+			}
+			expireAt = int64(v) * 1000
+		case rdbOpExpireTimeMs:
+			v, err := r.readUint64()
+			if err != nil {
+				return nil, err
+			}
+			expireAt = int64(v)
+		case rdbOpIdle:
+			if _, err := r.readLen(); err != nil {
+				return nil, err
+			}
+		case rdbOpFreq:
+			if _, err := r.readByte(); err != nil {
+				return nil, err
+			}
+		default:
+			key, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			e := &Entry{DB: r.db, Key: key, ExpireAt: expireAt}
+			if err := r.readObject(e, t); err != nil {
+				return nil, errors.Trace(err)
+			}
+			return e, nil
+		}
+	}
+}
+
+func (r *Reader) verifyChecksum() error {
+	if r.version < 5 {
+		return nil
+	}
+	expect := r.crc.Sum64()
+	var b [8]byte
+	if _, err := io.ReadFull(r.r, b[:]); err != nil {
+		return errors.Trace(err)
+	}
+	// a zero checksum means the checksum is disabled
+	if v := binary.LittleEndian.Uint64(b[:]); v != 0 && v != expect {
+		return errors.Trace(ErrBadChecksum)
+	}
+	return nil
+}
+
+func (r *Reader) readObject(e *Entry, t byte) error {
+	switch t {
+	case rdbTypeString:
+		e.Type = TypeString
+		v, err := r.readString()
+		e.Value = v
+		return err
+	case rdbTypeList, rdbTypeSet:
+		if t == rdbTypeList {
+			e.Type = TypeList
+		} else {
+			e.Type = TypeSet
+		}
+		n, err := r.readLen()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			v, err := r.readString()
+			if err != nil {
+				return err
+			}
+			e.Values = append(e.Values, v)
+		}
+		return nil
+	case rdbTypeZSet, rdbTypeZSet2:
+		e.Type = TypeZSet
+		n, err := r.readLen()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			m, err := r.readString()
+			if err != nil {
+				return err
+			}
+			var score float64
+			if t == rdbTypeZSet {
+				score, err = r.readDouble()
+			} else {
+				score, err = r.readBinaryDouble()
+			}
+			if err != nil {
+				return err
+			}
+			e.Members = append(e.Members, ZMember{Member: m, Score: score})
+		}
+		return nil
+	case rdbTypeHash:
+		e.Type = TypeHash
+		n, err := r.readLen()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			f, err := r.readString()
+			if err != nil {
+				return err
+			}
+			v, err := r.readString()
+			if err != nil {
+				return err
+			}
+			e.Fields = append(e.Fields, HashField{Field: f, Value: v})
+		}
+		return nil
+	case rdbTypeZipmap:
+		e.Type = TypeHash
+		b, err := r.readString()
+		if err != nil {
+			return err
+		}
+		e.Fields, err = parseZipmap(b)
+		return err
+	case rdbTypeZiplist:
+		e.Type = TypeList
+		b, err := r.readString()
+		if err != nil {
+			return err
+		}
+		e.Values, err = parseZiplist(b)
+		return err
+	case rdbTypeQuick:
+		e.Type = TypeList
+		n, err := r.readLen()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			b, err := r.readString()
+			if err != nil {
+				return err
+			}
+			values, err := parseZiplist(b)
+			if err != nil {
+				return err
+			}
+			e.Values = append(e.Values, values...)
+		}
+		return nil
+	case rdbTypeIntset:
+		e.Type = TypeSet
+		b, err := r.readString()
+		if err != nil {
+			return err
+		}
+		e.Values, err = parseIntset(b)
+		return err
+	case rdbTypeZSetZL:
+		e.Type = TypeZSet
+		b, err := r.readString()
+		if err != nil {
+			return err
+		}
+		values, err := parseZiplist(b)
+		if err != nil {
+			return err
+		}
+		if len(values)%2 != 0 {
+			return errors.Trace(ErrBadEncoding)
+		}
+		for i := 0; i < len(values); i += 2 {
+			score, err := strconv.ParseFloat(string(values[i+1]), 64)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			e.Members = append(e.Members, ZMember{Member: values[i], Score: score})
+		}
+		return nil
+	case rdbTypeHashZL:
+		e.Type = TypeHash
+		b, err := r.readString()
+		if err != nil {
+			return err
+		}
+		values, err := parseZiplist(b)
+		if err != nil {
+			return err
+		}
+		if len(values)%2 != 0 {
+			return errors.Trace(ErrBadEncoding)
+		}
+		for i := 0; i < len(values); i += 2 {
+			e.Fields = append(e.Fields, HashField{Field: values[i], Value: values[i+1]})
+		}
+		return nil
+	}
+	return errors.Errorf("%s: %d", ErrUnsupportedObj, t)
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rdb
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+func loadEntries(b []byte) (map[string]*Entry, error) {
+	r := NewReader(bytes.NewReader(b))
+	m := make(map[string]*Entry)
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[string(e.Key)] = e
+	}
+}
+
+func TestReadDump(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/dump.rdb")
+	assert.MustNoError(err)
+	m, err := loadEntries(b)
+	assert.MustNoError(err)
+	assert.Must(len(m) == 16)
+
+	for key, value := range map[string]string{
+		"str": "hello", "int": "12345", "neg": "-7", "big": "3000000000",
+	} {
+		e := m[key]
+		assert.Must(e.Type == TypeString && string(e.Value) == value)
+	}
+	assert.Must(string(m["lzf"].Value) == string(bytes.Repeat([]byte("abcdefgh"), 64)))
+
+	list := m["list.zl"]
+	assert.Must(list.Type == TypeList && len(list.Values) == 6)
+	for i, v := range []string{"a", "b", "1", "300", "70000", "-5"} {
+		assert.Must(string(list.Values[i]) == v)
+	}
+	list = m["list.big"]
+	assert.Must(list.Type == TypeList && len(list.Values) == 200)
+	assert.Must(string(list.Values[199]) == "item200")
+	list = m["list.linked"]
+	assert.Must(list.Type == TypeList && len(list.Values) == 2)
+	assert.Must(len(list.Values[1]) == 100)
+
+	set := m["set.int"]
+	assert.Must(set.Type == TypeSet && len(set.Values) == 5)
+	assert.Must(string(set.Values[0]) == "-50" && string(set.Values[4]) == "100000")
+	assert.Must(m["set.str"].Type == TypeSet && len(m["set.str"].Values) == 3)
+
+	zset := m["zset.zl"]
+	assert.Must(zset.Type == TypeZSet && len(zset.Members) == 3)
+	scores := make(map[string]float64)
+	for _, x := range zset.Members {
+		scores[string(x.Member)] = x.Score
+	}
+	assert.Must(scores["a"] == 1 && scores["b"] == 2.5 && scores["c"] == -3)
+	zset = m["zset.big"]
+	assert.Must(zset.Type == TypeZSet && len(zset.Members) == 200)
+	for _, x := range zset.Members {
+		i, err := strconv.Atoi(string(x.Member[1:]))
+		assert.MustNoError(err)
+		assert.Must(x.Score == float64(i)/2)
+	}
+
+	hash := m["hash.zl"]
+	assert.Must(hash.Type == TypeHash && len(hash.Fields) == 2)
+	assert.Must(string(hash.Fields[1].Field) == "f2" && string(hash.Fields[1].Value) == "2")
+	assert.Must(m["hash.big"].Type == TypeHash && len(m["hash.big"].Fields) == 600)
+
+	assert.Must(m["expire"].ExpireAt == 4102444800000)
+	assert.Must(m["str"].ExpireAt == 0)
+	assert.Must(m["db1key"].DB == 1 && m["str"].DB == 0)
+}
+
+func TestReadBadChecksum(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/dump.rdb")
+	assert.MustNoError(err)
+	b[len(b)-1] ^= 0xff
+	_, err = loadEntries(b)
+	assert.Must(errors.Equal(err, ErrBadChecksum))
+
+	// checksum disabled
+	for i := len(b) - 8; i < len(b); i++ {
+		b[i] = 0
+	}
+	_, err = loadEntries(b)
+	assert.MustNoError(err)
+}
+
+func TestReadTruncated(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/dump.rdb")
+	assert.MustNoError(err)
+	_, err = loadEntries(b[:len(b)/2])
+	assert.Must(err != nil && err != io.EOF)
+
+	_, err = loadEntries([]byte("REDIS0099"))
+	assert.Must(err != nil)
+
+	// a string claiming a huge length, without the data
+	for _, b := range [][]byte{
+		[]byte("REDIS0006\x00\x03key\x81\x00\x00\x00\x10\x00\x00\x00\x00"),
+		[]byte("REDIS0006\x00\x03key\x80\x10\x00\x00\x00abc"),
+		[]byte("REDIS0006\x00\x03key\xc3\x02\x80\x10\x00\x00\x00\x01ab"),
+	} {
+		_, err = loadEntries(b)
+		assert.Must(err != nil && err != io.EOF)
+	}
+}
+
+func TestCrc64(t *testing.T) {
+	assert.Must(crc64(0, []byte("123456789")) == 0xe9c6d914c4b8d9ca)
+}
+
+func TestParseZipmap(t *testing.T) {
+	b := []byte{2, 1, 'a', 2, 0, 'v', '1', 3, 'b', 'c', 'd', 1, 1, 'x', 0, 0xff}
+	fields, err := parseZipmap(b)
+	assert.MustNoError(err)
+	assert.Must(len(fields) == 2)
+	assert.Must(string(fields[0].Field) == "a" && string(fields[0].Value) == "v1")
+	assert.Must(string(fields[1].Field) == "bcd" && string(fields[1].Value) == "x")
+}
+
+func TestParseIntset(t *testing.T) {
+	b := []byte{4, 0, 0, 0, 2, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x01, 0x00}
+	values, err := parseIntset(b)
+	assert.MustNoError(err)
+	assert.Must(len(values) == 2 && string(values[0]) == "-1" && string(values[1]) == "65536")
+}
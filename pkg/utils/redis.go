@@ -85,6 +85,40 @@ func SlotsMgrtTagSlot(c redis.Conn, slotId int, toAddr string) (int, int, error)
 	}
 }
 
+func parseRedisInfo(info string) map[string]string {
+	m := make(map[string]string)
+	lines := strings.Split(info, "\n")
+	for _, line := range lines {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 {
+			k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// GetRedisInfo returns the fields of a section of INFO, or all sections if
+// section is empty.
+func GetRedisInfo(addr, passwd string, section string) (map[string]string, error) {
+	c, err := DialTo(addr, passwd)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var ret string
+	if section == "" {
+		ret, err = redis.String(c.Do("INFO"))
+	} else {
+		ret, err = redis.String(c.Do("INFO", section))
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseRedisInfo(ret), nil
+}
+
 func GetRedisStat(addr, passwd string) (map[string]string, error) {
 	c, err := DialTo(addr, passwd)
 	if err != nil {
@@ -96,15 +130,7 @@ func GetRedisStat(addr, passwd string) (map[string]string, error) {
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	m := make(map[string]string)
-	lines := strings.Split(ret, "\n")
-	for _, line := range lines {
-		kv := strings.SplitN(line, ":", 2)
-		if len(kv) == 2 {
-			k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
-			m[k] = v
-		}
-	}
+	m := parseRedisInfo(ret)
 
 	reply, err := redis.Strings(c.Do("config", "get", "maxmemory"))
 	if err != nil {
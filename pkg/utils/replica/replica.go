@@ -0,0 +1,316 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package replica
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+var (
+	ErrBadSyncReply = errors.New("bad reply of sync")
+	ErrNotStreaming = errors.New("replica is not streaming")
+)
+
+type countReader struct {
+	r io.Reader
+	n atomic2.Int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// Replica connects to a redis master as a slave. Sync returns the rdb snapshot,
+// after it has been fully read, Next returns the commands replicated from master.
+type Replica struct {
+	mu   sync.Mutex
+	sock net.Conn
+	cr   *countReader
+	dec  *redis.Decoder
+	enc  *redis.Encoder
+
+	runId  string
+	psync  bool
+	base   int64 // replication offset of the snapshot
+	mark   int64 // bytes read from sock when the stream starts
+	offset atomic2.Int64
+
+	rdb       io.Reader
+	streaming bool
+
+	ReadTimeout time.Duration
+}
+
+func Dial(addr, auth string, timeout time.Duration) (*Replica, error) {
+	sock, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	r := NewReplica(sock)
+	r.ReadTimeout = timeout
+	if auth != "" {
+		if _, err := r.call("AUTH", auth); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func NewReplica(sock net.Conn) *Replica {
+	r := &Replica{sock: sock, cr: &countReader{r: sock}}
+	r.dec = redis.NewDecoderSize(r.cr, 1024*64)
+	r.enc = redis.NewEncoderSize(sock, 1024*16)
+	return r
+}
+
+func (r *Replica) Close() error {
+	return r.sock.Close()
+}
+
+func newCommand(args ...string) *redis.Resp {
+	var array = make([]*redis.Resp, len(args))
+	for i, s := range args {
+		array[i] = redis.NewBulkBytes([]byte(s))
+	}
+	return redis.NewArray(array)
+}
+
+func (r *Replica) setDeadline() {
+	if r.ReadTimeout != 0 {
+		r.sock.SetReadDeadline(time.Now().Add(r.ReadTimeout))
+	}
+}
+
+// request sends a command and returns the reply, which may be an error.
+func (r *Replica) request(args ...string) (*redis.Resp, error) {
+	r.mu.Lock()
+	err := r.enc.Encode(newCommand(args...), true)
+	r.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	r.setDeadline()
+	return r.dec.Decode()
+}
+
+func (r *Replica) call(args ...string) (*redis.Resp, error) {
+	resp, err := r.request(args...)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, errors.Errorf("%s: %s", args[0], resp.Value)
+	}
+	return resp, nil
+}
+
+// Sync starts a full resynchronization, it tries PSYNC first and falls back to
+// SYNC for masters that don't know PSYNC. The returned reader yields the rdb
+// snapshot, which is sent with its size ahead or ended by a mark if master
+// syncs diskless.
+func (r *Replica) Sync(port int) (io.Reader, error) {
+	if port != 0 {
+		// just a hint shown in INFO of master, old masters may not support it
+		r.call("REPLCONF", "listening-port", strconv.Itoa(port))
+	}
+	// diskless snapshots are understood, old masters reply an error
+	r.call("REPLCONF", "capa", "eof")
+
+	resp, err := r.request("PSYNC", "?", "-1")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch {
+	case resp.IsError():
+		if !bytes.HasPrefix(resp.Value, []byte("ERR unknown command")) {
+			return nil, errors.Errorf("PSYNC: %s", resp.Value)
+		}
+		r.mu.Lock()
+		err = r.enc.Encode(newCommand("SYNC"), true)
+		r.mu.Unlock()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	case resp.IsString():
+		fields := strings.Fields(string(resp.Value))
+		if len(fields) != 3 || fields[0] != "FULLRESYNC" {
+			return nil, errors.Errorf("%s: %s", ErrBadSyncReply, resp.Value)
+		}
+		r.runId = fields[1]
+		if r.base, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			return nil, errors.Trace(err)
+		}
+		r.psync = true
+	default:
+		return nil, errors.Trace(ErrBadSyncReply)
+	}
+
+	// master sends newlines as keepalive while it's preparing the snapshot
+	for {
+		r.sock.SetReadDeadline(time.Time{})
+		b, err := r.dec.ReadByte()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if b == '\n' {
+			continue
+		}
+		if b != '$' {
+			return nil, errors.Trace(ErrBadSyncReply)
+		}
+		break
+	}
+	line, err := r.dec.ReadBytes('\n')
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	line = bytes.TrimSpace(line)
+	if bytes.HasPrefix(line, []byte("EOF:")) {
+		mark := line[4:]
+		if len(mark) != eofMarkSize {
+			return nil, errors.Trace(ErrBadSyncReply)
+		}
+		r.rdb = &eofReader{r: r, mark: append([]byte{}, mark...)}
+		return r.rdb, nil
+	}
+	size, err := strconv.ParseInt(string(line), 10, 64)
+	if err != nil || size < 0 {
+		return nil, errors.Trace(ErrBadSyncReply)
+	}
+	r.rdb = &snapshotReader{r: r, left: size}
+	return r.rdb, nil
+}
+
+const eofMarkSize = 40
+
+type snapshotReader struct {
+	r    *Replica
+	left int64
+}
+
+func (s *snapshotReader) Read(p []byte) (int, error) {
+	if s.left == 0 {
+		s.r.startStream()
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.left {
+		p = p[:s.left]
+	}
+	n, err := s.r.dec.Read(p)
+	s.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if s.left == 0 {
+		s.r.startStream()
+	}
+	return n, err
+}
+
+// eofReader reads a diskless snapshot, which is ended by the mark. Master
+// doesn't stream commands until it's acked, so the mark is the last bytes
+// received.
+type eofReader struct {
+	r    *Replica
+	mark []byte
+	buf  []byte // bytes not returned yet, the tail may be a part of the mark
+	done bool
+}
+
+func (s *eofReader) Read(p []byte) (int, error) {
+	var chunk [16 * 1024]byte
+	for !s.done && len(s.buf) <= len(s.mark) {
+		n, err := s.r.dec.Read(chunk[:])
+		s.buf = append(s.buf, chunk[:n]...)
+		if bytes.HasSuffix(s.buf, s.mark) {
+			s.buf = s.buf[:len(s.buf)-len(s.mark)]
+			s.done = true
+		} else if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	n := len(s.buf)
+	if !s.done {
+		n -= len(s.mark)
+	}
+	n = copy(p, s.buf[:n])
+	s.buf = s.buf[n:]
+	if s.done && len(s.buf) == 0 {
+		s.r.startStream()
+		if n == 0 {
+			return 0, io.EOF
+		}
+	}
+	return n, nil
+}
+
+func (r *Replica) startStream() {
+	if !r.streaming {
+		r.streaming = true
+		r.mark = r.consumed()
+		r.offset.Set(r.base)
+	}
+}
+
+func (r *Replica) consumed() int64 {
+	return r.cr.n.Get() - int64(r.dec.Buffered())
+}
+
+// Next returns the next command replicated from master.
+func (r *Replica) Next() (*redis.Resp, error) {
+	if !r.streaming {
+		return nil, errors.Trace(ErrNotStreaming)
+	}
+	r.sock.SetReadDeadline(time.Time{})
+	resp, err := r.dec.Decode()
+	if err != nil {
+		return nil, err
+	}
+	r.offset.Set(r.base + r.consumed() - r.mark)
+	return resp, nil
+}
+
+// Buffered returns the number of bytes received but not returned by Next yet.
+func (r *Replica) Buffered() int {
+	return r.dec.Buffered()
+}
+
+func (r *Replica) RunId() string {
+	return r.runId
+}
+
+// PSync returns whether the snapshot is synced by PSYNC, otherwise offsets are
+// counted from 0 instead of the replication offset of master.
+func (r *Replica) PSync() bool {
+	return r.psync
+}
+
+// Offset returns the replication offset of the last command returned by Next.
+func (r *Replica) Offset() int64 {
+	return r.offset.Get()
+}
+
+// Ack reports the replication offset to master, it's safe to be called
+// concurrently with Next.
+func (r *Replica) Ack() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(newCommand("REPLCONF", "ACK", strconv.FormatInt(r.Offset(), 10)), true)
+}
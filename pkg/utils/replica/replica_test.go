@@ -0,0 +1,207 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package replica
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/rdb"
+)
+
+const (
+	masterPSync = iota
+	masterSync
+	masterDiskless
+	masterLoading
+)
+
+// fakeMaster serves a single replica with the rdb fixture followed by the commands.
+func fakeMaster(mode int, commands []*redis.Resp, acks chan<- string) net.Listener {
+	snapshot, err := ioutil.ReadFile("../rdb/testdata/dump.rdb")
+	assert.MustNoError(err)
+	mark := strings.Repeat("0123456789", 4)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		conn := redis.NewConn(c)
+		stream := func() {
+			for _, cmd := range commands {
+				conn.Writer.Encode(cmd, false)
+			}
+			conn.Writer.Flush()
+		}
+		for {
+			req, err := conn.Reader.Decode()
+			if err != nil {
+				return
+			}
+			switch string(req.Array[0].Value) {
+			case "REPLCONF":
+				if string(req.Array[1].Value) == "ACK" {
+					if mode == masterDiskless {
+						// commands are streamed after the first ack
+						mode = masterPSync
+						stream()
+					}
+					acks <- string(req.Array[2].Value)
+					continue
+				}
+				conn.Writer.Encode(redis.NewString([]byte("OK")), true)
+			case "PSYNC":
+				switch mode {
+				case masterSync:
+					conn.Writer.Encode(redis.NewError([]byte("ERR unknown command 'PSYNC'")), true)
+					continue
+				case masterLoading:
+					conn.Writer.Encode(redis.NewError([]byte("LOADING Redis is loading the dataset in memory")), true)
+					continue
+				}
+				conn.Writer.Encode(redis.NewString([]byte("FULLRESYNC 0123456789abcdef 100")), true)
+				if mode == masterDiskless {
+					fmt.Fprintf(conn.Writer, "\n$EOF:%s\r\n", mark)
+					conn.Writer.Write(snapshot)
+					conn.Writer.Write([]byte(mark))
+					conn.Writer.Flush()
+					continue
+				}
+				fallthrough
+			case "SYNC":
+				fmt.Fprintf(conn.Writer, "\n\n$%d\r\n", len(snapshot))
+				conn.Writer.Write(snapshot)
+				stream()
+			}
+		}
+	}()
+	return l
+}
+
+func TestReplica(t *testing.T) {
+	commands := []*redis.Resp{
+		newCommand("SELECT", "0"),
+		newCommand("SET", "key", "value"),
+		newCommand("PING"),
+	}
+	acks := make(chan string, 1)
+	l := fakeMaster(masterPSync, commands, acks)
+	defer l.Close()
+
+	r, err := Dial(l.Addr().String(), "", time.Second)
+	assert.MustNoError(err)
+	defer r.Close()
+
+	snapshot, err := r.Sync(6380)
+	assert.MustNoError(err)
+	assert.Must(r.RunId() == "0123456789abcdef")
+
+	_, err = r.Next()
+	assert.Must(err != nil)
+
+	reader := rdb.NewReader(snapshot)
+	var n int
+	for {
+		_, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.MustNoError(err)
+		n++
+	}
+	assert.Must(n == 16)
+	// consume the end of the snapshot
+	_, err = snapshot.Read(make([]byte, 1))
+	assert.Must(err == io.EOF)
+	assert.Must(r.Offset() == 100)
+
+	var offset int64 = 100
+	for _, cmd := range commands {
+		resp, err := r.Next()
+		assert.MustNoError(err)
+		assert.Must(string(resp.Array[0].Value) == string(cmd.Array[0].Value))
+		b, err := redis.EncodeToBytes(cmd)
+		assert.MustNoError(err)
+		offset += int64(len(b))
+		assert.Must(r.Offset() == offset)
+	}
+
+	assert.MustNoError(r.Ack())
+	assert.Must(<-acks == fmt.Sprint(offset))
+}
+
+func TestReplicaSyncFallback(t *testing.T) {
+	l := fakeMaster(masterSync, []*redis.Resp{newCommand("SET", "a", "b")}, nil)
+	defer l.Close()
+
+	r, err := Dial(l.Addr().String(), "", time.Second)
+	assert.MustNoError(err)
+	defer r.Close()
+
+	snapshot, err := r.Sync(0)
+	assert.MustNoError(err)
+	assert.Must(!r.PSync())
+	_, err = io.Copy(ioutil.Discard, snapshot)
+	assert.MustNoError(err)
+
+	resp, err := r.Next()
+	assert.MustNoError(err)
+	assert.Must(string(resp.Array[1].Value) == "a")
+	assert.Must(r.Offset() > 0)
+}
+
+func TestReplicaSyncError(t *testing.T) {
+	l := fakeMaster(masterLoading, nil, nil)
+	defer l.Close()
+
+	r, err := Dial(l.Addr().String(), "", time.Second)
+	assert.MustNoError(err)
+	defer r.Close()
+
+	// only masters that don't know PSYNC fall back to SYNC
+	_, err = r.Sync(0)
+	assert.Must(err != nil && strings.Contains(err.Error(), "LOADING"))
+}
+
+func TestReplicaDiskless(t *testing.T) {
+	commands := []*redis.Resp{newCommand("SET", "a", "b")}
+	acks := make(chan string, 1)
+	l := fakeMaster(masterDiskless, commands, acks)
+	defer l.Close()
+
+	r, err := Dial(l.Addr().String(), "", time.Second)
+	assert.MustNoError(err)
+	defer r.Close()
+
+	snapshot, err := r.Sync(0)
+	assert.MustNoError(err)
+	assert.Must(r.PSync())
+	b, err := ioutil.ReadAll(snapshot)
+	assert.MustNoError(err)
+	expect, err := ioutil.ReadFile("../rdb/testdata/dump.rdb")
+	assert.MustNoError(err)
+	assert.Must(bytes.Equal(b, expect))
+	assert.Must(r.Offset() == 100)
+
+	assert.MustNoError(r.Ack())
+	assert.Must(<-acks == "100")
+	resp, err := r.Next()
+	assert.MustNoError(err)
+	assert.Must(string(resp.Array[1].Value) == "a")
+	b, err = redis.EncodeToBytes(commands[0])
+	assert.MustNoError(err)
+	assert.Must(r.Offset() == 100+int64(len(b)))
+}
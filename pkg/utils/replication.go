@@ -0,0 +1,118 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package utils
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ReplicationSlave is a slave seen by its master, e.g.
+//
+//	slave0:ip=127.0.0.1,port=6380,state=online,offset=86,lag=1
+type ReplicationSlave struct {
+	Addr   string `json:"addr"`
+	State  string `json:"state"`
+	Offset int64  `json:"offset"`
+	Lag    int64  `json:"lag"` // seconds since the last ack, -1 if unknown
+}
+
+// ReplicationInfo is the replication section of INFO, fields of masters or
+// slaves are zero if not applicable, except those documented.
+type ReplicationInfo struct {
+	Role             string             `json:"role"`
+	MasterReplOffset int64              `json:"master_repl_offset"`
+	ConnectedSlaves  int                `json:"connected_slaves"`
+	Slaves           []ReplicationSlave `json:"slaves,omitempty"`
+
+	MasterAddr          string `json:"master_addr,omitempty"`
+	MasterLinkUp        bool   `json:"master_link_up"`
+	MasterLastIOSeconds int64  `json:"master_last_io_seconds"`   // -1 if the link is down or unknown
+	MasterDownSeconds   int64  `json:"master_link_down_seconds"` // -1 if the link is up or unknown
+	MasterSyncing       bool   `json:"master_sync_in_progress"`
+	SlaveReplOffset     int64  `json:"slave_repl_offset"`
+}
+
+func (r *ReplicationInfo) IsMaster() bool {
+	return r.Role == "master"
+}
+
+func (r *ReplicationInfo) IsSlave() bool {
+	return r.Role == "slave"
+}
+
+func parseInfoInt(m map[string]string, key string, defval int64) int64 {
+	n, err := strconv.ParseInt(m[key], 10, 64)
+	if err != nil {
+		return defval
+	}
+	return n
+}
+
+func parseReplicationSlave(s string) (ReplicationSlave, bool) {
+	var slave ReplicationSlave
+	var ip, port string
+	slave.Lag = -1
+	for _, kv := range strings.Split(s, ",") {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			continue
+		}
+		switch p[0] {
+		case "ip":
+			ip = p[1]
+		case "port":
+			port = p[1]
+		case "state":
+			slave.State = p[1]
+		case "offset":
+			slave.Offset, _ = strconv.ParseInt(p[1], 10, 64)
+		case "lag":
+			if lag, err := strconv.ParseInt(p[1], 10, 64); err == nil {
+				slave.Lag = lag
+			}
+		}
+	}
+	if ip == "" || port == "" {
+		return slave, false
+	}
+	slave.Addr = net.JoinHostPort(ip, port)
+	return slave, true
+}
+
+// ParseReplicationInfo parses the fields of INFO replication.
+func ParseReplicationInfo(m map[string]string) *ReplicationInfo {
+	r := &ReplicationInfo{
+		Role:                m["role"],
+		MasterReplOffset:    parseInfoInt(m, "master_repl_offset", 0),
+		ConnectedSlaves:     int(parseInfoInt(m, "connected_slaves", 0)),
+		MasterLastIOSeconds: -1,
+		MasterDownSeconds:   -1,
+	}
+	for i := 0; i < r.ConnectedSlaves; i++ {
+		if s, ok := parseReplicationSlave(m["slave"+strconv.Itoa(i)]); ok {
+			r.Slaves = append(r.Slaves, s)
+		}
+	}
+	if r.IsSlave() {
+		r.MasterAddr = net.JoinHostPort(m["master_host"], m["master_port"])
+		r.MasterLinkUp = m["master_link_status"] == "up"
+		r.MasterLastIOSeconds = parseInfoInt(m, "master_last_io_seconds_ago", -1)
+		r.MasterSyncing = m["master_sync_in_progress"] == "1"
+		if !r.MasterLinkUp {
+			r.MasterDownSeconds = parseInfoInt(m, "master_link_down_since_seconds", -1)
+		}
+		r.SlaveReplOffset = parseInfoInt(m, "slave_repl_offset", 0)
+	}
+	return r
+}
+
+func GetReplicationInfo(addr, passwd string) (*ReplicationInfo, error) {
+	m, err := GetRedisInfo(addr, passwd, "replication")
+	if err != nil {
+		return nil, err
+	}
+	return ParseReplicationInfo(m), nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package utils
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestParseReplicationInfo(t *testing.T) {
+	r := ParseReplicationInfo(parseRedisInfo(`# Replication
+role:master
+connected_slaves:2
+slave0:ip=127.0.0.1,port=6380,state=online,offset=86,lag=1
+slave1:ip=127.0.0.1,port=6381,state=wait_bgsave,offset=0,lag=0
+master_repl_offset:86
+repl_backlog_active:1
+`))
+	assert.Must(r.IsMaster() && r.MasterReplOffset == 86 && r.ConnectedSlaves == 2)
+	assert.Must(len(r.Slaves) == 2)
+	assert.Must(r.Slaves[0].Addr == "127.0.0.1:6380" && r.Slaves[0].State == "online" && r.Slaves[0].Offset == 86 && r.Slaves[0].Lag == 1)
+	assert.Must(r.Slaves[1].Addr == "127.0.0.1:6381" && r.Slaves[1].State == "wait_bgsave")
+	assert.Must(r.MasterLastIOSeconds == -1 && r.MasterDownSeconds == -1)
+
+	r = ParseReplicationInfo(parseRedisInfo(`# Replication
+role:slave
+master_host:127.0.0.1
+master_port:6379
+master_link_status:down
+master_last_io_seconds_ago:-1
+master_sync_in_progress:1
+master_link_down_since_seconds:42
+slave_repl_offset:1
+connected_slaves:0
+master_repl_offset:0
+`))
+	assert.Must(r.IsSlave() && r.MasterAddr == "127.0.0.1:6379")
+	assert.Must(!r.MasterLinkUp && r.MasterSyncing && r.MasterLastIOSeconds == -1 && r.SlaveReplOffset == 1)
+	assert.Must(r.MasterDownSeconds == 42)
+}